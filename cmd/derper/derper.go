@@ -46,8 +46,18 @@ var (
 	hostname      = flag.String("hostname", "derp.tailscale.com", "LetsEncrypt host name, if addr's port is :443")
 	logCollection = flag.String("logcollection", "", "If non-empty, logtail collection to log to")
 	runSTUN       = flag.Bool("stun", false, "also run a STUN server")
+	stunAltPort   = flag.Int("stun-alt-port", 0, "if non-zero and --stun is set, also answer STUN on this UDP port, and answer RFC 5780 requests to change the response's port from the other port; advertise it as the node's STUNAltPort")
 	meshPSKFile   = flag.String("mesh-psk-file", defaultMeshPSKFile(), "if non-empty, path to file containing the mesh pre-shared key file. It should contain some hex string; whitespace is trimmed.")
 	meshWith      = flag.String("mesh-with", "", "optional comma-separated list of hostnames to mesh with; the server's own hostname can be in the list")
+	meshWithFile  = flag.String("mesh-with-file", "", "optional path to a file of hostnames to mesh with, in addition to --mesh-with, separated by commas or whitespace; it's reloaded when it changes, adding and removing mesh peers to match")
+
+	verifyClientsFile = flag.String("verify-clients-file", "", "if non-empty, path to a file listing the node public keys allowed to connect, one per line; it's reloaded when it changes")
+	verifyClientsURL  = flag.String("verify-clients-url", "", "if non-empty, URL of a local HTTP service that's POSTed each connecting client's node key as JSON, and answers 200 to accept it or 403 to reject it")
+
+	clientBytesPerSec        = flag.Int("client-bytes-per-sec", 0, "if non-zero, the sustained rate of WireGuard packet bytes each client may send; excess packets are dropped")
+	clientPacketsPerSec      = flag.Int("client-packets-per-sec", 0, "if non-zero, the sustained rate of WireGuard packets each client may send; excess packets are dropped")
+	clientDiscoBytesPerSec   = flag.Int("client-disco-bytes-per-sec", 0, "if non-zero, the sustained rate of disco packet bytes each client may send; excess packets are dropped")
+	clientDiscoPacketsPerSec = flag.Int("client-disco-packets-per-sec", 0, "if non-zero, the sustained rate of disco packets each client may send; excess packets are dropped")
 )
 
 type config struct {
@@ -137,14 +147,28 @@ func main() {
 		s.SetMeshKey(key)
 		log.Printf("DERP mesh key configured")
 	}
-	if err := startMesh(s); err != nil {
+	m, err := startMesh(s)
+	if err != nil {
 		log.Fatalf("startMesh: %v", err)
 	}
+	go m.runChecks()
+	if err := startVerifyClients(s); err != nil {
+		log.Fatalf("startVerifyClients: %v", err)
+	}
+	s.SetRateLimits(derp.RateLimit{
+		BytesPerSecond:   *clientBytesPerSec,
+		PacketsPerSecond: *clientPacketsPerSec,
+	}, derp.RateLimit{
+		BytesPerSecond:   *clientDiscoBytesPerSec,
+		PacketsPerSecond: *clientDiscoPacketsPerSec,
+	})
 	expvar.Publish("derp", s.ExpVar())
+	expvar.Publish("mesh", m.ExpVar())
 
 	// Create our own mux so we don't expose /debug/ stuff to the world.
-	mux := tsweb.NewMux(debugHandler(s))
+	mux := tsweb.NewMux(debugHandler(s, m))
 	mux.Handle("/derp", derphttp.Handler(s))
+	mux.Handle("/metrics", tsweb.Protected(http.HandlerFunc(tsweb.MetricsHandler)))
 	mux.Handle("/", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Content-Type", "text/html; charset=utf-8")
 		w.WriteHeader(200)
@@ -171,7 +195,6 @@ func main() {
 		Handler: mux,
 	}
 
-	var err error
 	if letsEncrypt {
 		if *certDir == "" {
 			log.Fatalf("missing required --certdir flag")
@@ -214,8 +237,16 @@ func main() {
 	}
 }
 
-func debugHandler(s *derp.Server) http.Handler {
+func debugHandler(s *derp.Server, m *mesh) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/debug/mesh/peers" {
+			m.servePeers(w, r)
+			return
+		}
+		if r.URL.Path == "/debug/mesh" || r.URL.Path == "/debug/mesh.json" {
+			m.serveHTTP(w, r)
+			return
+		}
 		if r.RequestURI == "/debug/check" {
 			err := s.ConsistencyCheck()
 			if err != nil {
@@ -233,14 +264,19 @@ func debugHandler(s *derp.Server) http.Handler {
 		f("<li><b>Hostname:</b> %v</li>\n", html.EscapeString(*hostname))
 		f("<li><b>Uptime:</b> %v</li>\n", tsweb.Uptime())
 		f("<li><b>Mesh Key:</b> %v</li>\n", s.HasMeshKey())
+		f("<li><b>Mesh peers file:</b> %v</li>\n", html.EscapeString(*meshWithFile))
+		f("<li><b>Client allowlist:</b> %v</li>\n", html.EscapeString(*verifyClientsFile))
+		f("<li><b>Client verifier:</b> %v</li>\n", html.EscapeString(*verifyClientsURL))
 		f("<li><b>Version:</b> %v</li>\n", html.EscapeString(version.Long))
 
 		f(`<li><a href="/debug/vars">/debug/vars</a> (Go)</li>
    <li><a href="/debug/varz">/debug/varz</a> (Prometheus)</li>
+   <li><a href="/metrics">/metrics</a> (Prometheus, with Go runtime stats)</li>
    <li><a href="/debug/pprof/">/debug/pprof/</a></li>
    <li><a href="/debug/pprof/goroutine?debug=1">/debug/pprof/goroutine</a> (collapsed)</li>
    <li><a href="/debug/pprof/goroutine?debug=2">/debug/pprof/goroutine</a> (full)</li>
    <li><a href="/debug/check">/debug/check</a> internal consistency check</li>
+   <li><a href="/debug/mesh">/debug/mesh</a> mesh peers (<a href="/debug/mesh.json">JSON</a>)</li>
 <ul>
 </html>
 `)
@@ -253,16 +289,25 @@ func serveSTUN() {
 		log.Fatalf("failed to open STUN listener: %v", err)
 	}
 	log.Printf("running STUN server on %v", pc.LocalAddr())
+	var altPC net.PacketConn
+	if *stunAltPort != 0 {
+		altPC, err = net.ListenPacket("udp", fmt.Sprintf(":%d", *stunAltPort))
+		if err != nil {
+			log.Fatalf("failed to open alternate STUN listener: %v", err)
+		}
+		log.Printf("running alternate STUN server on %v", altPC.LocalAddr())
+	}
 
 	var (
 		stats           = new(metrics.Set)
 		stunDisposition = &metrics.LabelMap{Label: "disposition"}
 		stunAddrFamily  = &metrics.LabelMap{Label: "family"}
 
-		stunReadError  = stunDisposition.Get("read_error")
-		stunNotSTUN    = stunDisposition.Get("not_stun")
-		stunWriteError = stunDisposition.Get("write_error")
-		stunSuccess    = stunDisposition.Get("success")
+		stunReadError         = stunDisposition.Get("read_error")
+		stunNotSTUN           = stunDisposition.Get("not_stun")
+		stunWriteError        = stunDisposition.Get("write_error")
+		stunSuccess           = stunDisposition.Get("success")
+		stunChangeUnsupported = stunDisposition.Get("change_unsupported")
 
 		stunIPv4 = stunAddrFamily.Get("ipv4")
 		stunIPv6 = stunAddrFamily.Get("ipv6")
@@ -271,44 +316,64 @@ func serveSTUN() {
 	stats.Set("counter_addrfamily", stunAddrFamily)
 	expvar.Publish("stun", stats)
 
-	var buf [64 << 10]byte
-	for {
-		n, addr, err := pc.ReadFrom(buf[:])
-		if err != nil {
-			log.Printf("STUN ReadFrom: %v", err)
-			time.Sleep(time.Second)
-			stunReadError.Add(1)
-			continue
-		}
-		ua, ok := addr.(*net.UDPAddr)
-		if !ok {
-			log.Printf("STUN unexpected address %T %v", addr, addr)
-			stunReadError.Add(1)
-			continue
-		}
-		pkt := buf[:n]
-		if !stun.Is(pkt) {
-			stunNotSTUN.Add(1)
-			continue
-		}
-		txid, err := stun.ParseBindingRequest(pkt)
-		if err != nil {
-			stunNotSTUN.Add(1)
-			continue
-		}
-		if ua.IP.To4() != nil {
-			stunIPv4.Add(1)
-		} else {
-			stunIPv6.Add(1)
-		}
-		res := stun.Response(txid, ua.IP, uint16(ua.Port))
-		_, err = pc.WriteTo(res, addr)
-		if err != nil {
-			stunWriteError.Add(1)
-		} else {
-			stunSuccess.Add(1)
+	// serve answers the STUN requests arriving on pc. Requests
+	// asking to change the response's port are answered from
+	// otherPC, if non-nil.
+	serve := func(pc, otherPC net.PacketConn) {
+		var buf [64 << 10]byte
+		for {
+			n, addr, err := pc.ReadFrom(buf[:])
+			if err != nil {
+				log.Printf("STUN ReadFrom: %v", err)
+				time.Sleep(time.Second)
+				stunReadError.Add(1)
+				continue
+			}
+			ua, ok := addr.(*net.UDPAddr)
+			if !ok {
+				log.Printf("STUN unexpected address %T %v", addr, addr)
+				stunReadError.Add(1)
+				continue
+			}
+			pkt := buf[:n]
+			if !stun.Is(pkt) {
+				stunNotSTUN.Add(1)
+				continue
+			}
+			txid, err := stun.ParseBindingRequest(pkt)
+			if err != nil {
+				stunNotSTUN.Add(1)
+				continue
+			}
+			resPC := pc
+			changeIP, changePort := stun.ParseChangeRequest(pkt)
+			if changePort {
+				resPC = otherPC
+			}
+			if changeIP || resPC == nil {
+				// We have no alternate IP address to
+				// answer from, or no alternate port.
+				stunChangeUnsupported.Add(1)
+				continue
+			}
+			if ua.IP.To4() != nil {
+				stunIPv4.Add(1)
+			} else {
+				stunIPv6.Add(1)
+			}
+			res := stun.Response(txid, ua.IP, uint16(ua.Port))
+			_, err = resPC.WriteTo(res, addr)
+			if err != nil {
+				stunWriteError.Add(1)
+			} else {
+				stunSuccess.Add(1)
+			}
 		}
 	}
+	if altPC != nil {
+		go serve(altPC, pc)
+	}
+	serve(pc, altPC)
 }
 
 var validProdHostname = regexp.MustCompile(`^derp([^.]*)\.tailscale\.com\.?$`)
@@ -5,8 +5,21 @@
 package main
 
 import (
+	"bytes"
 	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
 	"testing"
+
+	"go4.org/mem"
+	"tailscale.com/derp"
+	"tailscale.com/types/key"
 )
 
 func TestProdAutocertHostPolicy(t *testing.T) {
@@ -33,3 +46,109 @@ func TestProdAutocertHostPolicy(t *testing.T) {
 	}
 
 }
+
+func TestParseAllowlist(t *testing.T) {
+	k1 := strings.Repeat("ab", 32)
+	k2 := strings.Repeat("0f", 32)
+	in := "# comment\n\n" + k1 + "\n  nodekey:" + k2 + "  \n"
+	keys, err := parseAllowlist(strings.NewReader(in))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 2 {
+		t.Errorf("got %d keys; want 2", len(keys))
+	}
+	for _, hex := range []string{k1, k2} {
+		k, _ := key.NewPublicFromHexMem(mem.S(hex))
+		if !keys[k] {
+			t.Errorf("key %s missing", hex)
+		}
+	}
+
+	if _, err := parseAllowlist(strings.NewReader(k1 + "\nbogus\n")); err == nil || !strings.Contains(err.Error(), "line 2") {
+		t.Errorf("bad line error = %v; want mention of line 2", err)
+	}
+}
+
+func TestAllowlistReload(t *testing.T) {
+	k1 := key.Public{1}
+	k2 := key.Public{2}
+	path := filepath.Join(t.TempDir(), "allowlist")
+	write := func(keys ...key.Public) {
+		t.Helper()
+		var buf bytes.Buffer
+		for _, k := range keys {
+			fmt.Fprintf(&buf, "nodekey:%x\n", k[:])
+		}
+		if err := ioutil.WriteFile(path, buf.Bytes(), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write(k1)
+	al, err := newAllowlist(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := al.verify(k1, derp.ClientInfo{}); err != nil {
+		t.Errorf("k1: %v", err)
+	}
+	if err := al.verify(k2, derp.ClientInfo{}); !errors.Is(err, derp.ErrClientNotAllowed) {
+		t.Errorf("k2: %v; want ErrClientNotAllowed", err)
+	}
+
+	write(k1, k2)
+	if err := al.load(); err != nil {
+		t.Fatal(err)
+	}
+	if err := al.verify(k2, derp.ClientInfo{}); err != nil {
+		t.Errorf("k2 after reload: %v", err)
+	}
+
+	// A broken file leaves the previous keys in effect.
+	if err := ioutil.WriteFile(path, []byte("bogus\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := al.load(); err == nil {
+		t.Error("load of invalid allowlist succeeded")
+	}
+	if err := al.verify(k2, derp.ClientInfo{}); err != nil {
+		t.Errorf("k2 after failed reload: %v", err)
+	}
+}
+
+func TestVerifyCallout(t *testing.T) {
+	allowed := key.Public{1}
+	denied := key.Public{2}
+	var got verifyRequest
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req verifyRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, err.Error(), 400)
+			return
+		}
+		switch req.NodeKey {
+		case fmt.Sprintf("nodekey:%x", allowed[:]):
+			got = req
+		case fmt.Sprintf("nodekey:%x", denied[:]):
+			http.Error(w, "no", http.StatusForbidden)
+		default:
+			http.Error(w, "oops", 500)
+		}
+	}))
+	defer ts.Close()
+	vc := &verifyCallout{url: ts.URL, client: ts.Client()}
+
+	info := derp.ClientInfo{Version: 2, RemoteAddr: "1.2.3.4:5678"}
+	if err := vc.verify(allowed, info); err != nil {
+		t.Errorf("allowed: %v", err)
+	}
+	if got.Version != 2 || got.RemoteAddr != "1.2.3.4:5678" {
+		t.Errorf("verifier got %+v", got)
+	}
+	if err := vc.verify(denied, info); !errors.Is(err, derp.ErrClientNotAllowed) {
+		t.Errorf("denied: %v; want ErrClientNotAllowed", err)
+	}
+	if err := vc.verify(key.Public{3}, info); err == nil || errors.Is(err, derp.ErrClientNotAllowed) {
+		t.Errorf("verifier failure: %v; want non-ErrClientNotAllowed error", err)
+	}
+}
@@ -5,42 +5,623 @@
 package main
 
 import (
+	"bufio"
 	"context"
+	"crypto/subtle"
+	"encoding/json"
 	"errors"
+	"expvar"
 	"fmt"
+	"html"
+	"io"
 	"log"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
+	"unicode"
 
 	"tailscale.com/derp"
 	"tailscale.com/derp/derphttp"
+	"tailscale.com/metrics"
 	"tailscale.com/types/key"
 	"tailscale.com/types/logger"
 )
 
-func startMesh(s *derp.Server) error {
-	if *meshWith == "" {
-		return nil
+const (
+	// meshCheckInterval is how often the server's
+	// ConsistencyCheck runs and the mesh metrics are updated.
+	meshCheckInterval = 30 * time.Second
+
+	// meshPingInterval is how often each mesh peer is pinged, to
+	// measure the link's round trip time and notice dead links.
+	meshPingInterval = 15 * time.Second
+
+	// meshPingTimeout is how long a mesh peer has to answer a
+	// ping before its link is considered dead and redialed.
+	meshPingTimeout = 5 * time.Second
+
+	// meshFilePollInterval is how often --mesh-with-file is
+	// checked for changes.
+	meshFilePollInterval = 10 * time.Second
+)
+
+// mesh is a server's set of mesh links to the other servers in its
+// region, along with the health reporting about them.
+type mesh struct {
+	s      *derp.Server
+	scheme string // of the peers' DERP URLs; "https" except in tests
+
+	checks         expvar.Int // runs of ConsistencyCheck
+	checkFailures  expvar.Int // ... that failed
+	checkOK        expvar.Int // 1 if the last run succeeded, else 0
+	peerConnected  metrics.LabelMap
+	peerClients    metrics.LabelMap
+	peerReconnects metrics.LabelMap
+	peerRTT        metrics.LabelMap
+
+	mu        sync.Mutex
+	peers     map[string]*meshPeer // keyed by host
+	lastCheck time.Time            // zero until the first ConsistencyCheck
+	checkErr  error                // of the last ConsistencyCheck
+}
+
+// meshPeer is a mesh link to another server, over which this server
+// learns of that server's clients so it can forward packets to them.
+type meshPeer struct {
+	host   string
+	c      *derphttp.Client
+	cancel context.CancelFunc // stops the link's goroutines
+
+	mu      sync.Mutex
+	closed  bool
+	clients map[key.Public]bool // the peer's clients, forwarded to via c
+	rtt     time.Duration       // of the last mesh ping; 0 if unknown
+}
+
+func newMesh(s *derp.Server) *mesh {
+	return &mesh{
+		s:              s,
+		scheme:         "https",
+		peerConnected:  metrics.LabelMap{Label: "peer"},
+		peerClients:    metrics.LabelMap{Label: "peer"},
+		peerReconnects: metrics.LabelMap{Label: "peer"},
+		peerRTT:        metrics.LabelMap{Label: "peer"},
+		peers:          map[string]*meshPeer{},
+	}
+}
+
+// startMesh returns the mesh of s, meshed with the --mesh-with and
+// --mesh-with-file hosts. If --mesh-with-file is set, the mesh follows
+// changes to it.
+func startMesh(s *derp.Server) (*mesh, error) {
+	m := newMesh(s)
+	if *meshWith == "" && *meshWithFile == "" {
+		return m, nil
 	}
 	if !s.HasMeshKey() {
-		return errors.New("--mesh-with requires --mesh-psk-file")
+		return nil, errors.New("--mesh-with and --mesh-with-file require --mesh-psk-file")
 	}
-	for _, host := range strings.Split(*meshWith, ",") {
-		if err := startMeshWithHost(s, host); err != nil {
-			return err
+	static := strings.Split(*meshWith, ",")
+	hosts := static
+	if *meshWithFile != "" {
+		mf := &meshFile{path: *meshWithFile}
+		fileHosts, _, err := mf.load()
+		if err != nil {
+			return nil, err
 		}
+		hosts = append(hosts[:len(hosts):len(hosts)], fileHosts...)
+		go m.watchFile(mf, static)
 	}
-	return nil
+	if err := m.setPeers(hosts); err != nil {
+		return nil, err
+	}
+	return m, nil
 }
 
-func startMeshWithHost(s *derp.Server, host string) error {
+// addPeer starts meshing with the server at host.
+func (m *mesh) addPeer(host string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.addPeerLocked(host)
+}
+
+func (m *mesh) addPeerLocked(host string) error {
+	if _, dup := m.peers[host]; dup {
+		return fmt.Errorf("duplicate mesh peer %q", host)
+	}
 	logf := logger.WithPrefix(log.Printf, fmt.Sprintf("mesh(%q): ", host))
-	c, err := derphttp.NewClient(s.PrivateKey(), "https://"+host+"/derp", logf)
+	c, err := derphttp.NewClient(m.s.PrivateKey(), m.scheme+"://"+host+"/derp", logf)
 	if err != nil {
 		return err
 	}
-	c.MeshKey = s.MeshKey()
-	add := func(k key.Public) { s.AddPacketForwarder(k, c) }
-	remove := func(k key.Public) { s.RemovePacketForwarder(k, c) }
-	go c.RunWatchConnectionLoop(context.Background(), s.PublicKey(), logf, add, remove)
+	c.MeshKey = m.s.MeshKey()
+	ctx, cancel := context.WithCancel(context.Background())
+	p := &meshPeer{
+		host:    host,
+		c:       c,
+		cancel:  cancel,
+		clients: map[key.Public]bool{},
+	}
+	m.peers[host] = p
+	add := func(k key.Public) { p.setClient(m.s, k, true) }
+	remove := func(k key.Public) { p.setClient(m.s, k, false) }
+	go c.RunWatchConnectionLoop(ctx, m.s.PublicKey(), logf, add, remove)
+	go p.runPinger(ctx, logf)
 	return nil
 }
+
+// removePeer stops meshing with the server at host. Packets for its
+// clients are no longer forwarded to it, unless they're also known
+// to be connected to another peer.
+func (m *mesh) removePeer(host string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.removePeerLocked(host)
+}
+
+func (m *mesh) removePeerLocked(host string) error {
+	p, ok := m.peers[host]
+	if !ok {
+		return fmt.Errorf("no mesh peer %q", host)
+	}
+	p.close(m.s)
+	delete(m.peers, host)
+	for _, lm := range []*metrics.LabelMap{&m.peerConnected, &m.peerClients, &m.peerReconnects, &m.peerRTT} {
+		lm.Delete(host)
+	}
+	return nil
+}
+
+// setPeers makes hosts the mesh peers, adding and removing links as
+// needed. Links to hosts that were already peers are left alone.
+// Empty hosts are ignored.
+func (m *mesh) setPeers(hosts []string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	want := map[string]bool{}
+	for _, host := range hosts {
+		if host != "" {
+			want[host] = true
+		}
+	}
+	var firstErr error
+	for host := range m.peers {
+		if !want[host] {
+			m.removePeerLocked(host)
+		}
+	}
+	for host := range want {
+		if _, ok := m.peers[host]; ok {
+			continue
+		}
+		if err := m.addPeerLocked(host); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// hosts returns the hosts of m's peers, sorted.
+func (m *mesh) hosts() []string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	hosts := make([]string, 0, len(m.peers))
+	for host := range m.peers {
+		hosts = append(hosts, host)
+	}
+	sort.Strings(hosts)
+	return hosts
+}
+
+// close closes all of m's mesh links.
+func (m *mesh) close() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for host, p := range m.peers {
+		p.close(m.s)
+		delete(m.peers, host)
+	}
+}
+
+// setClient records whether the peer has client k and updates the
+// packet forwarding of s accordingly.
+func (p *meshPeer) setClient(s *derp.Server, k key.Public, present bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closed {
+		return
+	}
+	if present {
+		p.clients[k] = true
+		s.AddPacketForwarder(k, p.c)
+	} else {
+		delete(p.clients, k)
+		s.RemovePacketForwarder(k, p.c)
+	}
+}
+
+// close stops the link and stops forwarding packets of s over it.
+func (p *meshPeer) close(s *derp.Server) {
+	p.cancel()
+	p.c.Close()
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.closed = true
+	for k := range p.clients {
+		s.RemovePacketForwarder(k, p.c)
+	}
+	p.clients = nil
+}
+
+// runPinger pings the peer every meshPingInterval while its link is
+// up, until ctx is done. A ping that's not answered in time closes
+// the link, which RunWatchConnectionLoop then redials.
+func (p *meshPeer) runPinger(ctx context.Context, logf logger.Logf) {
+	t := time.NewTicker(meshPingInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+		var rtt time.Duration
+		if p.c.WatchConnectionStatus().Connected {
+			pingCtx, cancel := context.WithTimeout(ctx, meshPingTimeout)
+			start := time.Now()
+			err := p.c.Ping(pingCtx)
+			cancel()
+			switch {
+			case err == nil:
+				rtt = time.Since(start)
+			case ctx.Err() != nil:
+				return
+			case !errors.Is(err, derp.ErrPingUnsupported):
+				logf("ping: %v", err)
+			}
+		}
+		p.mu.Lock()
+		p.rtt = rtt
+		p.mu.Unlock()
+	}
+}
+
+// meshPeerStatus is the state of a mesh link, as served by
+// /debug/mesh.json.
+type meshPeerStatus struct {
+	Host string
+	derphttp.WatchConnectionStatus
+	RTT        float64  `json:",omitempty"` // seconds; 0 if unknown
+	Clients    int      // clients of the peer this server forwards to
+	ClientKeys []string `json:",omitempty"` // the Clients, if requested
+}
+
+// meshStatus is the JSON response of /debug/mesh.json.
+type meshStatus struct {
+	Peers []meshPeerStatus
+
+	// LastCheck is when ConsistencyCheck last ran, and CheckError
+	// is its error, if it failed.
+	LastCheck  time.Time
+	CheckError string `json:",omitempty"`
+}
+
+// status returns the state of m's mesh links, sorted by host. If
+// withKeys, it includes the keys of the clients known via each link.
+func (m *mesh) status(withKeys bool) meshStatus {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.statusLocked(withKeys)
+}
+
+func (m *mesh) statusLocked(withKeys bool) meshStatus {
+	st := meshStatus{LastCheck: m.lastCheck}
+	if m.checkErr != nil {
+		st.CheckError = m.checkErr.Error()
+	}
+	for _, p := range m.peers {
+		ps := meshPeerStatus{
+			Host:                  p.host,
+			WatchConnectionStatus: p.c.WatchConnectionStatus(),
+		}
+		p.mu.Lock()
+		ps.RTT = p.rtt.Seconds()
+		ps.Clients = len(p.clients)
+		if withKeys {
+			for k := range p.clients {
+				ps.ClientKeys = append(ps.ClientKeys, fmt.Sprintf("%s%x", nodeKeyPrefix, k[:]))
+			}
+			sort.Strings(ps.ClientKeys)
+		}
+		p.mu.Unlock()
+		st.Peers = append(st.Peers, ps)
+	}
+	sort.Slice(st.Peers, func(i, j int) bool { return st.Peers[i].Host < st.Peers[j].Host })
+	return st
+}
+
+// serveHTTP serves m's status at /debug/mesh as HTML, and at
+// /debug/mesh.json as a JSON meshStatus. With ?clients=1, the JSON
+// includes the keys of the clients known via each peer.
+func (m *mesh) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	st := m.status(r.FormValue("clients") == "1")
+	if strings.HasSuffix(r.URL.Path, ".json") {
+		w.Header().Set("Content-Type", "application/json")
+		e := json.NewEncoder(w)
+		e.SetIndent("", "\t")
+		e.Encode(st)
+		return
+	}
+
+	f := func(format string, args ...interface{}) { fmt.Fprintf(w, format, args...) }
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	f(`<html><body>
+<h1>DERP mesh</h1>
+<p><a href="/debug/mesh.json">JSON</a>, <a href="/debug/mesh.json?clients=1">with client keys</a></p>
+`)
+	switch {
+	case st.LastCheck.IsZero():
+		f("<p>ConsistencyCheck: not run yet</p>\n")
+	case st.CheckError != "":
+		f("<p>ConsistencyCheck at %v: <b>%s</b></p>\n", st.LastCheck.Format(time.RFC3339), html.EscapeString(st.CheckError))
+	default:
+		f("<p>ConsistencyCheck at %v: okay</p>\n", st.LastCheck.Format(time.RFC3339))
+	}
+	if len(st.Peers) == 0 {
+		f("<p>No mesh peers.</p></body></html>\n")
+		return
+	}
+	f("<table border=1 cellpadding=3>\n<tr><th>Peer</th><th>State</th><th>Since</th><th>Reconnects</th><th>RTT</th><th>Clients</th><th>Last error</th></tr>\n")
+	for _, ps := range st.Peers {
+		state := "disconnected"
+		switch {
+		case ps.SelfConnect:
+			state = "self"
+		case ps.Connected:
+			state = "connected"
+		}
+		var since, rtt, lastErr string
+		if !ps.Since.IsZero() {
+			since = time.Since(ps.Since).Round(time.Second).String()
+		}
+		if ps.RTT != 0 {
+			rtt = time.Duration(ps.RTT * float64(time.Second)).Round(time.Microsecond).String()
+		}
+		if ps.LastError != "" {
+			lastErr = fmt.Sprintf("%s ago: %s", time.Since(ps.LastErrorTime).Round(time.Second), ps.LastError)
+		}
+		f("<tr><td>%s</td><td>%s</td><td>%s</td><td>%d</td><td>%s</td><td>%d</td><td>%s</td></tr>\n",
+			html.EscapeString(ps.Host), state, since, ps.Reconnects, rtt, ps.Clients, html.EscapeString(lastErr))
+	}
+	f("</table></body></html>\n")
+}
+
+// servePeers serves the mesh admin endpoint at /debug/mesh/peers.
+// GET returns the peers' hosts as a JSON list. POST adds the hosts
+// in the "add" form values and removes those in the "remove" ones,
+// then returns the resulting list. If --mesh-with-file is set, such
+// changes last until the file next changes.
+//
+// Because added peers are sent the mesh key, POST is only allowed
+// from loopback and must present the mesh key as a bearer token.
+func (m *mesh) servePeers(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+	case "POST":
+		if !m.s.HasMeshKey() {
+			http.Error(w, "meshing requires --mesh-psk-file", http.StatusBadRequest)
+			return
+		}
+		if !isLoopbackRemote(r) {
+			http.Error(w, "mesh changes only allowed from localhost", http.StatusForbidden)
+			return
+		}
+		if !m.authorized(r) {
+			http.Error(w, "mesh changes require the mesh key", http.StatusUnauthorized)
+			return
+		}
+		r.ParseForm()
+		for _, host := range r.Form["add"] {
+			if err := checkMeshHost(host); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+		for _, host := range r.Form["remove"] {
+			if err := m.removePeer(host); err != nil {
+				http.Error(w, err.Error(), http.StatusNotFound)
+				return
+			}
+			log.Printf("derper: removed mesh peer %q", host)
+		}
+		for _, host := range r.Form["add"] {
+			if err := m.addPeer(host); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			log.Printf("derper: added mesh peer %q", host)
+		}
+	default:
+		http.Error(w, "want GET or POST", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(m.hosts())
+}
+
+// authorized reports whether r carries the mesh key in an
+// "Authorization: Bearer" header.
+func (m *mesh) authorized(r *http.Request) bool {
+	const prefix = "Bearer "
+	auth := r.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, prefix) {
+		return false
+	}
+	got := strings.TrimSpace(strings.TrimPrefix(auth, prefix))
+	return subtle.ConstantTimeCompare([]byte(got), []byte(m.s.MeshKey())) == 1
+}
+
+// isLoopbackRemote reports whether r came from a loopback address.
+func isLoopbackRemote(r *http.Request) bool {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return false
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// checkMeshHost returns an error unless host is a plain hostname or
+// IPv4 address, optionally followed by a port, as used to build a
+// peer's DERP URL.
+func checkMeshHost(host string) error {
+	name := host
+	if strings.Contains(host, ":") {
+		var port string
+		var err error
+		name, port, err = net.SplitHostPort(host)
+		if err != nil {
+			return fmt.Errorf("invalid mesh peer %q: %w", host, err)
+		}
+		if n, err := strconv.ParseUint(port, 10, 16); err != nil || n == 0 {
+			return fmt.Errorf("invalid port in mesh peer %q", host)
+		}
+	}
+	if name == "" || len(name) > 253 || name[0] == '-' || name[0] == '.' {
+		return fmt.Errorf("invalid mesh peer %q", host)
+	}
+	for _, c := range name {
+		switch {
+		case 'a' <= c && c <= 'z', 'A' <= c && c <= 'Z', '0' <= c && c <= '9', c == '-', c == '.':
+		default:
+			return fmt.Errorf("invalid mesh peer %q: not a plain hostname", host)
+		}
+	}
+	return nil
+}
+
+// meshFile is a --mesh-with-file file of mesh peer hosts.
+type meshFile struct {
+	path    string
+	modTime time.Time
+	size    int64
+}
+
+// load returns the hosts in the file, and whether it changed since
+// the last load. If it didn't, the hosts are nil.
+func (mf *meshFile) load() (hosts []string, changed bool, err error) {
+	fi, err := os.Stat(mf.path)
+	if err != nil {
+		return nil, false, err
+	}
+	if fi.ModTime().Equal(mf.modTime) && fi.Size() == mf.size {
+		return nil, false, nil
+	}
+	f, err := os.Open(mf.path)
+	if err != nil {
+		return nil, false, err
+	}
+	defer f.Close()
+	hosts, err = parseMeshHosts(f)
+	if err != nil {
+		return nil, false, fmt.Errorf("%s: %w", mf.path, err)
+	}
+	mf.modTime = fi.ModTime()
+	mf.size = fi.Size()
+	return hosts, true, nil
+}
+
+// parseMeshHosts parses a --mesh-with-file file: hostnames separated
+// by commas or whitespace. Text from a '#' to the end of its line is
+// ignored.
+func parseMeshHosts(r io.Reader) ([]string, error) {
+	var hosts []string
+	bs := bufio.NewScanner(r)
+	for bs.Scan() {
+		line := bs.Text()
+		if i := strings.IndexByte(line, '#'); i != -1 {
+			line = line[:i]
+		}
+		hosts = append(hosts, strings.FieldsFunc(line, func(r rune) bool {
+			return r == ',' || unicode.IsSpace(r)
+		})...)
+	}
+	if err := bs.Err(); err != nil {
+		return nil, err
+	}
+	return hosts, nil
+}
+
+// reloadFile makes the hosts in mf, plus static, m's peers, if mf
+// changed since it was last loaded.
+func (m *mesh) reloadFile(mf *meshFile, static []string) error {
+	hosts, changed, err := mf.load()
+	if err != nil || !changed {
+		return err
+	}
+	log.Printf("derper: loaded %d mesh peers from %s", len(hosts), mf.path)
+	return m.setPeers(append(hosts, static...))
+}
+
+// watchFile calls reloadFile every meshFilePollInterval, forever.
+func (m *mesh) watchFile(mf *meshFile, static []string) {
+	for range time.Tick(meshFilePollInterval) {
+		if err := m.reloadFile(mf, static); err != nil {
+			log.Printf("derper: reloading mesh peers: %v", err)
+		}
+	}
+}
+
+// runChecks runs check every meshCheckInterval, forever.
+func (m *mesh) runChecks() {
+	m.check()
+	for range time.Tick(meshCheckInterval) {
+		m.check()
+	}
+}
+
+// check runs the server's ConsistencyCheck and updates m's metrics.
+func (m *mesh) check() {
+	err := m.s.ConsistencyCheck()
+	m.checks.Add(1)
+	if err != nil {
+		log.Printf("derper: ConsistencyCheck: %v", err)
+		m.checkFailures.Add(1)
+		m.checkOK.Set(0)
+	} else {
+		m.checkOK.Set(1)
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.lastCheck = time.Now()
+	m.checkErr = err
+	for _, ps := range m.statusLocked(false).Peers {
+		var connected int64
+		if ps.Connected {
+			connected = 1
+		}
+		m.peerConnected.Get(ps.Host).Set(connected)
+		m.peerClients.Get(ps.Host).Set(int64(ps.Clients))
+		m.peerReconnects.Get(ps.Host).Set(int64(ps.Reconnects))
+		m.peerRTT.GetFloat(ps.Host).Set(ps.RTT)
+	}
+}
+
+// ExpVar returns an expvar variable suitable for registering with
+// expvar.Publish.
+func (m *mesh) ExpVar() expvar.Var {
+	set := new(metrics.Set)
+	set.Set("counter_consistency_checks", &m.checks)
+	set.Set("counter_consistency_check_failures", &m.checkFailures)
+	set.Set("gauge_consistency_ok", &m.checkOK)
+	set.Set("gauge_peer_connected", &m.peerConnected)
+	set.Set("gauge_peer_clients", &m.peerClients)
+	set.Set("counter_peer_reconnects", &m.peerReconnects)
+	set.Set("gauge_peer_rtt_seconds", &m.peerRTT)
+	return set
+}
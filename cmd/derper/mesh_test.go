@@ -0,0 +1,419 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"expvar"
+	"fmt"
+	"io/ioutil"
+	"net/http/httptest"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"tailscale.com/derp"
+	"tailscale.com/derp/derphttp"
+	"tailscale.com/metrics"
+	"tailscale.com/types/key"
+)
+
+// testMeshServer is an in-process DERP server for mesh tests.
+type testMeshServer struct {
+	s    *derp.Server
+	m    *mesh
+	host string // host:port of its HTTP server
+}
+
+func newTestMeshServers(t *testing.T, n int) []*testMeshServer {
+	t.Helper()
+	meshKey := strings.Repeat("ab", 32)
+	var servers []*testMeshServer
+	for i := 0; i < n; i++ {
+		s := derp.NewServer(key.NewPrivate(), t.Logf)
+		s.SetMeshKey(meshKey)
+		hs := httptest.NewServer(derphttp.Handler(s))
+		m := newMesh(s)
+		m.scheme = "http"
+		t.Cleanup(func() {
+			m.close()
+			hs.Close()
+			s.Close()
+		})
+		servers = append(servers, &testMeshServer{
+			s:    s,
+			m:    m,
+			host: strings.TrimPrefix(hs.URL, "http://"),
+		})
+	}
+	return servers
+}
+
+// meshAll meshes every server with every server, including itself,
+// as --mesh-with is usually configured.
+func meshAll(t *testing.T, servers []*testMeshServer) {
+	t.Helper()
+	for _, ts := range servers {
+		for _, peer := range servers {
+			if err := ts.m.addPeer(peer.host); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+}
+
+// waitFor calls cond until it returns nil, failing the test with
+// cond's last error if that takes too long.
+func waitFor(t *testing.T, cond func() error) {
+	t.Helper()
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		err := cond()
+		if err == nil {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatal(err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func findPeer(st meshStatus, host string) (meshPeerStatus, bool) {
+	for _, ps := range st.Peers {
+		if ps.Host == host {
+			return ps, true
+		}
+	}
+	return meshPeerStatus{}, false
+}
+
+func TestMeshStatus(t *testing.T) {
+	servers := newTestMeshServers(t, 3)
+	meshAll(t, servers)
+	a, b := servers[0], servers[1]
+
+	if err := a.m.addPeer(b.host); err == nil {
+		t.Error("duplicate addPeer succeeded")
+	}
+
+	// Connect a client to a, and wait for the other servers to
+	// learn of it over their mesh links.
+	clientKey := key.NewPrivate()
+	c, err := derphttp.NewClient(clientKey, "http://"+a.host+"/derp", t.Logf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if err := c.Connect(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	clientPub := clientKey.Public()
+	wantKey := fmt.Sprintf("nodekey:%x", clientPub[:])
+	for _, ts := range servers[1:] {
+		waitFor(t, func() error {
+			ps, ok := findPeer(ts.m.status(true), a.host)
+			if !ok {
+				return fmt.Errorf("%s: no peer %s", ts.host, a.host)
+			}
+			if !ps.Connected {
+				return fmt.Errorf("%s: peer %s not connected: %+v", ts.host, a.host, ps)
+			}
+			for _, k := range ps.ClientKeys {
+				if k == wantKey {
+					return nil
+				}
+			}
+			return fmt.Errorf("%s: client not known via %s; have %q", ts.host, a.host, ps.ClientKeys)
+		})
+	}
+
+	st := a.m.status(false)
+	if len(st.Peers) != len(servers) {
+		t.Fatalf("got %d peers; want %d", len(st.Peers), len(servers))
+	}
+	waitFor(t, func() error {
+		if ps, _ := findPeer(a.m.status(false), a.host); !ps.SelfConnect {
+			return fmt.Errorf("self peer not detected: %+v", ps)
+		}
+		return nil
+	})
+
+	// The consistency check passes on all servers, and is
+	// reported in the metrics.
+	for _, ts := range servers {
+		ts.m.check()
+		if got := ts.m.checkOK.Value(); got != 1 {
+			t.Errorf("%s: checkOK = %d; want 1 (%v)", ts.host, got, ts.m.status(false).CheckError)
+		}
+		if got := ts.m.checks.Value(); got != 1 {
+			t.Errorf("%s: checks = %d; want 1", ts.host, got)
+		}
+	}
+	if got := b.m.peerConnected.Get(a.host).Value(); got != 1 {
+		t.Errorf("b's peer_connected{peer=a} = %d; want 1", got)
+	}
+	if got := b.m.peerClients.Get(a.host).Value(); got < 1 {
+		t.Errorf("b's peer_clients{peer=a} = %d; want >= 1", got)
+	}
+
+	// The JSON endpoint serves the same.
+	rec := httptest.NewRecorder()
+	b.m.serveHTTP(rec, httptest.NewRequest("GET", "/debug/mesh.json?clients=1", nil))
+	var got meshStatus
+	if err := json.Unmarshal(rec.Body.Bytes(), &got); err != nil {
+		t.Fatalf("bad JSON: %v\n%s", err, rec.Body.Bytes())
+	}
+	if ps, ok := findPeer(got, a.host); !ok || !ps.Connected || len(ps.ClientKeys) != ps.Clients {
+		t.Errorf("JSON status of peer a = %+v, %v", ps, ok)
+	}
+	rec = httptest.NewRecorder()
+	b.m.serveHTTP(rec, httptest.NewRequest("GET", "/debug/mesh", nil))
+	if body := rec.Body.String(); !strings.Contains(body, a.host) || !strings.Contains(body, "connected") {
+		t.Errorf("HTML status lacks peer a:\n%s", body)
+	}
+
+	// When a's client leaves, the others forget it.
+	c.Close()
+	for _, ts := range servers[1:] {
+		waitFor(t, func() error {
+			ps, _ := findPeer(ts.m.status(true), a.host)
+			for _, k := range ps.ClientKeys {
+				if k == wantKey {
+					return fmt.Errorf("%s: client still known via %s", ts.host, a.host)
+				}
+			}
+			return nil
+		})
+	}
+}
+
+func TestMeshReconnect(t *testing.T) {
+	servers := newTestMeshServers(t, 2)
+	meshAll(t, servers)
+	a, b := servers[0], servers[1]
+	waitFor(t, func() error {
+		if ps, _ := findPeer(b.m.status(false), a.host); !ps.Connected {
+			return fmt.Errorf("peer not connected: %+v", ps)
+		}
+		return nil
+	})
+
+	// Have a close b's mesh link to it; b notices and reconnects,
+	// counting it.
+	closer, err := derphttp.NewClient(key.NewPrivate(), "http://"+a.host+"/derp", t.Logf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer closer.Close()
+	closer.MeshKey = a.s.MeshKey()
+	if err := closer.ClosePeer(b.s.PublicKey()); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, func() error {
+		ps, _ := findPeer(b.m.status(false), a.host)
+		if ps.LastError == "" || !ps.Connected || ps.Reconnects != 1 {
+			return fmt.Errorf("peer didn't reconnect: %+v", ps)
+		}
+		return nil
+	})
+	b.m.check()
+	if got := b.m.peerReconnects.Get(a.host).Value(); got != 1 {
+		t.Errorf("peer_reconnects{peer=a} = %d; want 1", got)
+	}
+}
+
+func TestParseMeshHosts(t *testing.T) {
+	in := "# region peers\nderp1a.example.com, derp1b.example.com\n\n  derp1c.example.com derp1d.example.com # new\n"
+	got, err := parseMeshHosts(strings.NewReader(in))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"derp1a.example.com", "derp1b.example.com", "derp1c.example.com", "derp1d.example.com"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %q; want %q", got, want)
+	}
+}
+
+// remoteClients returns the number of clients s knows of only via
+// its mesh peers.
+func remoteClients(s *derp.Server) int {
+	return s.ExpVar().(*metrics.Set).Get("gauge_clients_remote").(expvar.Func)().(int)
+}
+
+func TestMeshMembership(t *testing.T) {
+	servers := newTestMeshServers(t, 3)
+	a, b, c := servers[0], servers[1], servers[2]
+	if err := a.m.setPeers([]string{b.host, ""}); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, func() error {
+		if ps, _ := findPeer(a.m.status(false), b.host); !ps.Connected {
+			return fmt.Errorf("peer b not connected: %+v", ps)
+		}
+		return nil
+	})
+
+	connect := func(ts *testMeshServer) key.Public {
+		k := key.NewPrivate()
+		dc, err := derphttp.NewClient(k, "http://"+ts.host+"/derp", t.Logf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { dc.Close() })
+		if err := dc.Connect(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+		return k.Public()
+	}
+	connect(a)
+	cClient := connect(c)
+	wantKey := fmt.Sprintf("nodekey:%x", cClient[:])
+	knowsCClient := func() bool {
+		ps, _ := findPeer(a.m.status(true), c.host)
+		for _, k := range ps.ClientKeys {
+			if k == wantKey {
+				return true
+			}
+		}
+		return false
+	}
+
+	post := func(form string) []string {
+		t.Helper()
+		req := httptest.NewRequest("POST", "/debug/mesh/peers", strings.NewReader(form))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.Header.Set("Authorization", "Bearer "+a.s.MeshKey())
+		req.RemoteAddr = "127.0.0.1:1234"
+		rec := httptest.NewRecorder()
+		a.m.servePeers(rec, req)
+		if rec.Code != 200 {
+			t.Fatalf("POST %s: %v: %s", form, rec.Code, rec.Body.Bytes())
+		}
+		var hosts []string
+		if err := json.Unmarshal(rec.Body.Bytes(), &hosts); err != nil {
+			t.Fatal(err)
+		}
+		return hosts
+	}
+
+	// Adding c through the admin endpoint makes a learn of c's
+	// client, without disturbing its own.
+	remoteBefore := remoteClients(a.s)
+	if got, want := post("add="+c.host), []string{b.host, c.host}; !reflect.DeepEqual(got, want) && !reflect.DeepEqual(got, []string{c.host, b.host}) {
+		t.Errorf("peers after add = %q; want %q", got, want)
+	}
+	waitFor(t, func() error {
+		if !knowsCClient() {
+			return errors.New("c's client not known via peer c")
+		}
+		return nil
+	})
+	if got := remoteClients(a.s); got <= remoteBefore {
+		t.Errorf("remote clients = %d after adding peer c; want more than %d", got, remoteBefore)
+	}
+
+	// Removing it forgets them again, and no more.
+	if got, want := post("remove="+c.host), []string{b.host}; !reflect.DeepEqual(got, want) {
+		t.Errorf("peers after remove = %q; want %q", got, want)
+	}
+	if got := remoteClients(a.s); got != remoteBefore {
+		t.Errorf("remote clients = %d after removing peer c; want %d", got, remoteBefore)
+	}
+	if err := a.s.ConsistencyCheck(); err != nil {
+		t.Errorf("ConsistencyCheck: %v", err)
+	}
+
+	for _, tt := range []struct {
+		name       string
+		query      string
+		remoteAddr string
+		auth       string
+		want       int
+	}{
+		{"unknown", "remove=nonexistent", "127.0.0.1:1234", "Bearer " + a.s.MeshKey(), 404},
+		{"not_loopback", "add=" + c.host, "100.64.1.2:1234", "Bearer " + a.s.MeshKey(), 403},
+		{"no_key", "add=" + c.host, "127.0.0.1:1234", "", 401},
+		{"wrong_key", "add=" + c.host, "[::1]:1234", "Bearer nope", 401},
+		{"not_hostname", "add=evil.example%2Fx%3F", "127.0.0.1:1234", "Bearer " + a.s.MeshKey(), 400},
+	} {
+		req := httptest.NewRequest("POST", "/debug/mesh/peers?"+tt.query, nil)
+		req.RemoteAddr = tt.remoteAddr
+		if tt.auth != "" {
+			req.Header.Set("Authorization", tt.auth)
+		}
+		rec := httptest.NewRecorder()
+		a.m.servePeers(rec, req)
+		if rec.Code != tt.want {
+			t.Errorf("%s: got status %v; want %v", tt.name, rec.Code, tt.want)
+		}
+	}
+	if got, want := a.m.hosts(), []string{b.host}; !reflect.DeepEqual(got, want) {
+		t.Errorf("peers after rejected changes = %q; want %q", got, want)
+	}
+
+	// The mesh follows --mesh-with-file, along with --mesh-with.
+	path := filepath.Join(t.TempDir(), "mesh")
+	if err := ioutil.WriteFile(path, []byte(c.host+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	mf := &meshFile{path: path}
+	if err := a.m.reloadFile(mf, []string{b.host}); err != nil {
+		t.Fatal(err)
+	}
+	wantHosts := []string{b.host, c.host}
+	sort.Strings(wantHosts)
+	if got := a.m.hosts(); !reflect.DeepEqual(got, wantHosts) {
+		t.Errorf("peers after file load = %q; want %q", got, wantHosts)
+	}
+	waitFor(t, func() error {
+		if !knowsCClient() {
+			return errors.New("c's client not known via peer c from file")
+		}
+		return nil
+	})
+	if err := ioutil.WriteFile(path, []byte("# none\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.m.reloadFile(mf, []string{b.host}); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := a.m.hosts(), []string{b.host}; !reflect.DeepEqual(got, want) {
+		t.Errorf("peers after file change = %q; want %q", got, want)
+	}
+	if got := remoteClients(a.s); got != remoteBefore {
+		t.Errorf("remote clients = %d after file removed peer c; want %d", got, remoteBefore)
+	}
+}
+
+func TestCheckMeshHost(t *testing.T) {
+	for _, tt := range []struct {
+		host string
+		ok   bool
+	}{
+		{"derp1.tailscale.com", true},
+		{"derp1b", true},
+		{"127.0.0.1:8443", true},
+		{"", false},
+		{"-x.example", false},
+		{"evil.example/x?", false},
+		{"user@evil.example", false},
+		{"evil.example#", false},
+		{"https://evil.example", false},
+		{"evil.example:0", false},
+		{"evil.example:http", false},
+		{"[::1]:443", false},
+	} {
+		err := checkMeshHost(tt.host)
+		if (err == nil) != tt.ok {
+			t.Errorf("checkMeshHost(%q) = %v; want ok=%v", tt.host, err, tt.ok)
+		}
+	}
+}
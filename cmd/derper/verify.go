@@ -0,0 +1,207 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"go4.org/mem"
+	"tailscale.com/derp"
+	"tailscale.com/types/key"
+)
+
+// allowlistPollInterval is how often the -verify-clients-file
+// allowlist is checked for changes.
+const allowlistPollInterval = 10 * time.Second
+
+// verifyCalloutTimeout bounds how long the -verify-clients-url
+// verifier has to answer.
+const verifyCalloutTimeout = 5 * time.Second
+
+// nodeKeyPrefix is the prefix of node public keys in the form
+// Tailscale displays them, as accepted in allowlist files.
+const nodeKeyPrefix = "nodekey:"
+
+// startVerifyClients configures s to only accept clients allowed by
+// the -verify-clients-file allowlist and the -verify-clients-url
+// verifier, if either is set. If both are, clients must be allowed
+// by both.
+func startVerifyClients(s *derp.Server) error {
+	var verifiers []derp.VerifyClientFunc
+	if *verifyClientsFile != "" {
+		al, err := newAllowlist(*verifyClientsFile)
+		if err != nil {
+			return err
+		}
+		go al.watch(allowlistPollInterval)
+		verifiers = append(verifiers, al.verify)
+	}
+	if *verifyClientsURL != "" {
+		vc := &verifyCallout{
+			url:    *verifyClientsURL,
+			client: &http.Client{Timeout: verifyCalloutTimeout},
+		}
+		verifiers = append(verifiers, vc.verify)
+	}
+	if len(verifiers) == 0 {
+		return nil
+	}
+	s.SetVerifyClient(func(k key.Public, info derp.ClientInfo) error {
+		for _, v := range verifiers {
+			if err := v(k, info); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	return nil
+}
+
+// allowlist is a set of node public keys allowed to use the server,
+// loaded from a file that's reloaded when it changes.
+type allowlist struct {
+	path string
+
+	mu      sync.Mutex
+	keys    map[key.Public]bool
+	modTime time.Time
+	size    int64
+}
+
+func newAllowlist(path string) (*allowlist, error) {
+	al := &allowlist{path: path}
+	if err := al.load(); err != nil {
+		return nil, err
+	}
+	return al, nil
+}
+
+func (al *allowlist) verify(k key.Public, _ derp.ClientInfo) error {
+	al.mu.Lock()
+	defer al.mu.Unlock()
+	if !al.keys[k] {
+		return fmt.Errorf("key %x not in allowlist: %w", k[:], derp.ErrClientNotAllowed)
+	}
+	return nil
+}
+
+// load reads the allowlist file if it changed since the last load.
+// On error, the previously loaded keys remain in effect.
+func (al *allowlist) load() error {
+	fi, err := os.Stat(al.path)
+	if err != nil {
+		return err
+	}
+	al.mu.Lock()
+	unchanged := al.keys != nil && fi.ModTime().Equal(al.modTime) && fi.Size() == al.size
+	al.mu.Unlock()
+	if unchanged {
+		return nil
+	}
+
+	f, err := os.Open(al.path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	keys, err := parseAllowlist(f)
+	if err != nil {
+		return fmt.Errorf("%s: %w", al.path, err)
+	}
+
+	al.mu.Lock()
+	defer al.mu.Unlock()
+	al.keys = keys
+	al.modTime = fi.ModTime()
+	al.size = fi.Size()
+	log.Printf("derper: loaded %d allowed client keys from %s", len(keys), al.path)
+	return nil
+}
+
+// watch reloads the allowlist every interval, forever.
+func (al *allowlist) watch(interval time.Duration) {
+	for range time.Tick(interval) {
+		if err := al.load(); err != nil {
+			log.Printf("derper: reloading client allowlist: %v", err)
+		}
+	}
+}
+
+// parseAllowlist parses an allowlist file: one node public key per
+// line, in hex, optionally prefixed by "nodekey:". Blank lines and
+// lines starting with '#' are ignored.
+func parseAllowlist(r io.Reader) (map[key.Public]bool, error) {
+	keys := map[key.Public]bool{}
+	bs := bufio.NewScanner(r)
+	for lineNum := 1; bs.Scan(); lineNum++ {
+		line := strings.TrimSpace(bs.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		k, err := key.NewPublicFromHexMem(mem.S(strings.TrimPrefix(line, nodeKeyPrefix)))
+		if err != nil {
+			return nil, fmt.Errorf("line %d: invalid key %q: %v", lineNum, line, err)
+		}
+		keys[k] = true
+	}
+	if err := bs.Err(); err != nil {
+		return nil, err
+	}
+	return keys, nil
+}
+
+// verifyCallout asks an HTTP service whether clients may connect.
+//
+// Each connecting client results in a POST to url of a JSON
+// verifyRequest. The verifier answers with status 200 to accept the
+// client or 403 to reject it. Anything else rejects the client too,
+// but is counted and logged as a verifier failure.
+type verifyCallout struct {
+	url    string
+	client *http.Client
+}
+
+// verifyRequest is the JSON body sent to the -verify-clients-url verifier.
+type verifyRequest struct {
+	NodeKey    string `json:"nodeKey"` // "nodekey:" + hex
+	Version    int    `json:"version,omitempty"`
+	RemoteAddr string `json:"remoteAddr,omitempty"`
+}
+
+func (vc *verifyCallout) verify(k key.Public, info derp.ClientInfo) error {
+	body, err := json.Marshal(verifyRequest{
+		NodeKey:    fmt.Sprintf("%s%x", nodeKeyPrefix, k[:]),
+		Version:    info.Version,
+		RemoteAddr: info.RemoteAddr,
+	})
+	if err != nil {
+		return err
+	}
+	res, err := vc.client.Post(vc.url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	msg, _ := ioutil.ReadAll(io.LimitReader(res.Body, 1<<10))
+	switch res.StatusCode {
+	case http.StatusOK:
+		return nil
+	case http.StatusForbidden:
+		return fmt.Errorf("verifier: %s: %w", bytes.TrimSpace(msg), derp.ErrClientNotAllowed)
+	}
+	return errors.New("verifier: unexpected HTTP status " + res.Status)
+}
@@ -0,0 +1,97 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cli
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/peterbourgon/ff/v2/ffcli"
+)
+
+var captureCmd = &ffcli.Command{
+	Name:       "capture",
+	ShortUsage: "capture -o FILE [-filter=EXPR]",
+	ShortHelp:  "Capture the packets passing through tailscaled's TUN device",
+	LongHelp: `Writes the decrypted packets passing through tailscaled's TUN
+device to a pcapng file, until interrupted. Packets dropped by the
+packet filter are included; each packet's comment says where it
+was seen and the filter's verdict.
+
+The -filter expression is a sequence of "host IP" and "port N"
+terms, optionally joined by "and", all of which must match.
+
+Capturing must be enabled with tailscaled's --debug-capture flag,
+and requires root (or, on Windows, an elevated administrator).`,
+	Exec: runCapture,
+	FlagSet: (func() *flag.FlagSet {
+		fs := flag.NewFlagSet("capture", flag.ExitOnError)
+		fs.StringVar(&captureArgs.out, "o", "", `pcapng file to write, or "-" for stdout`)
+		fs.StringVar(&captureArgs.filter, "filter", "", `packets to capture, like "host 100.101.102.103 and port 22"`)
+		return fs
+	})(),
+}
+
+var captureArgs struct {
+	out    string
+	filter string
+}
+
+func runCapture(ctx context.Context, args []string) error {
+	if len(args) > 0 {
+		return errors.New("unexpected non-flag arguments to 'tailscale debug capture'")
+	}
+	if captureArgs.out == "" {
+		return errors.New("missing -o flag")
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go func() {
+		interrupt := make(chan os.Signal, 1)
+		signal.Notify(interrupt, syscall.SIGINT, syscall.SIGTERM)
+		<-interrupt
+		cancel()
+	}()
+
+	q := url.Values{}
+	if captureArgs.filter != "" {
+		q.Set("filter", captureArgs.filter)
+	}
+	res, err := localAPIResponse(ctx, "POST", "/localapi/v0/debug-capture?"+q.Encode(), nil)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	out := io.Writer(os.Stdout)
+	if captureArgs.out != "-" {
+		f, err := os.Create(captureArgs.out)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		out = f
+		fmt.Fprintf(os.Stderr, "Capturing to %s; press Ctrl-C to stop.\n", captureArgs.out)
+	}
+	n, err := io.Copy(out, res.Body)
+	if ctx.Err() != nil {
+		err = nil
+	}
+	if err != nil {
+		return fmt.Errorf("capture: %w", err)
+	}
+	if captureArgs.out != "-" {
+		fmt.Fprintf(os.Stderr, "Wrote %d bytes to %s.\n", n, captureArgs.out)
+	}
+	return nil
+}
@@ -32,7 +32,7 @@ func ActLikeCLI() bool {
 	}
 	switch os.Args[1] {
 	case "up", "down", "status", "netcheck", "ping", "version",
-		"debug",
+		"debug", "dns",
 		"-V", "--version", "-h", "--help":
 		return true
 	}
@@ -63,6 +63,8 @@ change in the future.
 			statusCmd,
 			pingCmd,
 			versionCmd,
+			debugCmd,
+			dnsCmd,
 		},
 		FlagSet: rootfs,
 		Exec:    func(context.Context, []string) error { return flag.ErrHelp },
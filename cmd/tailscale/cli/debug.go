@@ -0,0 +1,126 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cli
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"net/url"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/peterbourgon/ff/v2/ffcli"
+	"inet.af/netaddr"
+	"tailscale.com/wgengine/filter"
+)
+
+var debugCmd = &ffcli.Command{
+	Name:       "debug",
+	ShortUsage: "debug <subcommand> [flags]",
+	ShortHelp:  "Debugging tools",
+	LongHelp:   `"tailscale debug" contains misc debug facilities; it is not a stable interface.`,
+	Subcommands: []*ffcli.Command{
+		filterTraceCmd,
+		filterCheckCmd,
+		captureCmd,
+	},
+	Exec: func(context.Context, []string) error { return flag.ErrHelp },
+}
+
+var filterTraceCmd = &ffcli.Command{
+	Name:       "filter-trace",
+	ShortUsage: "filter-trace [-peer=IP] [-port=N] [-drops] [-follow] [-json]",
+	ShortHelp:  "Show recent packet filter decisions",
+	LongHelp: `Shows the packet filter's recent decisions: dropped packets, and
+the first packets of new inbound flows, with the index of the
+packet filter rule that allowed them.`,
+	Exec: runFilterTrace,
+	FlagSet: (func() *flag.FlagSet {
+		fs := flag.NewFlagSet("filter-trace", flag.ExitOnError)
+		fs.StringVar(&filterTraceArgs.peer, "peer", "", "only show packets to or from this IP")
+		fs.UintVar(&filterTraceArgs.port, "port", 0, "only show packets to or from this port")
+		fs.BoolVar(&filterTraceArgs.drops, "drops", false, "only show dropped packets")
+		fs.BoolVar(&filterTraceArgs.follow, "follow", false, "keep running, showing new decisions as they happen")
+		fs.BoolVar(&filterTraceArgs.json, "json", false, "output in JSON format, one event per line (WARNING: format subject to change)")
+		return fs
+	})(),
+}
+
+var filterTraceArgs struct {
+	peer   string
+	port   uint
+	drops  bool
+	follow bool
+	json   bool
+}
+
+// filterTracePollInterval is how often filter-trace -follow asks
+// tailscaled for new events.
+const filterTracePollInterval = time.Second
+
+func runFilterTrace(ctx context.Context, args []string) error {
+	if len(args) > 0 {
+		return errors.New("unexpected non-flag arguments to 'tailscale debug filter-trace'")
+	}
+	q := url.Values{}
+	if filterTraceArgs.peer != "" {
+		if _, err := netaddr.ParseIP(filterTraceArgs.peer); err != nil {
+			return fmt.Errorf("invalid -peer: %v", err)
+		}
+		q.Set("peer", filterTraceArgs.peer)
+	}
+	if filterTraceArgs.port != 0 {
+		if filterTraceArgs.port > 65535 {
+			return fmt.Errorf("invalid -port %d", filterTraceArgs.port)
+		}
+		q.Set("port", strconv.FormatUint(uint64(filterTraceArgs.port), 10))
+	}
+	if filterTraceArgs.drops {
+		q.Set("drops", "true")
+	}
+
+	enc := json.NewEncoder(os.Stdout)
+	var since uint64
+	for {
+		q.Set("since", strconv.FormatUint(since, 10))
+		var evs []filter.TraceEvent
+		if err := localAPIJSON(ctx, "GET", "/localapi/v0/filter-trace?"+q.Encode(), nil, &evs); err != nil {
+			return err
+		}
+		for _, ev := range evs {
+			if filterTraceArgs.json {
+				enc.Encode(ev)
+			} else {
+				printTraceEvent(ev)
+			}
+			since = ev.Seq
+		}
+		if !filterTraceArgs.follow {
+			return nil
+		}
+		select {
+		case <-time.After(filterTracePollInterval):
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
+
+func printTraceEvent(ev filter.TraceEvent) {
+	rule := "-"
+	if ev.Rule >= 0 {
+		rule = strconv.Itoa(ev.Rule)
+	}
+	fmt.Printf("%s %-3s %-6s %-6s %s -> %s rule=%s %s\n",
+		ev.Time.Local().Format("15:04:05.000"),
+		ev.Dir, ev.Verdict, ev.Proto,
+		netaddr.IPPort{IP: ev.Src, Port: ev.SrcPort},
+		netaddr.IPPort{IP: ev.Dst, Port: ev.DstPort},
+		rule, ev.Why)
+}
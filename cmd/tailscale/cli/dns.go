@@ -0,0 +1,393 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cli
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/peterbourgon/ff/v2/ffcli"
+	"golang.org/x/net/dns/dnsmessage"
+	"inet.af/netaddr"
+)
+
+var dnsCmd = &ffcli.Command{
+	Name:       "dns",
+	ShortUsage: "dns <subcommand> [flags]",
+	ShortHelp:  "Diagnose MagicDNS",
+	LongHelp:   `"tailscale dns" inspects the DNS resolver built into tailscaled.`,
+	Subcommands: []*ffcli.Command{
+		dnsQueryCmd,
+		dnsLogCmd,
+	},
+	Exec: func(context.Context, []string) error { return flag.ErrHelp },
+}
+
+var dnsQueryCmd = &ffcli.Command{
+	Name:       "query",
+	ShortUsage: "query <name|IP> [type]",
+	ShortHelp:  "Look up a name with tailscaled's DNS resolver",
+	LongHelp: `Sends a DNS query through tailscaled's DNS resolver, the same
+way as queries from the operating system, and prints the full
+response like dig(1) does. The type defaults to A, or to PTR
+when given an IP address.`,
+	Exec: runDNSQuery,
+}
+
+var dnsLogCmd = &ffcli.Command{
+	Name:       "log",
+	ShortUsage: "log [-size=N] [-follow] [-json]",
+	ShortHelp:  "Show queries recently answered by tailscaled's DNS resolver",
+	LongHelp: `Shows the queries tailscaled's DNS resolver answered, and how:
+locally, from its cache, or by forwarding them upstream.
+The query log is off by default; turn it on with -size.
+
+Reading or changing the query log requires root (or admin) access
+to tailscaled.`,
+	Exec: runDNSLog,
+	FlagSet: (func() *flag.FlagSet {
+		fs := flag.NewFlagSet("log", flag.ExitOnError)
+		fs.IntVar(&dnsLogArgs.size, "size", -1, "if non-negative, first set the number of queries to keep a record of (0 turns the log off)")
+		fs.BoolVar(&dnsLogArgs.follow, "follow", false, "keep running, showing new queries as they are answered")
+		fs.BoolVar(&dnsLogArgs.json, "json", false, "output in JSON format, one query per line (WARNING: format subject to change)")
+		return fs
+	})(),
+}
+
+var dnsLogArgs struct {
+	size   int
+	follow bool
+	json   bool
+}
+
+// dnsLogPollInterval is how often dns log -follow asks
+// tailscaled for new queries.
+const dnsLogPollInterval = time.Second
+
+// dnsLogEntry is the subset of tsdns.QueryLogEntry that the CLI
+// prints. It's declared here so the CLI doesn't depend on tsdns.
+type dnsLogEntry struct {
+	Seq        uint64
+	Time       time.Time
+	Source     netaddr.IPPort
+	Transport  string
+	Name       string
+	Type       string
+	Resolution string
+	Upstream   string
+	RCode      string
+	Duration   time.Duration
+	Err        string
+}
+
+func runDNSLog(ctx context.Context, args []string) error {
+	if len(args) > 0 {
+		return errors.New("unexpected non-flag arguments to 'tailscale dns log'")
+	}
+	if dnsLogArgs.size >= 0 {
+		q := url.Values{"size": {strconv.Itoa(dnsLogArgs.size)}}
+		res, err := localAPIResponse(ctx, "POST", "/localapi/v0/dns-query-log?"+q.Encode(), nil)
+		if err != nil {
+			return err
+		}
+		res.Body.Close()
+		if dnsLogArgs.size == 0 {
+			return nil
+		}
+	}
+
+	var (
+		raw   []json.RawMessage
+		since uint64
+	)
+	for {
+		q := url.Values{"since": {strconv.FormatUint(since, 10)}}
+		if err := localAPIJSON(ctx, "GET", "/localapi/v0/dns-query-log?"+q.Encode(), nil, &raw); err != nil {
+			return err
+		}
+		for _, j := range raw {
+			var ent dnsLogEntry
+			if err := json.Unmarshal(j, &ent); err != nil {
+				return err
+			}
+			if dnsLogArgs.json {
+				fmt.Printf("%s\n", j)
+			} else {
+				printDNSLogEntry(ent)
+			}
+			since = ent.Seq
+		}
+		if !dnsLogArgs.follow {
+			return nil
+		}
+		select {
+		case <-time.After(dnsLogPollInterval):
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
+
+func printDNSLogEntry(ent dnsLogEntry) {
+	how := ent.Resolution
+	if ent.Upstream != "" {
+		how += " to " + ent.Upstream
+	}
+	status := ent.RCode
+	if ent.Err != "" {
+		status = "error: " + ent.Err
+	}
+	src := "-"
+	if ent.Source != (netaddr.IPPort{}) {
+		src = ent.Source.String()
+	}
+	fmt.Printf("%s %-5s %-21s %s %s %s in %v (%s)\n",
+		ent.Time.Local().Format("15:04:05.000"),
+		ent.Transport, src, ent.Name, ent.Type, status,
+		ent.Duration.Round(time.Microsecond), how)
+}
+
+func runDNSQuery(ctx context.Context, args []string) error {
+	if len(args) < 1 || len(args) > 2 {
+		return errors.New("usage: tailscale dns query <name|IP> [type]")
+	}
+	name := args[0]
+	typ := dnsmessage.TypeA
+	if ip, err := netaddr.ParseIP(name); err == nil {
+		name = reverseDNSName(ip)
+		typ = dnsmessage.TypePTR
+	}
+	if len(args) == 2 {
+		var ok bool
+		typ, ok = parseDNSType(args[1])
+		if !ok {
+			return fmt.Errorf("unknown DNS type %q", args[1])
+		}
+	}
+	if !strings.HasSuffix(name, ".") {
+		name += "."
+	}
+	qname, err := dnsmessage.NewName(name)
+	if err != nil {
+		return fmt.Errorf("invalid name %q: %w", args[0], err)
+	}
+
+	b := dnsmessage.NewBuilder(nil, dnsmessage.Header{
+		ID:               uint16(rand.Intn(1 << 16)),
+		RecursionDesired: true,
+	})
+	b.StartQuestions()
+	b.Question(dnsmessage.Question{Name: qname, Type: typ, Class: dnsmessage.ClassINET})
+	query, err := b.Finish()
+	if err != nil {
+		return err
+	}
+
+	start := time.Now()
+	res, err := localAPIResponse(ctx, "POST", "/localapi/v0/dns-query", bytes.NewReader(query))
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	out, err := ioutil.ReadAll(io.LimitReader(res.Body, 0xffff))
+	if err != nil {
+		return err
+	}
+	elapsed := time.Since(start)
+
+	var msg dnsmessage.Message
+	if err := msg.Unpack(out); err != nil {
+		return fmt.Errorf("invalid DNS response: %w", err)
+	}
+	printDNSMessage(os.Stdout, &msg, len(out), elapsed)
+	return nil
+}
+
+// reverseDNSName returns the in-addr.arpa or ip6.arpa name
+// for ip, as looked up for PTR records.
+func reverseDNSName(ip netaddr.IP) string {
+	var sb strings.Builder
+	if ip.Is4() {
+		a := ip.As4()
+		for i := len(a) - 1; i >= 0; i-- {
+			fmt.Fprintf(&sb, "%d.", a[i])
+		}
+		sb.WriteString("in-addr.arpa.")
+		return sb.String()
+	}
+	a := ip.As16()
+	for i := len(a) - 1; i >= 0; i-- {
+		fmt.Fprintf(&sb, "%x.%x.", a[i]&0xf, a[i]>>4)
+	}
+	sb.WriteString("ip6.arpa.")
+	return sb.String()
+}
+
+var dnsTypeNames = map[dnsmessage.Type]string{
+	dnsmessage.TypeA:     "A",
+	dnsmessage.TypeNS:    "NS",
+	dnsmessage.TypeCNAME: "CNAME",
+	dnsmessage.TypeSOA:   "SOA",
+	dnsmessage.TypePTR:   "PTR",
+	dnsmessage.TypeMX:    "MX",
+	dnsmessage.TypeTXT:   "TXT",
+	dnsmessage.TypeAAAA:  "AAAA",
+	dnsmessage.TypeSRV:   "SRV",
+	dnsmessage.TypeOPT:   "OPT",
+	dnsmessage.TypeHINFO: "HINFO",
+	dnsmessage.TypeAXFR:  "AXFR",
+	dnsmessage.TypeALL:   "ANY",
+}
+
+// dnsTypeString returns the conventional name of t,
+// or TYPEn (RFC 3597) if it doesn't have one.
+func dnsTypeString(t dnsmessage.Type) string {
+	if s, ok := dnsTypeNames[t]; ok {
+		return s
+	}
+	return "TYPE" + strconv.Itoa(int(t))
+}
+
+// parseDNSType parses a DNS type as printed by dnsTypeString,
+// case-insensitively.
+func parseDNSType(s string) (dnsmessage.Type, bool) {
+	s = strings.ToUpper(s)
+	for t, name := range dnsTypeNames {
+		if s == name {
+			return t, true
+		}
+	}
+	if strings.HasPrefix(s, "TYPE") {
+		n, err := strconv.ParseUint(s[len("TYPE"):], 10, 16)
+		if err == nil {
+			return dnsmessage.Type(n), true
+		}
+	}
+	return 0, false
+}
+
+var dnsRCodeNames = map[dnsmessage.RCode]string{
+	dnsmessage.RCodeSuccess:        "NOERROR",
+	dnsmessage.RCodeFormatError:    "FORMERR",
+	dnsmessage.RCodeServerFailure:  "SERVFAIL",
+	dnsmessage.RCodeNameError:      "NXDOMAIN",
+	dnsmessage.RCodeNotImplemented: "NOTIMP",
+	dnsmessage.RCodeRefused:        "REFUSED",
+}
+
+func dnsRCodeString(rc dnsmessage.RCode) string {
+	if s, ok := dnsRCodeNames[rc]; ok {
+		return s
+	}
+	return "RCODE" + strconv.Itoa(int(rc))
+}
+
+// printDNSMessage prints msg, a response of size bytes that took
+// elapsed to arrive, in the style of dig(1).
+func printDNSMessage(w io.Writer, msg *dnsmessage.Message, size int, elapsed time.Duration) {
+	h := msg.Header
+	opcode := "QUERY"
+	if h.OpCode != 0 {
+		opcode = "OPCODE" + strconv.Itoa(int(h.OpCode))
+	}
+	fmt.Fprintf(w, ";; ->>HEADER<<- opcode: %s, status: %s, id: %d\n", opcode, dnsRCodeString(h.RCode), h.ID)
+	var flags []string
+	for _, f := range []struct {
+		set  bool
+		name string
+	}{
+		{h.Response, "qr"},
+		{h.Authoritative, "aa"},
+		{h.Truncated, "tc"},
+		{h.RecursionDesired, "rd"},
+		{h.RecursionAvailable, "ra"},
+	} {
+		if f.set {
+			flags = append(flags, f.name)
+		}
+	}
+	fmt.Fprintf(w, ";; flags: %s; QUERY: %d, ANSWER: %d, AUTHORITY: %d, ADDITIONAL: %d\n",
+		strings.Join(flags, " "), len(msg.Questions), len(msg.Answers), len(msg.Authorities), len(msg.Additionals))
+
+	if len(msg.Questions) > 0 {
+		fmt.Fprintf(w, "\n;; QUESTION SECTION:\n")
+		for _, q := range msg.Questions {
+			fmt.Fprintf(w, ";%s\t\t%s\t%s\n", q.Name, dnsClassString(q.Class), dnsTypeString(q.Type))
+		}
+	}
+	for _, sec := range []struct {
+		name string
+		rrs  []dnsmessage.Resource
+	}{
+		{"ANSWER", msg.Answers},
+		{"AUTHORITY", msg.Authorities},
+		{"ADDITIONAL", msg.Additionals},
+	} {
+		if len(sec.rrs) == 0 {
+			continue
+		}
+		fmt.Fprintf(w, "\n;; %s SECTION:\n", sec.name)
+		for _, rr := range sec.rrs {
+			fmt.Fprintf(w, "%s\t%d\t%s\t%s\t%s\n", rr.Header.Name, rr.Header.TTL,
+				dnsClassString(rr.Header.Class), dnsTypeString(rr.Header.Type), dnsResourceString(rr.Body))
+		}
+	}
+	fmt.Fprintf(w, "\n;; Query time: %d msec\n", elapsed.Milliseconds())
+	fmt.Fprintf(w, ";; SERVER: tailscaled\n")
+	fmt.Fprintf(w, ";; MSG SIZE  rcvd: %d\n", size)
+}
+
+func dnsClassString(c dnsmessage.Class) string {
+	if c == dnsmessage.ClassINET {
+		return "IN"
+	}
+	return "CLASS" + strconv.Itoa(int(c))
+}
+
+// dnsResourceString returns the presentation format (RFC 1035)
+// of a resource record's data.
+func dnsResourceString(body dnsmessage.ResourceBody) string {
+	switch b := body.(type) {
+	case *dnsmessage.AResource:
+		return netaddr.IPv4(b.A[0], b.A[1], b.A[2], b.A[3]).String()
+	case *dnsmessage.AAAAResource:
+		return netaddr.IPFrom16(b.AAAA).String()
+	case *dnsmessage.CNAMEResource:
+		return b.CNAME.String()
+	case *dnsmessage.NSResource:
+		return b.NS.String()
+	case *dnsmessage.PTRResource:
+		return b.PTR.String()
+	case *dnsmessage.MXResource:
+		return fmt.Sprintf("%d %s", b.Pref, b.MX)
+	case *dnsmessage.SRVResource:
+		return fmt.Sprintf("%d %d %d %s", b.Priority, b.Weight, b.Port, b.Target)
+	case *dnsmessage.SOAResource:
+		return fmt.Sprintf("%s %s %d %d %d %d %d", b.NS, b.MBox, b.Serial, b.Refresh, b.Retry, b.Expire, b.MinTTL)
+	case *dnsmessage.TXTResource:
+		quoted := make([]string, len(b.TXT))
+		for i, s := range b.TXT {
+			quoted[i] = strconv.Quote(s)
+		}
+		return strings.Join(quoted, " ")
+	case *dnsmessage.UnknownResource:
+		return fmt.Sprintf(`\# %d %x`, len(b.Data), b.Data)
+	case *dnsmessage.OPTResource:
+		return fmt.Sprintf("; OPT with %d options", len(b.Options))
+	}
+	return fmt.Sprintf("%v", body)
+}
@@ -0,0 +1,214 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cli
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"github.com/peterbourgon/ff/v2/ffcli"
+	"inet.af/netaddr"
+	"tailscale.com/net/packet"
+	"tailscale.com/tailcfg"
+	"tailscale.com/types/logger"
+	"tailscale.com/wgengine/filter"
+)
+
+var filterCheckCmd = &ffcli.Command{
+	Name:       "filter-check",
+	ShortUsage: "filter-check [-rules=FILE] {-src=IP -dst=IP [-proto=tcp] [-port=N] | -tests=FILE}",
+	ShortHelp:  "Evaluate a packet filter against synthetic packets",
+	LongHelp: strings.TrimSpace(`
+Evaluates a packet filter against synthetic inbound packets, without
+sending any traffic, and reports the verdict and the matching rule.
+
+The filter is read from -rules, a JSON array of tailcfg.FilterRule (as
+in a MapResponse's PacketFilter), or else is the current netmap's filter
+as fetched from tailscaled. Rule indexes are positions in that array.
+
+With -tests, the test cases are read from a JSON array of objects like
+
+  {"Src": "100.101.102.103", "Dst": "100.64.0.1", "Proto": "tcp", "Port": 22, "Want": "accept"}
+
+and the command exits non-zero if any case doesn't get the verdict it
+wants, so that ACL changes can be checked in CI.
+`),
+	Exec: runFilterCheck,
+	FlagSet: (func() *flag.FlagSet {
+		fs := flag.NewFlagSet("filter-check", flag.ExitOnError)
+		fs.StringVar(&filterCheckArgs.rules, "rules", "", "JSON file of []tailcfg.FilterRule; if empty, use the current netmap's filter")
+		fs.StringVar(&filterCheckArgs.src, "src", "", "source IP of the packet")
+		fs.StringVar(&filterCheckArgs.dst, "dst", "", "destination IP of the packet")
+		fs.StringVar(&filterCheckArgs.proto, "proto", "tcp", `IP protocol: "tcp", "udp" or "icmp"`)
+		fs.UintVar(&filterCheckArgs.port, "port", 0, "destination port of the packet")
+		fs.StringVar(&filterCheckArgs.tests, "tests", "", "JSON file of test cases to check, instead of a single packet")
+		return fs
+	})(),
+}
+
+var filterCheckArgs struct {
+	rules string
+	src   string
+	dst   string
+	proto string
+	port  uint
+	tests string
+}
+
+// filterCheckCase is a test case for filter-check -tests.
+type filterCheckCase struct {
+	Src   string
+	Dst   string
+	Proto string // "tcp" (the default), "udp" or "icmp"
+	Port  uint16
+	Want  string // "accept" or "drop"
+}
+
+func runFilterCheck(ctx context.Context, args []string) error {
+	if len(args) > 0 {
+		return errors.New("unexpected non-flag arguments to 'tailscale debug filter-check'")
+	}
+	matches, err := filterCheckMatches(ctx)
+	if err != nil {
+		return err
+	}
+	// Check the rules alone: treat every destination as local.
+	var local netaddr.IPSetBuilder
+	local.AddPrefix(netaddr.MustParseIPPrefix("0.0.0.0/0"))
+	local.AddPrefix(netaddr.MustParseIPPrefix("::/0"))
+	f := filter.New(matches, local.IPSet(), nil, logger.Discard)
+
+	if filterCheckArgs.tests != "" {
+		return runFilterCheckTests(f, matches)
+	}
+	if filterCheckArgs.src == "" || filterCheckArgs.dst == "" {
+		return errors.New("-src and -dst are required, unless -tests is given")
+	}
+	if filterCheckArgs.port > 65535 {
+		return fmt.Errorf("invalid -port %d", filterCheckArgs.port)
+	}
+	tc := filterCheckCase{
+		Src:   filterCheckArgs.src,
+		Dst:   filterCheckArgs.dst,
+		Proto: filterCheckArgs.proto,
+		Port:  uint16(filterCheckArgs.port),
+	}
+	r, why, rule, err := checkFilterCase(f, tc)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("%v (%s)\n", r, why)
+	if rule >= 0 {
+		fmt.Printf("matched rule %d: %v\n", rule, matches[rule])
+	}
+	return nil
+}
+
+// filterCheckMatches returns the packet filter to check, from
+// -rules or from tailscaled.
+func filterCheckMatches(ctx context.Context) ([]filter.Match, error) {
+	if filterCheckArgs.rules == "" {
+		var matches []filter.Match
+		if err := localAPIJSON(ctx, "GET", "/localapi/v0/packet-filter", nil, &matches); err != nil {
+			return nil, err
+		}
+		return matches, nil
+	}
+	j, err := ioutil.ReadFile(filterCheckArgs.rules)
+	if err != nil {
+		return nil, err
+	}
+	var rules []tailcfg.FilterRule
+	if err := json.Unmarshal(j, &rules); err != nil {
+		return nil, fmt.Errorf("parsing %s: %w", filterCheckArgs.rules, err)
+	}
+	matches, err := filter.MatchesFromFilterRules(rules)
+	if err != nil {
+		return nil, fmt.Errorf("parsing %s: %w", filterCheckArgs.rules, err)
+	}
+	return matches, nil
+}
+
+func runFilterCheckTests(f *filter.Filter, matches []filter.Match) error {
+	j, err := ioutil.ReadFile(filterCheckArgs.tests)
+	if err != nil {
+		return err
+	}
+	var tests []filterCheckCase
+	if err := json.Unmarshal(j, &tests); err != nil {
+		return fmt.Errorf("parsing %s: %w", filterCheckArgs.tests, err)
+	}
+	failed := 0
+	for i, tc := range tests {
+		var wantAccept bool
+		switch strings.ToLower(tc.Want) {
+		case "accept":
+			wantAccept = true
+		case "drop":
+		default:
+			return fmt.Errorf("test %d: Want must be \"accept\" or \"drop\", not %q", i, tc.Want)
+		}
+		r, why, rule, err := checkFilterCase(f, tc)
+		if err != nil {
+			return fmt.Errorf("test %d: %w", i, err)
+		}
+		status := "PASS"
+		if (r == filter.Accept) != wantAccept {
+			status = "FAIL"
+			failed++
+		}
+		fmt.Printf("%s: %s %s -> %s:%d: %v (%s)", status, protoOrDefault(tc.Proto), tc.Src, tc.Dst, tc.Port, r, why)
+		if rule >= 0 {
+			fmt.Printf(", rule %d: %v", rule, matches[rule])
+		}
+		fmt.Println()
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d filter tests failed", failed, len(tests))
+	}
+	fmt.Fprintf(os.Stderr, "all %d filter tests passed\n", len(tests))
+	return nil
+}
+
+func protoOrDefault(proto string) string {
+	if proto == "" {
+		return "tcp"
+	}
+	return strings.ToLower(proto)
+}
+
+// checkFilterCase runs tc through f.
+func checkFilterCase(f *filter.Filter, tc filterCheckCase) (r filter.Response, why string, rule int, err error) {
+	src, err := netaddr.ParseIP(tc.Src)
+	if err != nil {
+		return 0, "", 0, fmt.Errorf("invalid source IP: %w", err)
+	}
+	dst, err := netaddr.ParseIP(tc.Dst)
+	if err != nil {
+		return 0, "", 0, fmt.Errorf("invalid destination IP: %w", err)
+	}
+	var proto packet.IPProto
+	switch protoOrDefault(tc.Proto) {
+	case "tcp":
+		proto = packet.TCP
+	case "udp":
+		proto = packet.UDP
+	case "icmp":
+		proto = packet.ICMPv4
+		if dst.Is6() {
+			proto = packet.ICMPv6
+		}
+	default:
+		return 0, "", 0, fmt.Errorf("unknown protocol %q", tc.Proto)
+	}
+	r, why, rule = f.Check(proto, src, dst, tc.Port)
+	return r, why, rule, nil
+}
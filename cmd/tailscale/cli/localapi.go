@@ -0,0 +1,72 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cli
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strconv"
+
+	"tailscale.com/safesocket"
+)
+
+// localClient does HTTP requests to tailscaled's LocalAPI.
+// The hostname in the HTTP request is ignored.
+var localClient = &http.Client{
+	Transport: &http.Transport{
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			// On macOS, when dialing from non-sandboxed program to sandboxed GUI running
+			// a TCP server on a random port, find the random port. For HTTP connections,
+			// we don't send the token. It gets added in an HTTP Basic-Auth header.
+			if port, _, err := safesocket.LocalTCPPortAndToken(); err == nil {
+				var d net.Dialer
+				return d.DialContext(ctx, "tcp", "localhost:"+strconv.Itoa(port))
+			}
+			return safesocket.Connect(rootArgs.socket, 41112)
+		},
+	},
+}
+
+// localAPIResponse sends a LocalAPI request for path (which includes
+// the "/localapi/v0/" prefix) and returns the response if it was
+// successful. The caller must close the response body.
+func localAPIResponse(ctx context.Context, method, path string, body io.Reader) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, method, "http://local-tailscaled.sock"+path, body)
+	if err != nil {
+		return nil, err
+	}
+	if _, token, err := safesocket.LocalTCPPortAndToken(); err == nil {
+		req.SetBasicAuth("", token)
+	}
+	res, err := localClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to tailscaled: %w", err)
+	}
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		defer res.Body.Close()
+		slurp, _ := ioutil.ReadAll(io.LimitReader(res.Body, 1<<10))
+		return nil, fmt.Errorf("%s: HTTP %s: %s", path, res.Status, slurp)
+	}
+	return res, nil
+}
+
+// localAPIJSON sends a LocalAPI request and decodes its JSON
+// response into v.
+func localAPIJSON(ctx context.Context, method, path string, body io.Reader, v interface{}) error {
+	res, err := localAPIResponse(ctx, method, path, body)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if err := json.NewDecoder(res.Body).Decode(v); err != nil {
+		return fmt.Errorf("%s: invalid JSON response: %w", path, err)
+	}
+	return nil
+}
@@ -30,8 +30,8 @@ var netcheckCmd = &ffcli.Command{
 	Exec:       runNetcheck,
 	FlagSet: (func() *flag.FlagSet {
 		fs := flag.NewFlagSet("netcheck", flag.ExitOnError)
-		fs.StringVar(&netcheckArgs.format, "format", "", `output format; empty (for human-readable), "json" or "json-line"`)
-		fs.DurationVar(&netcheckArgs.every, "every", 0, "if non-zero, do an incremental report with the given frequency")
+		fs.StringVar(&netcheckArgs.format, "format", "", `output format; empty (for human-readable), "json" or "json-line"; JSON formats print one record per report, with the full report and the time it started`)
+		fs.DurationVar(&netcheckArgs.every, "every", 0, "if non-zero, do an incremental report with the given frequency, continuing after failed ones")
 		fs.BoolVar(&netcheckArgs.verbose, "verbose", false, "verbose logs")
 		return fs
 	})(),
@@ -44,9 +44,15 @@ var netcheckArgs struct {
 }
 
 func runNetcheck(ctx context.Context, args []string) error {
+	switch netcheckArgs.format {
+	case "", "json", "json-line":
+	default:
+		return fmt.Errorf("unknown output format %q", netcheckArgs.format)
+	}
+
 	c := &netcheck.Client{
 		UDPBindAddr: os.Getenv("TS_DEBUG_NETCHECK_UDP_BIND"),
-		PortMapper:  portmapper.NewClient(logger.WithPrefix(log.Printf, "portmap: ")),
+		PortMapper:  portmapper.NewClient(logger.WithPrefix(log.Printf, "portmap: "), nil),
 	}
 	if netcheckArgs.verbose {
 		c.Logf = logger.WithPrefix(log.Printf, "netcheck: ")
@@ -67,40 +73,56 @@ func runNetcheck(ctx context.Context, args []string) error {
 		if netcheckArgs.verbose {
 			c.Logf("GetReport took %v; err=%v", d.Round(time.Millisecond), err)
 		}
-		if err != nil {
+		if err != nil && netcheckArgs.every == 0 {
 			log.Fatalf("netcheck: %v", err)
 		}
-		if err := printReport(dm, report); err != nil {
+		if err := printReport(dm, t0, report, err); err != nil {
 			return err
 		}
 		if netcheckArgs.every == 0 {
 			return nil
 		}
-		time.Sleep(netcheckArgs.every)
+		select {
+		case <-time.After(netcheckArgs.every):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
 	}
 }
 
-func printReport(dm *tailcfg.DERPMap, report *netcheck.Report) error {
-	var j []byte
-	var err error
-	switch netcheckArgs.format {
-	case "":
-		break
-	case "json":
-		j, err = json.MarshalIndent(report, "", "\t")
-	case "json-line":
-		j, err = json.Marshal(report)
-	default:
-		return fmt.Errorf("unknown output format %q", netcheckArgs.format)
-	}
-	if err != nil {
-		return err
-	}
-	if j != nil {
+// netcheckRecord is the JSON output for one report.
+type netcheckRecord struct {
+	Time  time.Time // when the report started
+	Error string    `json:",omitempty"` // why the report failed, if it did
+	*netcheck.Report
+}
+
+// printReport prints report, started at t0, or the error repErr that
+// getting it failed with.
+func printReport(dm *tailcfg.DERPMap, t0 time.Time, report *netcheck.Report, repErr error) error {
+	if netcheckArgs.format != "" {
+		rec := netcheckRecord{Time: t0.UTC(), Report: report}
+		if repErr != nil {
+			rec.Error = repErr.Error()
+		}
+		var j []byte
+		var err error
+		if netcheckArgs.format == "json-line" {
+			j, err = json.Marshal(rec)
+		} else {
+			j, err = json.MarshalIndent(rec, "", "\t")
+		}
+		if err != nil {
+			return err
+		}
 		j = append(j, '\n')
 		os.Stdout.Write(j)
 		return nil
 	}
+	if repErr != nil {
+		log.Printf("netcheck: %v", repErr)
+		return nil
+	}
 
 	fmt.Printf("\nReport:\n")
 	fmt.Printf("\t* UDP: %v\n", report.UDP)
@@ -118,7 +140,12 @@ func printReport(dm *tailcfg.DERPMap, report *netcheck.Report) error {
 	}
 	fmt.Printf("\t* MappingVariesByDestIP: %v\n", report.MappingVariesByDestIP)
 	fmt.Printf("\t* HairPinning: %v\n", report.HairPinning)
+	fmt.Printf("\t* NAT mapping: %v\n", natBehavior(report.MappingBehavior))
+	fmt.Printf("\t* NAT filtering: %v\n", natBehavior(report.FilteringBehavior))
 	fmt.Printf("\t* PortMapping: %v\n", portMapping(report))
+	for _, m := range report.PortMappings {
+		fmt.Printf("\t\t- %v: %v\n", m.Protocol, m.External)
+	}
 
 	// When DERP latency checking failed,
 	// magicsock will try to pick the DERP server that
@@ -176,3 +203,10 @@ func portMapping(r *netcheck.Report) string {
 	}
 	return strings.Join(got, ", ")
 }
+
+func natBehavior(b netcheck.NATBehavior) string {
+	if b == "" {
+		return "unknown"
+	}
+	return string(b)
+}
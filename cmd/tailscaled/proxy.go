@@ -0,0 +1,186 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// HTTP proxy code and outbound dialing for userspace networking mode.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"strconv"
+	"strings"
+
+	dns "golang.org/x/net/dns/dnsmessage"
+	"inet.af/netaddr"
+	"tailscale.com/net/socks5"
+	"tailscale.com/net/tsaddr"
+	"tailscale.com/types/logger"
+	"tailscale.com/wgengine/netstack"
+	"tailscale.com/wgengine/tsdns"
+)
+
+// dialFunc is the signature of net.Dialer.DialContext.
+type dialFunc func(ctx context.Context, network, addr string) (net.Conn, error)
+
+// outboundDialer dials on behalf of local proxy clients.
+//
+// Destinations on the tailnet (Tailscale IPs, peers' subnet routes,
+// and MagicDNS names) are dialed through ns, if non-nil. Everything
+// else is dialed directly from the host. TCP connections to the
+// MagicDNS server, 100.100.100.100:53, are served by resolver.
+type outboundDialer struct {
+	logf     logger.Logf
+	ns       *netstack.Impl  // or nil if using a kernel TUN
+	resolver *tsdns.Resolver // or nil
+}
+
+func (d *outboundDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	var stdDialer net.Dialer
+	if !strings.HasPrefix(network, "tcp") {
+		return stdDialer.DialContext(ctx, network, addr)
+	}
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("invalid port in %q", addr)
+	}
+	ip, err := netaddr.ParseIP(host)
+	if err == nil && ip == tsaddr.TailscaleServiceIP() && port == 53 && d.resolver != nil {
+		c, s := net.Pipe()
+		go d.resolver.HandleTCPConn(s)
+		return c, nil
+	}
+	if d.ns == nil {
+		return stdDialer.DialContext(ctx, network, addr)
+	}
+	if err != nil {
+		var ok bool
+		ip, ok = d.resolveMagicDNS(host)
+		if !ok {
+			// Not a tailnet name; let the host resolve and dial it.
+			return stdDialer.DialContext(ctx, network, addr)
+		}
+	}
+	if !d.ns.ReachableViaTailnet(ip) {
+		return stdDialer.DialContext(ctx, network, addr)
+	}
+	c, err := d.ns.DialContextTCP(ctx, netaddr.IPPort{IP: ip, Port: uint16(port)})
+	if err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// resolveMagicDNS resolves host using the MagicDNS map, preferring
+// IPv4 addresses. It reports whether host is a MagicDNS name with
+// an address.
+func (d *outboundDialer) resolveMagicDNS(host string) (ip netaddr.IP, ok bool) {
+	if d.resolver == nil {
+		return netaddr.IP{}, false
+	}
+	if !strings.HasSuffix(host, ".") {
+		host += "."
+	}
+	// Resolve returns IPv4 addresses first.
+	ips, rcode, err := d.resolver.Resolve(host, dns.TypeALL)
+	if err != nil || rcode != dns.RCodeSuccess || len(ips) == 0 {
+		return netaddr.IP{}, false
+	}
+	return ips[0], true
+}
+
+// runSOCKS5Server serves a SOCKS5 proxy on addr, dialing via dial.
+func runSOCKS5Server(logf logger.Logf, addr string, dial dialFunc) {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		log.Fatalf("SOCKS5 listener: %v", err)
+	}
+	logf("SOCKS5 server listening on %v", ln.Addr())
+	srv := &socks5.Server{
+		Logf:   logger.WithPrefix(logf, "socks5: "),
+		Dialer: dial,
+	}
+	if err := srv.Serve(ln); err != nil {
+		logf("SOCKS5 server: %v", err)
+	}
+}
+
+// runHTTPProxyServer serves an HTTP proxy on addr, dialing via dial.
+func runHTTPProxyServer(logf logger.Logf, addr string, dial dialFunc) {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		log.Fatalf("HTTP proxy listener: %v", err)
+	}
+	logf("HTTP proxy listening on %v", ln.Addr())
+	srv := &http.Server{
+		Handler: httpProxyHandler(dial),
+	}
+	if err := srv.Serve(ln); err != nil {
+		logf("HTTP proxy server: %v", err)
+	}
+}
+
+// httpProxyHandler returns an HTTP proxy http.Handler using the
+// provided backend dialer.
+//
+// CONNECT requests are tunneled; other requests with absolute URLs
+// are forwarded with a reverse proxy.
+func httpProxyHandler(dialer dialFunc) http.Handler {
+	rp := &httputil.ReverseProxy{
+		Director: func(r *http.Request) {}, // no change
+		Transport: &http.Transport{
+			DialContext: dialer,
+		},
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "CONNECT" {
+			if r.URL.Host == "" {
+				http.Error(w, "bogus proxy request", http.StatusBadRequest)
+				return
+			}
+			rp.ServeHTTP(w, r)
+			return
+		}
+
+		// CONNECT support:
+
+		dst := r.RequestURI
+		c, err := dialer(r.Context(), "tcp", dst)
+		if err != nil {
+			w.Header().Set("Tailscale-Connect-Error", err.Error())
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+		defer c.Close()
+
+		cc, ccbuf, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		defer cc.Close()
+
+		io.WriteString(cc, "HTTP/1.1 200 OK\r\n\r\n")
+
+		errc := make(chan error, 1)
+		go func() {
+			_, err := io.Copy(cc, c)
+			errc <- err
+		}()
+		go func() {
+			_, err := io.Copy(c, ccbuf)
+			errc <- err
+		}()
+		<-errc
+	})
+}
@@ -27,13 +27,16 @@ import (
 	"tailscale.com/ipn/ipnserver"
 	"tailscale.com/logpolicy"
 	"tailscale.com/paths"
+	"tailscale.com/tsweb"
 	"tailscale.com/types/flagtype"
 	"tailscale.com/types/logger"
 	"tailscale.com/version"
 	"tailscale.com/wgengine"
+	"tailscale.com/wgengine/filter"
 	"tailscale.com/wgengine/magicsock"
 	"tailscale.com/wgengine/netstack"
 	"tailscale.com/wgengine/router"
+	"tailscale.com/wgengine/tstun"
 )
 
 // globalStateKey is the ipn.StateKey that tailscaled loads on
@@ -69,6 +72,11 @@ var args struct {
 	statepath  string
 	socketpath string
 	verbose    int
+	socksAddr  string // listen address for SOCKS5 server
+	httpProxy  string // listen address for HTTP proxy server
+	conntrack  filter.ConntrackConfig
+	dnsOverTCP bool // answer DNS over TCP with netstack, with a kernel TUN
+	capture    bool // let root capture packets with the LocalAPI
 }
 
 var (
@@ -96,11 +104,19 @@ func main() {
 	flag.BoolVar(&args.cleanup, "cleanup", false, "clean up system state and exit")
 	flag.BoolVar(&args.fake, "fake", false, "use userspace fake tunnel+routing instead of kernel TUN interface")
 	flag.StringVar(&args.debug, "debug", "", "listen address ([ip]:port) of optional debug server")
-	flag.StringVar(&args.tunname, "tun", defaultTunName(), "tunnel interface name")
+	flag.StringVar(&args.tunname, "tun", defaultTunName(), `tunnel interface name; use "userspace-networking" (beta) to not use TUN and instead proxy tailnet traffic to local sockets and advertised subnets in userspace`)
 	flag.Var(flagtype.PortValue(&args.port, magicsock.DefaultPort), "port", "UDP port to listen on for WireGuard and peer-to-peer traffic; 0 means automatically select")
 	flag.StringVar(&args.statepath, "state", paths.DefaultTailscaledStateFile(), "path of state file")
 	flag.StringVar(&args.socketpath, "socket", paths.DefaultTailscaledSocket(), "path of the service unix socket")
 	flag.BoolVar(&printVersion, "version", false, "print version information and exit")
+	flag.StringVar(&args.socksAddr, "socks5-server", "", `optional [ip]:port to run a SOCKS5 server (e.g. "localhost:1080")`)
+	flag.StringVar(&args.httpProxy, "outbound-http-proxy-listen", "", `optional [ip]:port to run an outbound HTTP proxy (e.g. "localhost:8080")`)
+	flag.BoolVar(&args.dnsOverTCP, "dns-over-tcp", false, "answer DNS queries over TCP to 100.100.100.100 using netstack, when using a kernel TUN interface")
+	flag.BoolVar(&args.capture, "debug-capture", false, "let root capture the decrypted packets passing through the TUN device, with 'tailscale debug capture'")
+	flag.DurationVar(&args.conntrack.UDPTimeout, "filter-udp-timeout", 0, "how long the packet filter remembers an idle outbound UDP flow; 0 means the default")
+	flag.DurationVar(&args.conntrack.ICMPTimeout, "filter-icmp-timeout", 0, "how long the packet filter remembers an outbound ICMP echo request; 0 means the default")
+	flag.IntVar(&args.conntrack.MaxUDPFlows, "filter-max-udp-flows", 0, "maximum number of UDP flows the packet filter remembers; 0 means the default")
+	flag.IntVar(&args.conntrack.MaxICMPFlows, "filter-max-icmp-flows", 0, "maximum number of ICMP echo requests the packet filter remembers; 0 means the default")
 
 	if len(os.Args) > 1 {
 		sub := os.Args[1]
@@ -191,14 +207,25 @@ func run() error {
 	}
 
 	var e wgengine.Engine
-	if args.fake {
+	var ns *netstack.Impl
+	if useNetstack := args.tunname == "userspace-networking"; args.fake || useNetstack {
 		var impl wgengine.FakeImplFunc
-		if args.tunname == "userspace-networking" {
-			impl = netstack.Impl
+		if useNetstack {
+			impl = func(logf logger.Logf, tundev *tstun.TUN, e wgengine.Engine, mc *magicsock.Conn) error {
+				var err error
+				ns, err = netstack.Create(logf, tundev, e, mc)
+				if err != nil {
+					return fmt.Errorf("netstack.Create: %w", err)
+				}
+				return ns.Start()
+			}
 		}
 		e, err = wgengine.NewFakeUserspaceEngine(logf, 0, impl)
 	} else {
 		e, err = wgengine.NewUserspaceEngine(logf, args.tunname, args.port)
+		if err == nil && args.dnsOverTCP {
+			startNetstackDNS(logf, e)
+		}
 	}
 	if err != nil {
 		logf("wgengine.New: %v", err)
@@ -206,6 +233,22 @@ func run() error {
 	}
 	e = wgengine.NewWatchdog(e)
 
+	if args.socksAddr != "" || args.httpProxy != "" {
+		if args.fake && ns == nil {
+			log.Fatalf("--socks5-server and --outbound-http-proxy-listen require --tun=userspace-networking when used with --fake")
+		}
+		d := &outboundDialer{logf: logf, ns: ns}
+		if re, ok := e.(wgengine.ResolvingEngine); ok {
+			d.resolver, _ = re.GetResolver()
+		}
+		if args.socksAddr != "" {
+			go runSOCKS5Server(logf, args.socksAddr, d.DialContext)
+		}
+		if args.httpProxy != "" {
+			go runHTTPProxyServer(logf, args.httpProxy, d.DialContext)
+		}
+	}
+
 	ctx, cancel := context.WithCancel(context.Background())
 	// Exit gracefully by cancelling the ipnserver context in most common cases:
 	// interrupted from the TTY or killed by a service manager.
@@ -233,6 +276,8 @@ func run() error {
 		LegacyConfigPath:   paths.LegacyConfigPath(),
 		SurviveDisconnects: true,
 		DebugMux:           debugMux,
+		Conntrack:          args.conntrack,
+		AllowCapture:       args.capture,
 	}
 	err = ipnserver.Run(ctx, logf, pol.PublicID.String(), ipnserver.FixedEngine(e), opts)
 	// Cancelation is not an error: it is the only way to stop ipnserver.
@@ -244,6 +289,25 @@ func run() error {
 	return nil
 }
 
+// startNetstackDNS makes a netstack answer DNS queries over TCP to
+// 100.100.100.100 for e, an engine with a kernel TUN device, as
+// requested by --dns-over-tcp. Failure is logged but not fatal, as
+// DNS over UDP keeps working.
+func startNetstackDNS(logf logger.Logf, e wgengine.Engine) {
+	ig, ok := e.(wgengine.InternalsGetter)
+	if !ok {
+		return
+	}
+	tundev, mc := ig.GetInternals()
+	ns, err := netstack.Create(logf, tundev, e, mc)
+	if err == nil {
+		err = ns.StartDNS()
+	}
+	if err != nil {
+		logf("netstack: DNS over TCP unavailable: %v", err)
+	}
+}
+
 func newDebugMux() *http.ServeMux {
 	mux := http.NewServeMux()
 	mux.HandleFunc("/debug/pprof/", pprof.Index)
@@ -251,6 +315,8 @@ func newDebugMux() *http.ServeMux {
 	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
 	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
 	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	mux.HandleFunc("/debug/varz", tsweb.VarzHandler)
+	mux.HandleFunc("/metrics", tsweb.MetricsHandler)
 	return mux
 }
 
@@ -22,6 +22,7 @@ import (
 	"fmt"
 	"log"
 	"os"
+	"strconv"
 	"time"
 
 	"golang.org/x/sys/windows"
@@ -118,6 +119,11 @@ func startIPNServer(ctx context.Context, logid string) error {
 		if err != nil {
 			return nil, err
 		}
+		// The service takes no flags, so --dns-over-tcp is
+		// TS_DNS_OVER_TCP here.
+		if dnsOverTCP, _ := strconv.ParseBool(os.Getenv("TS_DNS_OVER_TCP")); dnsOverTCP {
+			startNetstackDNS(logf, eng)
+		}
 		return wgengine.NewWatchdog(eng), nil
 	}
 
@@ -158,6 +164,8 @@ func startIPNServer(ctx context.Context, logid string) error {
 		SurviveDisconnects: false,
 		StatePath:          args.statepath,
 	}
+	// Like --debug-capture elsewhere.
+	opts.AllowCapture, _ = strconv.ParseBool(os.Getenv("TS_DEBUG_CAPTURE"))
 	if err != nil {
 		// Return nicer errors to users, annotated with logids, which helps
 		// when they file bugs.
@@ -42,7 +42,12 @@ const (
 // ProtocolVersion is bumped whenever there's a wire-incompatible change.
 //   * version 1 (zero on wire): consistent box headers, in use by employee dev nodes a bit
 //   * version 2: received packets have src addrs in frameRecvPacket at beginning
-const ProtocolVersion = 2
+//   * version 3: server replies to framePing with framePong
+const ProtocolVersion = 3
+
+// pingProtocolVersion is the first ProtocolVersion in which
+// servers reply to framePing.
+const pingProtocolVersion = 3
 
 // frameType is the one byte frame type at the beginning of the frame
 // header.  The second field is a big-endian uint32 describing the
@@ -62,6 +67,8 @@ Steady state:
 * server occasionally sends frameKeepAlive
 * client sends frameSendPacket
 * server then sends frameRecvPacket to recipient
+* client occasionally sends framePing (if the server's version is 3+)
+* server then replies with framePong
 */
 const (
 	frameServerKey     = frameType(0x01) // 8B magic + 32B public key + (0+ bytes future use)
@@ -70,7 +77,7 @@ const (
 	frameSendPacket    = frameType(0x04) // 32B dest pub key + packet bytes
 	frameForwardPacket = frameType(0x0a) // 32B src pub key + 32B dst pub key + packet bytes
 	frameRecvPacket    = frameType(0x05) // v0/1: packet bytes, v2: 32B src pub key + packet bytes
-	frameKeepAlive     = frameType(0x06) // no payload, no-op (to be replaced with ping/pong)
+	frameKeepAlive     = frameType(0x06) // no payload, no-op (superseded by framePing for clients that measure RTT)
 	frameNotePreferred = frameType(0x07) // 1 byte payload: 0x01 or 0x00 for whether this is client's home node
 
 	// framePeerGone is sent from server to client to signal that
@@ -97,8 +104,18 @@ const (
 	// connection. (To be used for cluster load balancing
 	// purposes, when clients end up on a non-ideal node)
 	frameClosePeer = frameType(0x11) // 32B pub key of peer to close.
+
+	// framePing is sent by clients to measure the round trip time
+	// to the server and to check that the connection is still
+	// alive. The server replies with framePong, echoing the
+	// payload. Only servers of pingProtocolVersion or later do.
+	framePing = frameType(0x12) // 8 byte payload, opaque
+	framePong = frameType(0x13) // 8 byte payload of the framePing being replied to
 )
 
+// pingLen is the length of framePing and framePong payloads.
+const pingLen = 8
+
 var bin = binary.BigEndian
 
 func writeUint32(bw *bufio.Writer, v uint32) error {
@@ -12,6 +12,7 @@ import (
 	"fmt"
 	"io"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"golang.org/x/crypto/nacl/box"
@@ -32,6 +33,8 @@ type Client struct {
 	wmu sync.Mutex // hold while writing to bw
 	bw  *bufio.Writer
 
+	serverVersion int32 // atomic; server's ProtocolVersion, or 0 until known
+
 	// Owned by Recv:
 	peeked  int   // bytes to discard on next Recv
 	readErr error // sticky read error
@@ -283,6 +286,30 @@ func (c *Client) ClosePeer(target key.Public) error {
 	return writeFrame(c.bw, frameClosePeer, target[:])
 }
 
+// ErrPingUnsupported is returned by SendPing when the server doesn't
+// reply to pings, or its protocol version isn't known yet.
+var ErrPingUnsupported = errors.New("derp server does not support ping")
+
+// SendPing sends a ping with the given payload to the server, which
+// replies with a PongMessage of the same payload, returned by Recv.
+//
+// The server's version is learned from the ServerInfoMessage, so
+// SendPing returns ErrPingUnsupported until Recv has returned that.
+func (c *Client) SendPing(data [8]byte) error {
+	if c.ServerProtocolVersion() < pingProtocolVersion {
+		return ErrPingUnsupported
+	}
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	return writeFrame(c.bw, framePing, data[:])
+}
+
+// ServerProtocolVersion returns the server's ProtocolVersion,
+// or 0 if it isn't known yet.
+func (c *Client) ServerProtocolVersion() int {
+	return int(atomic.LoadInt32(&c.serverVersion))
+}
+
 // ReceivedMessage represents a type returned by Client.Recv. Unless
 // otherwise documented, the returned message aliases the byte slice
 // provided to Recv and thus the message is only as good as that
@@ -319,6 +346,12 @@ type ServerInfoMessage struct{}
 
 func (ServerInfoMessage) msg() {}
 
+// PongMessage is a ReceivedMessage that's the server's reply to a
+// ping sent with Client.SendPing, carrying the ping's payload.
+type PongMessage [8]byte
+
+func (PongMessage) msg() {}
+
 // Recv reads a message from the DERP server.
 //
 // The returned message may alias memory owned by the Client; it
@@ -390,16 +423,26 @@ func (c *Client) recvTimeout(timeout time.Duration) (m ReceivedMessage, err erro
 			// needing to wait an RTT to discover the version at startup.
 			// We'd prefer to give the connection to the client (magicsock)
 			// to start writing as soon as possible.
-			_, err := c.parseServerInfo(b)
+			si, err := c.parseServerInfo(b)
 			if err != nil {
 				return nil, fmt.Errorf("invalid server info frame: %v", err)
 			}
+			atomic.StoreInt32(&c.serverVersion, int32(si.Version))
 			// TODO: add the results of parseServerInfo to ServerInfoMessage if we ever need it.
 			return ServerInfoMessage{}, nil
 		case frameKeepAlive:
 			// TODO: eventually we'll have server->client pings that
 			// require ack pongs.
 			continue
+		case framePong:
+			if n < pingLen {
+				c.logf("[unexpected] dropping short pong frame from DERP server")
+				continue
+			}
+			var pm PongMessage
+			copy(pm[:], b[:pingLen])
+			return pm, nil
+
 		case framePeerGone:
 			if n < keyLen {
 				c.logf("[unexpected] dropping short peerGone frame from DERP server")
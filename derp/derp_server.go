@@ -32,6 +32,7 @@ import (
 	"go4.org/mem"
 	"golang.org/x/crypto/nacl/box"
 	"golang.org/x/sync/errgroup"
+	"golang.org/x/time/rate"
 	"tailscale.com/disco"
 	"tailscale.com/metrics"
 	"tailscale.com/types/key"
@@ -87,6 +88,9 @@ type Server struct {
 	logf        logger.Logf
 	memSys0     uint64 // runtime.MemStats.Sys at start (or early-ish)
 	meshKey     string
+	verify      VerifyClientFunc // or nil to accept all clients
+	limitWG     RateLimit        // for each client's WireGuard packets
+	limitDisco  RateLimit        // for each client's disco packets
 	limitedLogf logger.Logf
 	metaCert    []byte // the encoded x509 cert to send after LetsEncrypt cert+intermediate
 
@@ -104,8 +108,10 @@ type Server struct {
 	packetsDroppedFwdUnknown *expvar.Int // unknown dst pubkey on forward
 	packetsDroppedGone       *expvar.Int // dst conn shutting down
 	packetsDroppedQueueHead  *expvar.Int // queue full, drop head packet
-	packetsDroppedQueueTail  *expvar.Int // queue full, drop tail packet
+	packetsDroppedQueueTail  *expvar.Int // queue full, drop tail packet; no longer used, kept for dashboards
 	packetsDroppedWrite      *expvar.Int // error writing to dst conn
+	packetsDroppedLimitWG    *expvar.Int // src over its WireGuard rate limit
+	packetsDroppedLimitDisco *expvar.Int // src over its disco rate limit
 	_                        [pad32bit]byte
 	packetsForwardedOut      expvar.Int
 	packetsForwardedIn       expvar.Int
@@ -120,6 +126,9 @@ type Server struct {
 	multiForwarderCreated    expvar.Int
 	multiForwarderDeleted    expvar.Int
 	removePktForwardOther    expvar.Int
+	clientsRejected          metrics.LabelMap
+	clientsRejectedDenied    *expvar.Int // verifier said no
+	clientsRejectedError     *expvar.Int // verifier failed to decide
 
 	mu          sync.Mutex
 	closed      bool
@@ -175,6 +184,7 @@ func NewServer(privateKey key.Private, logf logger.Logf) *Server {
 		limitedLogf:          logger.RateLimitedFn(logf, 30*time.Second, 5, 100),
 		packetsRecvByKind:    metrics.LabelMap{Label: "kind"},
 		packetsDroppedReason: metrics.LabelMap{Label: "reason"},
+		clientsRejected:      metrics.LabelMap{Label: "reason"},
 		clients:              map[key.Public]*sclient{},
 		clientsEver:          map[key.Public]bool{},
 		clientsMesh:          map[key.Public]PacketForwarder{},
@@ -192,6 +202,10 @@ func NewServer(privateKey key.Private, logf logger.Logf) *Server {
 	s.packetsDroppedQueueHead = s.packetsDroppedReason.Get("queue_head")
 	s.packetsDroppedQueueTail = s.packetsDroppedReason.Get("queue_tail")
 	s.packetsDroppedWrite = s.packetsDroppedReason.Get("write_error")
+	s.packetsDroppedLimitWG = s.packetsDroppedReason.Get("throttled_wireguard")
+	s.packetsDroppedLimitDisco = s.packetsDroppedReason.Get("throttled_disco")
+	s.clientsRejectedDenied = s.clientsRejected.Get("not_allowed")
+	s.clientsRejectedError = s.clientsRejected.Get("verify_error")
 	return s
 }
 
@@ -203,6 +217,68 @@ func (s *Server) SetMeshKey(v string) {
 	s.meshKey = v
 }
 
+// ErrClientNotAllowed is the error a VerifyClientFunc returns,
+// possibly wrapped, when it rejects a client by policy, as opposed to
+// failing to decide.
+var ErrClientNotAllowed = errors.New("client not allowed")
+
+// ClientInfo describes a client connecting to a Server,
+// for a VerifyClientFunc.
+type ClientInfo struct {
+	// Version is the DERP protocol version the client speaks,
+	// or 0 if it didn't say.
+	Version int `json:"version,omitempty"`
+
+	// RemoteAddr is the address the client connected from,
+	// usually ip:port.
+	RemoteAddr string `json:"remoteAddr,omitempty"`
+}
+
+// VerifyClientFunc decides whether the client with the given public
+// key may use a Server. It returns nil to accept the client, or an
+// error to close its connection: one wrapping ErrClientNotAllowed if
+// the client isn't permitted, or any other error if the decision
+// couldn't be made. Clients are rejected in either case.
+//
+// It's called concurrently, once per connection, before the client
+// is registered with the Server. Mesh peers presenting the server's
+// mesh key are always accepted without it being called.
+type VerifyClientFunc func(clientKey key.Public, info ClientInfo) error
+
+// SetVerifyClient sets the func that decides which clients may
+// connect to the server. By default, any client may.
+//
+// It must be called before serving begins.
+func (s *Server) SetVerifyClient(f VerifyClientFunc) {
+	s.verify = f
+}
+
+// RateLimit is a token bucket limit on the packets each client may
+// send through a Server. The zero value means no limit.
+type RateLimit struct {
+	// BytesPerSecond is the sustained rate of packet bytes a client
+	// may send, or zero for no limit. Bursts of a second's worth are
+	// allowed, and always of at least MaxPacketSize.
+	BytesPerSecond int
+
+	// PacketsPerSecond is the sustained rate of packets a client may
+	// send, or zero for no limit. Bursts of a second's worth are
+	// allowed.
+	PacketsPerSecond int
+}
+
+// SetRateLimits sets the limits on the rate at which each client may
+// send packets to other clients: wireguard for WireGuard packets and
+// disco for disco (NAT traversal) packets, each with its own token
+// buckets. Packets beyond the limits are dropped. Mesh peers are not
+// limited. By default, there are no limits.
+//
+// It must be called before serving begins.
+func (s *Server) SetRateLimits(wireguard, disco RateLimit) {
+	s.limitWG = wireguard
+	s.limitDisco = disco
+}
+
 // HasMeshKey reports whether the server is configured with a mesh key.
 func (s *Server) HasMeshKey() bool { return s.meshKey != "" }
 
@@ -436,7 +512,7 @@ func (s *Server) accept(nc Conn, brw *bufio.ReadWriter, remoteAddr string, connN
 	if err != nil {
 		return fmt.Errorf("receive client key: %v", err)
 	}
-	if err := s.verifyClient(clientKey, clientInfo); err != nil {
+	if err := s.verifyClient(clientKey, clientInfo, remoteAddr); err != nil {
 		return fmt.Errorf("client %x rejected: %v", clientKey, err)
 	}
 
@@ -457,12 +533,16 @@ func (s *Server) accept(nc Conn, brw *bufio.ReadWriter, remoteAddr string, connN
 		done:        ctx.Done(),
 		remoteAddr:  remoteAddr,
 		connectedAt: time.Now(),
-		sendQueue:   make(chan pkt, perClientSendQueueDepth),
+		sendQueue:   newFairQueue(),
 		peerGone:    make(chan key.Public),
+		sendPong:    make(chan [8]byte, 1),
 		canMesh:     clientInfo.MeshKey != "" && clientInfo.MeshKey == s.meshKey,
 	}
 	if c.canMesh {
 		c.meshUpdate = make(chan struct{})
+	} else {
+		c.limitWG = newClientLimiter(s.limitWG)
+		c.limitDisco = newClientLimiter(s.limitDisco)
 	}
 	if clientInfo != nil {
 		c.info = *clientInfo
@@ -517,6 +597,8 @@ func (c *sclient) run(ctx context.Context) error {
 			err = c.handleFrameWatchConns(ft, fl)
 		case frameClosePeer:
 			err = c.handleFrameClosePeer(ft, fl)
+		case framePing:
+			err = c.handleFramePing(ft, fl)
 		default:
 			err = c.handleUnknownFrame(ft, fl)
 		}
@@ -580,6 +662,30 @@ func (c *sclient) handleFrameClosePeer(ft frameType, fl uint32) error {
 	return nil
 }
 
+// handleFramePing reads a ping frame from the client and queues the
+// pong reply.
+func (c *sclient) handleFramePing(ft frameType, fl uint32) error {
+	if fl < pingLen || fl > 1<<10 {
+		return fmt.Errorf("ping frame of unexpected length %d", fl)
+	}
+	var data [8]byte
+	if _, err := io.ReadFull(c.br, data[:]); err != nil {
+		return err
+	}
+	if extra := int64(fl) - pingLen; extra > 0 {
+		if _, err := io.CopyN(ioutil.Discard, c.br, extra); err != nil {
+			return err
+		}
+	}
+	select {
+	case c.sendPong <- data:
+	default:
+		// A pong is already queued; the client is pinging
+		// faster than we can answer. Drop this one.
+	}
+	return nil
+}
+
 // handleFrameForwardPacket reads a "forward packet" frame from the client
 // (which must be a trusted client, a peer in our mesh).
 func (c *sclient) handleFrameForwardPacket(ft frameType, fl uint32) error {
@@ -636,6 +742,9 @@ func (c *sclient) handleFrameSendPacket(ft frameType, fl uint32) error {
 	if err != nil {
 		return fmt.Errorf("client %x: recvPacket: %v", c.key, err)
 	}
+	if !c.allowSend(contents) {
+		return nil
+	}
 
 	var fwd PacketForwarder
 	s.mu.Lock()
@@ -675,60 +784,110 @@ func (c *sclient) sendPkt(dst *sclient, p pkt) error {
 	s := c.s
 	dstKey := dst.key
 
-	// Attempt to queue for sending up to 3 times. On each attempt, if
-	// the queue is full, try to drop from queue head to prioritize
-	// fresher packets.
-	for attempt := 0; attempt < 3; attempt++ {
-		select {
-		case <-dst.done:
-			s.packetsDropped.Add(1)
-			s.packetsDroppedGone.Add(1)
-			if debug {
-				c.logf("dropping packet for shutdown client %x", dstKey)
-			}
-			return nil
-		default:
-		}
-		select {
-		case dst.sendQueue <- p:
-			return nil
-		default:
+	select {
+	case <-dst.done:
+		s.packetsDropped.Add(1)
+		s.packetsDroppedGone.Add(1)
+		if debug {
+			c.logf("dropping packet for shutdown client %x", dstKey)
 		}
+		return nil
+	default:
+	}
 
-		select {
-		case <-dst.sendQueue:
-			s.packetsDropped.Add(1)
-			s.packetsDroppedQueueHead.Add(1)
-			if verboseDropKeys[dstKey] {
-				// Generate a full string including src and dst, so
-				// the limiter kicks in once per src.
-				msg := fmt.Sprintf("tail drop %s -> %s", p.src.ShortString(), dstKey.ShortString())
-				c.s.limitedLogf(msg)
-			}
-			if debug {
-				c.logf("dropping packet from client %x queue head", dstKey)
-			}
-		default:
-		}
+	// If the queue is full, the fair queue drops the oldest packet
+	// of whichever sender has the most queued, to prioritize fresher
+	// packets and to keep one sender from crowding out the others.
+	dropped, didDrop := dst.sendQueue.push(p)
+	if !didDrop {
+		return nil
 	}
-	// Failed to make room for packet. This can happen in a heavily
-	// contended queue with racing writers. Give up and tail-drop in
-	// this case to keep reader unblocked.
 	s.packetsDropped.Add(1)
-	s.packetsDroppedQueueTail.Add(1)
+	s.packetsDroppedQueueHead.Add(1)
 	if verboseDropKeys[dstKey] {
 		// Generate a full string including src and dst, so
 		// the limiter kicks in once per src.
-		msg := fmt.Sprintf("head drop %s -> %s", p.src.ShortString(), dstKey.ShortString())
+		msg := fmt.Sprintf("head drop %s -> %s", dropped.src.ShortString(), dstKey.ShortString())
 		c.s.limitedLogf(msg)
 	}
 	if debug {
-		c.logf("dropping packet from client %x queue tail", dstKey)
+		c.logf("dropping packet from client %x queue head", dstKey)
 	}
-
 	return nil
 }
 
+// allowSend reports whether c is within its rate limits to send
+// contents, counting the packet as dropped if not.
+func (c *sclient) allowSend(contents []byte) bool {
+	lim, throttled := c.limitWG, c.s.packetsDroppedLimitWG
+	if disco.LooksLikeDiscoWrapper(contents) {
+		lim, throttled = c.limitDisco, c.s.packetsDroppedLimitDisco
+	}
+	if lim.allow(time.Now(), len(contents)) {
+		return true
+	}
+	c.s.packetsDropped.Add(1)
+	throttled.Add(1)
+	if debug {
+		c.logf("dropping packet from client %x over its rate limit", c.key)
+	}
+	return false
+}
+
+// clientLimiter enforces a RateLimit for one client.
+// A nil clientLimiter allows everything.
+type clientLimiter struct {
+	bytes   *rate.Limiter // or nil if unlimited
+	packets *rate.Limiter // or nil if unlimited
+}
+
+// newClientLimiter returns a clientLimiter enforcing l,
+// or nil if l has no limits.
+func newClientLimiter(l RateLimit) *clientLimiter {
+	if l == (RateLimit{}) {
+		return nil
+	}
+	cl := new(clientLimiter)
+	if l.BytesPerSecond > 0 {
+		burst := l.BytesPerSecond
+		if burst < MaxPacketSize {
+			burst = MaxPacketSize
+		}
+		cl.bytes = rate.NewLimiter(rate.Limit(l.BytesPerSecond), burst)
+	}
+	if l.PacketsPerSecond > 0 {
+		cl.packets = rate.NewLimiter(rate.Limit(l.PacketsPerSecond), l.PacketsPerSecond)
+	}
+	return cl
+}
+
+// allow reports whether a packet of n bytes may be sent at now,
+// taking the tokens for it if so.
+func (cl *clientLimiter) allow(now time.Time, n int) bool {
+	if cl == nil {
+		return true
+	}
+	var packets *rate.Reservation
+	if cl.packets != nil {
+		packets = cl.packets.ReserveN(now, 1)
+		if !packets.OK() || packets.DelayFrom(now) > 0 {
+			packets.CancelAt(now)
+			return false
+		}
+	}
+	if cl.bytes != nil {
+		bytes := cl.bytes.ReserveN(now, n)
+		if !bytes.OK() || bytes.DelayFrom(now) > 0 {
+			bytes.CancelAt(now)
+			if packets != nil {
+				packets.CancelAt(now)
+			}
+			return false
+		}
+	}
+	return true
+}
+
 // requestPeerGoneWrite sends a request to write a "peer gone" frame
 // that the provided peer has disconnected. It blocks until either the
 // write request is scheduled, or the client has closed.
@@ -749,10 +908,27 @@ func (c *sclient) requestMeshUpdate() {
 	}
 }
 
-func (s *Server) verifyClient(clientKey key.Public, info *clientInfo) error {
-	// TODO(crawshaw): implement policy constraints on who can use the DERP server
-	// TODO(bradfitz): ... and at what rate.
-	return nil
+func (s *Server) verifyClient(clientKey key.Public, info *clientInfo, remoteAddr string) error {
+	// TODO(bradfitz): limit the rate at which clients can connect.
+	if s.verify == nil {
+		return nil
+	}
+	if info.MeshKey != "" && info.MeshKey == s.meshKey {
+		return nil
+	}
+	err := s.verify(clientKey, ClientInfo{
+		Version:    info.Version,
+		RemoteAddr: remoteAddr,
+	})
+	if err == nil {
+		return nil
+	}
+	if errors.Is(err, ErrClientNotAllowed) {
+		s.clientsRejectedDenied.Add(1)
+	} else {
+		s.clientsRejectedError.Add(1)
+	}
+	return err
 }
 
 func (s *Server) sendServerKey(bw *bufio.Writer) error {
@@ -893,10 +1069,13 @@ type sclient struct {
 	logf       logger.Logf
 	done       <-chan struct{} // closed when connection closes
 	remoteAddr string          // usually ip:port from net.Conn.RemoteAddr().String()
-	sendQueue  chan pkt        // packets queued to this client; never closed
+	sendQueue  *fairQueue      // packets queued to this client
 	peerGone   chan key.Public // write request that a previous sender has disconnected (not used by mesh peers)
+	sendPong   chan [8]byte    // write request for a pong replying to a ping
 	meshUpdate chan struct{}   // write request to write peerStateChange
 	canMesh    bool            // clientInfo had correct mesh token for inter-region routing
+	limitWG    *clientLimiter  // rate limit on WireGuard packets sent; nil if none
+	limitDisco *clientLimiter  // rate limit on disco packets sent; nil if none
 
 	// Owned by run, not thread-safe.
 	br          *bufio.Reader
@@ -934,6 +1113,116 @@ type pkt struct {
 	// TODO(danderson): enqueue time, to measure queue latency?
 }
 
+// fairQueue is the queue of packets to write to an sclient.
+//
+// It holds at most perClientSendQueueDepth packets, kept per sender
+// and dequeued round robin across senders, so that a sender flooding
+// the client can't starve its other peers. When it's full, the oldest
+// packet of the sender with the most queued packets is dropped.
+type fairQueue struct {
+	// ready has a value whenever the queue might be non-empty.
+	// Each receive from it should be followed by one pop, which
+	// refills it if packets remain.
+	ready chan struct{}
+
+	mu    sync.Mutex
+	bySrc map[key.Public][]pkt
+	order []key.Public // senders with queued packets, in round-robin order
+	n     int          // total packets queued
+}
+
+func newFairQueue() *fairQueue {
+	return &fairQueue{
+		ready: make(chan struct{}, 1),
+		bySrc: map[key.Public][]pkt{},
+	}
+}
+
+// push enqueues p. If the queue was full, it reports the packet
+// that was dropped to make room.
+func (q *fairQueue) push(p pkt) (dropped pkt, didDrop bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	pq, ok := q.bySrc[p.src]
+	if !ok {
+		q.order = append(q.order, p.src)
+	}
+	q.bySrc[p.src] = append(pq, p)
+	q.n++
+	if q.n > perClientSendQueueDepth {
+		dropped, didDrop = q.dropLongestLocked(), true
+	}
+	q.signalLocked()
+	return dropped, didDrop
+}
+
+// dropLongestLocked removes and returns the oldest packet of the
+// sender with the most queued packets.
+func (q *fairQueue) dropLongestLocked() pkt {
+	longest := 0
+	for i, src := range q.order {
+		if len(q.bySrc[src]) > len(q.bySrc[q.order[longest]]) {
+			longest = i
+		}
+	}
+	return q.popAtLocked(longest, false)
+}
+
+// pop dequeues the next packet to send, if any.
+func (q *fairQueue) pop() (p pkt, ok bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.n == 0 {
+		return pkt{}, false
+	}
+	p = q.popAtLocked(0, true)
+	if q.n > 0 {
+		q.signalLocked()
+	}
+	return p, true
+}
+
+// popAtLocked removes and returns the oldest packet of the sender at
+// index i of q.order. If that leaves the sender with queued packets
+// and rotate is true, the sender moves to the back of q.order.
+func (q *fairQueue) popAtLocked(i int, rotate bool) pkt {
+	src := q.order[i]
+	pq := q.bySrc[src]
+	p := pq[0]
+	pq[0] = pkt{} // release memory
+	pq = pq[1:]
+	q.n--
+	if len(pq) == 0 {
+		delete(q.bySrc, src)
+		q.order = append(q.order[:i], q.order[i+1:]...)
+		return p
+	}
+	q.bySrc[src] = pq
+	if rotate {
+		q.order = append(q.order[:i], q.order[i+1:]...)
+		q.order = append(q.order, src)
+	}
+	return p
+}
+
+// drain empties the queue, returning how many packets it held.
+func (q *fairQueue) drain() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	n := q.n
+	q.bySrc = map[key.Public][]pkt{}
+	q.order = nil
+	q.n = 0
+	return n
+}
+
+func (q *fairQueue) signalLocked() {
+	select {
+	case q.ready <- struct{}{}:
+	default:
+	}
+}
+
 func (c *sclient) setPreferred(v bool) {
 	if c.preferred == v {
 		return
@@ -966,16 +1255,11 @@ func (c *sclient) sendLoop(ctx context.Context) error {
 		c.nc.Close()
 
 		// Drain the send queue to count dropped packets
-		for {
-			select {
-			case <-c.sendQueue:
-				c.s.packetsDropped.Add(1)
-				c.s.packetsDroppedGone.Add(1)
-				if debug {
-					c.logf("dropping packet for shutdown %x", c.key)
-				}
-			default:
-				return
+		if n := c.sendQueue.drain(); n > 0 {
+			c.s.packetsDropped.Add(int64(n))
+			c.s.packetsDroppedGone.Add(int64(n))
+			if debug {
+				c.logf("dropping %d packets for shutdown %x", n, c.key)
 			}
 		}
 	}()
@@ -1000,8 +1284,11 @@ func (c *sclient) sendLoop(ctx context.Context) error {
 		case <-c.meshUpdate:
 			werr = c.sendMeshUpdates()
 			continue
-		case msg := <-c.sendQueue:
-			werr = c.sendPacket(msg.src, msg.bs)
+		case data := <-c.sendPong:
+			werr = c.sendPongFrame(data)
+			continue
+		case <-c.sendQueue.ready:
+			werr = c.sendQueuedPacket()
 			continue
 		case <-keepAliveTick.C:
 			werr = c.sendKeepAlive()
@@ -1023,14 +1310,26 @@ func (c *sclient) sendLoop(ctx context.Context) error {
 		case <-c.meshUpdate:
 			werr = c.sendMeshUpdates()
 			continue
-		case msg := <-c.sendQueue:
-			werr = c.sendPacket(msg.src, msg.bs)
+		case data := <-c.sendPong:
+			werr = c.sendPongFrame(data)
+		case <-c.sendQueue.ready:
+			werr = c.sendQueuedPacket()
 		case <-keepAliveTick.C:
 			werr = c.sendKeepAlive()
 		}
 	}
 }
 
+// sendQueuedPacket sends the next packet from c.sendQueue, if any,
+// without flushing.
+func (c *sclient) sendQueuedPacket() error {
+	msg, ok := c.sendQueue.pop()
+	if !ok {
+		return nil
+	}
+	return c.sendPacket(msg.src, msg.bs)
+}
+
 func (c *sclient) setWriteDeadline() {
 	c.nc.SetWriteDeadline(time.Now().Add(writeTimeout))
 }
@@ -1041,6 +1340,16 @@ func (c *sclient) sendKeepAlive() error {
 	return writeFrameHeader(c.bw, frameKeepAlive, 0)
 }
 
+// sendPongFrame sends a pong frame, without flushing.
+func (c *sclient) sendPongFrame(data [8]byte) error {
+	c.setWriteDeadline()
+	if err := writeFrameHeader(c.bw, framePong, pingLen); err != nil {
+		return err
+	}
+	_, err := c.bw.Write(data[:])
+	return err
+}
+
 // sendPeerGone sends a peerGone frame, without flushing.
 func (c *sclient) sendPeerGone(peer key.Public) error {
 	c.s.peerGoneFrames.Add(1)
@@ -1156,7 +1465,7 @@ func (s *Server) AddPacketForwarder(dst key.Public, fwd PacketForwarder) {
 			return
 		}
 		if m, ok := prev.(multiForwarder); ok {
-			if _, ok := m[fwd]; !ok {
+			if _, ok := m[fwd]; ok {
 				// Duplicate registration of same forwarder in set; ignore.
 				return
 			}
@@ -1290,6 +1599,7 @@ func (s *Server) ExpVar() expvar.Var {
 	m.Set("multiforwarder_created", &s.multiForwarderCreated)
 	m.Set("multiforwarder_deleted", &s.multiForwarderDeleted)
 	m.Set("packet_forwarder_delete_other_value", &s.removePktForwardOther)
+	m.Set("counter_clients_rejected_reason", &s.clientsRejected)
 	var expvarVersion expvar.String
 	expvarVersion.Set(version.Long)
 	m.Set("version", &expvarVersion)
@@ -6,6 +6,7 @@ package derp
 
 import (
 	"bufio"
+	"bytes"
 	"context"
 	crand "crypto/rand"
 	"crypto/x509"
@@ -647,6 +648,68 @@ func TestWatch(t *testing.T) {
 	w3.wantGone(t, c1.pub)
 }
 
+func TestVerifyClient(t *testing.T) {
+	s := NewServer(newPrivateKey(t), t.Logf)
+	defer s.Close()
+	s.SetMeshKey("mesh-key")
+
+	allowed := newPrivateKey(t)
+	denied := newPrivateKey(t)
+	broken := newPrivateKey(t)
+	var gotInfo ClientInfo
+	s.SetVerifyClient(func(k key.Public, info ClientInfo) error {
+		switch k {
+		case allowed.Public():
+			gotInfo = info
+			return nil
+		case broken.Public():
+			return errors.New("verifier unreachable")
+		}
+		return fmt.Errorf("key %s: %w", k.ShortString(), ErrClientNotAllowed)
+	})
+
+	connect := func(priv key.Private, opts ...ClientOpt) error {
+		cout, cin := net.Pipe()
+		defer cout.Close()
+		brwServer := bufio.NewReadWriter(bufio.NewReader(cin), bufio.NewWriter(cin))
+		go s.Accept(cin, brwServer, "test-client")
+
+		brw := bufio.NewReadWriter(bufio.NewReader(cout), bufio.NewWriter(cout))
+		c, err := NewClient(priv, cout, brw, t.Logf, opts...)
+		if err != nil {
+			return err
+		}
+		_, err = c.Recv()
+		return err
+	}
+
+	if err := connect(allowed); err != nil {
+		t.Errorf("allowed client: %v", err)
+	}
+	if gotInfo.Version != ProtocolVersion || gotInfo.RemoteAddr != "test-client" {
+		t.Errorf("verifier got %+v", gotInfo)
+	}
+	if err := connect(denied); err == nil {
+		t.Error("denied client connected")
+	}
+	if err := connect(broken); err == nil {
+		t.Error("client connected despite verifier error")
+	}
+	if err := connect(newPrivateKey(t), MeshKey("mesh-key")); err != nil {
+		t.Errorf("mesh peer: %v", err)
+	}
+	if err := connect(denied, MeshKey("wrong-key")); err == nil {
+		t.Error("denied client connected with wrong mesh key")
+	}
+
+	if got, want := s.clientsRejectedDenied.Value(), int64(2); got != want {
+		t.Errorf("not_allowed rejections = %d; want %d", got, want)
+	}
+	if got, want := s.clientsRejectedError.Value(), int64(1); got != want {
+		t.Errorf("verify_error rejections = %d; want %d", got, want)
+	}
+}
+
 type testFwd int
 
 func (testFwd) ForwardPacket(key.Public, key.Public, []byte) error { panic("not called in tests") }
@@ -727,6 +790,36 @@ func TestForwarderRegistration(t *testing.T) {
 		},
 	})
 
+	// A third forwarder joins the set, in last place.
+	s.AddPacketForwarder(u1, testFwd(200))
+	want(map[key.Public]PacketForwarder{
+		u1: multiForwarder{
+			testFwd(1):   1,
+			testFwd(100): 2,
+			testFwd(200): 3,
+		},
+	})
+
+	// Re-adding one already in the set doesn't change its place.
+	s.AddPacketForwarder(u1, testFwd(1))
+	want(map[key.Public]PacketForwarder{
+		u1: multiForwarder{
+			testFwd(1):   1,
+			testFwd(100): 2,
+			testFwd(200): 3,
+		},
+	})
+
+	// Removing one of three leaves a set of two.
+	s.RemovePacketForwarder(u1, testFwd(200))
+	want(map[key.Public]PacketForwarder{
+		u1: multiForwarder{
+			testFwd(1):   1,
+			testFwd(100): 2,
+		},
+	})
+	wantCounter(&s.multiForwarderDeleted, 0)
+
 	// Removing a forwarder in a multi set that does exist should collapse it away
 	// from being a multiForwarder.
 	wantCounter(&s.multiForwarderDeleted, 0)
@@ -773,6 +866,161 @@ func TestForwarderRegistration(t *testing.T) {
 	})
 }
 
+func TestFairQueue(t *testing.T) {
+	q := newFairQueue()
+	flooder, other := key.Public{1}, key.Public{2}
+	for i := 0; i < perClientSendQueueDepth; i++ {
+		if _, didDrop := q.push(pkt{src: flooder, bs: []byte{byte(i)}}); didDrop {
+			t.Fatalf("dropped packet %d before queue was full", i)
+		}
+	}
+	dropped, didDrop := q.push(pkt{src: other, bs: []byte{100}})
+	if !didDrop || dropped.src != flooder || dropped.bs[0] != 0 {
+		t.Fatalf("full queue dropped %v, %v; want flooder's oldest packet", dropped, didDrop)
+	}
+	dropped, didDrop = q.push(pkt{src: other, bs: []byte{101}})
+	if !didDrop || dropped.src != flooder || dropped.bs[0] != 1 {
+		t.Fatalf("full queue dropped %v, %v; want flooder's oldest packet", dropped, didDrop)
+	}
+
+	// The other sender's two packets come out interleaved with the
+	// flooder's, not behind all of them.
+	var got []byte
+	for i := 0; i < 4; i++ {
+		select {
+		case <-q.ready:
+		default:
+			t.Fatalf("ready not set before pop %d", i)
+		}
+		p, ok := q.pop()
+		if !ok {
+			t.Fatalf("pop %d failed", i)
+		}
+		got = append(got, p.bs[0])
+	}
+	if want := []byte{2, 100, 3, 101}; !bytes.Equal(got, want) {
+		t.Errorf("popped %v; want %v", got, want)
+	}
+
+	if n := q.drain(); n != perClientSendQueueDepth-4 {
+		t.Errorf("drain = %d; want %d", n, perClientSendQueueDepth-4)
+	}
+	if p, ok := q.pop(); ok {
+		t.Errorf("pop after drain = %v", p)
+	}
+}
+
+func TestClientLimiter(t *testing.T) {
+	var nilLimiter *clientLimiter
+	if !nilLimiter.allow(time.Now(), MaxPacketSize) {
+		t.Error("nil limiter denied a packet")
+	}
+	if l := newClientLimiter(RateLimit{}); l != nil {
+		t.Errorf("zero RateLimit gave limiter %v; want nil", l)
+	}
+
+	now := time.Now()
+	pl := newClientLimiter(RateLimit{PacketsPerSecond: 2})
+	for i, want := range []bool{true, true, false} {
+		if got := pl.allow(now, 1000); got != want {
+			t.Errorf("packet %d: allow = %v; want %v", i, got, want)
+		}
+	}
+	if !pl.allow(now.Add(time.Second), 1000) {
+		t.Error("packet limit didn't refill")
+	}
+
+	bl := newClientLimiter(RateLimit{BytesPerSecond: 1000, PacketsPerSecond: 2})
+	if !bl.allow(now, MaxPacketSize) {
+		t.Error("burst below MaxPacketSize")
+	}
+	if bl.allow(now, 1) {
+		t.Error("byte limit not enforced")
+	}
+	// The denied packet didn't use up the last packet token.
+	if !bl.allow(now.Add(time.Millisecond), 1) {
+		t.Error("packet denied by byte limit took a packet token")
+	}
+}
+
+func TestRateLimitDrops(t *testing.T) {
+	s := NewServer(newPrivateKey(t), t.Logf)
+	defer s.Close()
+	s.SetRateLimits(RateLimit{PacketsPerSecond: 1}, RateLimit{})
+
+	newClient := func(name string) *Client {
+		t.Helper()
+		c1, c2 := net.Pipe()
+		t.Cleanup(func() { c2.Close() })
+		go s.Accept(c1, bufio.NewReadWriter(bufio.NewReader(c1), bufio.NewWriter(c1)), name)
+		c, err := NewClient(newPrivateKey(t), c2, bufio.NewReadWriter(bufio.NewReader(c2), bufio.NewWriter(c2)), t.Logf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		waitConnect(t, c)
+		return c
+	}
+	alice := newClient("alice")
+	bob := newClient("bob")
+	go func() {
+		for {
+			if _, err := bob.Recv(); err != nil {
+				return
+			}
+		}
+	}()
+
+	const sent = 5
+	for i := 0; i < sent; i++ {
+		if err := alice.Send(bob.publicKey, []byte("not disco")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for s.packetsRecv.Value() < sent && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	// At least the first packet is allowed, and with a burst of one,
+	// most of the rest are dropped unless the test ran very slowly.
+	if got := s.packetsDroppedLimitWG.Value(); got < 1 || got > sent-1 {
+		t.Errorf("throttled_wireguard drops = %d; want 1..%d", got, sent-1)
+	}
+	if got := s.packetsDroppedLimitDisco.Value(); got != 0 {
+		t.Errorf("throttled_disco drops = %d; want 0", got)
+	}
+}
+
+func TestPing(t *testing.T) {
+	s := NewServer(newPrivateKey(t), t.Logf)
+	defer s.Close()
+
+	c1, c2 := net.Pipe()
+	defer c2.Close()
+	go s.Accept(c1, bufio.NewReadWriter(bufio.NewReader(c1), bufio.NewWriter(c1)), "test-client")
+	c, err := NewClient(newPrivateKey(t), c2, bufio.NewReadWriter(bufio.NewReader(c2), bufio.NewWriter(c2)), t.Logf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := [8]byte{1, 2, 3, 4, 5, 6, 7, 8}
+	if err := c.SendPing(data); err != ErrPingUnsupported {
+		t.Errorf("SendPing before ServerInfo = %v; want ErrPingUnsupported", err)
+	}
+	waitConnect(t, c)
+	if got := c.ServerProtocolVersion(); got != ProtocolVersion {
+		t.Errorf("ServerProtocolVersion = %d; want %d", got, ProtocolVersion)
+	}
+	if err := c.SendPing(data); err != nil {
+		t.Fatal(err)
+	}
+	m, err := c.recvTimeout(5 * time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pm, ok := m.(PongMessage); !ok || pm != PongMessage(data) {
+		t.Errorf("got %T %v; want PongMessage %v", m, m, data)
+	}
+}
+
 func TestMetaCert(t *testing.T) {
 	priv := newPrivateKey(t)
 	pub := priv.Public()
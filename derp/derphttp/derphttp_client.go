@@ -13,6 +13,7 @@ package derphttp
 import (
 	"bufio"
 	"context"
+	crand "crypto/rand"
 	"crypto/tls"
 	"crypto/x509"
 	"errors"
@@ -68,6 +69,8 @@ type Client struct {
 	client       *derp.Client
 	connGen      int // incremented once per new connection; valid values are >0
 	serverPubKey key.Public
+	pingOut      map[derp.PongMessage]chan struct{} // closed when the pong for an outstanding Ping arrives
+	watchStatus  WatchConnectionStatus              // maintained by RunWatchConnectionLoop
 }
 
 // NewRegionClient returns a new DERP-over-HTTP client. It connects lazily.
@@ -692,6 +695,61 @@ func (c *Client) ClosePeer(target key.Public) error {
 	return err
 }
 
+// Ping sends a ping to the DERP server and waits for the pong, or for
+// ctx to be done. Pongs are noticed by Recv, so another goroutine must
+// be calling Recv for Ping to succeed.
+//
+// If the pong doesn't arrive in time, the connection is presumed dead
+// and is closed, so that it's reestablished by the next call that uses
+// it. If the server doesn't support pings, Ping returns
+// derp.ErrPingUnsupported.
+func (c *Client) Ping(ctx context.Context) error {
+	client, _, err := c.connect(ctx, "derphttp.Client.Ping")
+	if err != nil {
+		return err
+	}
+	var data derp.PongMessage
+	if _, err := crand.Read(data[:]); err != nil {
+		return err
+	}
+	pong := make(chan struct{})
+	c.mu.Lock()
+	if c.pingOut == nil {
+		c.pingOut = map[derp.PongMessage]chan struct{}{}
+	}
+	c.pingOut[data] = pong
+	c.mu.Unlock()
+	defer func() {
+		c.mu.Lock()
+		delete(c.pingOut, data)
+		c.mu.Unlock()
+	}()
+
+	if err := client.SendPing(data); err != nil {
+		if err != derp.ErrPingUnsupported {
+			c.closeForReconnect(client)
+		}
+		return err
+	}
+	select {
+	case <-pong:
+		return nil
+	case <-ctx.Done():
+		c.closeForReconnect(client)
+		return ctx.Err()
+	}
+}
+
+// notePong wakes up the Ping call waiting for m, if any.
+func (c *Client) notePong(m derp.PongMessage) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if pong, ok := c.pingOut[m]; ok {
+		close(pong)
+		delete(c.pingOut, m)
+	}
+}
+
 // Recv reads a message from c. The returned message may alias memory from Client.
 // The message should only be used until the next Client call.
 func (c *Client) Recv() (derp.ReceivedMessage, error) {
@@ -713,6 +771,9 @@ func (c *Client) RecvDetail() (m derp.ReceivedMessage, connGen int, err error) {
 			err = ErrClientClosed
 		}
 	}
+	if pm, ok := m.(derp.PongMessage); ok {
+		c.notePong(pm)
+	}
 	return m, connGen, err
 }
 
@@ -146,6 +146,60 @@ func TestSendRecv(t *testing.T) {
 	recvNothing(1)
 }
 
+func TestPing(t *testing.T) {
+	s := derp.NewServer(key.NewPrivate(), t.Logf)
+	defer s.Close()
+	httpsrv := &http.Server{
+		TLSNextProto: make(map[string]func(*http.Server, *tls.Conn, http.Handler)),
+		Handler:      Handler(s),
+	}
+	ln, err := net.Listen("tcp4", "localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go httpsrv.Serve(ln)
+
+	c, err := NewClient(key.NewPrivate(), "http://"+ln.Addr().String(), t.Logf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	waitConnect(t, c)
+
+	recvErr := make(chan error, 1)
+	go func() {
+		for {
+			if _, err := c.Recv(); err != nil {
+				recvErr <- err
+				return
+			}
+		}
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	for i := 0; i < 3; i++ {
+		if err := c.Ping(ctx); err != nil {
+			t.Fatalf("Ping %d: %v", i, err)
+		}
+	}
+
+	// A ping that can't be answered in time breaks the connection,
+	// so it's redialed.
+	expired, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := c.Ping(expired); err == nil {
+		t.Fatal("Ping with expired context succeeded")
+	}
+	select {
+	case err := <-recvErr:
+		t.Logf("Recv after failed ping: %v", err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("connection not closed after failed ping")
+	}
+}
+
 func waitConnect(t testing.TB, c *Client) {
 	t.Helper()
 	if m, err := c.Recv(); err != nil {
@@ -14,6 +14,61 @@ import (
 	"tailscale.com/types/logger"
 )
 
+// WatchConnectionStatus is the state of a RunWatchConnectionLoop's
+// subscription to its server's connection changes.
+type WatchConnectionStatus struct {
+	// Connected is whether the subscription is currently active.
+	Connected bool
+	// Since is when Connected last changed. It's the zero time
+	// if the loop has never connected.
+	Since time.Time
+	// Reconnects is how many times the subscription was
+	// reestablished after being lost.
+	Reconnects int
+	// LastError is the most recent error connecting or reading
+	// from the server, or empty if there's been none.
+	LastError     string
+	LastErrorTime time.Time
+	// SelfConnect is whether the loop stopped because the server
+	// turned out to be ignoreServerKey.
+	SelfConnect bool
+}
+
+// WatchConnectionStatus returns the state of c's
+// RunWatchConnectionLoop.
+func (c *Client) WatchConnectionStatus() WatchConnectionStatus {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.watchStatus
+}
+
+// noteWatchConnected records in c's WatchConnectionStatus that the
+// subscription was established, if err is nil, or that it was lost
+// or couldn't be established because of err.
+func (c *Client) noteWatchConnected(err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	st := &c.watchStatus
+	now := time.Now()
+	if err != nil {
+		st.LastError = err.Error()
+		st.LastErrorTime = now
+		if st.Connected {
+			st.Connected = false
+			st.Since = now
+		}
+		return
+	}
+	if st.Connected {
+		return
+	}
+	if !st.Since.IsZero() {
+		st.Reconnects++
+	}
+	st.Connected = true
+	st.Since = now
+}
+
 // RunWatchConnectionLoop loops until ctx is done, sending WatchConnectionChanges and subscribing to
 // connection changes.
 //
@@ -25,6 +80,8 @@ import (
 // updates about how many peers are on the server. Error log output is
 // set to the c's logger, regardless of infoLogf's value.
 //
+// The state of the loop is available from WatchConnectionStatus.
+//
 // To force RunWatchConnectionLoop to return quickly, its ctx needs to
 // be closed, and c itself needs to be closed.
 func (c *Client) RunWatchConnectionLoop(ctx context.Context, ignoreServerKey key.Public, infoLogf logger.Logf, add, remove func(key.Public)) {
@@ -104,6 +161,7 @@ func (c *Client) RunWatchConnectionLoop(ctx context.Context, ignoreServerKey key
 		err := c.WatchConnectionChanges()
 		if err != nil {
 			clear()
+			c.noteWatchConnected(err)
 			logf("WatchConnectionChanges: %v", err)
 			sleep(retryInterval)
 			continue
@@ -111,12 +169,17 @@ func (c *Client) RunWatchConnectionLoop(ctx context.Context, ignoreServerKey key
 
 		if c.ServerPublicKey() == ignoreServerKey {
 			logf("detected self-connect; ignoring host")
+			c.mu.Lock()
+			c.watchStatus.SelfConnect = true
+			c.mu.Unlock()
 			return
 		}
+		c.noteWatchConnected(nil)
 		for {
 			m, connGen, err := c.RecvDetail()
 			if err != nil {
 				clear()
+				c.noteWatchConnected(err)
 				logf("Recv: %v", err)
 				sleep(retryInterval)
 				break
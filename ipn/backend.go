@@ -79,6 +79,63 @@ type Notify struct {
 	// type is mirrored in xcode/Shared/IPN.swift
 }
 
+// NotifyWatchOpt is a bitmask of options selecting which Notify
+// messages a watcher of the IPN bus receives. See
+// LocalBackend.WatchNotifications.
+type NotifyWatchOpt uint64
+
+const (
+	// NotifyWatchState selects State, ErrMessage and LoginFinished.
+	NotifyWatchState NotifyWatchOpt = 1 << iota
+	// NotifyWatchPrefs selects Prefs.
+	NotifyWatchPrefs
+	// NotifyWatchNetMap selects NetMap.
+	NotifyWatchNetMap
+	// NotifyWatchEngineUpdates selects Engine.
+	NotifyWatchEngineUpdates
+	// NotifyWatchBrowseToURL selects BrowseToURL.
+	NotifyWatchBrowseToURL
+
+	// NotifyInitialState, if set, makes the first message
+	// delivered to the watcher a snapshot of the current values
+	// of the selected fields.
+	NotifyInitialState
+)
+
+// notifyWatchFields is the set of NotifyWatchOpt bits that select
+// fields, as opposed to modifying how they're delivered.
+const notifyWatchFields = NotifyWatchState | NotifyWatchPrefs | NotifyWatchNetMap | NotifyWatchEngineUpdates | NotifyWatchBrowseToURL
+
+// Filter returns the subset of n selected by opts, and whether that
+// subset is non-empty. If opts selects no fields, all of n is
+// selected.
+func (opts NotifyWatchOpt) Filter(n Notify) (_ Notify, ok bool) {
+	if opts&notifyWatchFields == 0 {
+		return n, true
+	}
+	ret := Notify{Version: n.Version}
+	if opts&NotifyWatchState != 0 {
+		ret.State = n.State
+		ret.ErrMessage = n.ErrMessage
+		ret.LoginFinished = n.LoginFinished
+	}
+	if opts&NotifyWatchPrefs != 0 {
+		ret.Prefs = n.Prefs
+	}
+	if opts&NotifyWatchNetMap != 0 {
+		ret.NetMap = n.NetMap
+	}
+	if opts&NotifyWatchEngineUpdates != 0 {
+		ret.Engine = n.Engine
+	}
+	if opts&NotifyWatchBrowseToURL != 0 {
+		ret.BrowseToURL = n.BrowseToURL
+	}
+	ok = ret.State != nil || ret.ErrMessage != nil || ret.LoginFinished != nil ||
+		ret.Prefs != nil || ret.NetMap != nil || ret.Engine != nil || ret.BrowseToURL != nil
+	return ret, ok
+}
+
 // StateKey is an opaque identifier for a set of LocalBackend state
 // (preferences, private keys, etc.).
 //
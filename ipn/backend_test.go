@@ -0,0 +1,30 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ipn
+
+import "testing"
+
+func TestNotifyWatchOptFilter(t *testing.T) {
+	st := Running
+	url := "https://example.com/"
+	n := Notify{Version: "v", State: &st, BrowseToURL: &url}
+
+	if got, ok := NotifyWatchOpt(0).Filter(n); !ok || got.State == nil || got.BrowseToURL == nil {
+		t.Errorf("empty mask: got %+v, %v; want everything", got, ok)
+	}
+	if got, ok := NotifyInitialState.Filter(n); !ok || got.State == nil || got.BrowseToURL == nil {
+		t.Errorf("NotifyInitialState only: got %+v, %v; want everything", got, ok)
+	}
+	got, ok := NotifyWatchState.Filter(n)
+	if !ok || got.State == nil || got.BrowseToURL != nil {
+		t.Errorf("NotifyWatchState: got %+v, %v; want only State", got, ok)
+	}
+	if got.Version != "v" {
+		t.Errorf("Version = %q; want %q", got.Version, "v")
+	}
+	if got, ok := NotifyWatchNetMap.Filter(n); ok {
+		t.Errorf("NotifyWatchNetMap: got %+v, %v; want nothing", got, ok)
+	}
+}
@@ -9,6 +9,7 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"io"
 	"os"
 	"runtime"
 	"strings"
@@ -35,6 +36,7 @@ import (
 	"tailscale.com/util/systemd"
 	"tailscale.com/version"
 	"tailscale.com/wgengine"
+	"tailscale.com/wgengine/capture"
 	"tailscale.com/wgengine/filter"
 	"tailscale.com/wgengine/router"
 	"tailscale.com/wgengine/router/dns"
@@ -78,7 +80,9 @@ type LocalBackend struct {
 	serverURL       string           // tailcontrol URL
 	newDecompressor func() (controlclient.Decompressor, error)
 
-	filterHash string
+	filterHash  string
+	filterTrace *filter.Tracer         // shared by all the filters we install
+	conntrack   filter.ConntrackConfig // of all the filters we install
 
 	// The mutex protects the following elements.
 	mu             sync.Mutex
@@ -102,6 +106,11 @@ type LocalBackend struct {
 	authURL      string
 	interact     bool
 	prevIfState  *interfaces.State
+	capturing    bool // a StreamCapture is in progress
+
+	// notifyWatchers are the LocalAPI subscribers of the IPN bus,
+	// in addition to notify.
+	notifyWatchers map[*notifyWatcher]bool
 
 	// statusLock must be held before calling statusChanged.Wait() or
 	// statusChanged.Broadcast().
@@ -116,9 +125,6 @@ func NewLocalBackend(logf logger.Logf, logid string, store ipn.StateStore, e wge
 		panic("ipn.NewLocalBackend: wgengine must not be nil")
 	}
 
-	// Default filter blocks everything, until Start() is called.
-	e.SetFilter(filter.NewAllowNone(logf))
-
 	ctx, cancel := context.WithCancel(context.Background())
 	portpoll, err := portlist.NewPoller()
 	if err != nil {
@@ -137,7 +143,11 @@ func NewLocalBackend(logf logger.Logf, logid string, store ipn.StateStore, e wge
 		state:          ipn.NoState,
 		portpoll:       portpoll,
 		gotPortPollRes: make(chan struct{}),
+		filterTrace:    filter.NewTracer(filterTraceSize),
 	}
+	// Default filter blocks everything, until Start() is called.
+	b.setFilter(filter.NewAllowNone(logf))
+
 	e.SetLinkChangeCallback(b.linkChange)
 	b.statusChanged = sync.NewCond(&b.statusLock)
 
@@ -268,6 +278,15 @@ func (b *LocalBackend) SetDecompressor(fn func() (controlclient.Decompressor, er
 	b.newDecompressor = fn
 }
 
+// SetConntrackConfig sets the connection tracking configuration of
+// the packet filter. It must be called before Start.
+func (b *LocalBackend) SetConntrackConfig(c filter.ConntrackConfig) {
+	b.conntrack = c
+	if f := b.e.GetFilter(); f != nil {
+		f.SetConntrackConfig(c)
+	}
+}
+
 // setClientStatus is the callback invoked by the control client whenever it posts a new status.
 // Among other things, this is where we update the netmap, packet filters, DNS and DERP maps.
 func (b *LocalBackend) setClientStatus(st controlclient.Status) {
@@ -508,7 +527,11 @@ func (b *LocalBackend) Start(opts ipn.Options) error {
 	}
 	applyPrefsToHostinfo(hostinfo, b.prefs)
 
-	b.notify = opts.Notify
+	if opts.Notify != nil {
+		// Callers of the LocalAPI don't provide a
+		// callback; keep delivering to the existing one.
+		b.notify = opts.Notify
+	}
 	b.setNetMapLocked(nil)
 	persistv := b.prefs.Persist
 	machinePrivKey := b.machinePrivKey
@@ -634,30 +657,166 @@ func (b *LocalBackend) updateFilter(netMap *netmap.NetworkMap, prefs *ipn.Prefs)
 
 	if !haveNetmap {
 		b.logf("netmap packet filter: (not ready yet)")
-		b.e.SetFilter(filter.NewAllowNone(b.logf))
+		b.setFilter(filter.NewAllowNone(b.logf))
 		return
 	}
 
 	oldFilter := b.e.GetFilter()
 	if shieldsUp {
 		b.logf("netmap packet filter: (shields up)")
-		b.e.SetFilter(filter.NewShieldsUpFilter(localNets, oldFilter, b.logf))
+		b.setFilter(filter.NewShieldsUpFilter(localNets, oldFilter, b.logf))
 	} else {
 		b.logf("netmap packet filter: %v", packetFilter)
-		b.e.SetFilter(filter.New(packetFilter, localNets, oldFilter, b.logf))
+		b.setFilter(filter.New(packetFilter, localNets, oldFilter, b.logf))
+	}
+}
+
+// filterTraceSize is the number of packet filter decisions retained
+// for FilterTrace.
+const filterTraceSize = 1000
+
+// setFilter installs f in the engine, recording its decisions for
+// FilterTrace and applying the SetConntrackConfig configuration.
+func (b *LocalBackend) setFilter(f *filter.Filter) {
+	f.SetTracer(b.filterTrace)
+	f.SetConntrackConfig(b.conntrack)
+	b.e.SetFilter(f)
+}
+
+// FilterTrace returns the recent packet filter decisions selected by
+// tf, oldest first.
+func (b *LocalBackend) FilterTrace(tf filter.TraceFilter) []filter.TraceEvent {
+	return b.filterTrace.Events(tf)
+}
+
+var errNoResolver = errors.New("engine has no DNS resolver")
+
+// dnsResolver returns the engine's DNS resolver.
+func (b *LocalBackend) dnsResolver() (*tsdns.Resolver, error) {
+	re, ok := b.e.(wgengine.ResolvingEngine)
+	if !ok {
+		return nil, errNoResolver
+	}
+	r, ok := re.GetResolver()
+	if !ok {
+		return nil, errNoResolver
+	}
+	return r, nil
+}
+
+// FlushDNSCache removes all cached upstream responses from the
+// engine's DNS resolver.
+func (b *LocalBackend) FlushDNSCache() error {
+	r, err := b.dnsResolver()
+	if err != nil {
+		return err
+	}
+	r.FlushCache()
+	return nil
+}
+
+// SetDNSQueryLogSize sets the number of queries the engine's DNS
+// resolver keeps a record of. Zero disables the query log.
+func (b *LocalBackend) SetDNSQueryLogSize(size int) error {
+	r, err := b.dnsResolver()
+	if err != nil {
+		return err
+	}
+	r.SetQueryLogSize(size)
+	return nil
+}
+
+// DNSQueryLog returns the queries recorded by the engine's DNS
+// resolver with a Seq greater than since.
+func (b *LocalBackend) DNSQueryLog(since uint64) ([]tsdns.QueryLogEntry, error) {
+	r, err := b.dnsResolver()
+	if err != nil {
+		return nil, err
+	}
+	return r.QueryLog(since), nil
+}
+
+// DNSQuery sends the DNS query, a DNS message, through the engine's
+// DNS resolver and returns the response.
+func (b *LocalBackend) DNSQuery(query []byte) ([]byte, error) {
+	r, err := b.dnsResolver()
+	if err != nil {
+		return nil, err
+	}
+	return r.Query(query)
+}
+
+var (
+	errNoCapture      = errors.New("engine doesn't support packet capture")
+	errCaptureRunning = errors.New("a packet capture is already in progress")
+)
+
+// StreamCapture writes the packets passing through the engine's TUN
+// device that are selected by f to w, as a pcapng stream, until ctx
+// is done or a write to w fails. Only one capture can run at a time.
+func (b *LocalBackend) StreamCapture(ctx context.Context, w io.Writer, f capture.Filter) error {
+	ce, ok := b.e.(wgengine.CapturingEngine)
+	if !ok {
+		return errNoCapture
+	}
+	b.mu.Lock()
+	if b.capturing {
+		b.mu.Unlock()
+		return errCaptureRunning
+	}
+	b.capturing = true
+	b.mu.Unlock()
+	defer func() {
+		b.mu.Lock()
+		b.capturing = false
+		b.mu.Unlock()
+	}()
+
+	sink := capture.NewSink(f)
+	if !ce.InstallCaptureHook(sink.Capture) {
+		return errNoCapture
 	}
+	defer ce.InstallCaptureHook(nil)
+	b.logf("packet capture started")
+	err := sink.Run(ctx, w)
+	b.logf("packet capture stopped; %d packets dropped", sink.Dropped())
+	if err == context.Canceled {
+		err = nil
+	}
+	return err
 }
 
 // dnsCIDRsEqual determines whether two CIDR lists are equal
-// for DNS map construction purposes (that is, only the first entry counts).
+// for DNS map construction purposes.
 func dnsCIDRsEqual(newAddr, oldAddr []netaddr.IPPrefix) bool {
 	if len(newAddr) != len(oldAddr) {
 		return false
 	}
-	if len(newAddr) == 0 || newAddr[0] == oldAddr[0] {
-		return true
+	for i := range newAddr {
+		if newAddr[i] != oldAddr[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// dnsServicesEqual determines whether two service lists are equal
+// for DNS map construction purposes (that is, descriptions don't count
+// for services without an SRV record).
+func dnsServicesEqual(newSvcs, oldSvcs []tailcfg.Service) bool {
+	if len(newSvcs) != len(oldSvcs) {
+		return false
+	}
+	for i := range newSvcs {
+		n, o := &newSvcs[i], &oldSvcs[i]
+		if n.Proto != o.Proto || n.Port != o.Port {
+			return false
+		}
+		if srvServiceName(*n) != "" && n.Description != o.Description {
+			return false
+		}
 	}
-	return false
+	return true
 }
 
 // dnsMapsEqual determines whether the new and the old network map
@@ -681,6 +840,9 @@ func dnsMapsEqual(new, old *netmap.NetworkMap) bool {
 	if !dnsCIDRsEqual(new.Addresses, old.Addresses) {
 		return false
 	}
+	if !dnsServicesEqual(new.Hostinfo.Services, old.Hostinfo.Services) {
+		return false
+	}
 
 	for i, newPeer := range new.Peers {
 		oldPeer := old.Peers[i]
@@ -690,11 +852,70 @@ func dnsMapsEqual(new, old *netmap.NetworkMap) bool {
 		if !dnsCIDRsEqual(newPeer.Addresses, oldPeer.Addresses) {
 			return false
 		}
+		if !dnsServicesEqual(newPeer.Hostinfo.Services, oldPeer.Hostinfo.Services) {
+			return false
+		}
 	}
 
 	return true
 }
 
+// srvServiceNames are the service names, as used in SRV record names
+// (RFC 2782), of well-known ports.
+var srvServiceNames = map[tailcfg.ServiceProto]map[uint16]string{
+	tailcfg.TCP: {
+		21:   "ftp",
+		22:   "ssh",
+		80:   "http",
+		443:  "https",
+		445:  "smb",
+		3389: "rdp",
+		5900: "rfb",
+	},
+}
+
+// srvServiceName returns the service name of svc for its SRV record,
+// or the empty string if it has none.
+func srvServiceName(svc tailcfg.Service) string {
+	return srvServiceNames[svc.Proto][svc.Port]
+}
+
+// dnsRecords adds to records the DNS records of the node with the
+// given name, addresses and services. A service on a well-known port
+// gets an SRV record, such as _ssh._tcp.<name> for port 22, and a
+// TXT record with its description, if any.
+func dnsRecords(records map[string]tsdns.Records, name string, addrs []netaddr.IPPrefix, services []tailcfg.Service) {
+	if len(addrs) == 0 || name == "" {
+		return
+	}
+	name = strings.TrimSuffix(name, ".") + "."
+
+	rec := records[name]
+	for _, addr := range addrs {
+		rec.IPs = append(rec.IPs, addr.IP)
+	}
+	records[name] = rec
+
+	for _, svc := range services {
+		svcName := srvServiceName(svc)
+		if svcName == "" {
+			continue
+		}
+		srvName := "_" + svcName + "._" + string(svc.Proto) + "." + name
+		rec := records[srvName]
+		if len(rec.SRV) > 0 {
+			// Already added, as when the service
+			// listens on both IPv4 and IPv6.
+			continue
+		}
+		rec.SRV = append(rec.SRV, tsdns.SRV{Port: svc.Port, Target: name})
+		if svc.Description != "" {
+			rec.TXT = append(rec.TXT, "description="+svc.Description)
+		}
+		records[srvName] = rec
+	}
+}
+
 // updateDNSMap updates the domain map in the DNS resolver in wgengine
 // based on the given netMap and user preferences.
 func (b *LocalBackend) updateDNSMap(netMap *netmap.NetworkMap) {
@@ -703,20 +924,13 @@ func (b *LocalBackend) updateDNSMap(netMap *netmap.NetworkMap) {
 		return
 	}
 
-	nameToIP := make(map[string]netaddr.IP)
-	set := func(name string, addrs []netaddr.IPPrefix) {
-		if len(addrs) == 0 || name == "" {
-			return
-		}
-		nameToIP[name] = addrs[0].IP
-	}
-
+	records := make(map[string]tsdns.Records)
 	for _, peer := range netMap.Peers {
-		set(peer.Name, peer.Addresses)
+		dnsRecords(records, peer.Name, peer.Addresses, peer.Hostinfo.Services)
 	}
-	set(netMap.Name, netMap.Addresses)
+	dnsRecords(records, netMap.Name, netMap.Addresses, netMap.Hostinfo.Services)
 
-	dnsMap := tsdns.NewMap(nameToIP, magicDNSRootDomains(netMap))
+	dnsMap := tsdns.NewMapFromRecords(records, magicDNSRootDomains(netMap))
 	// map diff will be logged in tsdns.Resolver.SetMap.
 	b.e.SetDNSMap(dnsMap)
 }
@@ -759,21 +973,134 @@ func (b *LocalBackend) readPoller() {
 	}
 }
 
-// send delivers n to the connected frontend. If no frontend is
-// connected, the notification is dropped without being delivered.
+// notifyWatcher is a subscriber registered with WatchNotifications.
+type notifyWatcher struct {
+	mask ipn.NotifyWatchOpt
+	ch   chan *ipn.Notify // closed by send if the watcher falls behind
+}
+
+// notifyFor returns the notification that w gets for n, and whether
+// it gets one at all. Everything sent to watchers goes through it, so
+// that they never see private keys.
+func (w *notifyWatcher) notifyFor(n ipn.Notify) (_ ipn.Notify, ok bool) {
+	n, ok = w.mask.Filter(n)
+	if !ok {
+		return n, false
+	}
+	if n.Prefs != nil && n.Prefs.Persist != nil {
+		p := n.Prefs.Clone()
+		p.Persist = nil
+		n.Prefs = p
+	}
+	if n.NetMap != nil && !n.NetMap.PrivateKey.IsZero() {
+		nm := *n.NetMap
+		nm.PrivateKey = wgkey.Private{}
+		n.NetMap = &nm
+	}
+	return n, true
+}
+
+// notifyWatcherQueueSize is the number of notifications that may be
+// queued for a watcher before it's considered too slow and is
+// disconnected.
+const notifyWatcherQueueSize = 64
+
+// send delivers n to the connected frontend and to any watchers. If
+// no frontend is connected and nobody is watching, the notification
+// is silently dropped; that's normal, such as for state changes
+// before any frontend has connected.
+//
+// send never blocks on watchers: a watcher whose queue is full is
+// unsubscribed, ending its WatchNotifications call.
 func (b *LocalBackend) send(n ipn.Notify) {
+	n.Version = version.Long
+
 	b.mu.Lock()
 	notify := b.notify
+	for w := range b.notifyWatchers {
+		wn, ok := w.notifyFor(n)
+		if !ok {
+			continue
+		}
+		select {
+		case w.ch <- &wn:
+		default:
+			b.logf("IPN bus watcher too slow; disconnecting it")
+			delete(b.notifyWatchers, w)
+			close(w.ch)
+		}
+	}
 	b.mu.Unlock()
 
 	if notify != nil {
-		n.Version = version.Long
 		notify(n)
-	} else {
-		b.logf("nil notify callback; dropping %+v", n)
 	}
 }
 
+// WatchNotifications subscribes to the backend's notifications
+// selected by mask, calling fn for each one until ctx is done, fn
+// returns false, or the watcher falls too far behind (see send).
+//
+// If mask includes ipn.NotifyInitialState, fn is first called with
+// the current values of the selected fields.
+func (b *LocalBackend) WatchNotifications(ctx context.Context, mask ipn.NotifyWatchOpt, fn func(n *ipn.Notify) (keepGoing bool)) {
+	w := &notifyWatcher{
+		mask: mask,
+		ch:   make(chan *ipn.Notify, notifyWatcherQueueSize),
+	}
+	b.mu.Lock()
+	if mask&ipn.NotifyInitialState != 0 {
+		// Queue the snapshot while holding mu, so no
+		// notification can slip in before it.
+		if n, ok := w.notifyFor(b.initialNotifyLocked()); ok {
+			w.ch <- &n
+		}
+	}
+	if b.notifyWatchers == nil {
+		b.notifyWatchers = make(map[*notifyWatcher]bool)
+	}
+	b.notifyWatchers[w] = true
+	b.mu.Unlock()
+
+	defer func() {
+		b.mu.Lock()
+		delete(b.notifyWatchers, w)
+		b.mu.Unlock()
+	}()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case n, ok := <-w.ch:
+			if !ok || !fn(n) {
+				return
+			}
+		}
+	}
+}
+
+// initialNotifyLocked returns a Notify describing the backend's
+// current state, for watchers that ask for ipn.NotifyInitialState.
+//
+// b.mu must be held.
+func (b *LocalBackend) initialNotifyLocked() ipn.Notify {
+	state := b.state
+	es := b.engineStatus
+	n := ipn.Notify{
+		Version: version.Long,
+		State:   &state,
+		Prefs:   b.prefs.Clone(),
+		NetMap:  b.netMap,
+		Engine:  &es,
+	}
+	if b.authURL != "" {
+		url := b.authURL
+		n.BrowseToURL = &url
+	}
+	return n
+}
+
 // popBrowserAuthNow shuts down the data plane and sends an auth URL
 // to the connected frontend, if any.
 func (b *LocalBackend) popBrowserAuthNow() {
@@ -1060,6 +1387,32 @@ func (b *LocalBackend) Ping(ipStr string) {
 	})
 }
 
+// PingWait is like Ping, but waits for and returns the result
+// instead of sending it as a notification.
+func (b *LocalBackend) PingWait(ctx context.Context, ip netaddr.IP) (*ipnstate.PingResult, error) {
+	ch := make(chan *ipnstate.PingResult, 1)
+	b.e.Ping(ip, func(pr *ipnstate.PingResult) {
+		select {
+		case ch <- pr:
+		default:
+		}
+	})
+	select {
+	case pr := <-ch:
+		return pr, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// Prefs returns a copy of b's current prefs, or nil if they
+// haven't been loaded yet.
+func (b *LocalBackend) Prefs() *ipn.Prefs {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.prefs.Clone()
+}
+
 // parseWgStatusLocked returns an EngineStatus based on s.
 //
 // b.mu must be held; mostly because the caller is about to anyway, and doing so
@@ -1295,6 +1648,13 @@ func (b *LocalBackend) authReconfig() {
 			PerDomain:   nm.DNS.PerDomain,
 			Proxied:     proxied,
 		}
+		for _, route := range nm.DNS.Routes {
+			rcfg.DNS.Routes = append(rcfg.DNS.Routes, dns.Route{
+				Suffix:      route.Suffix,
+				Nameservers: route.Nameservers,
+				Fallback:    route.Fallback,
+			})
+		}
 	}
 
 	err = b.e.Reconfig(cfg, rcfg)
@@ -1399,7 +1759,6 @@ func (b *LocalBackend) enterState(newState ipn.State) {
 	state := b.state
 	b.state = newState
 	prefs := b.prefs
-	notify := b.notify
 	bc := b.c
 	networkUp := b.prevIfState.AnyInterfaceUp()
 	activeLogin := b.activeLogin
@@ -1411,9 +1770,7 @@ func (b *LocalBackend) enterState(newState ipn.State) {
 	}
 	b.logf("Switching ipn state %v -> %v (WantRunning=%v)",
 		state, newState, prefs.WantRunning)
-	if notify != nil {
-		b.send(ipn.Notify{State: &newState})
-	}
+	b.send(ipn.Notify{State: &newState})
 
 	if bc != nil {
 		bc.SetPaused(newState == ipn.Stopped || !networkUp)
@@ -1665,6 +2022,16 @@ func (b *LocalBackend) TestOnlyPublicKeys() (machineKey tailcfg.MachineKey, node
 	return tailcfg.MachineKey(mk), tailcfg.NodeKey(nk)
 }
 
+// TestOnlySetNetMap makes nm the current network map and notifies
+// the frontend and watchers of it, as if it came from control. Used
+// in tests only.
+func (b *LocalBackend) TestOnlySetNetMap(nm *netmap.NetworkMap) {
+	b.mu.Lock()
+	b.setNetMapLocked(nm)
+	b.mu.Unlock()
+	b.send(ipn.Notify{NetMap: nm})
+}
+
 // temporarilySetMachineKeyInPersist reports whether we should set
 // the machine key in Prefs.Persist.LegacyFrontendPrivateMachineKey
 // for the frontend to write out to its preferences for use later.
@@ -5,11 +5,18 @@
 package ipnlocal
 
 import (
+	"context"
+	"reflect"
 	"testing"
+	"time"
 
 	"inet.af/netaddr"
+	"tailscale.com/ipn"
 	"tailscale.com/tailcfg"
 	"tailscale.com/types/netmap"
+	"tailscale.com/types/wgkey"
+	"tailscale.com/wgengine"
+	"tailscale.com/wgengine/tsdns"
 )
 
 func TestNetworkMapCompare(t *testing.T) {
@@ -24,6 +31,16 @@ func TestNetworkMapCompare(t *testing.T) {
 		t.Fatal(err)
 	}
 	node2 := &tailcfg.Node{Addresses: []netaddr.IPPrefix{prefix2}}
+	node12 := &tailcfg.Node{Addresses: []netaddr.IPPrefix{prefix1, prefix2}}
+	node11 := &tailcfg.Node{Addresses: []netaddr.IPPrefix{prefix1, prefix1}}
+
+	ssh := tailcfg.Service{Proto: tailcfg.TCP, Port: 22, Description: "sshd"}
+	ssh2 := tailcfg.Service{Proto: tailcfg.TCP, Port: 22, Description: "dropbear"}
+	other := tailcfg.Service{Proto: tailcfg.TCP, Port: 1234, Description: "foo"}
+	other2 := tailcfg.Service{Proto: tailcfg.TCP, Port: 1234, Description: "bar"}
+	withServices := func(svcs ...tailcfg.Service) *tailcfg.Node {
+		return &tailcfg.Node{Hostinfo: tailcfg.Hostinfo{Services: svcs}}
+	}
 
 	tests := []struct {
 		name string
@@ -110,6 +127,43 @@ func TestNetworkMapCompare(t *testing.T) {
 			&netmap.NetworkMap{Peers: []*tailcfg.Node{&tailcfg.Node{User: 1}}},
 			true,
 		},
+		{
+			"Node second addresses differ",
+			&netmap.NetworkMap{Peers: []*tailcfg.Node{node12}},
+			&netmap.NetworkMap{Peers: []*tailcfg.Node{node11}},
+			false,
+		},
+		{
+			"Node services identical",
+			&netmap.NetworkMap{Peers: []*tailcfg.Node{withServices(ssh, other)}},
+			&netmap.NetworkMap{Peers: []*tailcfg.Node{withServices(ssh, other)}},
+			true,
+		},
+		{
+			"Node services differ",
+			&netmap.NetworkMap{Peers: []*tailcfg.Node{withServices(ssh)}},
+			&netmap.NetworkMap{Peers: []*tailcfg.Node{withServices(ssh, other)}},
+			false,
+		},
+		{
+			"Node SRV service descriptions differ",
+			&netmap.NetworkMap{Peers: []*tailcfg.Node{withServices(ssh)}},
+			&netmap.NetworkMap{Peers: []*tailcfg.Node{withServices(ssh2)}},
+			false,
+		},
+		{
+			"Node other service descriptions differ",
+			// Only services with SRV records have TXT records.
+			&netmap.NetworkMap{Peers: []*tailcfg.Node{withServices(other)}},
+			&netmap.NetworkMap{Peers: []*tailcfg.Node{withServices(other2)}},
+			true,
+		},
+		{
+			"Self services differ",
+			&netmap.NetworkMap{Hostinfo: tailcfg.Hostinfo{Services: []tailcfg.Service{ssh}}},
+			&netmap.NetworkMap{},
+			false,
+		},
 	}
 	for _, tt := range tests {
 		got := dnsMapsEqual(tt.a, tt.b)
@@ -118,3 +172,212 @@ func TestNetworkMapCompare(t *testing.T) {
 		}
 	}
 }
+
+func TestDNSRecords(t *testing.T) {
+	records := make(map[string]tsdns.Records)
+	dnsRecords(records, "", []netaddr.IPPrefix{netaddr.MustParseIPPrefix("100.64.0.1/32")}, nil)
+	dnsRecords(records, "nobody.ipn.dev.", nil, nil)
+	if len(records) != 0 {
+		t.Errorf("records for nodes without name or addresses: %v", records)
+	}
+
+	dnsRecords(records, "host.ipn.dev",
+		[]netaddr.IPPrefix{
+			netaddr.MustParseIPPrefix("100.64.0.1/32"),
+			netaddr.MustParseIPPrefix("fd7a:115c:a1e0::1/128"),
+		},
+		[]tailcfg.Service{
+			{Proto: tailcfg.TCP, Port: 22, Description: "sshd"},
+			{Proto: tailcfg.TCP, Port: 22, Description: "sshd"}, // IPv6 listener
+			{Proto: tailcfg.TCP, Port: 80},
+			{Proto: tailcfg.TCP, Port: 1234, Description: "foo"},
+			{Proto: tailcfg.UDP, Port: 22},
+		})
+	want := map[string]tsdns.Records{
+		"host.ipn.dev.": {IPs: []netaddr.IP{
+			netaddr.MustParseIP("100.64.0.1"),
+			netaddr.MustParseIP("fd7a:115c:a1e0::1"),
+		}},
+		"_ssh._tcp.host.ipn.dev.": {
+			SRV: []tsdns.SRV{{Port: 22, Target: "host.ipn.dev."}},
+			TXT: []string{"description=sshd"},
+		},
+		"_http._tcp.host.ipn.dev.": {
+			SRV: []tsdns.SRV{{Port: 80, Target: "host.ipn.dev."}},
+		},
+	}
+	if !reflect.DeepEqual(records, want) {
+		t.Errorf("records = %+v; want %+v", records, want)
+	}
+}
+
+func newTestBackend(t *testing.T) *LocalBackend {
+	t.Helper()
+	e, err := wgengine.NewFakeUserspaceEngine(t.Logf, 0, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := NewLocalBackend(t.Logf, "logid", &ipn.MemoryStore{}, e)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(b.Shutdown)
+	return b
+}
+
+// startWatcher calls b.WatchNotifications in a new goroutine, sending
+// each notification to the returned channel, and waits until the
+// watcher has registered. The returned channel is closed when the
+// watch ends.
+func startWatcher(t *testing.T, ctx context.Context, b *LocalBackend, mask ipn.NotifyWatchOpt, fn func(*ipn.Notify) bool) <-chan *ipn.Notify {
+	t.Helper()
+	b.mu.Lock()
+	before := len(b.notifyWatchers)
+	b.mu.Unlock()
+
+	got := make(chan *ipn.Notify, 100)
+	go func() {
+		defer close(got)
+		b.WatchNotifications(ctx, mask, func(n *ipn.Notify) bool {
+			got <- n
+			if fn != nil {
+				return fn(n)
+			}
+			return true
+		})
+	}()
+	for {
+		b.mu.Lock()
+		n := len(b.notifyWatchers)
+		b.mu.Unlock()
+		if n > before {
+			return got
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func recvNotify(t *testing.T, ch <-chan *ipn.Notify) *ipn.Notify {
+	t.Helper()
+	select {
+	case n, ok := <-ch:
+		if !ok {
+			t.Fatal("watch ended unexpectedly")
+		}
+		return n
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout waiting for notification")
+	}
+	return nil
+}
+
+func TestWatchNotifications(t *testing.T) {
+	b := newTestBackend(t)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	got := startWatcher(t, ctx, b, 0, nil)
+
+	st := ipn.Running
+	b.send(ipn.Notify{State: &st})
+	n := recvNotify(t, got)
+	if n.State == nil || *n.State != ipn.Running {
+		t.Errorf("got State %v; want Running", n.State)
+	}
+	if n.Version == "" {
+		t.Error("Version not set")
+	}
+
+	cancel()
+	for range got {
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if len(b.notifyWatchers) != 0 {
+		t.Errorf("watcher not unregistered after cancel")
+	}
+}
+
+func TestWatchNotificationsMask(t *testing.T) {
+	b := newTestBackend(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	got := startWatcher(t, ctx, b, ipn.NotifyWatchState|ipn.NotifyInitialState, nil)
+	n := recvNotify(t, got)
+	if n.State == nil || *n.State != ipn.NoState {
+		t.Errorf("initial State = %v; want NoState", n.State)
+	}
+	if n.Engine != nil {
+		t.Errorf("initial state includes unrequested Engine")
+	}
+
+	url := "https://example.com/login"
+	b.send(ipn.Notify{BrowseToURL: &url}) // not selected
+	st := ipn.Starting
+	b.send(ipn.Notify{State: &st, BrowseToURL: &url})
+	n = recvNotify(t, got)
+	if n.State == nil || *n.State != ipn.Starting {
+		t.Errorf("got State %v; want Starting", n.State)
+	}
+	if n.BrowseToURL != nil {
+		t.Errorf("got unrequested BrowseToURL")
+	}
+}
+
+func TestWatchNotificationsSlowWatcher(t *testing.T) {
+	b := newTestBackend(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	unblock := make(chan struct{})
+	got := startWatcher(t, ctx, b, 0, func(*ipn.Notify) bool {
+		<-unblock
+		return true
+	})
+
+	// The watcher is stuck in its first callback; flood it. None
+	// of these sends may block.
+	st := ipn.Running
+	for i := 0; i < notifyWatcherQueueSize*2; i++ {
+		b.send(ipn.Notify{State: &st})
+	}
+	b.mu.Lock()
+	n := len(b.notifyWatchers)
+	b.mu.Unlock()
+	if n != 0 {
+		t.Errorf("slow watcher still registered")
+	}
+	close(unblock)
+	for range got {
+		// Drain until the watch ends.
+	}
+}
+
+func TestWatchNotificationsNoPrivateKey(t *testing.T) {
+	b := newTestBackend(t)
+	priv, err := wgkey.NewPrivate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	nm := &netmap.NetworkMap{PrivateKey: priv}
+	b.TestOnlySetNetMap(nm)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	got := startWatcher(t, ctx, b, ipn.NotifyWatchNetMap|ipn.NotifyInitialState, nil)
+
+	// Both the initial snapshot and later notifications are stripped.
+	n := recvNotify(t, got)
+	if n.NetMap == nil || !n.NetMap.PrivateKey.IsZero() {
+		t.Errorf("initial NetMap = %+v; want one without its private key", n.NetMap)
+	}
+	b.send(ipn.Notify{NetMap: nm})
+	n = recvNotify(t, got)
+	if n.NetMap == nil || !n.NetMap.PrivateKey.IsZero() {
+		t.Errorf("sent NetMap = %+v; want one without its private key", n.NetMap)
+	}
+	if nm.PrivateKey != priv {
+		t.Errorf("backend's NetMap was modified")
+	}
+}
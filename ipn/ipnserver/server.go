@@ -42,6 +42,7 @@ import (
 	"tailscale.com/util/systemd"
 	"tailscale.com/version"
 	"tailscale.com/wgengine"
+	"tailscale.com/wgengine/filter"
 )
 
 // Options is the configuration of the Tailscale node agent.
@@ -91,6 +92,16 @@ type Options struct {
 	// DebugMux, if non-nil, specifies an HTTP ServeMux in which
 	// to register a debug handler.
 	DebugMux *http.ServeMux
+
+	// Conntrack configures the packet filter's connection
+	// tracking. Zero fields mean the default values.
+	Conntrack filter.ConntrackConfig
+
+	// AllowCapture is whether root (or, on Windows, an elevated
+	// administrator) may capture packets with the LocalAPI.
+	// Captures expose the decrypted traffic of every local user,
+	// so it's off by default.
+	AllowCapture bool
 }
 
 // server is an IPN backend and its set of 0 or more active connections
@@ -104,6 +115,8 @@ type server struct {
 	// connection (such as on Windows by default).  Even if this
 	// is true, the ForceDaemon pref can override this.
 	resetOnZero bool
+	// allowCapture is Options.AllowCapture.
+	allowCapture bool
 
 	bsMu sync.Mutex // lock order: bsMu, then mu
 	bs   *ipn.BackendServer
@@ -276,7 +289,7 @@ func (s *server) serveConn(ctx context.Context, c net.Conn, logf logger.Logf) {
 			// favicon.ico and such.
 			IdleTimeout: 5 * time.Second,
 			ErrorLog:    logger.StdLogger(logf),
-			Handler:     s.localhostHandler(ci),
+			Handler:     s.localhostHandler(ci, ci.IsUnixSock && !isReadonlyConn(c, logf), s.allowCapture && isRootConn(c, ci, logf)),
 		}
 		httpServer.Serve(&oneConnListener{&protoSwitchConn{s: s, br: br, Conn: c}})
 		return
@@ -365,6 +378,30 @@ func isReadonlyConn(c net.Conn, logf logger.Logf) bool {
 	return ro
 }
 
+// isRootConn reports whether c, with identity ci, is from root or,
+// on Windows, from an elevated administrator process. Unlike
+// isReadonlyConn, it doesn't consider admin group members to be
+// root.
+func isRootConn(c net.Conn, ci connIdentity, logf logger.Logf) bool {
+	if runtime.GOOS == "windows" {
+		if ci.Pid == 0 {
+			return false
+		}
+		elevated, err := pidowner.IsElevatedPID(ci.Pid)
+		if err != nil {
+			logf("checking elevation of pid %d: %v", ci.Pid, err)
+			return false
+		}
+		return elevated
+	}
+	creds, err := peercred.Get(c)
+	if err != nil {
+		return false
+	}
+	uid, ok := creds.UserID()
+	return ok && uid == "0"
+}
+
 var darwinAdminGroupIDCache atomic.Value // of string
 
 func darwinAdminGroupID() string {
@@ -573,8 +610,9 @@ func Run(ctx context.Context, logf logger.Logf, logid string, getEngine func() (
 	}
 
 	server := &server{
-		logf:        logf,
-		resetOnZero: !opts.SurviveDisconnects,
+		logf:         logf,
+		resetOnZero:  !opts.SurviveDisconnects,
+		allowCapture: opts.AllowCapture,
 	}
 
 	// When the context is closed or when we return, whichever is first, close our listner
@@ -701,12 +739,13 @@ func Run(ctx context.Context, logf logger.Logf, logid string, getEngine func() (
 	b.SetDecompressor(func() (controlclient.Decompressor, error) {
 		return smallzstd.NewDecoder(nil)
 	})
+	b.SetConntrackConfig(opts.Conntrack)
 
 	if opts.DebugMux != nil {
 		opts.DebugMux.HandleFunc("/debug/ipn", func(w http.ResponseWriter, r *http.Request) {
 			serveHTMLStatus(w, b)
 		})
-		h := localapi.NewHandler(b)
+		h := localapi.NewHandler(b, logf)
 		h.PermitRead = true
 		opts.DebugMux.Handle("/localapi/", h)
 	}
@@ -947,12 +986,17 @@ func (psc *protoSwitchConn) Close() error {
 	return nil
 }
 
-func (s *server) localhostHandler(ci connIdentity) http.Handler {
+// localhostHandler returns the handler for an HTTP connection from
+// ci. The LocalAPI's mutating endpoints are only allowed if
+// permitWrite, which requires the same privileges as a read-write
+// connection using the IPN protocol.
+func (s *server) localhostHandler(ci connIdentity, permitWrite, permitCapture bool) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		if ci.IsUnixSock && strings.HasPrefix(r.URL.Path, "/localapi/") {
-			h := localapi.NewHandler(s.b)
+			h := localapi.NewHandler(s.b, s.logf)
 			h.PermitRead = true
-			h.PermitWrite = false // TODO: flesh out connIdentity on more platforms then set this
+			h.PermitWrite = permitWrite
+			h.PermitCapture = permitCapture
 			h.ServeHTTP(w, r)
 			return
 		}
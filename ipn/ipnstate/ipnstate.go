@@ -70,6 +70,11 @@ type PeerStatus struct {
 	CurAddr string // one of Addrs, or unique if roaming
 	Relay   string // DERP region
 
+	// DERPLatency is the round trip time in seconds to the DERP
+	// server of each region (by region code) this node is connected
+	// to, as last measured with a DERP ping. It's only set for Self.
+	DERPLatency map[string]float64 `json:",omitempty"`
+
 	RxBytes       int64
 	TxBytes       int64
 	Created       time.Time // time registered with tailcontrol
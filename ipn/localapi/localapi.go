@@ -3,20 +3,97 @@
 // license that can be found in the LICENSE file.
 
 // Package localapi contains the HTTP server handlers for tailscaled's API server.
+//
+// The API is served under /localapi/v0/. Read-only endpoints require
+// Handler.PermitRead; endpoints that change state require
+// Handler.PermitWrite and a POST (or PATCH) request. Responses are
+// JSON unless otherwise noted.
+//
+//	GET   /localapi/v0/whois?ip=IP        tailcfg.WhoIsResponse for a peer's IP
+//	GET   /localapi/v0/status             ipnstate.Status; ?peers=false omits peers
+//	GET   /localapi/v0/prefs              ipn.Prefs, without Persist
+//	PATCH /localapi/v0/prefs              merges the JSON body's top-level
+//	                                      fields into the current ipn.Prefs
+//	                                      and returns the result
+//	POST  /localapi/v0/start              starts the backend with the
+//	                                      ipn.Options in the JSON body
+//	POST  /localapi/v0/login-interactive  starts an interactive login; the
+//	                                      URL to visit is sent on the IPN bus
+//	POST  /localapi/v0/logout             logs out the current node
+//	POST  /localapi/v0/ping?ip=IP         disco ping; returns ipnstate.PingResult
+//	GET   /localapi/v0/netcheck           runs a netcheck.Report from tailscaled
+//	GET   /localapi/v0/watch-ipn-bus      stream of newline-delimited ipn.Notify
+//	                                      values, until the client hangs up;
+//	                                      ?mask=N selects fields and options
+//	                                      with ipn.NotifyWatchOpt bits
+//	GET   /localapi/v0/filter-trace       recent packet filter decisions, as
+//	                                      []filter.TraceEvent; optional
+//	                                      ?peer=IP, ?port=N, ?drops=true and
+//	                                      ?since=SEQ narrow the results
+//	GET   /localapi/v0/packet-filter      the current netmap's packet filter,
+//	                                      as []filter.Match
+//	POST  /localapi/v0/dns-cache-flush    empties the DNS resolver's cache
+//	                                      of upstream responses
+//	GET   /localapi/v0/dns-query-log      queries recorded by the DNS resolver,
+//	                                      as []tsdns.QueryLogEntry; optional
+//	                                      ?since=SEQ narrows the results;
+//	                                      needs write access
+//	POST  /localapi/v0/dns-query-log?size=N
+//	                                      makes the DNS resolver record its
+//	                                      N most recent queries; 0 disables
+//	                                      the query log, as by default
+//	POST  /localapi/v0/dns-query          answers the DNS query in the body
+//	                                      (application/dns-message) with the
+//	                                      DNS resolver, like DNS over TCP
+//	POST  /localapi/v0/debug-capture      streams the packets passing through
+//	                                      the TUN device as pcapng
+//	                                      (application/x-pcapng), until the
+//	                                      client hangs up; optional
+//	                                      ?filter=EXPR selects packets, as
+//	                                      documented by capture.ParseFilter;
+//	                                      needs PermitCapture
+//
+// A watch-ipn-bus stream that can't keep up with the backend is
+// ended by the server; clients should reconnect with
+// ipn.NotifyInitialState set to resynchronize.
 package localapi
 
 import (
+	"context"
 	"encoding/json"
 	"io"
+	"io/ioutil"
 	"net/http"
+	"strconv"
+	"time"
 
 	"inet.af/netaddr"
+	"tailscale.com/ipn"
 	"tailscale.com/ipn/ipnlocal"
+	"tailscale.com/net/netcheck"
 	"tailscale.com/tailcfg"
+	"tailscale.com/types/logger"
+	"tailscale.com/wgengine/capture"
+	"tailscale.com/wgengine/filter"
+	"tailscale.com/wgengine/tsdns"
 )
 
-func NewHandler(b *ipnlocal.LocalBackend) *Handler {
-	return &Handler{b: b}
+// pingTimeout is the maximum time the ping endpoint waits for a
+// result.
+const pingTimeout = 10 * time.Second
+
+// maxBodyBytes is the maximum size of a request body we'll read.
+const maxBodyBytes = 1 << 20
+
+// maxDNSQueryLogSize is the maximum number of queries the DNS
+// resolver can be asked to record.
+const maxDNSQueryLogSize = 10000
+
+// dnsMessageType is the media type of DNS messages (RFC 8484).
+const dnsMessageType = "application/dns-message"
+
+func NewHandler(b *ipnlocal.LocalBackend, logf logger.Logf) *Handler {
+	return &Handler{b: b, logf: logf}
 }
 
 type Handler struct {
@@ -31,7 +108,14 @@ type Handler struct {
 	// PermitWrite is whether mutating HTTP handlers are allowed.
 	PermitWrite bool
 
-	b *ipnlocal.LocalBackend
+	// PermitCapture is whether packet captures are allowed. They
+	// expose the decrypted traffic of every local user, so they're
+	// for root only, and only when tailscaled was started with
+	// captures enabled. It requires PermitWrite too.
+	PermitCapture bool
+
+	b    *ipnlocal.LocalBackend
+	logf logger.Logf
 }
 
 func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
@@ -53,14 +137,87 @@ func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	switch r.URL.Path {
 	case "/localapi/v0/whois":
 		h.serveWhoIs(w, r)
+	case "/localapi/v0/status":
+		h.serveStatus(w, r)
+	case "/localapi/v0/prefs":
+		h.servePrefs(w, r)
+	case "/localapi/v0/start":
+		h.serveStart(w, r)
+	case "/localapi/v0/login-interactive":
+		h.serveLoginInteractive(w, r)
+	case "/localapi/v0/logout":
+		h.serveLogout(w, r)
+	case "/localapi/v0/ping":
+		h.servePing(w, r)
+	case "/localapi/v0/netcheck":
+		h.serveNetcheck(w, r)
+	case "/localapi/v0/watch-ipn-bus":
+		h.serveWatchIPNBus(w, r)
+	case "/localapi/v0/filter-trace":
+		h.serveFilterTrace(w, r)
+	case "/localapi/v0/packet-filter":
+		h.servePacketFilter(w, r)
+	case "/localapi/v0/dns-cache-flush":
+		h.serveDNSCacheFlush(w, r)
+	case "/localapi/v0/dns-query-log":
+		h.serveDNSQueryLog(w, r)
+	case "/localapi/v0/dns-query":
+		h.serveDNSQuery(w, r)
+	case "/localapi/v0/debug-capture":
+		h.serveDebugCapture(w, r)
 	default:
 		io.WriteString(w, "tailscaled\n")
 	}
 }
 
-func (h *Handler) serveWhoIs(w http.ResponseWriter, r *http.Request) {
+// checkRead reports whether the request may use a read-only
+// endpoint, writing an error response if not.
+func (h *Handler) checkRead(w http.ResponseWriter, what string) bool {
 	if !h.PermitRead {
-		http.Error(w, "whois access denied", http.StatusForbidden)
+		http.Error(w, what+" access denied", http.StatusForbidden)
+		return false
+	}
+	return true
+}
+
+// checkWrite reports whether the request may use a mutating endpoint
+// with one of the given methods, writing an error response if not.
+func (h *Handler) checkWrite(w http.ResponseWriter, r *http.Request, what string, methods ...string) bool {
+	if !h.PermitWrite {
+		http.Error(w, what+" access denied", http.StatusForbidden)
+		return false
+	}
+	for _, m := range methods {
+		if r.Method == m {
+			return true
+		}
+	}
+	http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	return false
+}
+
+// backendStarted reports whether the backend has been started,
+// writing an error response if not.
+func (h *Handler) backendStarted(w http.ResponseWriter) bool {
+	if h.b.State() == ipn.NoState {
+		http.Error(w, "backend not started", http.StatusConflict)
+		return false
+	}
+	return true
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	j, err := json.MarshalIndent(v, "", "\t")
+	if err != nil {
+		http.Error(w, "JSON encoding error", 500)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(j)
+}
+
+func (h *Handler) serveWhoIs(w http.ResponseWriter, r *http.Request) {
+	if !h.checkRead(w, "whois") {
 		return
 	}
 	b := h.b
@@ -85,11 +242,343 @@ func (h *Handler) serveWhoIs(w http.ResponseWriter, r *http.Request) {
 		Node:        n,
 		UserProfile: &u,
 	}
-	j, err := json.MarshalIndent(res, "", "\t")
+	writeJSON(w, res)
+}
+
+func (h *Handler) serveStatus(w http.ResponseWriter, r *http.Request) {
+	if !h.checkRead(w, "status") {
+		return
+	}
+	st := h.b.Status()
+	if v := r.FormValue("peers"); v != "" {
+		if peers, _ := strconv.ParseBool(v); !peers {
+			st.Peer = nil
+		}
+	}
+	writeJSON(w, st)
+}
+
+func (h *Handler) servePrefs(w http.ResponseWriter, r *http.Request) {
+	if r.Method == "GET" {
+		if !h.checkRead(w, "prefs") {
+			return
+		}
+		p := h.b.Prefs()
+		if p == nil {
+			http.Error(w, "no prefs loaded", http.StatusConflict)
+			return
+		}
+		p.Persist = nil // contains private keys
+		writeJSON(w, p)
+		return
+	}
+	if !h.checkWrite(w, r, "prefs", "PATCH") {
+		return
+	}
+	p := h.b.Prefs()
+	if p == nil {
+		http.Error(w, "no prefs loaded", http.StatusConflict)
+		return
+	}
+	// Only the fields present in the body are overwritten.
+	if err := json.NewDecoder(io.LimitReader(r.Body, maxBodyBytes)).Decode(p); err != nil {
+		http.Error(w, "invalid prefs JSON: "+err.Error(), 400)
+		return
+	}
+	h.b.SetPrefs(p) // ignores Persist from the request
+	p = h.b.Prefs()
+	p.Persist = nil
+	writeJSON(w, p)
+}
+
+func (h *Handler) serveStart(w http.ResponseWriter, r *http.Request) {
+	if !h.checkWrite(w, r, "start", "POST") {
+		return
+	}
+	var opts ipn.Options
+	body, err := ioutil.ReadAll(io.LimitReader(r.Body, maxBodyBytes))
 	if err != nil {
-		http.Error(w, "JSON encoding error", 500)
+		http.Error(w, err.Error(), 400)
+		return
+	}
+	if err := json.Unmarshal(body, &opts); err != nil {
+		http.Error(w, "invalid options JSON: "+err.Error(), 400)
+		return
+	}
+	if err := h.b.Start(opts); err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (h *Handler) serveLoginInteractive(w http.ResponseWriter, r *http.Request) {
+	if !h.checkWrite(w, r, "login", "POST") || !h.backendStarted(w) {
+		return
+	}
+	h.b.StartLoginInteractive()
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (h *Handler) serveLogout(w http.ResponseWriter, r *http.Request) {
+	if !h.checkWrite(w, r, "logout", "POST") {
+		return
+	}
+	h.b.Logout()
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (h *Handler) servePing(w http.ResponseWriter, r *http.Request) {
+	if !h.checkWrite(w, r, "ping", "POST") {
+		return
+	}
+	ip, err := netaddr.ParseIP(r.FormValue("ip"))
+	if err != nil {
+		http.Error(w, "invalid or missing 'ip' parameter", 400)
+		return
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), pingTimeout)
+	defer cancel()
+	res, err := h.b.PingWait(ctx, ip)
+	if err != nil {
+		http.Error(w, "no ping reply: "+err.Error(), http.StatusGatewayTimeout)
+		return
+	}
+	writeJSON(w, res)
+}
+
+func (h *Handler) serveNetcheck(w http.ResponseWriter, r *http.Request) {
+	if !h.checkRead(w, "netcheck") {
+		return
+	}
+	nm := h.b.NetMap()
+	if nm == nil || nm.DERPMap == nil {
+		http.Error(w, "no DERP map available", http.StatusServiceUnavailable)
+		return
+	}
+	c := &netcheck.Client{
+		Logf: logger.WithPrefix(h.logf, "localapi: netcheck: "),
+	}
+	report, err := c.GetReport(r.Context(), nm.DERPMap)
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	writeJSON(w, report)
+}
+
+func (h *Handler) serveWatchIPNBus(w http.ResponseWriter, r *http.Request) {
+	if !h.checkRead(w, "watch-ipn-bus") {
+		return
+	}
+	var mask ipn.NotifyWatchOpt
+	if v := r.FormValue("mask"); v != "" {
+		m, err := strconv.ParseUint(v, 10, 64)
+		if err != nil {
+			http.Error(w, "invalid 'mask' parameter", 400)
+			return
+		}
+		mask = ipn.NotifyWatchOpt(m)
+	}
+	f, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "not a flusher", http.StatusInternalServerError)
 		return
 	}
 	w.Header().Set("Content-Type", "application/json")
-	w.Write(j)
+	w.WriteHeader(http.StatusOK)
+	f.Flush()
+
+	enc := json.NewEncoder(w)
+	h.b.WatchNotifications(r.Context(), mask, func(n *ipn.Notify) bool {
+		// The backend has already removed private keys.
+		// Read-only callers include other local users and
+		// the debug server; they don't get the netmap at all.
+		if !h.PermitWrite {
+			n.NetMap = nil
+		}
+		if err := enc.Encode(n); err != nil {
+			return false
+		}
+		f.Flush()
+		return true
+	})
+}
+
+func (h *Handler) serveFilterTrace(w http.ResponseWriter, r *http.Request) {
+	if !h.checkRead(w, "filter-trace") {
+		return
+	}
+	var tf filter.TraceFilter
+	if v := r.FormValue("peer"); v != "" {
+		ip, err := netaddr.ParseIP(v)
+		if err != nil {
+			http.Error(w, "invalid 'peer' parameter", 400)
+			return
+		}
+		tf.Peer = ip
+	}
+	if v := r.FormValue("port"); v != "" {
+		port, err := strconv.ParseUint(v, 10, 16)
+		if err != nil {
+			http.Error(w, "invalid 'port' parameter", 400)
+			return
+		}
+		tf.Port = uint16(port)
+	}
+	if v := r.FormValue("drops"); v != "" {
+		drops, err := strconv.ParseBool(v)
+		if err != nil {
+			http.Error(w, "invalid 'drops' parameter", 400)
+			return
+		}
+		tf.DropsOnly = drops
+	}
+	if v := r.FormValue("since"); v != "" {
+		since, err := strconv.ParseUint(v, 10, 64)
+		if err != nil {
+			http.Error(w, "invalid 'since' parameter", 400)
+			return
+		}
+		tf.Since = since
+	}
+	evs := h.b.FilterTrace(tf)
+	if evs == nil {
+		evs = []filter.TraceEvent{} // JSON [], not null
+	}
+	writeJSON(w, evs)
+}
+
+func (h *Handler) servePacketFilter(w http.ResponseWriter, r *http.Request) {
+	if !h.checkRead(w, "packet-filter") {
+		return
+	}
+	nm := h.b.NetMap()
+	if nm == nil {
+		http.Error(w, "no netmap", http.StatusServiceUnavailable)
+		return
+	}
+	pf := nm.PacketFilter
+	if pf == nil {
+		pf = []filter.Match{} // JSON [], not null
+	}
+	writeJSON(w, pf)
+}
+
+func (h *Handler) serveDNSCacheFlush(w http.ResponseWriter, r *http.Request) {
+	if !h.checkWrite(w, r, "dns-cache-flush", "POST") {
+		return
+	}
+	if err := h.b.FlushDNSCache(); err != nil {
+		http.Error(w, err.Error(), http.StatusNotImplemented)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (h *Handler) serveDNSQueryLog(w http.ResponseWriter, r *http.Request) {
+	// The query log reveals the names every local user looked up,
+	// so reading it requires write access too, as for captures.
+	if !h.checkWrite(w, r, "dns-query-log", "GET", "POST") {
+		return
+	}
+	if r.Method == "POST" {
+		size, err := strconv.Atoi(r.FormValue("size"))
+		if err != nil || size < 0 || size > maxDNSQueryLogSize {
+			http.Error(w, "invalid 'size' parameter", 400)
+			return
+		}
+		if err := h.b.SetDNSQueryLogSize(size); err != nil {
+			http.Error(w, err.Error(), http.StatusNotImplemented)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	var since uint64
+	if v := r.FormValue("since"); v != "" {
+		var err error
+		since, err = strconv.ParseUint(v, 10, 64)
+		if err != nil {
+			http.Error(w, "invalid 'since' parameter", 400)
+			return
+		}
+	}
+	ents, err := h.b.DNSQueryLog(since)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotImplemented)
+		return
+	}
+	if ents == nil {
+		ents = []tsdns.QueryLogEntry{} // JSON [], not null
+	}
+	writeJSON(w, ents)
+}
+
+func (h *Handler) serveDNSQuery(w http.ResponseWriter, r *http.Request) {
+	if !h.checkRead(w, "dns-query") {
+		return
+	}
+	if r.Method != "POST" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	query, err := ioutil.ReadAll(io.LimitReader(r.Body, 0xffff))
+	if err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+	if len(query) < 12 {
+		http.Error(w, "body is not a DNS query", 400)
+		return
+	}
+	out, err := h.b.DNSQuery(query)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	w.Header().Set("Content-Type", dnsMessageType)
+	w.Write(out)
+}
+
+func (h *Handler) serveDebugCapture(w http.ResponseWriter, r *http.Request) {
+	if !h.checkWrite(w, r, "debug-capture", "POST") {
+		return
+	}
+	if !h.PermitCapture {
+		http.Error(w, "debug-capture access denied; it needs tailscaled --debug-capture and root", http.StatusForbidden)
+		return
+	}
+	f, err := capture.ParseFilter(r.FormValue("filter"))
+	if err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+	if _, ok := w.(http.Flusher); !ok {
+		http.Error(w, "not a flusher", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/x-pcapng")
+	cw := &captureWriter{ResponseWriter: w}
+	if err := h.b.StreamCapture(r.Context(), cw, f); err != nil && !cw.wrote {
+		w.Header().Del("Content-Type")
+		http.Error(w, err.Error(), http.StatusConflict)
+	}
+}
+
+// captureWriter is an http.ResponseWriter and http.Flusher that
+// records whether the response has started, after which errors can
+// no longer be reported with a status code.
+type captureWriter struct {
+	http.ResponseWriter
+	wrote bool
+}
+
+func (cw *captureWriter) Write(p []byte) (int, error) {
+	cw.wrote = true
+	return cw.ResponseWriter.Write(p)
+}
+
+func (cw *captureWriter) Flush() {
+	cw.ResponseWriter.(http.Flusher).Flush()
 }
@@ -0,0 +1,200 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package localapi
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+
+	"tailscale.com/ipn"
+	"tailscale.com/ipn/ipnlocal"
+	"tailscale.com/ipn/ipnstate"
+	"tailscale.com/types/netmap"
+	"tailscale.com/types/wgkey"
+	"tailscale.com/wgengine"
+)
+
+func newTestBackend(t *testing.T) *ipnlocal.LocalBackend {
+	t.Helper()
+	e, err := wgengine.NewFakeUserspaceEngine(t.Logf, 0, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := ipnlocal.NewLocalBackend(t.Logf, "logid", &ipn.MemoryStore{}, e)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(b.Shutdown)
+	return b
+}
+
+func TestPermissions(t *testing.T) {
+	b := newTestBackend(t)
+	tests := []struct {
+		name        string
+		method      string
+		path        string
+		read, write bool
+		wantCode    int
+	}{
+		{"status-denied", "GET", "/localapi/v0/status", false, false, http.StatusForbidden},
+		{"status-ok", "GET", "/localapi/v0/status", true, false, http.StatusOK},
+		{"prefs-read-not-started", "GET", "/localapi/v0/prefs", true, false, http.StatusConflict},
+		{"prefs-patch-readonly", "PATCH", "/localapi/v0/prefs", true, false, http.StatusForbidden},
+		{"logout-readonly", "POST", "/localapi/v0/logout", true, false, http.StatusForbidden},
+		{"logout-wrong-method", "GET", "/localapi/v0/logout", true, true, http.StatusMethodNotAllowed},
+		{"login-not-started", "POST", "/localapi/v0/login-interactive", true, true, http.StatusConflict},
+		{"ping-bad-ip", "POST", "/localapi/v0/ping?ip=foo", true, true, http.StatusBadRequest},
+		{"netcheck-no-derpmap", "GET", "/localapi/v0/netcheck", true, false, http.StatusServiceUnavailable},
+		{"watch-denied", "GET", "/localapi/v0/watch-ipn-bus", false, false, http.StatusForbidden},
+		{"filter-trace-denied", "GET", "/localapi/v0/filter-trace", false, false, http.StatusForbidden},
+		{"filter-trace-ok", "GET", "/localapi/v0/filter-trace?peer=100.64.0.1&port=22&drops=1", true, false, http.StatusOK},
+		{"filter-trace-bad-port", "GET", "/localapi/v0/filter-trace?port=70000", true, false, http.StatusBadRequest},
+		{"packet-filter-no-netmap", "GET", "/localapi/v0/packet-filter", true, false, http.StatusServiceUnavailable},
+		{"watch-bad-mask", "GET", "/localapi/v0/watch-ipn-bus?mask=x", true, false, http.StatusBadRequest},
+		{"dns-cache-flush-readonly", "POST", "/localapi/v0/dns-cache-flush", true, false, http.StatusForbidden},
+		{"dns-cache-flush-wrong-method", "GET", "/localapi/v0/dns-cache-flush", true, true, http.StatusMethodNotAllowed},
+		{"dns-cache-flush-ok", "POST", "/localapi/v0/dns-cache-flush", true, true, http.StatusNoContent},
+		{"dns-query-log-denied", "GET", "/localapi/v0/dns-query-log", false, false, http.StatusForbidden},
+		{"dns-query-log-readonly", "GET", "/localapi/v0/dns-query-log?since=3", true, false, http.StatusForbidden},
+		{"dns-query-log-ok", "GET", "/localapi/v0/dns-query-log?since=3", true, true, http.StatusOK},
+		{"dns-query-log-bad-since", "GET", "/localapi/v0/dns-query-log?since=x", true, true, http.StatusBadRequest},
+		{"dns-query-log-wrong-method", "PUT", "/localapi/v0/dns-query-log", true, true, http.StatusMethodNotAllowed},
+		{"dns-query-log-size-readonly", "POST", "/localapi/v0/dns-query-log?size=100", true, false, http.StatusForbidden},
+		{"dns-query-log-size-too-big", "POST", "/localapi/v0/dns-query-log?size=1000000", true, true, http.StatusBadRequest},
+		{"dns-query-log-size-ok", "POST", "/localapi/v0/dns-query-log?size=100", true, true, http.StatusNoContent},
+		{"dns-query-denied", "POST", "/localapi/v0/dns-query", false, false, http.StatusForbidden},
+		{"dns-query-wrong-method", "GET", "/localapi/v0/dns-query", true, false, http.StatusMethodNotAllowed},
+		{"dns-query-empty", "POST", "/localapi/v0/dns-query", true, false, http.StatusBadRequest},
+		{"debug-capture-readonly", "POST", "/localapi/v0/debug-capture", true, false, http.StatusForbidden},
+		{"debug-capture-wrong-method", "GET", "/localapi/v0/debug-capture", true, true, http.StatusMethodNotAllowed},
+		{"debug-capture-not-permitted", "POST", "/localapi/v0/debug-capture", true, true, http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := NewHandler(b, t.Logf)
+			h.PermitRead = tt.read
+			h.PermitWrite = tt.write
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, httptest.NewRequest(tt.method, tt.path, nil))
+			if rec.Code != tt.wantCode {
+				t.Errorf("code = %d; want %d; body: %s", rec.Code, tt.wantCode, rec.Body.Bytes())
+			}
+		})
+	}
+}
+
+func TestDebugCapturePermission(t *testing.T) {
+	b := newTestBackend(t)
+	h := NewHandler(b, t.Logf)
+	h.PermitRead = true
+	h.PermitCapture = true
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("POST", "/localapi/v0/debug-capture", nil))
+	if rec.Code != http.StatusForbidden {
+		t.Errorf("without write access: code = %d; want %d", rec.Code, http.StatusForbidden)
+	}
+
+	h.PermitWrite = true
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("POST", "/localapi/v0/debug-capture?filter=net+10.0.0.0/8", nil))
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("bad filter: code = %d; want %d; body: %s", rec.Code, http.StatusBadRequest, rec.Body.Bytes())
+	}
+}
+
+func TestStatus(t *testing.T) {
+	b := newTestBackend(t)
+	h := NewHandler(b, t.Logf)
+	h.PermitRead = true
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("GET", "/localapi/v0/status?peers=false", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("code = %d; body: %s", rec.Code, rec.Body.Bytes())
+	}
+	var st ipnstate.Status
+	if err := json.Unmarshal(rec.Body.Bytes(), &st); err != nil {
+		t.Fatal(err)
+	}
+	if st.BackendState != ipn.NoState.String() {
+		t.Errorf("BackendState = %q; want %q", st.BackendState, ipn.NoState)
+	}
+}
+
+func TestWatchIPNBusInitialState(t *testing.T) {
+	b := newTestBackend(t)
+	h := NewHandler(b, t.Logf)
+	h.PermitRead = true
+	ts := httptest.NewServer(h)
+	defer ts.Close()
+
+	mask := ipn.NotifyWatchState | ipn.NotifyInitialState
+	res, err := http.Get(ts.URL + "/localapi/v0/watch-ipn-bus?mask=" + strconv.FormatUint(uint64(mask), 10))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("status = %v", res.Status)
+	}
+	var n ipn.Notify
+	if err := json.NewDecoder(res.Body).Decode(&n); err != nil {
+		t.Fatal(err)
+	}
+	if n.State == nil || *n.State != ipn.NoState {
+		t.Errorf("initial State = %v; want NoState", n.State)
+	}
+	if n.Engine != nil || n.NetMap != nil {
+		t.Errorf("got unrequested fields in %+v", n)
+	}
+}
+
+func TestWatchIPNBusNoPrivateKey(t *testing.T) {
+	b := newTestBackend(t)
+	priv, err := wgkey.NewPrivate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	b.TestOnlySetNetMap(&netmap.NetworkMap{PrivateKey: priv, Name: "foo.ipn.dev."})
+
+	for _, write := range []bool{false, true} {
+		h := NewHandler(b, t.Logf)
+		h.PermitRead = true
+		h.PermitWrite = write
+		ts := httptest.NewServer(h)
+
+		mask := ipn.NotifyWatchState | ipn.NotifyWatchNetMap | ipn.NotifyInitialState
+		res, err := http.Get(ts.URL + "/localapi/v0/watch-ipn-bus?mask=" + strconv.FormatUint(uint64(mask), 10))
+		if err != nil {
+			t.Fatal(err)
+		}
+		line, err := bufio.NewReader(res.Body).ReadBytes('\n')
+		res.Body.Close()
+		ts.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var n ipn.Notify
+		if err := json.Unmarshal(line, &n); err != nil {
+			t.Fatal(err)
+		}
+		if bytes.Contains(line, []byte(hex.EncodeToString(priv[:]))) {
+			t.Errorf("write=%v: stream contains the private key: %s", write, line)
+		}
+		if write {
+			if n.NetMap == nil || n.NetMap.Name != "foo.ipn.dev." {
+				t.Errorf("write=%v: NetMap = %+v; want one without its private key", write, n.NetMap)
+			}
+		} else if bytes.Contains(line, []byte("privkey:")) {
+			t.Errorf("write=%v: stream contains a private key: %s", write, line)
+		}
+	}
+}
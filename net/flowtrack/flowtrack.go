@@ -86,6 +86,21 @@ func (c *Cache) Remove(key Tuple) {
 	}
 }
 
+// Oldest returns the least recently used key and value in the cache,
+// without updating its recentness. It reports false if the cache is
+// empty.
+func (c *Cache) Oldest() (key Tuple, value interface{}, ok bool) {
+	if c.ll == nil {
+		return Tuple{}, nil, false
+	}
+	ele := c.ll.Back()
+	if ele == nil {
+		return Tuple{}, nil, false
+	}
+	e := ele.Value.(*entry)
+	return e.key, e.value, true
+}
+
 // RemoveOldest removes the oldest item from the cache, if any.
 func (c *Cache) RemoveOldest() {
 	if c.ll != nil {
@@ -42,6 +42,9 @@ func TestCache(t *testing.T) {
 	}
 
 	wantLen(0)
+	if _, _, ok := c.Oldest(); ok {
+		t.Fatal("Oldest on empty cache reported ok")
+	}
 	c.RemoveOldest() // shouldn't panic
 	c.Remove(k4)     // shouldn't panic
 
@@ -58,6 +61,9 @@ func TestCache(t *testing.T) {
 
 	wantVal(k3, 3)
 
+	if k, v, ok := c.Oldest(); !ok || k != k2 || v != 2 {
+		t.Fatalf("Oldest = %v, %v, %v; want %v, 2, true", k, v, ok, k2)
+	}
 	wantVal(k2, 2)
 	c.Remove(k2)
 	wantLen(1)
@@ -377,6 +377,36 @@ func LikelyHomeRouterIP() (gateway, myIP netaddr.IP, ok bool) {
 	return gateway, myIP, !myIP.IsZero()
 }
 
+var likelyHomeRouterIPv6 func() (gateway netaddr.IP, ifName string, ok bool)
+
+// LikelyHomeRouterIPv6 returns the likely IPv6 address of the
+// residential router, which is often link-local (and then has the
+// interface's name as its zone). In addition, it returns a global
+// IPv6 address of the current machine on the interface leading to
+// that router.
+// This is used as the destination for IPv6 PCP queries.
+func LikelyHomeRouterIPv6() (gateway, myIP netaddr.IP, ok bool) {
+	if likelyHomeRouterIPv6 == nil {
+		return
+	}
+	gateway, ifName, ok := likelyHomeRouterIPv6()
+	if !ok {
+		return
+	}
+	ForeachInterfaceAddress(func(i Interface, ip netaddr.IP) {
+		if i.Name != ifName || !i.IsUp() || !myIP.IsZero() {
+			return
+		}
+		if ip.Is6() && isGlobalV6(ip) {
+			myIP = ip
+		}
+	})
+	if gateway.IsLinkLocalUnicast() {
+		gateway = gateway.WithZone(ifName)
+	}
+	return gateway, myIP, !myIP.IsZero()
+}
+
 func isPrivateIP(ip netaddr.IP) bool {
 	return private1.Contains(ip) || private2.Contains(ip) || private3.Contains(ip)
 }
@@ -7,12 +7,14 @@ package interfaces
 import (
 	"bufio"
 	"bytes"
+	"encoding/hex"
 	"errors"
 	"io"
 	"log"
 	"os"
 	"os/exec"
 	"runtime"
+	"strconv"
 	"strings"
 
 	"go4.org/mem"
@@ -23,6 +25,7 @@ import (
 
 func init() {
 	likelyHomeRouterIP = likelyHomeRouterIPLinux
+	likelyHomeRouterIPv6 = likelyHomeRouterIPv6Linux
 }
 
 var procNetRouteErr syncs.AtomicBool
@@ -86,6 +89,65 @@ func likelyHomeRouterIPLinux() (ret netaddr.IP, ok bool) {
 	return ret, !ret.IsZero()
 }
 
+var procNetIPv6RouteErr syncs.AtomicBool
+
+func likelyHomeRouterIPv6Linux() (gw netaddr.IP, ifName string, ok bool) {
+	if procNetIPv6RouteErr.Get() {
+		return
+	}
+	f, err := os.Open("/proc/net/ipv6_route")
+	if err != nil {
+		// No IPv6, or no permission (as on Android).
+		procNetIPv6RouteErr.Set(true)
+		return
+	}
+	defer f.Close()
+	return parseIPv6DefaultRoute(f)
+}
+
+/*
+Parse fe80::1 and eth0 out of the default route in:
+
+$ cat /proc/net/ipv6_route
+20010db8000000000000000000000000 40 00000000000000000000000000000000 00 00000000000000000000000000000000 00000100 00000001 00000000 00000001     eth0
+00000000000000000000000000000000 00 00000000000000000000000000000000 00 fe800000000000000000000000000001 00000400 00000001 00000000 00000003     eth0
+*/
+func parseIPv6DefaultRoute(r io.Reader) (gw netaddr.IP, ifName string, ok bool) {
+	lineread.Reader(r, func(line []byte) error {
+		if ok {
+			return nil
+		}
+		f := strings.Fields(string(line))
+		if len(f) < 10 {
+			return nil
+		}
+		dst, dstLen, nextHopHex, flagsHex := f[0], f[1], f[4], f[8]
+		if strings.Trim(dst, "0") != "" || dstLen != "00" {
+			return nil // not a default route
+		}
+		flags, err := strconv.ParseUint(flagsHex, 16, 32)
+		if err != nil {
+			return nil
+		}
+		const RTF_UP = 0x0001
+		const RTF_GATEWAY = 0x0002
+		if flags&(RTF_UP|RTF_GATEWAY) != RTF_UP|RTF_GATEWAY {
+			return nil
+		}
+		nextHop, err := hex.DecodeString(nextHopHex)
+		if err != nil || len(nextHop) != 16 {
+			return nil
+		}
+		var a [16]byte
+		copy(a[:], nextHop)
+		gw = netaddr.IPFrom16(a)
+		ifName = f[9]
+		ok = true
+		return nil
+	})
+	return gw, ifName, ok
+}
+
 // Android apps don't have permission to read /proc/net/route, at
 // least on Google devices and the Android emulator.
 func likelyHomeRouterIPAndroid() (ret netaddr.IP, ok bool) {
@@ -4,7 +4,12 @@
 
 package interfaces
 
-import "testing"
+import (
+	"strings"
+	"testing"
+
+	"inet.af/netaddr"
+)
 
 func BenchmarkDefaultRouteInterface(b *testing.B) {
 	b.ReportAllocs()
@@ -14,3 +19,50 @@ func BenchmarkDefaultRouteInterface(b *testing.B) {
 		}
 	}
 }
+
+func TestParseIPv6DefaultRoute(t *testing.T) {
+	tests := []struct {
+		name   string
+		in     string
+		wantGW string
+		wantIf string
+	}{
+		{
+			name: "link-local",
+			in: `20010db8000000000000000000000000 40 00000000000000000000000000000000 00 00000000000000000000000000000000 00000100 00000001 00000000 00000001     eth0
+fe800000000000000000000000000000 40 00000000000000000000000000000000 00 00000000000000000000000000000000 00000100 00000002 00000000 00000001     eth0
+00000000000000000000000000000000 00 00000000000000000000000000000000 00 fe800000000000000000000000000001 00000400 00000001 00000000 00000003     eth0
+00000000000000000000000000000001 80 00000000000000000000000000000000 00 00000000000000000000000000000000 00000000 00000003 00000000 80200001       lo
+`,
+			wantGW: "fe80::1",
+			wantIf: "eth0",
+		},
+		{
+			name: "unreachable-default",
+			in: `00000000000000000000000000000000 00 00000000000000000000000000000000 00 00000000000000000000000000000000 ffffffff 00000001 00000000 00200200       lo
+00000000000000000000000000000000 00 00000000000000000000000000000000 00 20010db8000000000000000000000001 00000400 00000001 00000000 00000003    wlan0
+`,
+			wantGW: "2001:db8::1",
+			wantIf: "wlan0",
+		},
+		{
+			name: "no-default",
+			in: `fe800000000000000000000000000000 40 00000000000000000000000000000000 00 00000000000000000000000000000000 00000100 00000002 00000000 00000001     eth0
+`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			gw, ifName, ok := parseIPv6DefaultRoute(strings.NewReader(tt.in))
+			if !ok {
+				if tt.wantGW != "" {
+					t.Fatalf("no default route found; want %v", tt.wantGW)
+				}
+				return
+			}
+			if want := netaddr.MustParseIP(tt.wantGW); gw != want || ifName != tt.wantIf {
+				t.Errorf("got %v, %q; want %v, %q", gw, ifName, want, tt.wantIf)
+			}
+		})
+	}
+}
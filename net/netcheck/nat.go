@@ -0,0 +1,296 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package netcheck
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	"inet.af/netaddr"
+	"tailscale.com/net/stun"
+	"tailscale.com/tailcfg"
+	"tailscale.com/types/nettype"
+)
+
+// NATBehavior is how a NAT (or firewall) maps or filters UDP
+// traffic, as classified by RFC 4787 sections 4.1 and 5.
+type NATBehavior string
+
+const (
+	// EndpointIndependent means a NAT reuses a mapping for all
+	// destinations, or a firewall lets any host reply to it.
+	EndpointIndependent NATBehavior = "endpoint-independent"
+	// AddressDependent means a NAT reuses a mapping for all ports
+	// of a destination IP, or a firewall lets any port of an IP
+	// reply to it.
+	AddressDependent NATBehavior = "address-dependent"
+	// AddressAndPortDependent means a NAT creates a mapping per
+	// destination IP and port, or a firewall only lets that IP
+	// and port reply to it.
+	AddressAndPortDependent NATBehavior = "address-and-port-dependent"
+)
+
+// NAT behavior discovery timing.
+const (
+	natTestTimeout    = 1 * time.Second        // how long to wait for a response
+	natTestRetransmit = 200 * time.Millisecond // how often to resend an unanswered request
+)
+
+// natTestServers are the STUN servers used to classify NAT behavior,
+// as in RFC 5780 section 4.
+type natTestServers struct {
+	// primary is a STUN server.
+	primary netaddr.IPPort
+	// altPort, if non-zero, is another port on which primary's IP
+	// answers STUN, and from which it answers requests to change
+	// the port.
+	altPort uint16
+	// altIP, if non-zero, is the alternate IP address of primary's
+	// server, from which it answers requests to change the IP.
+	altIP netaddr.IP
+	// other, if non-zero, is a STUN server with a different IP
+	// address than primary.
+	other netaddr.IPPort
+}
+
+// natTestServersOf picks the STUN servers to classify NAT behavior
+// with from dm's nodes, preferring those of regions that were fastest
+// in last (which may be nil). It reports whether they can tell us
+// anything.
+func (c *Client) natTestServersOf(ctx context.Context, dm *tailcfg.DERPMap, last *Report) (s natTestServers, ok bool) {
+	rids := dm.RegionIDs()
+	if last != nil {
+		sort.SliceStable(rids, func(i, j int) bool {
+			da, db := last.RegionLatency[rids[i]], last.RegionLatency[rids[j]]
+			return da != 0 && (db == 0 || da < db)
+		})
+	}
+	var addrs []netaddr.IPPort // of nodes, in order of preference
+	var nodes []*tailcfg.DERPNode
+	for _, rid := range rids {
+		for _, n := range dm.Regions[rid].Nodes {
+			ua := c.nodeAddr(ctx, n, probeIPv4)
+			if ua == nil {
+				continue
+			}
+			ipp, ok := netaddr.FromStdAddr(ua.IP, ua.Port, ua.Zone)
+			if !ok {
+				continue
+			}
+			addrs = append(addrs, ipp)
+			nodes = append(nodes, n)
+		}
+	}
+	if len(addrs) == 0 {
+		return s, false
+	}
+
+	// Prefer a node that can change the port, and ideally the IP
+	// address, of its responses.
+	s.primary = addrs[0]
+	for i, n := range nodes {
+		if n.STUNAltPort <= 0 || n.STUNAltPort > 1<<16-1 {
+			continue
+		}
+		s.primary = addrs[i]
+		s.altPort = uint16(n.STUNAltPort)
+		if ip, err := netaddr.ParseIP(n.STUNAltIPv4); err == nil && ip.Is4() {
+			s.altIP = ip
+			s.other = netaddr.IPPort{IP: ip, Port: s.primary.Port}
+		}
+		break
+	}
+	if s.other.IsZero() {
+		for _, ipp := range addrs {
+			if ipp.IP != s.primary.IP {
+				s.other = ipp
+				break
+			}
+		}
+	}
+	return s, s.altPort != 0 || !s.other.IsZero()
+}
+
+// classifyNAT classifies the mapping and filtering behavior of the NAT
+// (or firewall) between this machine and the STUN servers s, with the
+// tests of RFC 5780 sections 4.3 and 4.4. It sends them from a new
+// socket from ln, as filtering tests need a NAT mapping that hasn't
+// sent traffic anywhere else yet. Behaviors that s can't help
+// determine are left empty.
+func classifyNAT(ctx context.Context, ln nettype.PacketListener, s natTestServers) (mapping, filtering NATBehavior, err error) {
+	pc, err := ln.ListenPacket(ctx, "udp4", ":0")
+	if err != nil {
+		return "", "", err
+	}
+	t := newNATTester(pc)
+	defer t.close()
+
+	// The first request creates our NAT mapping, and tells us its
+	// external address.
+	mapped, ok := t.query(ctx, s.primary, s.primary, stun.Request)
+	if !ok {
+		return "", "", fmt.Errorf("no STUN response from %v", s.primary)
+	}
+	altPrimary := netaddr.IPPort{IP: s.primary.IP, Port: s.altPort}
+
+	// Filtering tests: which changed sources can reply to us.
+	if s.altPort != 0 {
+		var changedIPOK, changedPortOK bool
+		var wg sync.WaitGroup
+		if !s.altIP.IsZero() {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				_, changedIPOK = t.query(ctx, s.primary, netaddr.IPPort{IP: s.altIP, Port: s.altPort}, func(tx stun.TxID) []byte {
+					return stun.RequestChange(tx, true, true)
+				})
+			}()
+		}
+		_, changedPortOK = t.query(ctx, s.primary, altPrimary, func(tx stun.TxID) []byte {
+			return stun.RequestChange(tx, false, true)
+		})
+		wg.Wait()
+		switch {
+		case changedIPOK:
+			filtering = EndpointIndependent
+		case changedPortOK && !s.altIP.IsZero():
+			filtering = AddressDependent
+		case changedPortOK:
+			// Without an alternate IP, we can't tell
+			// endpoint-independent and address-dependent
+			// filtering apart.
+		default:
+			filtering = AddressAndPortDependent
+		}
+	}
+
+	// Mapping tests: whether our external address changes with
+	// the destination IP, and then with its port.
+	if !s.other.IsZero() {
+		if mapped2, ok := t.query(ctx, s.other, s.other, stun.Request); ok {
+			switch {
+			case mapped2 == mapped:
+				mapping = EndpointIndependent
+			case s.altPort != 0:
+				if mapped3, ok := t.query(ctx, altPrimary, altPrimary, stun.Request); ok {
+					if mapped3 == mapped {
+						mapping = AddressDependent
+					} else {
+						mapping = AddressAndPortDependent
+					}
+				}
+			}
+		}
+	}
+	return mapping, filtering, nil
+}
+
+// natTester sends STUN requests from a socket, and matches their
+// responses to them.
+type natTester struct {
+	pc   net.PacketConn
+	done chan struct{} // closed when readLoop returns
+
+	mu      sync.Mutex
+	waiting map[stun.TxID]natTestWaiter
+}
+
+// natTestWaiter is a query waiting for the response to its request.
+type natTestWaiter struct {
+	src netaddr.IPPort      // where the response must come from
+	ch  chan netaddr.IPPort // gets the mapped address in the response
+}
+
+func newNATTester(pc net.PacketConn) *natTester {
+	t := &natTester{
+		pc:      pc,
+		done:    make(chan struct{}),
+		waiting: map[stun.TxID]natTestWaiter{},
+	}
+	go t.readLoop()
+	return t
+}
+
+func (t *natTester) close() {
+	t.pc.Close()
+	<-t.done
+}
+
+func (t *natTester) readLoop() {
+	defer close(t.done)
+	var buf [64 << 10]byte
+	for {
+		n, addr, err := t.pc.ReadFrom(buf[:])
+		if err != nil {
+			return
+		}
+		ua, ok := addr.(*net.UDPAddr)
+		if !ok {
+			continue
+		}
+		src, ok := netaddr.FromStdAddr(ua.IP, ua.Port, ua.Zone)
+		if !ok {
+			continue
+		}
+		tx, ip, port, err := stun.ParseResponse(buf[:n])
+		if err != nil {
+			continue
+		}
+		mapped, ok := netaddr.FromStdAddr(ip, int(port), "")
+		if !ok {
+			continue
+		}
+		t.mu.Lock()
+		w, ok := t.waiting[tx]
+		t.mu.Unlock()
+		// A response from elsewhere is from a server that
+		// ignored our CHANGE-REQUEST.
+		if ok && w.src == src {
+			select {
+			case w.ch <- mapped:
+			default:
+			}
+		}
+	}
+}
+
+// query sends the request made by newReq to dst until a response
+// arrives from wantSrc, or natTestTimeout passes. It returns the
+// mapped address in the response, and whether there was one.
+func (t *natTester) query(ctx context.Context, dst, wantSrc netaddr.IPPort, newReq func(stun.TxID) []byte) (mapped netaddr.IPPort, ok bool) {
+	tx := stun.NewTxID()
+	req := newReq(tx)
+	ch := make(chan netaddr.IPPort, 1)
+	t.mu.Lock()
+	t.waiting[tx] = natTestWaiter{src: wantSrc, ch: ch}
+	t.mu.Unlock()
+	defer func() {
+		t.mu.Lock()
+		defer t.mu.Unlock()
+		delete(t.waiting, tx)
+	}()
+
+	timeout := time.NewTimer(natTestTimeout)
+	defer timeout.Stop()
+	resend := time.NewTicker(natTestRetransmit)
+	defer resend.Stop()
+	dstAddr := dst.UDPAddr()
+	for {
+		t.pc.WriteTo(req, dstAddr)
+		select {
+		case mapped := <-ch:
+			return mapped, true
+		case <-resend.C:
+		case <-timeout.C:
+			return netaddr.IPPort{}, false
+		case <-ctx.Done():
+			return netaddr.IPPort{}, false
+		}
+	}
+}
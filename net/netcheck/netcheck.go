@@ -32,6 +32,7 @@ import (
 	"tailscale.com/syncs"
 	"tailscale.com/tailcfg"
 	"tailscale.com/types/logger"
+	"tailscale.com/types/nettype"
 	"tailscale.com/types/opt"
 )
 
@@ -45,6 +46,11 @@ const (
 	// overallProbeTimeout is the maximum amount of time netcheck will
 	// spend gathering a single report.
 	overallProbeTimeout = 5 * time.Second
+	// natClassifyInterval is how often the NAT behavior is
+	// classified again. It takes a second or more, and rarely
+	// changes without a link change, which classifies it again
+	// sooner; see MakeNextReportFull.
+	natClassifyInterval = 30 * time.Minute
 	// stunTimeout is the maximum amount of time netcheck will spend
 	// probing with STUN packets without getting a reply before
 	// switching to HTTP probing, on the assumption that outbound UDP
@@ -75,6 +81,13 @@ type Report struct {
 	MappingVariesByDestIP opt.Bool // for IPv4
 	HairPinning           opt.Bool // for IPv4
 
+	// MappingBehavior is how the NAT, if any, maps our IPv4 UDP
+	// traffic to different destinations. Empty means unknown.
+	MappingBehavior NATBehavior
+	// FilteringBehavior is which hosts the NAT or firewall, if any,
+	// lets reply to our IPv4 UDP traffic. Empty means unknown.
+	FilteringBehavior NATBehavior
+
 	// UPnP is whether UPnP appears present on the LAN.
 	// Empty means not checked.
 	UPnP opt.Bool
@@ -84,6 +97,9 @@ type Report struct {
 	// PCP is whether PCP appears present on the LAN.
 	// Empty means not checked.
 	PCP opt.Bool
+	// PortMappings are the port mappings the PortMapper currently
+	// holds, IPv4 first. Empty means none (or not checked).
+	PortMappings []portmapper.Mapping
 
 	PreferredDERP   int                   // or 0 for unknown
 	RegionLatency   map[int]time.Duration // keyed by DERP Region ID
@@ -109,6 +125,7 @@ func (r *Report) Clone() *Report {
 	r2.RegionLatency = cloneDurationMap(r2.RegionLatency)
 	r2.RegionV4Latency = cloneDurationMap(r2.RegionV4Latency)
 	r2.RegionV6Latency = cloneDurationMap(r2.RegionV6Latency)
+	r2.PortMappings = append([]portmapper.Mapping(nil), r2.PortMappings...)
 	return &r2
 }
 
@@ -146,6 +163,8 @@ type Client struct {
 	// SkipExternalNetwork controls whether the client should not try
 	// to reach things other than localhost. This is set to true
 	// in tests to avoid probing the local LAN's router, etc.
+	// It also skips classifying the NAT behavior, which runs in
+	// the background, past the end of GetReport.
 	SkipExternalNetwork bool
 
 	// UDPBindAddr, if non-empty, is the address to listen on for UDP.
@@ -156,12 +175,23 @@ type Client struct {
 	// If nil, portmap discovery is not done.
 	PortMapper *portmapper.Client // lazily initialized on first use
 
+	// PacketListener optionally specifies how to create the UDP
+	// sockets GetReport needs. If nil, netns.Listener is used.
+	PacketListener nettype.PacketListener
+
 	mu       sync.Mutex            // guards following
 	nextFull bool                  // do a full region scan, even if last != nil
 	prev     map[time.Time]*Report // some previous reports
 	last     *Report               // most recent report
 	lastFull time.Time             // time of last full (non-incremental) report
 	curState *reportState          // non-nil if we're in a call to GetReportn
+
+	// The most recent NAT classification; see maybeClassifyNAT.
+	natMapping   NATBehavior
+	natFiltering NATBehavior
+	natStarted   time.Time // when it started; zero if never
+	natRunning   bool      // a classification is in progress
+	natNext      bool      // classify again on the next GetReport
 }
 
 // STUNConn is the interface required by the netcheck Client when
@@ -180,6 +210,13 @@ func (c *Client) enoughRegions() int {
 	return 3
 }
 
+func (c *Client) packetListener() nettype.PacketListener {
+	if c.PacketListener != nil {
+		return c.PacketListener
+	}
+	return netns.Listener()
+}
+
 func (c *Client) logf(format string, a ...interface{}) {
 	if c.Logf != nil {
 		c.Logf(format, a...)
@@ -217,6 +254,7 @@ func (c *Client) MakeNextReportFull() {
 	c.mu.Lock()
 	defer c.mu.Unlock()
 	c.nextFull = true
+	c.natNext = true
 }
 
 func (c *Client) ReceiveSTUNPacket(pkt []byte, src netaddr.IPPort) {
@@ -599,6 +637,45 @@ func (rs *reportState) waitHairCheck(ctx context.Context) {
 	}
 }
 
+// maybeClassifyNAT starts classifying the NAT behavior with STUN
+// servers from dm, in the background, if it wasn't classified in the
+// last natClassifyInterval or MakeNextReportFull was called since.
+// Reports have the most recent classification, so they don't wait
+// for it.
+func (c *Client) maybeClassifyNAT(dm *tailcfg.DERPMap) {
+	c.mu.Lock()
+	now := c.timeNow()
+	if c.natRunning || (!c.natNext && !c.natStarted.IsZero() && now.Sub(c.natStarted) < natClassifyInterval) {
+		c.mu.Unlock()
+		return
+	}
+	c.natRunning = true
+	c.natNext = false
+	c.natStarted = now
+	last := c.last
+	c.mu.Unlock()
+
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), overallProbeTimeout)
+		defer cancel()
+		var mapping, filtering NATBehavior
+		if s, ok := c.natTestServersOf(ctx, dm, last); !ok {
+			c.vlogf("no STUN servers to classify NAT with")
+		} else {
+			var err error
+			mapping, filtering, err = classifyNAT(ctx, c.packetListener(), s)
+			if err != nil {
+				c.vlogf("classifying NAT: %v", err)
+			}
+		}
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		c.natRunning = false
+		c.natMapping = mapping
+		c.natFiltering = filtering
+	}()
+}
+
 func (rs *reportState) stopTimers() {
 	rs.mu.Lock()
 	defer rs.mu.Unlock()
@@ -690,6 +767,11 @@ func (rs *reportState) probePortMapServices() {
 	rs.setOptBool(&rs.report.UPnP, res.UPnP)
 	rs.setOptBool(&rs.report.PMP, res.PMP)
 	rs.setOptBool(&rs.report.PCP, res.PCP)
+
+	mappings := rs.c.PortMapper.Mappings()
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	rs.report.PortMappings = mappings
 }
 
 func newReport() *Report {
@@ -759,7 +841,7 @@ func (c *Client) GetReport(ctx context.Context, dm *tailcfg.DERPMap) (*Report, e
 	}
 
 	// Create a UDP4 socket used for sending to our discovered IPv4 address.
-	rs.pc4Hair, err = netns.Listener().ListenPacket(ctx, "udp4", ":0")
+	rs.pc4Hair, err = c.packetListener().ListenPacket(ctx, "udp4", ":0")
 	if err != nil {
 		c.logf("udp4: %v", err)
 		return nil, err
@@ -771,6 +853,10 @@ func (c *Client) GetReport(ctx context.Context, dm *tailcfg.DERPMap) (*Report, e
 		go rs.probePortMapServices()
 	}
 
+	if !c.SkipExternalNetwork {
+		c.maybeClassifyNAT(dm)
+	}
+
 	// At least the Apple Airport Extreme doesn't allow hairpin
 	// sends from a private socket until it's seen traffic from
 	// that src IP:port to something else out on the internet.
@@ -787,7 +873,7 @@ func (c *Client) GetReport(ctx context.Context, dm *tailcfg.DERPMap) (*Report, e
 	if f := c.GetSTUNConn4; f != nil {
 		rs.pc4 = f()
 	} else {
-		u4, err := netns.Listener().ListenPacket(ctx, "udp4", c.udpBindAddr())
+		u4, err := c.packetListener().ListenPacket(ctx, "udp4", c.udpBindAddr())
 		if err != nil {
 			c.logf("udp4: %v", err)
 			return nil, err
@@ -800,7 +886,7 @@ func (c *Client) GetReport(ctx context.Context, dm *tailcfg.DERPMap) (*Report, e
 		if f := c.GetSTUNConn6; f != nil {
 			rs.pc6 = f()
 		} else {
-			u6, err := netns.Listener().ListenPacket(ctx, "udp6", c.udpBindAddr())
+			u6, err := c.packetListener().ListenPacket(ctx, "udp6", c.udpBindAddr())
 			if err != nil {
 				c.logf("udp6: %v", err)
 			} else {
@@ -885,7 +971,12 @@ func (c *Client) GetReport(ctx context.Context, dm *tailcfg.DERPMap) (*Report, e
 		wg.Wait()
 	}
 
+	c.mu.Lock()
+	mapping, filtering := c.natMapping, c.natFiltering
+	c.mu.Unlock()
 	rs.mu.Lock()
+	rs.report.MappingBehavior = mapping
+	rs.report.FilteringBehavior = filtering
 	report := rs.report.Clone()
 	rs.mu.Unlock()
 
@@ -966,11 +1057,20 @@ func (c *Client) logConciseReport(r *Report, dm *tailcfg.DERPMap) {
 		fmt.Fprintf(w, " v6=%v", r.IPv6)
 		fmt.Fprintf(w, " mapvarydest=%v", r.MappingVariesByDestIP)
 		fmt.Fprintf(w, " hair=%v", r.HairPinning)
+		if r.MappingBehavior != "" {
+			fmt.Fprintf(w, " natmap=%v", r.MappingBehavior)
+		}
+		if r.FilteringBehavior != "" {
+			fmt.Fprintf(w, " natfilter=%v", r.FilteringBehavior)
+		}
 		if r.AnyPortMappingChecked() {
 			fmt.Fprintf(w, " portmap=%v%v%v", conciseOptBool(r.UPnP, "U"), conciseOptBool(r.PMP, "M"), conciseOptBool(r.PCP, "C"))
 		} else {
 			fmt.Fprintf(w, " portmap=?")
 		}
+		for _, m := range r.PortMappings {
+			fmt.Fprintf(w, " mapped=%v/%v", m.Protocol, m.External)
+		}
 		if r.GlobalV4 != "" {
 			fmt.Fprintf(w, " v4a=%v", r.GlobalV4)
 		}
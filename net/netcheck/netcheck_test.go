@@ -18,9 +18,11 @@ import (
 
 	"inet.af/netaddr"
 	"tailscale.com/net/interfaces"
+	"tailscale.com/net/portmapper"
 	"tailscale.com/net/stun"
 	"tailscale.com/net/stun/stuntest"
 	"tailscale.com/tailcfg"
+	"tailscale.com/tstest/natlab"
 )
 
 func TestHairpinSTUN(t *testing.T) {
@@ -566,6 +568,29 @@ func TestLogConciseReport(t *testing.T) {
 			},
 			want: "udp=true v4=false v6=false mapvarydest= hair= portmap=UC derp=0",
 		},
+		{
+			name: "portmap_mapped",
+			r: &Report{
+				UDP:  true,
+				UPnP: "false",
+				PMP:  "false",
+				PCP:  "true",
+				PortMappings: []portmapper.Mapping{
+					{Protocol: "PCP", External: netaddr.MustParseIPPort("203.0.113.1:41641")},
+					{Protocol: "PCP", External: netaddr.MustParseIPPort("[2001:db8::1]:41641")},
+				},
+			},
+			want: "udp=true v4=false v6=false mapvarydest= hair= portmap=C mapped=PCP/203.0.113.1:41641 mapped=PCP/[2001:db8::1]:41641 derp=0",
+		},
+		{
+			name: "nat_behavior",
+			r: &Report{
+				UDP:               true,
+				MappingBehavior:   AddressDependent,
+				FilteringBehavior: AddressAndPortDependent,
+			},
+			want: "udp=true v4=false v6=false mapvarydest= hair= natmap=address-dependent natfilter=address-and-port-dependent portmap=? derp=0",
+		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
@@ -616,3 +641,233 @@ func TestSortRegions(t *testing.T) {
 		t.Errorf("got %v; want %v", got, want)
 	}
 }
+
+func TestNATTestServersOf(t *testing.T) {
+	node := func(rid int, ip string, altPort int, altIP string) *tailcfg.DERPNode {
+		return &tailcfg.DERPNode{
+			Name:        fmt.Sprintf("%d%s", rid, ip),
+			RegionID:    rid,
+			HostName:    ip,
+			IPv4:        ip,
+			STUNAltPort: altPort,
+			STUNAltIPv4: altIP,
+		}
+	}
+	dmOf := func(nodes ...*tailcfg.DERPNode) *tailcfg.DERPMap {
+		dm := &tailcfg.DERPMap{Regions: map[int]*tailcfg.DERPRegion{}}
+		for _, n := range nodes {
+			r := dm.Regions[n.RegionID]
+			if r == nil {
+				r = &tailcfg.DERPRegion{RegionID: n.RegionID}
+				dm.Regions[n.RegionID] = r
+			}
+			r.Nodes = append(r.Nodes, n)
+		}
+		return dm
+	}
+	ipp := netaddr.MustParseIPPort
+	tests := []struct {
+		name   string
+		dm     *tailcfg.DERPMap
+		last   *Report
+		want   natTestServers
+		wantOK bool
+	}{
+		{
+			name: "one_node",
+			dm:   dmOf(node(1, "1.0.0.1", 0, "")),
+			want: natTestServers{primary: ipp("1.0.0.1:3478")},
+		},
+		{
+			name: "two_nodes",
+			dm:   dmOf(node(1, "1.0.0.1", 0, ""), node(2, "2.0.0.1", 0, "")),
+			want: natTestServers{
+				primary: ipp("1.0.0.1:3478"),
+				other:   ipp("2.0.0.1:3478"),
+			},
+			wantOK: true,
+		},
+		{
+			name: "prefer_fastest",
+			dm:   dmOf(node(1, "1.0.0.1", 0, ""), node(2, "2.0.0.1", 0, "")),
+			last: &Report{RegionLatency: map[int]time.Duration{1: 20 * time.Millisecond, 2: 10 * time.Millisecond}},
+			want: natTestServers{
+				primary: ipp("2.0.0.1:3478"),
+				other:   ipp("1.0.0.1:3478"),
+			},
+			wantOK: true,
+		},
+		{
+			name: "alt_port",
+			dm:   dmOf(node(1, "1.0.0.1", 0, ""), node(2, "2.0.0.1", 3479, "")),
+			want: natTestServers{
+				primary: ipp("2.0.0.1:3478"),
+				altPort: 3479,
+				other:   ipp("1.0.0.1:3478"),
+			},
+			wantOK: true,
+		},
+		{
+			name: "alt_ip",
+			dm:   dmOf(node(1, "1.0.0.1", 0, ""), node(2, "2.0.0.1", 3479, "2.0.0.2")),
+			want: natTestServers{
+				primary: ipp("2.0.0.1:3478"),
+				altPort: 3479,
+				altIP:   netaddr.MustParseIP("2.0.0.2"),
+				other:   ipp("2.0.0.2:3478"),
+			},
+			wantOK: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := &Client{Logf: t.Logf}
+			got, ok := c.natTestServersOf(context.Background(), tt.dm, tt.last)
+			if got != tt.want || ok != tt.wantOK {
+				t.Errorf("got %+v, %v; want %+v, %v", got, ok, tt.want, tt.wantOK)
+			}
+		})
+	}
+}
+
+func TestClassifyNAT(t *testing.T) {
+	natTypes := []struct {
+		typ  natlab.NATType
+		want NATBehavior
+	}{
+		{natlab.EndpointIndependentNAT, EndpointIndependent},
+		{natlab.AddressDependentNAT, AddressDependent},
+		{natlab.AddressAndPortDependentNAT, AddressAndPortDependent},
+	}
+	firewallTypes := []struct {
+		typ  natlab.FirewallType
+		want NATBehavior
+	}{
+		{natlab.EndpointIndependentFirewall, EndpointIndependent},
+		{natlab.AddressDependentFirewall, AddressDependent},
+		{natlab.AddressAndPortDependentFirewall, AddressAndPortDependent},
+	}
+	for _, nt := range natTypes {
+		for _, ft := range firewallTypes {
+			nt, ft := nt, ft
+			t.Run(fmt.Sprintf("%v_mapping_%v_filtering", nt.want, ft.want), func(t *testing.T) {
+				t.Parallel()
+				m := &natlab.Machine{Name: "m"}
+				nat := &natlab.Machine{Name: "nat"}
+				stun1 := &natlab.Machine{Name: "stun1"}
+				stun2 := &natlab.Machine{Name: "stun2"}
+				inet := natlab.NewInternet()
+				lan := &natlab.Network{
+					Name:    "lan",
+					Prefix4: netaddr.MustParseIPPrefix("192.168.0.0/24"),
+				}
+
+				stun1if := stun1.Attach("eth0", inet)
+				stun2if := stun2.Attach("eth0", inet)
+				natWAN := nat.Attach("wan", inet)
+				natLAN := nat.Attach("lan", lan)
+				m.Attach("eth0", lan)
+				lan.SetDefaultGateway(natLAN)
+				nat.PacketHandler = &natlab.SNAT44{
+					Machine:           nat,
+					ExternalInterface: natWAN,
+					Type:              nt.typ,
+					Firewall: &natlab.Firewall{
+						Type:             ft.typ,
+						TrustedInterface: natLAN,
+					},
+				}
+				cleanup := stuntest.ServeChangeRequests(t, stun1, stun2, 3478, 3479)
+				defer cleanup()
+
+				s := natTestServers{
+					primary: netaddr.IPPort{IP: stun1if.V4(), Port: 3478},
+					altPort: 3479,
+					altIP:   stun2if.V4(),
+					other:   netaddr.IPPort{IP: stun2if.V4(), Port: 3478},
+				}
+				ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+				defer cancel()
+				mapping, filtering, err := classifyNAT(ctx, m, s)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if mapping != nt.want {
+					t.Errorf("mapping = %q; want %q", mapping, nt.want)
+				}
+				if filtering != ft.want {
+					t.Errorf("filtering = %q; want %q", filtering, ft.want)
+				}
+			})
+		}
+	}
+}
+
+func TestMaybeClassifyNAT(t *testing.T) {
+	m := &natlab.Machine{Name: "m"}
+	stun1 := &natlab.Machine{Name: "stun1"}
+	stun2 := &natlab.Machine{Name: "stun2"}
+	inet := natlab.NewInternet()
+	m.Attach("eth0", inet)
+	stun1if := stun1.Attach("eth0", inet)
+	stun2if := stun2.Attach("eth0", inet)
+	cleanup := stuntest.ServeChangeRequests(t, stun1, stun2, 3478, 3479)
+	defer cleanup()
+	dm := &tailcfg.DERPMap{Regions: map[int]*tailcfg.DERPRegion{
+		1: {RegionID: 1, Nodes: []*tailcfg.DERPNode{{
+			Name:        "1a",
+			RegionID:    1,
+			HostName:    stun1if.V4().String(),
+			IPv4:        stun1if.V4().String(),
+			STUNAltPort: 3479,
+			STUNAltIPv4: stun2if.V4().String(),
+		}}},
+	}}
+
+	now := time.Unix(1000, 0)
+	c := &Client{
+		Logf:           t.Logf,
+		TimeNow:        func() time.Time { return now },
+		PacketListener: m,
+	}
+	classification := func() (running bool, mapping, filtering NATBehavior) {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		return c.natRunning, c.natMapping, c.natFiltering
+	}
+	wait := func() {
+		t.Helper()
+		deadline := time.Now().Add(10 * time.Second)
+		for {
+			running, mapping, filtering := classification()
+			if !running {
+				if mapping != EndpointIndependent || filtering != EndpointIndependent {
+					t.Fatalf("classified as %q mapping, %q filtering; want %q", mapping, filtering, EndpointIndependent)
+				}
+				return
+			}
+			if time.Now().After(deadline) {
+				t.Fatal("timeout waiting for NAT classification")
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	c.maybeClassifyNAT(dm)
+	wait()
+
+	// It's not classified again until natClassifyInterval passes.
+	c.mu.Lock()
+	c.natMapping, c.natFiltering = "", ""
+	c.mu.Unlock()
+	now = now.Add(natClassifyInterval / 2)
+	c.maybeClassifyNAT(dm)
+	if running, mapping, _ := classification(); running || mapping != "" {
+		t.Fatalf("classified again within natClassifyInterval")
+	}
+
+	// Or the link changes.
+	c.MakeNextReportFull()
+	c.maybeClassifyNAT(dm)
+	wait()
+}
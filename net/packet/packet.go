@@ -402,6 +402,15 @@ func (q *Parsed) IsEchoResponse() bool {
 	}
 }
 
+// EchoIDSeq returns the identifier and sequence number of q, which
+// must be an ICMP Echo Request or Response.
+func (q *Parsed) EchoIDSeq() (id, seq uint16) {
+	if len(q.b) < q.subofs+8 {
+		return 0, 0
+	}
+	return binary.BigEndian.Uint16(q.b[q.subofs+4:]), binary.BigEndian.Uint16(q.b[q.subofs+6:])
+}
+
 func Hexdump(b []byte) string {
 	out := new(strings.Builder)
 	for i := 0; i < len(b); i += 16 {
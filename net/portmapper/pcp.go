@@ -0,0 +1,291 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package portmapper
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"time"
+
+	"inet.af/netaddr"
+	"tailscale.com/net/netns"
+)
+
+// PCP constants.
+const (
+	pcpVersion = 2
+	pcpPort    = 5351
+
+	pcpMapLifetimeSec = 7200 // same as pmpMapLifetimeSec
+
+	pcpCodeOK = 0
+
+	pcpOpReply    = 0x80 // OR'd into request's op code on response
+	pcpOpAnnounce = 0
+	pcpOpMap      = 1
+
+	pcpUDPMapping = 17 // the IANA protocol number of UDP
+)
+
+// pcpMapping is an already-created PCP mapping. For IPv6, it's a
+// firewall pinhole rather than a NAT mapping, and its external
+// address is the same as its internal one.
+//
+// All fields are immutable once created.
+type pcpMapping struct {
+	gw       netaddr.IPPort // the PCP server
+	internal netaddr.IPPort
+	external netaddr.IPPort
+	nonce    [12]byte  // identifies the mapping to the server, for renewal and deletion
+	useUntil time.Time // the mapping's lifetime minus renewal interval
+	epoch    uint32    // the server's epoch when it created or renewed the mapping
+}
+
+func (m *pcpMapping) externalIPPort() netaddr.IPPort { return m.external }
+func (m *pcpMapping) renewAfter() time.Time          { return m.useUntil }
+func (m *pcpMapping) protocol() string               { return "PCP" }
+
+// release does a best effort fire-and-forget release of the PCP mapping m.
+func (m *pcpMapping) release() {
+	uc, err := listenPCP(context.Background(), m.internal.IP)
+	if err != nil {
+		return
+	}
+	defer uc.Close()
+	pkt := pcpMapRequest(m.internal, m.external, 0, m.nonce)
+	uc.WriteTo(pkt, m.gw.UDPAddr())
+}
+
+// listenPCP returns a UDP socket bound to myIP, from which to send
+// PCP requests. PCP servers check that requests come from the
+// address they say they're from, which matters for IPv6 hosts with
+// several addresses.
+func listenPCP(ctx context.Context, myIP netaddr.IP) (net.PacketConn, error) {
+	network := "udp4"
+	if myIP.Is6() {
+		network = "udp6"
+	}
+	return netns.Listener().ListenPacket(ctx, network, netaddr.IPPort{IP: myIP}.String())
+}
+
+// createPCPMapping asks the PCP server gw to map internal for
+// pcpMapLifetimeSec. If prev is a PCP mapping of internal by the same
+// server, it's renewed; otherwise, the server is asked for prev's
+// external port, if any. The returned mapping isn't stored in c.
+func (c *Client) createPCPMapping(ctx context.Context, gw, internal netaddr.IPPort, prev mapping) (*pcpMapping, error) {
+	var nonce [12]byte
+	var suggested netaddr.IPPort
+	if pm, ok := prev.(*pcpMapping); ok && pm.gw == gw && pm.internal == internal {
+		// Renewals must reuse the mapping's nonce.
+		nonce = pm.nonce
+		suggested = pm.external
+	} else {
+		if _, err := rand.Read(nonce[:]); err != nil {
+			return nil, err
+		}
+		if prev != nil {
+			suggested.Port = prev.externalIPPort().Port
+		}
+	}
+
+	uc, err := listenPCP(ctx, internal.IP)
+	if err != nil {
+		return nil, err
+	}
+	defer uc.Close()
+
+	uc.SetReadDeadline(time.Now().Add(portMapServiceTimeout))
+	defer closeCloserOnContextDone(ctx, uc)()
+
+	pkt := pcpMapRequest(internal, suggested, pcpMapLifetimeSec, nonce)
+	if _, err := uc.WriteTo(pkt, gw.UDPAddr()); err != nil {
+		return nil, err
+	}
+
+	res := make([]byte, 1500)
+	for {
+		n, srci, err := uc.ReadFrom(res)
+		if err != nil {
+			if ctx.Err() == context.Canceled {
+				return nil, err
+			}
+			return nil, NoMappingError{ErrNoPortMappingServices}
+		}
+		srcu := srci.(*net.UDPAddr)
+		src, ok := netaddr.FromStdAddr(srcu.IP, srcu.Port, srcu.Zone)
+		if !ok || src.Port != gw.Port || src.IP.WithZone("") != gw.IP.WithZone("") {
+			continue
+		}
+		pres, ok := parsePCPMapResponse(res[:n])
+		if !ok || pres.OpCode != pcpOpReply|pcpOpMap || pres.Nonce != nonce {
+			c.logf("unexpected PCP response: % 02x", res[:n])
+			continue
+		}
+		if pres.ResultCode != pcpCodeOK {
+			return nil, NoMappingError{fmt.Errorf("PCP response Op=0x%x,Res=%d", pres.OpCode, pres.ResultCode)}
+		}
+		if pres.Lifetime == 0 || pres.External.Port == 0 || pres.External.IP.IsUnspecified() {
+			return nil, NoMappingError{fmt.Errorf("PCP response with no mapping: %+v", pres)}
+		}
+
+		c.mu.Lock()
+		c.notePCPEpochLocked(gw.IP, pres.Epoch)
+		c.mu.Unlock()
+
+		d := time.Duration(pres.Lifetime) * time.Second
+		d /= 2 // renew in half the time
+		return &pcpMapping{
+			gw:       gw,
+			internal: internal,
+			external: pres.External,
+			nonce:    nonce,
+			useUntil: time.Now().Add(d),
+			epoch:    pres.Epoch,
+		}, nil
+	}
+}
+
+// pcpEpoch is an epoch time reported by a PCP server.
+type pcpEpoch struct {
+	epoch uint32
+	at    time.Time // when we received it
+}
+
+// notePCPEpochLocked records epoch, received from the PCP server at
+// gw. If the server lost its state (typically, by rebooting) since
+// its previous response, any mappings we have from it are renewed
+// right away, which recreates them.
+//
+// c.mu must be held.
+func (c *Client) notePCPEpochLocked(gw netaddr.IP, epoch uint32) {
+	now := time.Now()
+	prev, ok := c.pcpEpochs[gw]
+	if c.pcpEpochs == nil {
+		c.pcpEpochs = map[netaddr.IP]pcpEpoch{}
+	}
+	c.pcpEpochs[gw] = pcpEpoch{epoch, now}
+	if !ok || pcpEpochValid(prev.epoch, epoch, prev.at, now) {
+		return
+	}
+	c.logf("PCP server %v lost its state (epoch %d, previously %d); renewing mappings", gw, epoch, prev.epoch)
+	for k, m := range c.mappings {
+		if m, ok := m.(*pcpMapping); ok && m.gw.IP == gw {
+			expired := *m
+			expired.useUntil = time.Time{}
+			c.setMappingLocked(k, &expired)
+		}
+	}
+}
+
+// pcpEpochValid reports whether a PCP server's epoch, received at
+// now, is consistent with its previous epoch, received at prevTime.
+// If not, the server lost its state. See
+// https://tools.ietf.org/html/rfc6887#section-8.5
+func pcpEpochValid(prevEpoch, epoch uint32, prevTime, now time.Time) bool {
+	if int64(epoch) < int64(prevEpoch)-1 {
+		return false
+	}
+	clientDelta := int64(now.Sub(prevTime) / time.Second)
+	serverDelta := int64(epoch) - int64(prevEpoch)
+	if clientDelta+2 < serverDelta-serverDelta/16 || serverDelta+2 < clientDelta-clientDelta/16 {
+		return false
+	}
+	return true
+}
+
+// pcpAnnounceRequest generates a PCP packet with an ANNOUNCE opcode.
+func pcpAnnounceRequest(myIP netaddr.IP) []byte {
+	// See https://tools.ietf.org/html/rfc6887#section-7.1
+	pkt := make([]byte, 24)
+	pkt[0] = pcpVersion // version
+	pkt[1] = pcpOpAnnounce
+	myIP16 := myIP.As16()
+	copy(pkt[8:], myIP16[:])
+	return pkt
+}
+
+// pcpMapRequest generates a PCP packet with a MAP opcode, asking for
+// a UDP mapping of internal for lifetimeSec, preferably to suggested
+// (whose IP and port may each be zero). A zero lifetimeSec deletes
+// the mapping identified by nonce.
+func pcpMapRequest(internal, suggested netaddr.IPPort, lifetimeSec uint32, nonce [12]byte) []byte {
+	// 24 byte header + 36 byte map opcode
+	pkt := make([]byte, (32+32+128)/8+(96+8+24+16+16+128)/8)
+
+	// The header (https://tools.ietf.org/html/rfc6887#section-7.1)
+	pkt[0] = pcpVersion
+	pkt[1] = pcpOpMap
+	binary.BigEndian.PutUint32(pkt[4:8], lifetimeSec)
+	myIP16 := internal.IP.As16()
+	copy(pkt[8:], myIP16[:])
+
+	// The map opcode body (https://tools.ietf.org/html/rfc6887#section-11.1)
+	mapOp := pkt[24:]
+	copy(mapOp[:12], nonce[:])
+	mapOp[12] = pcpUDPMapping
+	binary.BigEndian.PutUint16(mapOp[16:], internal.Port)
+	binary.BigEndian.PutUint16(mapOp[18:], suggested.Port)
+	suggestedIP := suggested.IP
+	if suggestedIP.IsZero() && internal.IP.Is4() {
+		// "No preference" is the IPv4-mapped unspecified address
+		// for IPv4 mappings, and :: (all zeros) for IPv6.
+		suggestedIP = netaddr.IPv4(0, 0, 0, 0)
+	}
+	if !suggestedIP.IsZero() {
+		suggestedIP16 := suggestedIP.As16()
+		copy(mapOp[20:], suggestedIP16[:])
+	}
+	return pkt
+}
+
+type pcpResponse struct {
+	OpCode     uint8
+	ResultCode uint8
+	Lifetime   uint32
+	Epoch      uint32
+}
+
+func parsePCPResponse(b []byte) (res pcpResponse, ok bool) {
+	if len(b) < 24 || b[0] != pcpVersion {
+		return
+	}
+	res.OpCode = b[1]
+	res.ResultCode = b[3]
+	res.Lifetime = binary.BigEndian.Uint32(b[4:])
+	res.Epoch = binary.BigEndian.Uint32(b[8:])
+	return res, true
+}
+
+type pcpMapResponse struct {
+	pcpResponse
+
+	Nonce        [12]byte
+	Protocol     uint8
+	InternalPort uint16
+	External     netaddr.IPPort // assigned external address
+}
+
+func parsePCPMapResponse(b []byte) (res pcpMapResponse, ok bool) {
+	if len(b) < 60 {
+		return
+	}
+	if res.pcpResponse, ok = parsePCPResponse(b); !ok {
+		return
+	}
+	mapOp := b[24:]
+	copy(res.Nonce[:], mapOp[:12])
+	res.Protocol = mapOp[12]
+	res.InternalPort = binary.BigEndian.Uint16(mapOp[16:])
+	var ip16 [16]byte
+	copy(ip16[:], mapOp[20:36])
+	res.External = netaddr.IPPort{
+		IP:   netaddr.IPFrom16(ip16),
+		Port: binary.BigEndian.Uint16(mapOp[18:]),
+	}
+	return res, true
+}
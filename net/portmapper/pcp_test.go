@@ -0,0 +1,355 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package portmapper
+
+import (
+	"context"
+	"encoding/binary"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"inet.af/netaddr"
+)
+
+// fakePCPServer is an in-process PCP server, answering ANNOUNCE and
+// MAP requests.
+type fakePCPServer struct {
+	t    *testing.T
+	pc   net.PacketConn
+	port uint16
+
+	mu       sync.Mutex
+	epoch    uint32                // reported in responses
+	external netaddr.IP            // external IP of IPv4 mappings
+	mappings map[[12]byte]uint32   // lifetimes, by nonce
+	ports    map[[12]byte]uint16   // external ports, by nonce
+	requests []pcpMapRequestFields // MAP requests received, in order
+}
+
+type pcpMapRequestFields struct {
+	lifetime uint32
+	nonce    [12]byte
+}
+
+func newFakePCPServer(t *testing.T, addr string) *fakePCPServer {
+	pc, err := net.ListenPacket("udp", addr)
+	if err != nil {
+		t.Skipf("can't listen on %s: %v", addr, err)
+	}
+	s := &fakePCPServer{
+		t:        t,
+		pc:       pc,
+		port:     uint16(pc.LocalAddr().(*net.UDPAddr).Port),
+		epoch:    1000,
+		external: netaddr.MustParseIP("203.0.113.1"),
+		mappings: map[[12]byte]uint32{},
+		ports:    map[[12]byte]uint16{},
+	}
+	go s.serve()
+	t.Cleanup(func() { pc.Close() })
+	return s
+}
+
+func (s *fakePCPServer) serve() {
+	buf := make([]byte, 1500)
+	for {
+		n, src, err := s.pc.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		if n < 24 || buf[0] != pcpVersion {
+			continue // NAT-PMP probe
+		}
+		res := s.handle(buf[:n])
+		if res != nil {
+			s.pc.WriteTo(res, src)
+		}
+	}
+}
+
+func (s *fakePCPServer) handle(req []byte) []byte {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	res := make([]byte, len(req))
+	copy(res, req)
+	res[1] |= pcpOpReply
+	binary.BigEndian.PutUint32(res[8:], s.epoch)
+	for i := 12; i < 24; i++ {
+		res[i] = 0 // reserved in responses
+	}
+	switch req[1] {
+	case pcpOpAnnounce:
+		return res
+	case pcpOpMap:
+	default:
+		return nil
+	}
+	if len(req) < 60 {
+		s.t.Errorf("short MAP request: %x", req)
+		return nil
+	}
+	var f pcpMapRequestFields
+	f.lifetime = binary.BigEndian.Uint32(req[4:])
+	copy(f.nonce[:], req[24:36])
+	s.requests = append(s.requests, f)
+	if f.lifetime == 0 {
+		delete(s.mappings, f.nonce)
+		delete(s.ports, f.nonce)
+		return res
+	}
+
+	internalPort := binary.BigEndian.Uint16(req[24+16:])
+	var clientIP16 [16]byte
+	copy(clientIP16[:], req[8:24])
+	clientIP := netaddr.IPFrom16(clientIP16)
+	extPort, ok := s.ports[f.nonce]
+	if !ok {
+		extPort = internalPort + 10000
+		s.ports[f.nonce] = extPort
+	}
+	s.mappings[f.nonce] = f.lifetime
+	ext := s.external
+	if clientIP.Is6() {
+		ext, extPort = clientIP, internalPort // a pinhole
+	}
+	binary.BigEndian.PutUint16(res[24+18:], extPort)
+	ext16 := ext.As16()
+	copy(res[24+20:], ext16[:])
+	return res
+}
+
+func (s *fakePCPServer) setEpoch(epoch uint32) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.epoch = epoch
+}
+
+func (s *fakePCPServer) numMappings() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.mappings)
+}
+
+func (s *fakePCPServer) getRequests() []pcpMapRequestFields {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]pcpMapRequestFields(nil), s.requests...)
+}
+
+// silentPort returns a UDP port on localhost that never answers.
+func silentPort(t *testing.T) uint16 {
+	pc, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { pc.Close() })
+	return uint16(pc.LocalAddr().(*net.UDPAddr).Port)
+}
+
+func newFakePCPClient(t *testing.T, s *fakePCPServer) *Client {
+	c := NewClient(t.Logf, nil)
+	localhost := netaddr.IPv4(127, 0, 0, 1)
+	c.ipAndGateway = func() (gw, myIP netaddr.IP, ok bool) {
+		return localhost, localhost, true
+	}
+	c.ipAndGateway6 = func() (gw, myIP netaddr.IP, ok bool) {
+		return netaddr.IP{}, netaddr.IP{}, false
+	}
+	c.testPxPPort = s.port
+	c.testUPnPPort = silentPort(t)
+	t.Cleanup(func() { c.Close() })
+	return c
+}
+
+func waitForMappings(t *testing.T, s *fakePCPServer, want int) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for s.numMappings() != want {
+		if time.Now().After(deadline) {
+			t.Fatalf("PCP server has %d mappings; want %d", s.numMappings(), want)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestPCPMapping(t *testing.T) {
+	s := newFakePCPServer(t, "127.0.0.1:0")
+	c := newFakePCPClient(t, s)
+	c.SetLocalPort(1234)
+	ctx := context.Background()
+
+	res, err := c.Probe(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !res.PCP {
+		t.Fatalf("Probe = %+v; want PCP", res)
+	}
+
+	want := netaddr.IPPort{IP: s.external, Port: 11234}
+	ext, err := c.CreateOrGetMapping(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ext != want {
+		t.Errorf("CreateOrGetMapping = %v; want %v", ext, want)
+	}
+	if got, want := c.Mappings(), []Mapping{{Protocol: "PCP", External: want, LocalPort: 1234}}; len(got) != 1 || got[0] != want[0] {
+		t.Errorf("Mappings = %v; want %v", got, want)
+	}
+
+	// Renewals reuse the nonce.
+	c.mu.Lock()
+	m := *c.mappings[mapKey{port: 1234}].(*pcpMapping)
+	m.useUntil = time.Time{}
+	c.mappings[mapKey{port: 1234}] = &m
+	c.mu.Unlock()
+	if ext, err := c.CreateOrGetMapping(ctx); err != nil || ext != want {
+		t.Errorf("renewing CreateOrGetMapping = %v, %v; want %v", ext, err, want)
+	}
+	reqs := s.getRequests()
+	if len(reqs) != 2 || reqs[0].nonce != reqs[1].nonce || reqs[1].lifetime != pcpMapLifetimeSec {
+		t.Errorf("MAP requests = %+v; want two with the same nonce", reqs)
+	}
+
+	// The router reboots, losing its mappings, which the next
+	// probe notices. The mapping is then renewed in the background.
+	s.mu.Lock()
+	s.mappings = map[[12]byte]uint32{}
+	s.epoch = 0
+	s.mu.Unlock()
+	c.mu.Lock()
+	c.pcpSawTime = time.Time{} // make Probe ask again
+	c.mu.Unlock()
+	if _, err := c.Probe(ctx); err != nil {
+		t.Fatal(err)
+	}
+	waitForMappings(t, s, 1)
+
+	// Close deletes the mapping.
+	c.Close()
+	waitForMappings(t, s, 0)
+	if reqs := s.getRequests(); reqs[len(reqs)-1].lifetime != 0 {
+		t.Errorf("last MAP request = %+v; want a deletion", reqs[len(reqs)-1])
+	}
+}
+
+func TestPCPMappingNetworkDown(t *testing.T) {
+	s := newFakePCPServer(t, "127.0.0.1:0")
+	c := newFakePCPClient(t, s)
+	c.SetLocalPort(1234)
+	ctx := context.Background()
+	if _, err := c.Probe(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.CreateOrGetMapping(ctx); err != nil {
+		t.Fatal(err)
+	}
+	waitForMappings(t, s, 1)
+	c.NoteNetworkDown()
+	waitForMappings(t, s, 0)
+	if m := c.Mappings(); len(m) != 0 {
+		t.Errorf("Mappings after NoteNetworkDown = %v", m)
+	}
+}
+
+func TestPCPMapping6(t *testing.T) {
+	s := newFakePCPServer(t, "[::1]:0")
+	c := newFakePCPClient(t, s)
+	localhost6 := netaddr.MustParseIP("::1")
+	c.ipAndGateway6 = func() (gw, myIP netaddr.IP, ok bool) {
+		return localhost6, localhost6, true
+	}
+	ctx := context.Background()
+
+	if _, err := c.CreateOrGetMapping6(ctx); !IsNoMappingError(err) {
+		t.Errorf("CreateOrGetMapping6 without a port: error = %v; want NoMappingError", err)
+	}
+	c.SetLocalPort6(4567)
+	want := netaddr.IPPort{IP: localhost6, Port: 4567}
+	ext, err := c.CreateOrGetMapping6(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ext != want {
+		t.Errorf("CreateOrGetMapping6 = %v; want %v", ext, want)
+	}
+	if got := c.Mappings(); len(got) != 1 || got[0] != (Mapping{Protocol: "PCP", External: want, LocalPort: 4567}) {
+		t.Errorf("Mappings = %v", got)
+	}
+	c.SetLocalPort6(0)
+	waitForMappings(t, s, 0)
+}
+
+func TestPCPEpochValid(t *testing.T) {
+	t0 := time.Unix(1600000000, 0)
+	tests := []struct {
+		name             string
+		prevEpoch, epoch uint32
+		elapsed          time.Duration
+		want             bool
+	}{
+		{"steady", 1000, 1060, time.Minute, true},
+		{"slight-skew", 1000, 1062, time.Minute, true},
+		{"same", 1000, 1000, 0, true},
+		{"one-back", 1000, 999, 0, true},
+		{"rebooted", 1000, 5, time.Minute, false},
+		{"server-too-slow", 1000, 1010, time.Minute, false},
+		{"server-too-fast", 1000, 2000, time.Minute, false},
+	}
+	for _, tt := range tests {
+		if got := pcpEpochValid(tt.prevEpoch, tt.epoch, t0, t0.Add(tt.elapsed)); got != tt.want {
+			t.Errorf("%s: pcpEpochValid = %v; want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestPCPMapRequest(t *testing.T) {
+	nonce := [12]byte{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12}
+	internal := netaddr.MustParseIPPort("192.168.1.2:41641")
+	pkt := pcpMapRequest(internal, netaddr.IPPort{}, pcpMapLifetimeSec, nonce)
+	if len(pkt) != 60 || pkt[0] != pcpVersion || pkt[1] != pcpOpMap {
+		t.Fatalf("bad header: %x", pkt)
+	}
+	if got := binary.BigEndian.Uint32(pkt[4:]); got != pcpMapLifetimeSec {
+		t.Errorf("lifetime = %d", got)
+	}
+	var ip16 [16]byte
+	copy(ip16[:], pkt[8:24])
+	if got := netaddr.IPFrom16(ip16); got != internal.IP {
+		t.Errorf("client IP = %v; want %v", got, internal.IP)
+	}
+	copy(ip16[:], pkt[44:60])
+	if got := netaddr.IPFrom16(ip16); got != netaddr.IPv4(0, 0, 0, 0) {
+		t.Errorf("suggested IP = %v; want 0.0.0.0", got)
+	}
+
+	// A response is the request, with the reply bit and results set.
+	res := append([]byte(nil), pkt...)
+	res[1] |= pcpOpReply
+	binary.BigEndian.PutUint32(res[8:], 1234) // epoch
+	binary.BigEndian.PutUint16(res[42:], 5678)
+	ext := netaddr.MustParseIP("203.0.113.1").As16()
+	copy(res[44:], ext[:])
+	pres, ok := parsePCPMapResponse(res)
+	if !ok {
+		t.Fatal("parsePCPMapResponse failed")
+	}
+	want := pcpMapResponse{
+		pcpResponse:  pcpResponse{OpCode: pcpOpReply | pcpOpMap, Lifetime: pcpMapLifetimeSec, Epoch: 1234},
+		Nonce:        nonce,
+		Protocol:     pcpUDPMapping,
+		InternalPort: 41641,
+		External:     netaddr.MustParseIPPort("203.0.113.1:5678"),
+	}
+	if pres != want {
+		t.Errorf("parsePCPMapResponse = %+v; want %+v", pres, want)
+	}
+	if _, ok := parsePCPMapResponse(res[:59]); ok {
+		t.Error("parsed short response")
+	}
+}
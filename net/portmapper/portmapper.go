@@ -2,18 +2,18 @@
 // Use of this source code is governed by a BSD-style
 // license that can be found in the LICENSE file.
 
-// Package portmapper is a UDP port mapping client. It currently only does
-// NAT-PMP, but will likely do UPnP and perhaps PCP later.
+// Package portmapper is a UDP port mapping client. It does NAT-PMP,
+// PCP and UPnP, and PCP over IPv6 to open firewall pinholes.
 package portmapper
 
 import (
 	"context"
-	"crypto/rand"
 	"encoding/binary"
 	"errors"
 	"fmt"
 	"io"
 	"net"
+	"sort"
 	"sync"
 	"time"
 
@@ -28,6 +28,7 @@ import (
 //
 // NAT-PMP: https://tools.ietf.org/html/rfc6886
 // PCP: https://tools.ietf.org/html/rfc6887
+// UPnP IGD: http://upnp.org/specs/gw/UPnP-gw-WANIPConnection-v1-Service.pdf
 
 // portMapServiceTimeout is the time we wait for port mapping
 // services (UPnP, NAT-PMP, PCP) to respond before we give up and
@@ -42,13 +43,27 @@ const trustServiceStillAvailableDuration = 10 * time.Minute
 
 // Client is a port mapping client.
 type Client struct {
-	logf logger.Logf
+	logf     logger.Logf
+	onChange func() // or nil
+
+	// For tests:
+	ipAndGateway  func() (gw, myIP netaddr.IP, ok bool) // if nil, interfaces.LikelyHomeRouterIP
+	ipAndGateway6 func() (gw, myIP netaddr.IP, ok bool) // if nil, interfaces.LikelyHomeRouterIPv6
+	testPxPPort   uint16                                // if non-zero, NAT-PMP/PCP port to use
+	testUPnPPort  uint16                                // if non-zero, SSDP port to use
+
+	// mapMu serializes the creation and renewal of mappings, so
+	// that there's one request in flight per mapping. If both mapMu
+	// and mu are held, mapMu must be acquired first.
+	mapMu sync.Mutex
 
 	mu sync.Mutex // guards following, and all fields thereof
 
-	lastMyIP netaddr.IP
-	lastGW   netaddr.IP
-	closed   bool
+	lastMyIP  netaddr.IP
+	lastGW    netaddr.IP
+	lastMyIP6 netaddr.IP
+	lastGW6   netaddr.IP
+	closed    bool
 
 	lastProbe time.Time
 
@@ -56,18 +71,83 @@ type Client struct {
 	pmpPubIPTime time.Time  // time pmpPubIP last verified
 	pmpLastEpoch uint32
 
-	pcpSawTime  time.Time // time we last saw PCP was available
-	uPnPSawTime time.Time // time we last saw UPnP was available
+	pcpSawTime   time.Time // time we last saw PCP was available
+	uPnPSawTime  time.Time // time we last saw UPnP was available
+	uPnPLocation string    // URL of the UPnP IGD's root device description
+	noPCP6Time   time.Time // time no IPv6 PCP server answered us
+
+	pcpEpochs map[netaddr.IP]pcpEpoch // last epoch of each PCP server
 
 	localPort  uint16
-	pmpMapping *pmpMapping // non-nil if we have a PMP mapping
+	localPort6 uint16
+	extraPorts []uint16 // sorted; more local ports to map over IPv4
+
+	mappings   map[mapKey]mapping // the mappings we hold
+	renewTimer *time.Timer        // runs maintain when a mapping is due; nil if none
+}
+
+// mapKey identifies a mapping held by a Client: a local UDP port, and
+// whether it's mapped over IPv6 (with PCP) rather than IPv4.
+type mapKey struct {
+	port uint16
+	v6   bool
+}
+
+// mapping is an already-created port mapping, of any protocol.
+type mapping interface {
+	// externalIPPort returns the mapping's external address.
+	externalIPPort() netaddr.IPPort
+	// renewAfter returns the time after which the mapping should
+	// be renewed rather than returned as is.
+	renewAfter() time.Time
+	// protocol returns the name of the mapping's protocol, as
+	// reported in Mapping.Protocol.
+	protocol() string
+	// release does a best effort fire-and-forget release of the
+	// mapping. It mustn't block.
+	release()
+}
+
+// Mapping describes a port mapping held by a Client.
+type Mapping struct {
+	// Protocol is the protocol that created the mapping: "PCP",
+	// "PMP" (for NAT-PMP) or "UPnP".
+	Protocol string
+	// External is the mapping's external address. For IPv6, PCP
+	// opens a firewall pinhole, and it's the internal address.
+	External netaddr.IPPort
+	// LocalPort is the mapped local UDP port.
+	LocalPort uint16
+}
+
+func (m Mapping) String() string {
+	return m.Protocol + " " + m.External.String()
+}
+
+// Mappings returns the Client's current port mappings, IPv4 first,
+// then by local port.
+func (c *Client) Mappings() []Mapping {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var ret []Mapping
+	for k, m := range c.mappings {
+		ret = append(ret, Mapping{Protocol: m.protocol(), External: m.externalIPPort(), LocalPort: k.port})
+	}
+	sort.Slice(ret, func(i, j int) bool {
+		a, b := ret[i], ret[j]
+		if a.External.IP.Is4() != b.External.IP.Is4() {
+			return a.External.IP.Is4()
+		}
+		return a.LocalPort < b.LocalPort
+	})
+	return ret
 }
 
 // pmpMapping is an already-created PMP mapping.
 //
 // All fields are immutable once created.
 type pmpMapping struct {
-	gw       netaddr.IP
+	gw       netaddr.IPPort // the NAT-PMP server
 	external netaddr.IPPort
 	internal netaddr.IPPort
 	useUntil time.Time // the mapping's lifetime minus renewal interval
@@ -79,6 +159,10 @@ func (m *pmpMapping) externalValid() bool {
 	return !m.external.IP.IsZero() && m.external.Port != 0
 }
 
+func (m *pmpMapping) externalIPPort() netaddr.IPPort { return m.external }
+func (m *pmpMapping) renewAfter() time.Time          { return m.useUntil }
+func (m *pmpMapping) protocol() string               { return "PMP" }
+
 // release does a best effort fire-and-forget release of the PMP mapping m.
 func (m *pmpMapping) release() {
 	uc, err := netns.Listener().ListenPacket(context.Background(), "udp4", ":0")
@@ -87,24 +171,30 @@ func (m *pmpMapping) release() {
 	}
 	defer uc.Close()
 	pkt := buildPMPRequestMappingPacket(m.internal.Port, m.external.Port, pmpMapLifetimeDelete)
-	uc.WriteTo(pkt, netaddr.IPPort{IP: m.gw, Port: pmpPort}.UDPAddr())
+	uc.WriteTo(pkt, m.gw.UDPAddr())
 }
 
 // NewClient returns a new portmapping client.
-func NewClient(logf logger.Logf) *Client {
+//
+// The optional onChange argument specifies a func to run in a new
+// goroutine whenever the Client's port mappings change: when one is
+// created, changes its external address, or is lost. Mappings are
+// renewed in the background as long as they're wanted.
+func NewClient(logf logger.Logf, onChange func()) *Client {
 	return &Client{
-		logf: logf,
+		logf:     logf,
+		onChange: onChange,
 	}
 }
 
 // NoteNetworkDown should be called when the network has transitioned to a down state.
-// It's too late to release port mappings at this point (the user might've just turned off
-// their wifi), but we can make sure we invalidate mappings for later when the network
-// comes back.
+// It's likely too late to release port mappings at this point (the user might've just
+// turned off their wifi), but we try anyway, best effort, in case the router is still
+// reachable, and we make sure we invalidate mappings for later when the network comes back.
 func (c *Client) NoteNetworkDown() {
 	c.mu.Lock()
 	defer c.mu.Unlock()
-	c.invalidateMappingsLocked(false)
+	c.invalidateMappingsLocked(true)
 }
 
 func (c *Client) Close() error {
@@ -129,11 +219,181 @@ func (c *Client) SetLocalPort(localPort uint16) {
 		return
 	}
 	c.localPort = localPort
-	c.invalidateMappingsLocked(true)
+	c.pruneMappingsLocked()
+}
+
+// SetLocalPort6 updates the local port number of the IPv6 socket for
+// which we want a PCP firewall pinhole. Zero means none.
+func (c *Client) SetLocalPort6(localPort uint16) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.localPort6 == localPort {
+		return
+	}
+	c.localPort6 = localPort
+	c.pruneMappingsLocked()
+}
+
+// SetExtraLocalPorts sets the local ports, besides the one set by
+// SetLocalPort, to which we want to port map UDP traffic over IPv4,
+// such as those of other services on this machine. Their mappings
+// are created and renewed in the background, and reported by
+// Mappings.
+func (c *Client) SetExtraLocalPorts(ports []uint16) {
+	var extra []uint16
+	for _, p := range ports {
+		if p != 0 {
+			extra = append(extra, p)
+		}
+	}
+	sort.Slice(extra, func(i, j int) bool { return extra[i] < extra[j] })
+	for i := 1; i < len(extra); i++ {
+		if extra[i] == extra[i-1] {
+			extra = append(extra[:i], extra[i+1:]...)
+			i--
+		}
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.extraPorts = extra
+	c.pruneMappingsLocked()
+	if len(extra) > 0 && !c.closed {
+		go c.maintain()
+	}
+}
+
+// wantedKeysLocked returns the keys of the mappings the Client
+// should hold.
+func (c *Client) wantedKeysLocked() (keys []mapKey) {
+	if c.localPort != 0 {
+		keys = append(keys, mapKey{port: c.localPort})
+	}
+	if c.localPort6 != 0 {
+		keys = append(keys, mapKey{port: c.localPort6, v6: true})
+	}
+	for _, p := range c.extraPorts {
+		if p != c.localPort {
+			keys = append(keys, mapKey{port: p})
+		}
+	}
+	return keys
+}
+
+// wantedLocked reports whether the Client should hold a mapping for k.
+func (c *Client) wantedLocked(k mapKey) bool {
+	for _, k2 := range c.wantedKeysLocked() {
+		if k == k2 {
+			return true
+		}
+	}
+	return false
+}
+
+// pruneMappingsLocked releases the mappings the Client no longer
+// wants.
+func (c *Client) pruneMappingsLocked() {
+	for k := range c.mappings {
+		if !c.wantedLocked(k) {
+			c.deleteMappingLocked(k, true)
+		}
+	}
+}
+
+// setMappingLocked stores m as the mapping for k.
+func (c *Client) setMappingLocked(k mapKey, m mapping) {
+	old, ok := c.mappings[k]
+	if c.mappings == nil {
+		c.mappings = map[mapKey]mapping{}
+	}
+	c.mappings[k] = m
+	if !ok || old.externalIPPort() != m.externalIPPort() {
+		c.notifyChangeLocked()
+	}
+	c.scheduleRenewalLocked()
+}
+
+// deleteMappingLocked forgets the mapping for k, if any, first
+// releasing it if releaseOld is true.
+func (c *Client) deleteMappingLocked(k mapKey, releaseOld bool) {
+	m, ok := c.mappings[k]
+	if !ok {
+		return
+	}
+	if releaseOld {
+		m.release()
+	}
+	delete(c.mappings, k)
+	c.notifyChangeLocked()
+	c.scheduleRenewalLocked()
+}
+
+func (c *Client) notifyChangeLocked() {
+	if c.onChange != nil && !c.closed {
+		go c.onChange()
+	}
+}
+
+// scheduleRenewalLocked arranges for maintain to run when the first of
+// the Client's mappings is due for renewal.
+func (c *Client) scheduleRenewalLocked() {
+	if c.renewTimer != nil {
+		c.renewTimer.Stop()
+		c.renewTimer = nil
+	}
+	if c.closed {
+		return
+	}
+	var next time.Time
+	have := false
+	for _, m := range c.mappings {
+		if t := m.renewAfter(); !have || t.Before(next) {
+			next, have = t, true
+		}
+	}
+	if have {
+		c.renewTimer = time.AfterFunc(time.Until(next), c.maintain)
+	}
+}
+
+// maintainTimeout is how long maintain waits for each mapping to be
+// created or renewed.
+const maintainTimeout = 10 * time.Second
+
+// maintain creates or renews each mapping the Client wants that's
+// missing or due for renewal. It runs in the background, when a
+// mapping is due or the set of wanted mappings grows.
+func (c *Client) maintain() {
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return
+	}
+	now := time.Now()
+	var due []mapKey
+	for _, k := range c.wantedKeysLocked() {
+		if m, ok := c.mappings[k]; !ok || !now.Before(m.renewAfter()) {
+			due = append(due, k)
+		}
+	}
+	c.mu.Unlock()
+
+	for _, k := range due {
+		ctx, cancel := context.WithTimeout(context.Background(), maintainTimeout)
+		_, err := c.createOrGetMapping(ctx, k)
+		cancel()
+		if err != nil && !IsNoMappingError(err) {
+			c.logf("mapping local port %d: %v", k.port, err)
+		}
+	}
 }
 
 func (c *Client) gatewayAndSelfIP() (gw, myIP netaddr.IP, ok bool) {
-	gw, myIP, ok = interfaces.LikelyHomeRouterIP()
+	if c.ipAndGateway != nil {
+		gw, myIP, ok = c.ipAndGateway()
+	} else {
+		gw, myIP, ok = interfaces.LikelyHomeRouterIP()
+	}
 	if !ok {
 		gw = netaddr.IP{}
 		myIP = netaddr.IP{}
@@ -150,17 +410,67 @@ func (c *Client) gatewayAndSelfIP() (gw, myIP netaddr.IP, ok bool) {
 	return
 }
 
+func (c *Client) gatewayAndSelfIP6() (gw, myIP netaddr.IP, ok bool) {
+	if c.ipAndGateway6 != nil {
+		gw, myIP, ok = c.ipAndGateway6()
+	} else {
+		gw, myIP, ok = interfaces.LikelyHomeRouterIPv6()
+	}
+	if !ok {
+		gw = netaddr.IP{}
+		myIP = netaddr.IP{}
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if gw != c.lastGW6 || myIP != c.lastMyIP6 || !ok {
+		c.lastMyIP6 = myIP
+		c.lastGW6 = gw
+		c.invalidateMapping6Locked(true)
+	}
+	return
+}
+
 func (c *Client) invalidateMappingsLocked(releaseOld bool) {
-	if c.pmpMapping != nil {
-		if releaseOld {
-			c.pmpMapping.release()
+	for k := range c.mappings {
+		if !k.v6 {
+			c.deleteMappingLocked(k, releaseOld)
 		}
-		c.pmpMapping = nil
 	}
 	c.pmpPubIP = netaddr.IP{}
 	c.pmpPubIPTime = time.Time{}
 	c.pcpSawTime = time.Time{}
 	c.uPnPSawTime = time.Time{}
+	c.uPnPLocation = ""
+	c.pcpEpochs = nil
+	c.invalidateMapping6Locked(releaseOld)
+}
+
+func (c *Client) invalidateMapping6Locked(releaseOld bool) {
+	for k := range c.mappings {
+		if k.v6 {
+			c.deleteMappingLocked(k, releaseOld)
+		}
+	}
+	c.noPCP6Time = time.Time{}
+}
+
+// pxpPort returns the NAT-PMP and PCP server port.
+func (c *Client) pxpPort() uint16 {
+	if c.testPxPPort != 0 {
+		return c.testPxPPort
+	}
+	return pmpPort
+}
+
+// upnpPort returns the port to which SSDP discovery requests are
+// sent.
+func (c *Client) upnpPort() uint16 {
+	if c.testUPnPPort != 0 {
+		return c.testUPnPPort
+	}
+	return upnpPort
 }
 
 func (c *Client) sawPMPRecently() bool {
@@ -176,13 +486,21 @@ func (c *Client) sawPMPRecentlyLocked() bool {
 func (c *Client) sawPCPRecently() bool {
 	c.mu.Lock()
 	defer c.mu.Unlock()
+	return c.sawPCPRecentlyLocked()
+}
+
+func (c *Client) sawPCPRecentlyLocked() bool {
 	return c.pcpSawTime.After(time.Now().Add(-trustServiceStillAvailableDuration))
 }
 
 func (c *Client) sawUPnPRecently() bool {
 	c.mu.Lock()
 	defer c.mu.Unlock()
-	return c.uPnPSawTime.After(time.Now().Add(-trustServiceStillAvailableDuration))
+	return c.sawUPnPRecentlyLocked()
+}
+
+func (c *Client) sawUPnPRecentlyLocked() bool {
+	return c.uPnPLocation != "" && c.uPnPSawTime.After(time.Now().Add(-trustServiceStillAvailableDuration))
 }
 
 // closeCloserOnContextDone starts a new goroutine to call c.Close
@@ -223,78 +541,217 @@ func IsNoMappingError(err error) bool {
 var (
 	ErrNoPortMappingServices = errors.New("no port mapping services were found")
 	ErrGatewayNotFound       = errors.New("failed to look gateway address")
+
+	errNoLocalPort = errors.New("no local port to map")
+	errUnwanted    = errors.New("mapping no longer wanted")
 )
 
-// CreateOrGetMapping either creates a new mapping or returns a cached
-// valid one.
+// CreateOrGetMapping either creates a new mapping for the port set by
+// SetLocalPort or returns a cached valid one.
 //
 // If no mapping is available, the error will be of type
 // NoMappingError; see IsNoMappingError.
 func (c *Client) CreateOrGetMapping(ctx context.Context) (external netaddr.IPPort, err error) {
-	gw, myIP, ok := c.gatewayAndSelfIP()
+	c.mu.Lock()
+	k := mapKey{port: c.localPort}
+	_, had := c.mappings[k]
+	haveExtra := len(c.extraPorts) > 0
+	c.mu.Unlock()
+
+	external, err = c.createOrGetMapping(ctx, k)
+	if err == nil && !had && haveExtra {
+		// We've found a port mapping service; map the extra
+		// ports too.
+		go c.maintain()
+	}
+	return external, err
+}
+
+// CreateOrGetMapping6 either creates a new IPv6 PCP mapping for the
+// port set by SetLocalPort6 or returns a cached valid one. IPv6
+// doesn't need NAT, so the mapping is a firewall pinhole, and its
+// external address is this machine's global IPv6 address.
+//
+// If no mapping is available, the error will be of type
+// NoMappingError; see IsNoMappingError.
+func (c *Client) CreateOrGetMapping6(ctx context.Context) (external netaddr.IPPort, err error) {
+	c.mu.Lock()
+	k := mapKey{port: c.localPort6, v6: true}
+	c.mu.Unlock()
+	return c.createOrGetMapping(ctx, k)
+}
+
+// createOrGetMapping either creates (or renews) the mapping for k, or
+// returns it if it's valid.
+func (c *Client) createOrGetMapping(ctx context.Context, k mapKey) (external netaddr.IPPort, err error) {
+	if k.port == 0 {
+		return netaddr.IPPort{}, NoMappingError{errNoLocalPort}
+	}
+	c.mapMu.Lock()
+	defer c.mapMu.Unlock()
+
+	var gw, myIP netaddr.IP
+	var ok bool
+	if k.v6 {
+		gw, myIP, ok = c.gatewayAndSelfIP6()
+	} else {
+		gw, myIP, ok = c.gatewayAndSelfIP()
+	}
 	if !ok {
 		return netaddr.IPPort{}, NoMappingError{ErrGatewayNotFound}
 	}
 
+	// Do we have an existing mapping that's valid?
 	c.mu.Lock()
-	localPort := c.localPort
-	m := &pmpMapping{
-		gw:       gw,
-		internal: netaddr.IPPort{IP: myIP, Port: localPort},
+	prev := c.mappings[k]
+	if prev != nil && time.Now().Before(prev.renewAfter()) {
+		defer c.mu.Unlock()
+		return prev.externalIPPort(), nil
+	}
+	c.mu.Unlock()
+
+	internal := netaddr.IPPort{IP: myIP, Port: k.port}
+	var m mapping
+	if k.v6 {
+		m, err = c.createMapping6(ctx, gw, internal, prev)
+	} else {
+		m, err = c.createMapping(ctx, gw, internal, prev)
 	}
 
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err != nil {
+		if IsNoMappingError(err) {
+			// We couldn't renew the mapping, so it's lost.
+			c.deleteMappingLocked(k, false)
+		}
+		return netaddr.IPPort{}, err
+	}
+	if c.closed || !c.wantedLocked(k) {
+		m.release()
+		return netaddr.IPPort{}, NoMappingError{errUnwanted}
+	}
+	c.setMappingLocked(k, m)
+	return m.externalIPPort(), nil
+}
+
+// createMapping creates a new IPv4 mapping of internal, or renews
+// prev (which may be nil), with the best port mapping service we know
+// of on the gateway gw.
+func (c *Client) createMapping(ctx context.Context, gw netaddr.IP, internal netaddr.IPPort, prev mapping) (mapping, error) {
+	c.mu.Lock()
+	pxpAddr := netaddr.IPPort{IP: gw, Port: c.pxpPort()}
+
 	// prevPort is the port we had most previously, if any. We try
 	// to ask for the same port. 0 means to give us any port.
 	var prevPort uint16
-
-	// Do we have an existing mapping that's valid?
-	now := time.Now()
-	if m := c.pmpMapping; m != nil {
-		if now.Before(m.useUntil) {
-			defer c.mu.Unlock()
-			return m.external, nil
-		}
+	if prev != nil {
 		// The mapping might still be valid, so just try to renew it.
-		prevPort = m.external.Port
+		prevPort = prev.externalIPPort().Port
 	}
 
 	// If we just did a Probe (e.g. via netchecker) but didn't
-	// find a PMP service, bail out early rather than probing
-	// again. Cuts down latency for most clients.
+	// find a PCP, PMP or UPnP service, bail out early rather than
+	// probing again. Cuts down latency for most clients.
+	haveRecentPCP := c.sawPCPRecentlyLocked()
 	haveRecentPMP := c.sawPMPRecentlyLocked()
+	haveRecentUPnP := c.sawUPnPRecentlyLocked()
+	pm := &pmpMapping{
+		gw:       pxpAddr,
+		internal: internal,
+	}
 	if haveRecentPMP {
-		m.external.IP = c.pmpPubIP
+		pm.external.IP = c.pmpPubIP
 	}
-	if c.lastProbe.After(now.Add(-5*time.Second)) && !haveRecentPMP {
+	if c.lastProbe.After(time.Now().Add(-5*time.Second)) && !haveRecentPCP && !haveRecentPMP && !haveRecentUPnP {
 		c.mu.Unlock()
-		return netaddr.IPPort{}, NoMappingError{ErrNoPortMappingServices}
+		return nil, NoMappingError{ErrNoPortMappingServices}
+	}
+	upnpLocation := c.uPnPLocation
+
+	c.mu.Unlock()
+
+	// Try the services we know of in order of preference: PCP,
+	// NAT-PMP, then UPnP. If we don't know of any, try NAT-PMP.
+	if haveRecentPCP {
+		m, err := c.createPCPMapping(ctx, pxpAddr, internal, prev)
+		if err == nil {
+			return m, nil
+		}
+		if !IsNoMappingError(err) || !haveRecentPMP && !haveRecentUPnP {
+			return nil, err
+		}
+		c.logf("PCP mapping failed: %v", err)
+	}
+	if haveRecentPMP || !haveRecentPCP && !haveRecentUPnP {
+		err := c.createPMPMapping(ctx, pm, prevPort)
+		if err == nil {
+			return pm, nil
+		}
+		if !haveRecentUPnP || !IsNoMappingError(err) {
+			return nil, err
+		}
+		c.logf("NAT-PMP mapping failed: %v", err)
+	}
+	m, err := c.createUPnPMapping(ctx, gw, upnpLocation, internal, prevPort)
+	if err != nil {
+		return nil, err
 	}
+	return m, nil
+}
 
+// createMapping6 creates a new IPv6 PCP mapping of internal, or renews
+// prev (which may be nil), with the PCP server on the gateway gw.
+func (c *Client) createMapping6(ctx context.Context, gw netaddr.IP, internal netaddr.IPPort, prev mapping) (mapping, error) {
+	c.mu.Lock()
+	// IPv6 PCP servers are rare, so if we recently found there
+	// wasn't one, don't wait for it to not answer again.
+	if prev == nil && c.noPCP6Time.After(time.Now().Add(-trustServiceStillAvailableDuration)) {
+		c.mu.Unlock()
+		return nil, NoMappingError{ErrNoPortMappingServices}
+	}
+	pcpAddr := netaddr.IPPort{IP: gw, Port: c.pxpPort()}
 	c.mu.Unlock()
 
+	m, err := c.createPCPMapping(ctx, pcpAddr, internal, prev)
+	if err != nil {
+		if IsNoMappingError(err) {
+			c.mu.Lock()
+			c.noPCP6Time = time.Now()
+			c.mu.Unlock()
+		}
+		return nil, err
+	}
+	return m, nil
+}
+
+// createPMPMapping creates (or renews, if prevPort is non-zero) the
+// NAT-PMP mapping m, whose gw and internal fields are set, and whose
+// external IP is set if known. It fills in the rest of m.
+func (c *Client) createPMPMapping(ctx context.Context, m *pmpMapping, prevPort uint16) error {
 	uc, err := netns.Listener().ListenPacket(ctx, "udp4", ":0")
 	if err != nil {
-		return netaddr.IPPort{}, err
+		return err
 	}
 	defer uc.Close()
 
 	uc.SetReadDeadline(time.Now().Add(portMapServiceTimeout))
 	defer closeCloserOnContextDone(ctx, uc)()
 
-	pmpAddr := netaddr.IPPort{IP: gw, Port: pmpPort}
+	pmpAddr := m.gw
 	pmpAddru := pmpAddr.UDPAddr()
 
 	// Ask for our external address if needed.
 	if m.external.IP.IsZero() {
 		if _, err := uc.WriteTo(pmpReqExternalAddrPacket, pmpAddru); err != nil {
-			return netaddr.IPPort{}, err
+			return err
 		}
 	}
 
 	// And ask for a mapping.
-	pmpReqMapping := buildPMPRequestMappingPacket(localPort, prevPort, pmpMapLifetimeSec)
+	pmpReqMapping := buildPMPRequestMappingPacket(m.internal.Port, prevPort, pmpMapLifetimeSec)
 	if _, err := uc.WriteTo(pmpReqMapping, pmpAddru); err != nil {
-		return netaddr.IPPort{}, err
+		return err
 	}
 
 	res := make([]byte, 1500)
@@ -302,9 +759,9 @@ func (c *Client) CreateOrGetMapping(ctx context.Context) (external netaddr.IPPor
 		n, srci, err := uc.ReadFrom(res)
 		if err != nil {
 			if ctx.Err() == context.Canceled {
-				return netaddr.IPPort{}, err
+				return err
 			}
-			return netaddr.IPPort{}, NoMappingError{ErrNoPortMappingServices}
+			return NoMappingError{ErrNoPortMappingServices}
 		}
 		srcu := srci.(*net.UDPAddr)
 		src, ok := netaddr.FromStdAddr(srcu.IP, srcu.Port, srcu.Zone)
@@ -318,7 +775,7 @@ func (c *Client) CreateOrGetMapping(ctx context.Context) (external netaddr.IPPor
 				continue
 			}
 			if pres.ResultCode != 0 {
-				return netaddr.IPPort{}, NoMappingError{fmt.Errorf("PMP response Op=0x%x,Res=0x%x", pres.OpCode, pres.ResultCode)}
+				return NoMappingError{fmt.Errorf("PMP response Op=0x%x,Res=0x%x", pres.OpCode, pres.ResultCode)}
 			}
 			if pres.OpCode == pmpOpReply|pmpOpMapPublicAddr {
 				m.external.IP = pres.PublicAddr
@@ -333,10 +790,7 @@ func (c *Client) CreateOrGetMapping(ctx context.Context) (external netaddr.IPPor
 		}
 
 		if m.externalValid() {
-			c.mu.Lock()
-			defer c.mu.Unlock()
-			c.pmpMapping = m
-			return m.external, nil
+			return nil
 		}
 	}
 }
@@ -452,8 +906,10 @@ func (c *Client) Probe(ctx context.Context) (res ProbeResult, err error) {
 	defer cancel()
 	defer closeCloserOnContextDone(ctx, uc)()
 
-	pcpAddr := netaddr.IPPort{IP: gw, Port: pcpPort}.UDPAddr()
-	pmpAddr := netaddr.IPPort{IP: gw, Port: pmpPort}.UDPAddr()
+	pxpPort := c.pxpPort()
+	upnpPort := c.upnpPort()
+	pcpAddr := netaddr.IPPort{IP: gw, Port: pxpPort}.UDPAddr()
+	pmpAddr := pcpAddr
 	upnpAddr := netaddr.IPPort{IP: gw, Port: upnpPort}.UDPAddr()
 
 	// Don't send probes to services that we recently learned (for
@@ -488,22 +944,37 @@ func (c *Client) Probe(ctx context.Context) (res ProbeResult, err error) {
 			}
 			return res, err
 		}
-		port := addr.(*net.UDPAddr).Port
-		switch port {
+		srcu := addr.(*net.UDPAddr)
+		src, ok := netaddr.FromStdAddr(srcu.IP, srcu.Port, srcu.Zone)
+		if !ok || src.IP != gw {
+			continue
+		}
+		switch src.Port {
 		case upnpPort:
+			if res.UPnP {
+				// ssdp:all gets several responses; the first will do.
+				continue
+			}
 			if mem.Contains(mem.B(buf[:n]), mem.S(":InternetGatewayDevice:")) {
+				loc, err := parseUPnPDiscoResponse(buf[:n], gw)
+				if err != nil {
+					c.logf("unexpected UPnP discovery response: %v", err)
+					continue
+				}
 				res.UPnP = true
 				c.mu.Lock()
 				c.uPnPSawTime = time.Now()
+				c.uPnPLocation = loc
 				c.mu.Unlock()
 			}
-		case pcpPort: // same as pmpPort
+		case pxpPort: // PCP and PMP share a port
 			if pres, ok := parsePCPResponse(buf[:n]); ok {
 				if pres.OpCode == pcpOpReply|pcpOpAnnounce && pres.ResultCode == pcpCodeOK {
 					c.logf("Got PCP response: epoch: %v", pres.Epoch)
 					res.PCP = true
 					c.mu.Lock()
 					c.pcpSawTime = time.Now()
+					c.notePCPEpochLocked(gw, pres.Epoch)
 					c.mu.Unlock()
 					continue
 				}
@@ -526,78 +997,6 @@ func (c *Client) Probe(ctx context.Context) (res ProbeResult, err error) {
 	}
 }
 
-const (
-	pcpVersion = 2
-	pcpPort    = 5351
-
-	pcpCodeOK = 0
-
-	pcpOpReply    = 0x80 // OR'd into request's op code on response
-	pcpOpAnnounce = 0
-	pcpOpMap      = 1
-)
-
-// pcpAnnounceRequest generates a PCP packet with an ANNOUNCE opcode.
-func pcpAnnounceRequest(myIP netaddr.IP) []byte {
-	// See https://tools.ietf.org/html/rfc6887#section-7.1
-	pkt := make([]byte, 24)
-	pkt[0] = pcpVersion // version
-	pkt[1] = pcpOpAnnounce
-	myIP16 := myIP.As16()
-	copy(pkt[8:], myIP16[:])
-	return pkt
-}
-
-//lint:ignore U1000 moved this code from netcheck's old PCP probing; will be needed when we add PCP mapping
-
-// pcpMapRequest generates a PCP packet with a MAP opcode.
-func pcpMapRequest(myIP netaddr.IP, mapToLocalPort int, delete bool) []byte {
-	const udpProtoNumber = 17
-	lifetimeSeconds := uint32(1)
-	if delete {
-		lifetimeSeconds = 0
-	}
-	const opMap = 1
-
-	// 24 byte header + 36 byte map opcode
-	pkt := make([]byte, (32+32+128)/8+(96+8+24+16+16+128)/8)
-
-	// The header (https://tools.ietf.org/html/rfc6887#section-7.1)
-	pkt[0] = 2 // version
-	pkt[1] = opMap
-	binary.BigEndian.PutUint32(pkt[4:8], lifetimeSeconds)
-	myIP16 := myIP.As16()
-	copy(pkt[8:], myIP16[:])
-
-	// The map opcode body (https://tools.ietf.org/html/rfc6887#section-11.1)
-	mapOp := pkt[24:]
-	rand.Read(mapOp[:12]) // 96 bit mappping nonce
-	mapOp[12] = udpProtoNumber
-	binary.BigEndian.PutUint16(mapOp[16:], uint16(mapToLocalPort))
-	v4unspec := netaddr.MustParseIP("0.0.0.0")
-	v4unspec16 := v4unspec.As16()
-	copy(mapOp[20:], v4unspec16[:])
-	return pkt
-}
-
-type pcpResponse struct {
-	OpCode     uint8
-	ResultCode uint8
-	Lifetime   uint32
-	Epoch      uint32
-}
-
-func parsePCPResponse(b []byte) (res pcpResponse, ok bool) {
-	if len(b) < 24 || b[0] != pcpVersion {
-		return
-	}
-	res.OpCode = b[1]
-	res.ResultCode = b[3]
-	res.Lifetime = binary.BigEndian.Uint32(b[4:])
-	res.Epoch = binary.BigEndian.Uint32(b[8:])
-	return res, true
-}
-
 const (
 	upnpPort = 1900
 )
@@ -7,16 +7,20 @@ package portmapper
 import (
 	"context"
 	"os"
+	"reflect"
 	"strconv"
+	"sync/atomic"
 	"testing"
 	"time"
+
+	"inet.af/netaddr"
 )
 
 func TestCreateOrGetMapping(t *testing.T) {
 	if v, _ := strconv.ParseBool(os.Getenv("HIT_NETWORK")); !v {
 		t.Skip("skipping test without HIT_NETWORK=1")
 	}
-	c := NewClient(t.Logf)
+	c := NewClient(t.Logf, nil)
 	c.SetLocalPort(1234)
 	for i := 0; i < 2; i++ {
 		if i > 0 {
@@ -31,7 +35,7 @@ func TestClientProbe(t *testing.T) {
 	if v, _ := strconv.ParseBool(os.Getenv("HIT_NETWORK")); !v {
 		t.Skip("skipping test without HIT_NETWORK=1")
 	}
-	c := NewClient(t.Logf)
+	c := NewClient(t.Logf, nil)
 	for i := 0; i < 2; i++ {
 		if i > 0 {
 			time.Sleep(100 * time.Millisecond)
@@ -45,10 +49,99 @@ func TestClientProbeThenMap(t *testing.T) {
 	if v, _ := strconv.ParseBool(os.Getenv("HIT_NETWORK")); !v {
 		t.Skip("skipping test without HIT_NETWORK=1")
 	}
-	c := NewClient(t.Logf)
+	c := NewClient(t.Logf, nil)
 	c.SetLocalPort(1234)
 	res, err := c.Probe(context.Background())
 	t.Logf("Probe: %+v, %v", res, err)
 	ext, err := c.CreateOrGetMapping(context.Background())
 	t.Logf("CreateOrGetMapping: %v, %v", ext, err)
 }
+
+func TestMultipleMappings(t *testing.T) {
+	s := newFakePCPServer(t, "127.0.0.1:0")
+	var changes int32
+	c := newFakePCPClient(t, s)
+	c.onChange = func() { atomic.AddInt32(&changes, 1) }
+	waitForChange := func(what string) {
+		t.Helper()
+		deadline := time.Now().Add(5 * time.Second)
+		for atomic.LoadInt32(&changes) == 0 {
+			if time.Now().After(deadline) {
+				t.Fatalf("no change callback after %s", what)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		atomic.StoreInt32(&changes, 0)
+	}
+	wantMappings := func(want ...Mapping) {
+		t.Helper()
+		deadline := time.Now().Add(5 * time.Second)
+		for {
+			got := c.Mappings()
+			if reflect.DeepEqual(got, want) || len(got) == 0 && len(want) == 0 {
+				return
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("Mappings = %v; want %v", got, want)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	ctx := context.Background()
+
+	c.SetLocalPort(1234)
+	c.SetExtraLocalPorts([]uint16{5000, 0, 5000, 1234})
+	if _, err := c.Probe(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.CreateOrGetMapping(ctx); err != nil {
+		t.Fatal(err)
+	}
+	waitForChange("creating mappings")
+
+	// The extra port is mapped in the background, once the
+	// primary mapping shows there's a PCP server.
+	ext1 := netaddr.IPv4(203, 0, 113, 1)
+	wantMappings(
+		Mapping{Protocol: "PCP", External: netaddr.IPPort{IP: ext1, Port: 11234}, LocalPort: 1234},
+		Mapping{Protocol: "PCP", External: netaddr.IPPort{IP: ext1, Port: 15000}, LocalPort: 5000},
+	)
+	waitForMappings(t, s, 2)
+	atomic.StoreInt32(&changes, 0)
+
+	// Mappings due for renewal are renewed in the background,
+	// and a changed external address is reported.
+	ext2 := netaddr.IPv4(203, 0, 113, 2)
+	s.mu.Lock()
+	s.external = ext2
+	s.mu.Unlock()
+	c.mu.Lock()
+	for k, m := range c.mappings {
+		expired := *m.(*pcpMapping)
+		expired.useUntil = time.Time{}
+		c.setMappingLocked(k, &expired)
+	}
+	c.mu.Unlock()
+	waitForChange("renewing mappings with a new external IP")
+	wantMappings(
+		Mapping{Protocol: "PCP", External: netaddr.IPPort{IP: ext2, Port: 11234}, LocalPort: 1234},
+		Mapping{Protocol: "PCP", External: netaddr.IPPort{IP: ext2, Port: 15000}, LocalPort: 5000},
+	)
+
+	// Removing the extra port releases its mapping.
+	c.SetExtraLocalPorts(nil)
+	waitForChange("removing the extra port")
+	waitForMappings(t, s, 1)
+	wantMappings(Mapping{Protocol: "PCP", External: netaddr.IPPort{IP: ext2, Port: 11234}, LocalPort: 1234})
+
+	// A mapping that can't be renewed is lost.
+	s.pc.Close()
+	c.mu.Lock()
+	k := mapKey{port: 1234}
+	expired := *c.mappings[k].(*pcpMapping)
+	expired.useUntil = time.Time{}
+	c.setMappingLocked(k, &expired)
+	c.mu.Unlock()
+	waitForChange("losing the mapping")
+	wantMappings()
+}
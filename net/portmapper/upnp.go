@@ -0,0 +1,427 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package portmapper
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"inet.af/netaddr"
+	"tailscale.com/net/netns"
+)
+
+const (
+	// upnpMapLifetimeSec is the lease duration we ask UPnP IGDs
+	// for.
+	upnpMapLifetimeSec = 7200
+
+	// upnpTimeout is how long we give a UPnP IGD to fetch its
+	// device description and complete a SOAP action. It's longer
+	// than portMapServiceTimeout because those are HTTP requests,
+	// and consumer routers can be slow to answer them.
+	upnpTimeout = 3 * time.Second
+
+	// upnpMaxResponseSize is the maximum size of a device
+	// description or SOAP response we'll read.
+	upnpMaxResponseSize = 1 << 20
+
+	// upnpDescription is the NewPortMappingDescription of our
+	// mappings, shown in routers' admin UIs.
+	upnpDescription = "tailscale"
+)
+
+// UPnP error codes, from the WANIPConnection spec.
+const (
+	upnpErrConflictInMappingEntry       = 718
+	upnpErrOnlyPermanentLeasesSupported = 725
+)
+
+// upnpMapping is an already-created UPnP mapping.
+//
+// All fields are immutable once created.
+type upnpMapping struct {
+	svc      *upnpService
+	external netaddr.IPPort
+	internal netaddr.IPPort
+	useUntil time.Time // the mapping's lifetime minus renewal interval
+}
+
+func (m *upnpMapping) externalIPPort() netaddr.IPPort { return m.external }
+func (m *upnpMapping) renewAfter() time.Time          { return m.useUntil }
+func (m *upnpMapping) protocol() string               { return "UPnP" }
+
+// release does a best effort fire-and-forget release of the UPnP
+// mapping m, in a new goroutine.
+func (m *upnpMapping) release() {
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), upnpTimeout)
+		defer cancel()
+		m.svc.deletePortMapping(ctx, m.external.Port)
+	}()
+}
+
+// upnpService is the WANIPConnection or WANPPPConnection service of
+// a UPnP Internet Gateway Device.
+type upnpService struct {
+	hc         *http.Client
+	typ        string // e.g. "urn:schemas-upnp-org:service:WANIPConnection:1"
+	controlURL string // absolute URL to which SOAP requests are POSTed
+}
+
+// upnpError is a UPnP error returned by a SOAP action.
+type upnpError struct {
+	Code        int
+	Description string
+}
+
+func (e upnpError) Error() string {
+	return fmt.Sprintf("UPnP error %d: %s", e.Code, e.Description)
+}
+
+// isUPnPError reports whether err is a upnpError with the given code.
+func isUPnPError(err error, code int) bool {
+	var ue upnpError
+	return errors.As(err, &ue) && ue.Code == code
+}
+
+// parseUPnPDiscoResponse returns the root device description URL
+// from an SSDP discovery response sent by the gateway gw.
+func parseUPnPDiscoResponse(pkt []byte, gw netaddr.IP) (location string, err error) {
+	res, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(pkt)), nil)
+	if err != nil {
+		return "", err
+	}
+	res.Body.Close()
+	if res.StatusCode != 200 {
+		return "", fmt.Errorf("status %v", res.Status)
+	}
+	location = res.Header.Get("Location")
+	u, err := url.Parse(location)
+	if err != nil {
+		return "", err
+	}
+	if u.Scheme != "http" {
+		return "", fmt.Errorf("unsupported LOCATION %q", location)
+	}
+	if err := checkUPnPURLHost(u, gw); err != nil {
+		return "", fmt.Errorf("LOCATION: %v", err)
+	}
+	return location, nil
+}
+
+// checkUPnPURLHost returns an error unless u's host is the gateway
+// gw. Discovery responses and device descriptions are unauthenticated,
+// so we don't let them point us at other hosts.
+func checkUPnPURLHost(u *url.URL, gw netaddr.IP) error {
+	ip, err := netaddr.ParseIP(u.Hostname())
+	if err != nil || ip != gw {
+		return fmt.Errorf("%q isn't on the gateway %v", u, gw)
+	}
+	return nil
+}
+
+// createUPnPMapping creates (or renews, if prevPort is non-zero) a
+// UPnP mapping of internal on the IGD gw, whose root device
+// description is at location.
+func (c *Client) createUPnPMapping(ctx context.Context, gw netaddr.IP, location string, internal netaddr.IPPort, prevPort uint16) (*upnpMapping, error) {
+	ctx, cancel := context.WithTimeout(ctx, upnpTimeout)
+	defer cancel()
+
+	svc, err := getUPnPService(ctx, gw, location)
+	if err != nil {
+		c.logf("UPnP: %v", err)
+		return nil, NoMappingError{err}
+	}
+	extIP, err := svc.getExternalIPAddress(ctx)
+	if err != nil {
+		c.logf("UPnP: %v", err)
+		return nil, NoMappingError{err}
+	}
+
+	// Ask for our previous port, or for the same port as our
+	// local one if we have none. If it's taken by another
+	// machine's mapping, try a couple of random ones.
+	port := prevPort
+	if port == 0 {
+		port = internal.Port
+	}
+	lifetime := uint32(upnpMapLifetimeSec)
+	for tries := 0; ; {
+		err = svc.addPortMapping(ctx, port, internal, lifetime)
+		if err == nil {
+			break
+		}
+		switch {
+		case isUPnPError(err, upnpErrOnlyPermanentLeasesSupported) && lifetime != 0:
+			lifetime = 0
+			continue
+		case isUPnPError(err, upnpErrConflictInMappingEntry) && tries < 2:
+			tries++
+			port = uint16(1024 + rand.Intn(65535-1024))
+			continue
+		}
+		c.logf("UPnP: %v", err)
+		if ctx.Err() == context.Canceled {
+			return nil, err
+		}
+		return nil, NoMappingError{err}
+	}
+
+	// Renew in half the lease time. Permanent leases still get
+	// renewed, to notice if the router forgot them.
+	d := time.Duration(lifetime) * time.Second
+	if lifetime == 0 {
+		d = upnpMapLifetimeSec * time.Second
+	}
+	m := &upnpMapping{
+		svc:      svc,
+		external: netaddr.IPPort{IP: extIP, Port: port},
+		internal: internal,
+		useUntil: time.Now().Add(d / 2),
+	}
+	return m, nil
+}
+
+// upnpDevice is a device in a UPnP device description.
+type upnpDevice struct {
+	DeviceType string        `xml:"deviceType"`
+	Services   []upnpSvcDesc `xml:"serviceList>service"`
+	Devices    []upnpDevice  `xml:"deviceList>device"`
+}
+
+// upnpSvcDesc is a service in a UPnP device description.
+type upnpSvcDesc struct {
+	ServiceType string `xml:"serviceType"`
+	ControlURL  string `xml:"controlURL"`
+}
+
+// findConnectionService returns the first WANIPConnection or
+// WANPPPConnection service of d or its embedded devices, preferring
+// WANIPConnection.
+func (d *upnpDevice) findConnectionService() (upnpSvcDesc, bool) {
+	var ppp *upnpSvcDesc
+	var walk func(d *upnpDevice) *upnpSvcDesc
+	walk = func(d *upnpDevice) *upnpSvcDesc {
+		for i, s := range d.Services {
+			switch {
+			case strings.HasPrefix(s.ServiceType, "urn:schemas-upnp-org:service:WANIPConnection:"):
+				return &d.Services[i]
+			case strings.HasPrefix(s.ServiceType, "urn:schemas-upnp-org:service:WANPPPConnection:"):
+				if ppp == nil {
+					ppp = &d.Services[i]
+				}
+			}
+		}
+		for i := range d.Devices {
+			if s := walk(&d.Devices[i]); s != nil {
+				return s
+			}
+		}
+		return nil
+	}
+	if s := walk(d); s != nil {
+		return *s, true
+	}
+	if ppp != nil {
+		return *ppp, true
+	}
+	return upnpSvcDesc{}, false
+}
+
+// getUPnPService fetches the root device description at location, on
+// the gateway gw, and returns its WAN connection service.
+func getUPnPService(ctx context.Context, gw netaddr.IP, location string) (*upnpService, error) {
+	base, err := url.Parse(location)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkUPnPURLHost(base, gw); err != nil {
+		return nil, fmt.Errorf("LOCATION: %v", err)
+	}
+
+	hc := &http.Client{
+		Transport: &http.Transport{
+			DialContext:       netns.NewDialer().DialContext,
+			DisableKeepAlives: true,
+		},
+		// Don't follow redirects off the gateway.
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	req, err := http.NewRequestWithContext(ctx, "GET", location, nil)
+	if err != nil {
+		return nil, err
+	}
+	res, err := hc.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != 200 {
+		return nil, fmt.Errorf("fetching %s: %v", location, res.Status)
+	}
+	var root struct {
+		URLBase string     `xml:"URLBase"`
+		Device  upnpDevice `xml:"device"`
+	}
+	if err := xml.NewDecoder(io.LimitReader(res.Body, upnpMaxResponseSize)).Decode(&root); err != nil {
+		return nil, fmt.Errorf("parsing %s: %v", location, err)
+	}
+	sd, ok := root.Device.findConnectionService()
+	if !ok {
+		return nil, fmt.Errorf("%s has no WAN connection service", location)
+	}
+
+	if root.URLBase != "" {
+		if base, err = base.Parse(root.URLBase); err != nil {
+			return nil, fmt.Errorf("bad URLBase: %v", err)
+		}
+	}
+	ctl, err := base.Parse(sd.ControlURL)
+	if err != nil {
+		return nil, fmt.Errorf("bad controlURL: %v", err)
+	}
+	if ctl.Scheme != "http" {
+		return nil, fmt.Errorf("unsupported controlURL %q", ctl)
+	}
+	if err := checkUPnPURLHost(ctl, gw); err != nil {
+		return nil, fmt.Errorf("controlURL: %v", err)
+	}
+	return &upnpService{
+		hc:         hc,
+		typ:        sd.ServiceType,
+		controlURL: ctl.String(),
+	}, nil
+}
+
+// upnpArg is an argument to a SOAP action.
+type upnpArg struct {
+	name, value string
+}
+
+// call performs a SOAP action on s and returns the values of the
+// response's arguments, by name.
+func (s *upnpService) call(ctx context.Context, action string, args ...upnpArg) (map[string]string, error) {
+	var body strings.Builder
+	body.WriteString(`<?xml version="1.0"?>` +
+		`<s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/" s:encodingStyle="http://schemas.xmlsoap.org/soap/encoding/">` +
+		`<s:Body>`)
+	fmt.Fprintf(&body, `<u:%s xmlns:u="`, action)
+	xml.EscapeText(&body, []byte(s.typ))
+	body.WriteString(`">`)
+	for _, a := range args {
+		fmt.Fprintf(&body, "<%s>", a.name)
+		xml.EscapeText(&body, []byte(a.value))
+		fmt.Fprintf(&body, "</%s>", a.name)
+	}
+	fmt.Fprintf(&body, `</u:%s></s:Body></s:Envelope>`, action)
+
+	req, err := http.NewRequestWithContext(ctx, "POST", s.controlURL, strings.NewReader(body.String()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", `text/xml; charset="utf-8"`)
+	req.Header.Set("SOAPAction", `"`+s.typ+"#"+action+`"`)
+	res, err := s.hc.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", action, err)
+	}
+	defer res.Body.Close()
+	slurp, err := ioutil.ReadAll(io.LimitReader(res.Body, upnpMaxResponseSize))
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", action, err)
+	}
+	vals, err := parseSOAPResponse(slurp)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", action, err)
+	}
+	if res.StatusCode != 200 {
+		if code, err := strconv.Atoi(vals["errorCode"]); err == nil {
+			return nil, fmt.Errorf("%s: %w", action, upnpError{code, vals["errorDescription"]})
+		}
+		return nil, fmt.Errorf("%s: %v", action, res.Status)
+	}
+	return vals, nil
+}
+
+// parseSOAPResponse returns the text of the leaf elements of a SOAP
+// response or fault, by local name. That's all we need of the
+// handful of actions we use, whose arguments are all leaves with
+// unique names.
+func parseSOAPResponse(b []byte) (map[string]string, error) {
+	vals := map[string]string{}
+	dec := xml.NewDecoder(bytes.NewReader(b))
+	var name string // of the innermost open element, if it has no children yet
+	var text strings.Builder
+	for {
+		tok, err := dec.Token()
+		if err == io.EOF {
+			return vals, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		switch t := tok.(type) {
+		case xml.StartElement:
+			name = t.Name.Local
+			text.Reset()
+		case xml.CharData:
+			text.Write(t)
+		case xml.EndElement:
+			if name == t.Name.Local {
+				vals[name] = strings.TrimSpace(text.String())
+			}
+			name = ""
+		}
+	}
+}
+
+func (s *upnpService) getExternalIPAddress(ctx context.Context) (netaddr.IP, error) {
+	vals, err := s.call(ctx, "GetExternalIPAddress")
+	if err != nil {
+		return netaddr.IP{}, err
+	}
+	ip, err := netaddr.ParseIP(vals["NewExternalIPAddress"])
+	if err != nil {
+		return netaddr.IP{}, fmt.Errorf("GetExternalIPAddress: %v", err)
+	}
+	return ip, nil
+}
+
+func (s *upnpService) addPortMapping(ctx context.Context, externalPort uint16, internal netaddr.IPPort, lifetimeSec uint32) error {
+	_, err := s.call(ctx, "AddPortMapping",
+		upnpArg{"NewRemoteHost", ""},
+		upnpArg{"NewExternalPort", strconv.Itoa(int(externalPort))},
+		upnpArg{"NewProtocol", "UDP"},
+		upnpArg{"NewInternalPort", strconv.Itoa(int(internal.Port))},
+		upnpArg{"NewInternalClient", internal.IP.String()},
+		upnpArg{"NewEnabled", "1"},
+		upnpArg{"NewPortMappingDescription", upnpDescription},
+		upnpArg{"NewLeaseDuration", strconv.FormatUint(uint64(lifetimeSec), 10)},
+	)
+	return err
+}
+
+func (s *upnpService) deletePortMapping(ctx context.Context, externalPort uint16) error {
+	_, err := s.call(ctx, "DeletePortMapping",
+		upnpArg{"NewRemoteHost", ""},
+		upnpArg{"NewExternalPort", strconv.Itoa(int(externalPort))},
+		upnpArg{"NewProtocol", "UDP"},
+	)
+	return err
+}
@@ -0,0 +1,433 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package portmapper
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"inet.af/netaddr"
+)
+
+// fakeIGDExternalIP is the external IP of a fakeIGD.
+var fakeIGDExternalIP = netaddr.MustParseIP("203.0.113.1")
+
+// fakeIGD is an in-process UPnP Internet Gateway Device on localhost,
+// answering SSDP discovery and the WANIPConnection SOAP actions.
+type fakeIGD struct {
+	t        *testing.T
+	ssdp     net.PacketConn
+	pxp      net.PacketConn // swallows NAT-PMP and PCP probes
+	ts       *httptest.Server
+	ssdpPort uint16
+	pxpPort  uint16
+
+	mu            sync.Mutex
+	onlyPermanent bool                   // fail non-zero leases with error 725
+	rootDesc      string                 // if non-empty, served instead of fakeIGDRootDesc
+	mappings      map[uint16]fakeMapping // by external port
+	actions       []string               // SOAP actions called, in order
+}
+
+type fakeMapping struct {
+	client string // NewInternalClient
+	port   string // NewInternalPort
+	lease  string // NewLeaseDuration
+}
+
+func newFakeIGD(t *testing.T) *fakeIGD {
+	d := &fakeIGD{t: t, mappings: map[uint16]fakeMapping{}}
+	var err error
+	if d.ssdp, err = net.ListenPacket("udp4", "127.0.0.1:0"); err != nil {
+		t.Fatal(err)
+	}
+	if d.pxp, err = net.ListenPacket("udp4", "127.0.0.1:0"); err != nil {
+		t.Fatal(err)
+	}
+	d.ssdpPort = uint16(d.ssdp.LocalAddr().(*net.UDPAddr).Port)
+	d.pxpPort = uint16(d.pxp.LocalAddr().(*net.UDPAddr).Port)
+	d.ts = httptest.NewServer(d)
+	go d.serveSSDP()
+	go d.swallowPxP()
+	t.Cleanup(func() {
+		d.ssdp.Close()
+		d.pxp.Close()
+		d.ts.Close()
+	})
+	return d
+}
+
+func (d *fakeIGD) serveSSDP() {
+	buf := make([]byte, 1500)
+	for {
+		n, src, err := d.ssdp.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		if !strings.HasPrefix(string(buf[:n]), "M-SEARCH ") {
+			continue
+		}
+		// Answer like a real router would to ssdp:all: with the
+		// root device, then with the IGD.
+		for _, st := range []string{"upnp:rootdevice", "urn:schemas-upnp-org:device:InternetGatewayDevice:1"} {
+			res := "HTTP/1.1 200 OK\r\n" +
+				"CACHE-CONTROL: max-age=120\r\n" +
+				"ST: " + st + "\r\n" +
+				"USN: uuid:fake-igd::" + st + "\r\n" +
+				"EXT:\r\n" +
+				"SERVER: FakeOS/1.0 UPnP/1.1 FakeIGD/1.0\r\n" +
+				"LOCATION: " + d.ts.URL + "/rootDesc.xml\r\n" +
+				"\r\n"
+			d.ssdp.WriteTo([]byte(res), src)
+		}
+	}
+}
+
+func (d *fakeIGD) swallowPxP() {
+	buf := make([]byte, 1500)
+	for {
+		if _, _, err := d.pxp.ReadFrom(buf); err != nil {
+			return
+		}
+	}
+}
+
+const fakeIGDRootDesc = `<?xml version="1.0"?>
+<root xmlns="urn:schemas-upnp-org:device-1-0">
+<specVersion><major>1</major><minor>0</minor></specVersion>
+<device>
+  <deviceType>urn:schemas-upnp-org:device:InternetGatewayDevice:1</deviceType>
+  <serviceList>
+    <service>
+      <serviceType>urn:schemas-upnp-org:service:Layer3Forwarding:1</serviceType>
+      <controlURL>/ctl/L3F</controlURL>
+    </service>
+  </serviceList>
+  <deviceList>
+    <device>
+      <deviceType>urn:schemas-upnp-org:device:WANDevice:1</deviceType>
+      <deviceList>
+        <device>
+          <deviceType>urn:schemas-upnp-org:device:WANConnectionDevice:1</deviceType>
+          <serviceList>
+            <service>
+              <serviceType>urn:schemas-upnp-org:service:WANIPConnection:1</serviceType>
+              <controlURL>/ctl/IPConn</controlURL>
+            </service>
+          </serviceList>
+        </device>
+      </deviceList>
+    </device>
+  </deviceList>
+</device>
+</root>`
+
+const fakeIGDService = "urn:schemas-upnp-org:service:WANIPConnection:1"
+
+func (d *fakeIGD) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.URL.Path {
+	case "/rootDesc.xml":
+		w.Header().Set("Content-Type", "text/xml")
+		d.mu.Lock()
+		desc := d.rootDesc
+		d.mu.Unlock()
+		if desc == "" {
+			desc = fakeIGDRootDesc
+		}
+		fmt.Fprint(w, desc)
+		return
+	case "/ctl/IPConn":
+	default:
+		http.NotFound(w, r)
+		return
+	}
+	action := strings.TrimPrefix(strings.Trim(r.Header.Get("SOAPAction"), `"`), fakeIGDService+"#")
+	body, _ := ioutil.ReadAll(r.Body)
+	args, err := parseSOAPResponse(body)
+	if err != nil {
+		d.t.Errorf("bad SOAP request: %v", err)
+		http.Error(w, err.Error(), 400)
+		return
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.actions = append(d.actions, action)
+	var out string
+	switch action {
+	case "GetExternalIPAddress":
+		out = "<NewExternalIPAddress>" + fakeIGDExternalIP.String() + "</NewExternalIPAddress>"
+	case "AddPortMapping":
+		if args["NewProtocol"] != "UDP" || args["NewRemoteHost"] != "" {
+			d.t.Errorf("unexpected AddPortMapping args: %v", args)
+		}
+		ext := parsePort(args["NewExternalPort"])
+		if d.onlyPermanent && args["NewLeaseDuration"] != "0" {
+			d.soapFault(w, upnpErrOnlyPermanentLeasesSupported, "OnlyPermanentLeasesSupported")
+			return
+		}
+		if m, ok := d.mappings[ext]; ok && m.client != args["NewInternalClient"] {
+			d.soapFault(w, upnpErrConflictInMappingEntry, "ConflictInMappingEntry")
+			return
+		}
+		d.mappings[ext] = fakeMapping{args["NewInternalClient"], args["NewInternalPort"], args["NewLeaseDuration"]}
+	case "DeletePortMapping":
+		ext := parsePort(args["NewExternalPort"])
+		if _, ok := d.mappings[ext]; !ok {
+			d.soapFault(w, 714, "NoSuchEntryInArray")
+			return
+		}
+		delete(d.mappings, ext)
+	default:
+		d.soapFault(w, 401, "Invalid Action")
+		return
+	}
+	w.Header().Set("Content-Type", `text/xml; charset="utf-8"`)
+	fmt.Fprintf(w, `<?xml version="1.0"?>
+<s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/" s:encodingStyle="http://schemas.xmlsoap.org/soap/encoding/">
+<s:Body><u:%sResponse xmlns:u="%s">%s</u:%sResponse></s:Body>
+</s:Envelope>`, action, fakeIGDService, out, action)
+}
+
+func (d *fakeIGD) soapFault(w http.ResponseWriter, code int, desc string) {
+	w.Header().Set("Content-Type", `text/xml; charset="utf-8"`)
+	w.WriteHeader(500)
+	fmt.Fprintf(w, `<?xml version="1.0"?>
+<s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/" s:encodingStyle="http://schemas.xmlsoap.org/soap/encoding/">
+<s:Body><s:Fault>
+<faultcode>s:Client</faultcode>
+<faultstring>UPnPError</faultstring>
+<detail><UPnPError xmlns="urn:schemas-upnp-org:control-1-0">
+<errorCode>%d</errorCode>
+<errorDescription>%s</errorDescription>
+</UPnPError></detail>
+</s:Fault></s:Body>
+</s:Envelope>`, code, desc)
+}
+
+func parsePort(s string) uint16 {
+	n, _ := strconv.ParseUint(s, 10, 16)
+	return uint16(n)
+}
+
+func (d *fakeIGD) getMappings() map[uint16]fakeMapping {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	m := map[uint16]fakeMapping{}
+	for k, v := range d.mappings {
+		m[k] = v
+	}
+	return m
+}
+
+func (d *fakeIGD) countActions(action string) (n int) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for _, a := range d.actions {
+		if a == action {
+			n++
+		}
+	}
+	return n
+}
+
+// newFakeIGDClient returns a Client whose gateway is d.
+func newFakeIGDClient(t *testing.T, d *fakeIGD) *Client {
+	c := NewClient(t.Logf, nil)
+	localhost := netaddr.IPv4(127, 0, 0, 1)
+	c.ipAndGateway = func() (gw, myIP netaddr.IP, ok bool) {
+		return localhost, localhost, true
+	}
+	c.testPxPPort = d.pxpPort
+	c.testUPnPPort = d.ssdpPort
+	t.Cleanup(func() { c.Close() })
+	return c
+}
+
+func TestUPnPMapping(t *testing.T) {
+	d := newFakeIGD(t)
+	c := newFakeIGDClient(t, d)
+	c.SetLocalPort(1234)
+	ctx := context.Background()
+
+	res, err := c.Probe(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := (ProbeResult{UPnP: true}); res != want {
+		t.Fatalf("Probe = %+v; want %+v", res, want)
+	}
+
+	want := netaddr.IPPort{IP: fakeIGDExternalIP, Port: 1234}
+	ext, err := c.CreateOrGetMapping(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ext != want {
+		t.Errorf("CreateOrGetMapping = %v; want %v", ext, want)
+	}
+	wantMapping := fakeMapping{client: "127.0.0.1", port: "1234", lease: strconv.Itoa(upnpMapLifetimeSec)}
+	if got := d.getMappings(); len(got) != 1 || got[1234] != wantMapping {
+		t.Errorf("IGD mappings = %+v; want {1234: %+v}", got, wantMapping)
+	}
+
+	// A valid mapping is returned as is.
+	if ext, err := c.CreateOrGetMapping(ctx); err != nil || ext != want {
+		t.Errorf("second CreateOrGetMapping = %v, %v; want %v", ext, err, want)
+	}
+	if n := d.countActions("AddPortMapping"); n != 1 {
+		t.Errorf("AddPortMapping called %d times; want 1", n)
+	}
+
+	// Once it's due for renewal, the lease is renewed.
+	c.mu.Lock()
+	m := *c.mappings[mapKey{port: 1234}].(*upnpMapping)
+	m.useUntil = time.Now().Add(-time.Second)
+	c.mappings[mapKey{port: 1234}] = &m
+	c.mu.Unlock()
+	if ext, err := c.CreateOrGetMapping(ctx); err != nil || ext != want {
+		t.Errorf("renewing CreateOrGetMapping = %v, %v; want %v", ext, err, want)
+	}
+	if n := d.countActions("AddPortMapping"); n != 2 {
+		t.Errorf("AddPortMapping called %d times; want 2", n)
+	}
+
+	// Changing the local port releases the old mapping.
+	c.SetLocalPort(5678)
+	deadline := time.Now().Add(5 * time.Second)
+	for len(d.getMappings()) != 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("mapping not released; IGD mappings = %+v", d.getMappings())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestUPnPMappingConflictAndPermanentLease(t *testing.T) {
+	d := newFakeIGD(t)
+	d.onlyPermanent = true
+	d.mappings[1234] = fakeMapping{client: "192.168.1.2", port: "1234", lease: "0"}
+	c := newFakeIGDClient(t, d)
+	c.SetLocalPort(1234)
+	ctx := context.Background()
+
+	if _, err := c.Probe(ctx); err != nil {
+		t.Fatal(err)
+	}
+	ext, err := c.CreateOrGetMapping(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ext.IP != fakeIGDExternalIP || ext.Port == 1234 || ext.Port == 0 {
+		t.Errorf("CreateOrGetMapping = %v; want %v with a port other than 1234", ext, fakeIGDExternalIP)
+	}
+	got := d.getMappings()[ext.Port]
+	if want := (fakeMapping{client: "127.0.0.1", port: "1234", lease: "0"}); got != want {
+		t.Errorf("IGD mapping for %d = %+v; want %+v", ext.Port, got, want)
+	}
+	c.mu.Lock()
+	renewAfter := c.mappings[mapKey{port: 1234}].renewAfter()
+	c.mu.Unlock()
+	if d := time.Until(renewAfter); d <= 0 || d > upnpMapLifetimeSec*time.Second {
+		t.Errorf("permanent lease renews in %v", d)
+	}
+}
+
+func TestUPnPNoServices(t *testing.T) {
+	d := newFakeIGD(t)
+	c := newFakeIGDClient(t, d)
+	c.testUPnPPort = d.pxpPort // silent
+	c.SetLocalPort(1234)
+	ctx := context.Background()
+
+	res, err := c.Probe(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res != (ProbeResult{}) {
+		t.Errorf("Probe = %+v; want nothing", res)
+	}
+	if _, err := c.CreateOrGetMapping(ctx); !IsNoMappingError(err) {
+		t.Errorf("CreateOrGetMapping error = %v; want NoMappingError", err)
+	}
+}
+
+func TestUPnPControlURLOffGateway(t *testing.T) {
+	d := newFakeIGD(t)
+	ctx := context.Background()
+	localhost := netaddr.IPv4(127, 0, 0, 1)
+	if _, err := getUPnPService(ctx, localhost, d.ts.URL+"/rootDesc.xml"); err != nil {
+		t.Fatalf("on the gateway: %v", err)
+	}
+	for _, ctl := range []string{"http://192.0.2.1/ctl/IPConn", "http://localhost" + strings.TrimPrefix(d.ts.URL, "http://127.0.0.1") + "/ctl/IPConn"} {
+		d.mu.Lock()
+		d.rootDesc = strings.Replace(fakeIGDRootDesc, "/ctl/IPConn", ctl, 1)
+		d.mu.Unlock()
+		if svc, err := getUPnPService(ctx, localhost, d.ts.URL+"/rootDesc.xml"); err == nil {
+			t.Errorf("controlURL %q: got service with controlURL %q; want error", ctl, svc.controlURL)
+		}
+	}
+	if _, err := getUPnPService(ctx, netaddr.IPv4(192, 168, 1, 1), d.ts.URL+"/rootDesc.xml"); err == nil {
+		t.Errorf("LOCATION off the gateway: got no error")
+	}
+}
+
+func TestParseUPnPDiscoResponse(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    string
+		wantErr bool
+	}{
+		{
+			in:   "HTTP/1.1 200 OK\r\nST: upnp:rootdevice\r\nLOCATION: http://192.168.1.1:5000/rootDesc.xml\r\n\r\n",
+			want: "http://192.168.1.1:5000/rootDesc.xml",
+		},
+		{in: "HTTP/1.1 200 OK\r\nLOCATION: https://192.168.1.1/desc.xml\r\n\r\n", wantErr: true},
+		{in: "HTTP/1.1 200 OK\r\nLOCATION: http://192.168.1.2:5000/rootDesc.xml\r\n\r\n", wantErr: true},
+		{in: "HTTP/1.1 200 OK\r\nLOCATION: http://router.example.com/rootDesc.xml\r\n\r\n", wantErr: true},
+		{in: "HTTP/1.1 200 OK\r\n\r\n", wantErr: true},
+		{in: "NOTIFY * HTTP/1.1\r\n\r\n", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := parseUPnPDiscoResponse([]byte(tt.in), netaddr.IPv4(192, 168, 1, 1))
+		if (err != nil) != tt.wantErr || got != tt.want && !tt.wantErr {
+			t.Errorf("parseUPnPDiscoResponse(%q) = %q, %v; want %q (error %v)", tt.in, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
+
+func TestFindConnectionService(t *testing.T) {
+	ppp := upnpSvcDesc{ServiceType: "urn:schemas-upnp-org:service:WANPPPConnection:1", ControlURL: "/ppp"}
+	ip := upnpSvcDesc{ServiceType: "urn:schemas-upnp-org:service:WANIPConnection:2", ControlURL: "/ip"}
+	other := upnpSvcDesc{ServiceType: "urn:schemas-upnp-org:service:WANCommonInterfaceConfig:1", ControlURL: "/cic"}
+
+	d := upnpDevice{
+		Services: []upnpSvcDesc{other},
+		Devices: []upnpDevice{
+			{Services: []upnpSvcDesc{ppp}},
+			{Devices: []upnpDevice{{Services: []upnpSvcDesc{other, ip}}}},
+		},
+	}
+	if got, ok := d.findConnectionService(); !ok || got != ip {
+		t.Errorf("got %+v, %v; want WANIPConnection", got, ok)
+	}
+	d.Devices = d.Devices[:1]
+	if got, ok := d.findConnectionService(); !ok || got != ppp {
+		t.Errorf("got %+v, %v; want WANPPPConnection", got, ok)
+	}
+	d.Devices = nil
+	if got, ok := d.findConnectionService(); ok {
+		t.Errorf("got %+v; want none", got)
+	}
+}
@@ -0,0 +1,247 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package socks5 is a SOCKS5 server implementation.
+//
+// This is used for userspace networking in Tailscale. Specifically,
+// this is used for dialing out of the machine to other nodes, without
+// the host kernel's involvement, so it doesn't need proper routing tables,
+// TUN, IPv6, etc. This package is meant to only handle the SOCKS5 protocol
+// details and not any integration with Tailscale internals.
+//
+// Only the CONNECT command with no authentication is supported.
+// See RFC 1928.
+package socks5
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strconv"
+	"time"
+
+	"tailscale.com/types/logger"
+)
+
+const (
+	socks5Version = 5
+
+	// Authentication methods.
+	noAuthRequired   = 0
+	noAcceptableAuth = 255
+
+	// Commands.
+	connect = 1
+
+	// Address types.
+	ipv4       = 1
+	domainName = 3
+	ipv6       = 4
+
+	// Reply codes.
+	success              = 0
+	generalFailure       = 1
+	hostUnreachable      = 4
+	connectionRefused    = 5
+	commandNotSupported  = 7
+	addrTypeNotSupported = 8
+)
+
+// handshakeTimeout is how long a client has to complete the SOCKS
+// handshake before the server gives up on it.
+const handshakeTimeout = 30 * time.Second
+
+// Server is a SOCKS5 proxy server.
+type Server struct {
+	// Logf optionally specifies the logger to use.
+	// If nil, the standard logger is used.
+	Logf logger.Logf
+
+	// Dialer optionally specifies the dialer to use for outgoing
+	// connections. If nil, the net package's standard dialer is used.
+	Dialer func(ctx context.Context, network, addr string) (net.Conn, error)
+}
+
+func (s *Server) dial(ctx context.Context, network, addr string) (net.Conn, error) {
+	dial := s.Dialer
+	if dial == nil {
+		dialer := &net.Dialer{}
+		dial = dialer.DialContext
+	}
+	return dial(ctx, network, addr)
+}
+
+func (s *Server) logf(format string, args ...interface{}) {
+	logf := s.Logf
+	if logf == nil {
+		logf = log.Printf
+	}
+	logf(format, args...)
+}
+
+// Serve accepts and handles incoming connections on l until l
+// returns an error.
+func (s *Server) Serve(l net.Listener) error {
+	defer l.Close()
+	for {
+		c, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		go func() {
+			defer c.Close()
+			if err := s.serveConn(c); err != nil {
+				s.logf("socks5: client %v: %v", c.RemoteAddr(), err)
+			}
+		}()
+	}
+}
+
+// serveConn speaks SOCKS5 on c and, if the client's request is
+// valid, proxies data between c and the requested destination.
+func (s *Server) serveConn(c net.Conn) error {
+	c.SetDeadline(time.Now().Add(handshakeTimeout))
+	if err := negotiateAuth(c); err != nil {
+		return err
+	}
+	addr, err := readRequest(c)
+	if err != nil {
+		return err
+	}
+	c.SetDeadline(time.Time{})
+
+	srv, err := s.dial(context.Background(), "tcp", addr)
+	if err != nil {
+		writeReply(c, replyCodeForDialError(err), nil)
+		return fmt.Errorf("dial %v: %w", addr, err)
+	}
+	defer srv.Close()
+	bound, _ := srv.LocalAddr().(*net.TCPAddr)
+	if err := writeReply(c, success, bound); err != nil {
+		return err
+	}
+
+	errc := make(chan error, 2)
+	go func() {
+		_, err := io.Copy(c, srv)
+		errc <- err
+	}()
+	go func() {
+		_, err := io.Copy(srv, c)
+		errc <- err
+	}()
+	return <-errc
+}
+
+// negotiateAuth reads the client's greeting and selects the "no
+// authentication required" method, the only one we support.
+func negotiateAuth(c net.Conn) error {
+	var hdr [2]byte
+	if _, err := io.ReadFull(c, hdr[:]); err != nil {
+		return fmt.Errorf("reading greeting: %w", err)
+	}
+	if hdr[0] != socks5Version {
+		return fmt.Errorf("unsupported SOCKS version %d", hdr[0])
+	}
+	methods := make([]byte, hdr[1])
+	if _, err := io.ReadFull(c, methods); err != nil {
+		return fmt.Errorf("reading auth methods: %w", err)
+	}
+	for _, m := range methods {
+		if m == noAuthRequired {
+			_, err := c.Write([]byte{socks5Version, noAuthRequired})
+			return err
+		}
+	}
+	c.Write([]byte{socks5Version, noAcceptableAuth})
+	return errors.New("client offered no supported auth method")
+}
+
+// readRequest reads the client's request and returns the requested
+// destination as a "host:port" string.
+func readRequest(c net.Conn) (addr string, err error) {
+	var hdr [4]byte
+	if _, err := io.ReadFull(c, hdr[:]); err != nil {
+		return "", fmt.Errorf("reading request: %w", err)
+	}
+	if hdr[0] != socks5Version {
+		return "", fmt.Errorf("unsupported SOCKS version %d in request", hdr[0])
+	}
+	if hdr[1] != connect {
+		writeReply(c, commandNotSupported, nil)
+		return "", fmt.Errorf("unsupported command %d", hdr[1])
+	}
+	var host string
+	switch hdr[3] {
+	case ipv4:
+		var ip [4]byte
+		if _, err := io.ReadFull(c, ip[:]); err != nil {
+			return "", err
+		}
+		host = net.IP(ip[:]).String()
+	case ipv6:
+		var ip [16]byte
+		if _, err := io.ReadFull(c, ip[:]); err != nil {
+			return "", err
+		}
+		host = net.IP(ip[:]).String()
+	case domainName:
+		var n [1]byte
+		if _, err := io.ReadFull(c, n[:]); err != nil {
+			return "", err
+		}
+		name := make([]byte, n[0])
+		if _, err := io.ReadFull(c, name); err != nil {
+			return "", err
+		}
+		host = string(name)
+	default:
+		writeReply(c, addrTypeNotSupported, nil)
+		return "", fmt.Errorf("unsupported address type %d", hdr[3])
+	}
+	var port [2]byte
+	if _, err := io.ReadFull(c, port[:]); err != nil {
+		return "", err
+	}
+	return net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(port[:])))), nil
+}
+
+// writeReply writes a SOCKS5 reply with the given code. If bound is
+// nil, the unspecified IPv4 address and port zero are reported.
+func writeReply(c net.Conn, code byte, bound *net.TCPAddr) error {
+	buf := []byte{socks5Version, code, 0}
+	var port uint16
+	if bound == nil {
+		buf = append(buf, ipv4, 0, 0, 0, 0)
+	} else {
+		if ip4 := bound.IP.To4(); ip4 != nil {
+			buf = append(buf, ipv4)
+			buf = append(buf, ip4...)
+		} else {
+			buf = append(buf, ipv6)
+			buf = append(buf, bound.IP.To16()...)
+		}
+		port = uint16(bound.Port)
+	}
+	buf = append(buf, byte(port>>8), byte(port))
+	_, err := c.Write(buf)
+	return err
+}
+
+// replyCodeForDialError maps a dial error to the closest SOCKS5
+// reply code.
+func replyCodeForDialError(err error) byte {
+	var opErr *net.OpError
+	if errors.As(err, &opErr) {
+		if opErr.Timeout() {
+			return hostUnreachable
+		}
+		return connectionRefused
+	}
+	return generalFailure
+}
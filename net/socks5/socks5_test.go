@@ -0,0 +1,136 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package socks5
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"testing"
+
+	"golang.org/x/net/proxy"
+)
+
+func backendEchoServer(t *testing.T) net.Listener {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				io.Copy(c, c)
+			}()
+		}
+	}()
+	return ln
+}
+
+func socks5Server(t *testing.T, s *Server) net.Listener {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.Serve(ln)
+	return ln
+}
+
+func TestConnect(t *testing.T) {
+	backend := backendEchoServer(t)
+	defer backend.Close()
+
+	var dialed string
+	srv := &Server{
+		Logf: t.Logf,
+		Dialer: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			dialed = addr
+			if addr == "echo.test:80" {
+				addr = backend.Addr().String()
+			}
+			var d net.Dialer
+			return d.DialContext(ctx, network, addr)
+		},
+	}
+	ln := socks5Server(t, srv)
+	defer ln.Close()
+
+	for _, target := range []string{backend.Addr().String(), "echo.test:80"} {
+		t.Run(target, func(t *testing.T) {
+			d, err := proxy.SOCKS5("tcp", ln.Addr().String(), nil, proxy.Direct)
+			if err != nil {
+				t.Fatal(err)
+			}
+			c, err := d.Dial("tcp", target)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer c.Close()
+			if dialed != target {
+				t.Errorf("server dialed %q; want %q", dialed, target)
+			}
+			const msg = "hello, world"
+			if _, err := io.WriteString(c, msg); err != nil {
+				t.Fatal(err)
+			}
+			buf := make([]byte, len(msg))
+			if _, err := io.ReadFull(c, buf); err != nil {
+				t.Fatal(err)
+			}
+			if string(buf) != msg {
+				t.Errorf("got %q; want %q", buf, msg)
+			}
+		})
+	}
+}
+
+func TestDialFailure(t *testing.T) {
+	srv := &Server{
+		Logf: t.Logf,
+		Dialer: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			return nil, errors.New("nope")
+		},
+	}
+	ln := socks5Server(t, srv)
+	defer ln.Close()
+
+	d, err := proxy.SOCKS5("tcp", ln.Addr().String(), nil, proxy.Direct)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c, err := d.Dial("tcp", "10.1.2.3:80"); err == nil {
+		c.Close()
+		t.Fatal("unexpected success")
+	}
+}
+
+func TestUnsupportedAuth(t *testing.T) {
+	ln := socks5Server(t, &Server{Logf: t.Logf})
+	defer ln.Close()
+
+	c, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	// Offer only username/password auth.
+	if _, err := c.Write([]byte{socks5Version, 1, 2}); err != nil {
+		t.Fatal(err)
+	}
+	var resp [2]byte
+	if _, err := io.ReadFull(c, resp[:]); err != nil {
+		t.Fatal(err)
+	}
+	if resp != [2]byte{socks5Version, noAcceptableAuth} {
+		t.Errorf("got %v; want no acceptable auth", resp)
+	}
+}
@@ -18,6 +18,7 @@ const (
 	attrNumFingerprint   = 0x8028
 	attrMappedAddress    = 0x0001
 	attrXorMappedAddress = 0x0020
+	attrChangeRequest    = 0x0003 // RFC 5780 section 7.2
 	// This alternative attribute type is not
 	// mentioned in the RFC, but the shift into
 	// the "comprehension-optional" range seems
@@ -30,6 +31,10 @@ const (
 	magicCookie    = "\x21\x12\xa4\x42"
 	lenFingerprint = 8 // 2+byte header + 2-byte length + 4-byte crc32
 	headerLen      = 20
+
+	// CHANGE-REQUEST flags, RFC 5780 section 7.2.
+	changeIPFlag   = 0x4
+	changePortFlag = 0x2
 )
 
 // TxID is a transaction ID.
@@ -47,11 +52,35 @@ func NewTxID() TxID {
 // Request generates a binding request STUN packet.
 // The transaction ID, tID, should be a random sequence of bytes.
 func Request(tID TxID) []byte {
+	return request(tID, false, 0)
+}
+
+// RequestChange generates a binding request STUN packet, like
+// Request, that asks the server to send its response from a different
+// IP address and/or port, with an RFC 5780 CHANGE-REQUEST attribute.
+// Such requests are used to discover how a NAT filters traffic.
+func RequestChange(tID TxID, changeIP, changePort bool) []byte {
+	var flags uint32
+	if changeIP {
+		flags |= changeIPFlag
+	}
+	if changePort {
+		flags |= changePortFlag
+	}
+	return request(tID, true, flags)
+}
+
+func request(tID TxID, withChange bool, changeFlags uint32) []byte {
 	// STUN header, RFC5389 Section 6.
 	const lenAttrSoftware = 4 + len(software)
-	b := make([]byte, 0, headerLen+lenAttrSoftware+lenFingerprint)
+	const lenAttrChange = 4 + 4
+	attrsLen := lenAttrSoftware + lenFingerprint
+	if withChange {
+		attrsLen += lenAttrChange
+	}
+	b := make([]byte, 0, headerLen+attrsLen)
 	b = append(b, bindingRequest...)
-	b = appendU16(b, uint16(lenAttrSoftware+lenFingerprint)) // number of bytes following header
+	b = appendU16(b, uint16(attrsLen)) // number of bytes following header
 	b = append(b, magicCookie...)
 	b = append(b, tID[:]...)
 
@@ -60,6 +89,13 @@ func Request(tID TxID) []byte {
 	b = appendU16(b, uint16(len(software)))
 	b = append(b, software...)
 
+	// Attribute CHANGE-REQUEST, RFC5780 Section 7.2.
+	if withChange {
+		b = appendU16(b, attrChangeRequest)
+		b = appendU16(b, 4)
+		b = appendU32(b, changeFlags)
+	}
+
 	// Attribute FINGERPRINT, RFC5389 Section 15.5.
 	fp := fingerPrint(b)
 	b = appendU16(b, attrNumFingerprint)
@@ -120,6 +156,25 @@ func ParseBindingRequest(b []byte) (TxID, error) {
 	return txID, nil
 }
 
+// ParseChangeRequest reports which changes the RFC 5780
+// CHANGE-REQUEST attribute of the binding request b asks for, if it
+// has one. The request should already have been validated by
+// ParseBindingRequest.
+func ParseChangeRequest(b []byte) (changeIP, changePort bool) {
+	if len(b) < headerLen {
+		return false, false
+	}
+	foreachAttr(b[headerLen:], func(attrType uint16, a []byte) error {
+		if attrType == attrChangeRequest && len(a) == 4 {
+			flags := binary.BigEndian.Uint32(a)
+			changeIP = flags&changeIPFlag != 0
+			changePort = flags&changePortFlag != 0
+		}
+		return nil
+	})
+	return changeIP, changePort
+}
+
 var (
 	ErrNotSTUN            = errors.New("response is not a STUN packet")
 	ErrNotSuccessResponse = errors.New("STUN packet is not a response")
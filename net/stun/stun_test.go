@@ -240,6 +240,35 @@ func TestParseBindingRequest(t *testing.T) {
 	}
 }
 
+func TestParseChangeRequest(t *testing.T) {
+	tests := []struct {
+		changeIP, changePort bool
+	}{
+		{false, false},
+		{true, false},
+		{false, true},
+		{true, true},
+	}
+	for _, tt := range tests {
+		tx := stun.NewTxID()
+		req := stun.RequestChange(tx, tt.changeIP, tt.changePort)
+		gotTx, err := stun.ParseBindingRequest(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if gotTx != tx {
+			t.Errorf("original txID %q != got txID %q", tx, gotTx)
+		}
+		changeIP, changePort := stun.ParseChangeRequest(req)
+		if changeIP != tt.changeIP || changePort != tt.changePort {
+			t.Errorf("ParseChangeRequest(RequestChange(%v, %v)) = %v, %v", tt.changeIP, tt.changePort, changeIP, changePort)
+		}
+	}
+	if changeIP, changePort := stun.ParseChangeRequest(stun.Request(stun.NewTxID())); changeIP || changePort {
+		t.Errorf("ParseChangeRequest(Request) = %v, %v; want false, false", changeIP, changePort)
+	}
+}
+
 func TestResponse(t *testing.T) {
 	txN := func(n int) (x stun.TxID) {
 		for i := range x {
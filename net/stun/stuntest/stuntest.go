@@ -91,6 +91,90 @@ func runSTUN(t *testing.T, pc net.PacketConn, stats *stunStats, done chan<- stru
 	}
 }
 
+// ServeChangeRequests runs an RFC 5780 STUN server, which answers
+// requests with a CHANGE-REQUEST from its alternate IP address and/or
+// port. It listens on port and altPort of two machines: ln, whose
+// address is the server's primary one, and altLn, whose address is
+// its alternate one.
+func ServeChangeRequests(t *testing.T, ln, altLn nettype.PacketListener, port, altPort uint16) (cleanupFn func()) {
+	t.Helper()
+
+	var stats stunStats
+	var pcs [2][2]net.PacketConn // by IP (primary or alternate), then port
+	for i, ln := range []nettype.PacketListener{ln, altLn} {
+		for j, port := range []uint16{port, altPort} {
+			pc, err := ln.ListenPacket(context.Background(), "udp4", fmt.Sprintf(":%d", port))
+			if err != nil {
+				t.Fatalf("failed to open STUN listener: %v", err)
+			}
+			pcs[i][j] = pc
+		}
+	}
+	var dones []chan struct{}
+	for i := range pcs {
+		for j := range pcs[i] {
+			done := make(chan struct{})
+			dones = append(dones, done)
+			go runSTUNChange(t, pcs, i, j, &stats, done)
+		}
+	}
+	return func() {
+		for i := range pcs {
+			for _, pc := range pcs[i] {
+				pc.Close()
+			}
+		}
+		for _, done := range dones {
+			<-done
+		}
+	}
+}
+
+// runSTUNChange answers the STUN requests arriving on pcs[ip][port],
+// each from the PacketConn its CHANGE-REQUEST asks for.
+func runSTUNChange(t *testing.T, pcs [2][2]net.PacketConn, ip, port int, stats *stunStats, done chan<- struct{}) {
+	defer close(done)
+
+	pc := pcs[ip][port]
+	var buf [64 << 10]byte
+	for {
+		n, addr, err := pc.ReadFrom(buf[:])
+		if err != nil {
+			// TODO: when we switch to Go 1.16, replace this with errors.Is(err, net.ErrClosed)
+			if strings.Contains(err.Error(), "closed network connection") {
+				return
+			}
+			continue
+		}
+		ua := addr.(*net.UDPAddr)
+		pkt := buf[:n]
+		if !stun.Is(pkt) {
+			continue
+		}
+		txid, err := stun.ParseBindingRequest(pkt)
+		if err != nil {
+			continue
+		}
+
+		stats.mu.Lock()
+		stats.readIPv4++
+		stats.mu.Unlock()
+
+		resIP, resPort := ip, port
+		changeIP, changePort := stun.ParseChangeRequest(pkt)
+		if changeIP {
+			resIP ^= 1
+		}
+		if changePort {
+			resPort ^= 1
+		}
+		res := stun.Response(txid, ua.IP, uint16(ua.Port))
+		if _, err := pcs[resIP][resPort].WriteTo(res, addr); err != nil {
+			t.Logf("STUN server write failed: %v", err)
+		}
+	}
+}
+
 func DERPMapOf(stun ...string) *tailcfg.DERPMap {
 	m := &tailcfg.DERPMap{
 		Regions: map[int]*tailcfg.DERPRegion{},
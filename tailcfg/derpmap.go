@@ -113,6 +113,25 @@ type DERPNode struct {
 	// To disable STUN on this node, use -1.
 	STUNPort int `json:",omitempty"`
 
+	// STUNAltPort optionally specifies a second port on which the
+	// node answers STUN. The node's STUN server answers requests
+	// with an RFC 5780 CHANGE-REQUEST to change the port from its
+	// other port, which lets clients classify how their NAT maps
+	// and filters traffic. Zero means none.
+	STUNAltPort int `json:",omitempty"`
+
+	// STUNAltIPv4 optionally specifies a second IPv4 address of
+	// the node's STUN server, on which it answers STUN on both
+	// STUNPort and STUNAltPort, and from which it answers requests
+	// with a CHANGE-REQUEST to change the IP address. It's only
+	// used if STUNAltPort is set.
+	//
+	// derper has only one address and drops such requests, so this
+	// must be left empty for nodes whose STUN is served by derper.
+	// It's for nodes that run a separate STUN server with two
+	// addresses, implementing RFC 5780.
+	STUNAltIPv4 string `json:",omitempty"`
+
 	// STUNOnly marks a node as only a STUN server and not a DERP
 	// server.
 	STUNOnly bool `json:",omitempty"`
@@ -4,7 +4,7 @@
 
 package tailcfg
 
-//go:generate go run tailscale.com/cmd/cloner --type=User,Node,Hostinfo,NetInfo,Group,Role,Capability,Login,DNSConfig,RegisterResponse --clonefunc=true --output=tailcfg_clone.go
+//go:generate go run tailscale.com/cmd/cloner --type=User,Node,Hostinfo,NetInfo,Group,Role,Capability,Login,DNSConfig,DNSRoute,RegisterResponse --clonefunc=true --output=tailcfg_clone.go
 
 import (
 	"bytes"
@@ -423,6 +423,17 @@ type NetInfo struct {
 	// It reports true even if there's no NAT involved.
 	HairPinning opt.Bool
 
+	// NATMapping is how the NAT, if any, maps the node's IPv4 UDP
+	// traffic to different destinations, as classified by RFC 4787:
+	// "endpoint-independent", "address-dependent", or
+	// "address-and-port-dependent". Empty means unknown.
+	NATMapping string `json:",omitempty"`
+
+	// NATFiltering is which hosts the NAT or firewall, if any, lets
+	// reply to the node's IPv4 UDP traffic, with the same values as
+	// NATMapping. Empty means unknown.
+	NATFiltering string `json:",omitempty"`
+
 	// WorkingIPv6 is whether IPv6 works.
 	WorkingIPv6 opt.Bool
 
@@ -441,6 +452,12 @@ type NetInfo struct {
 	// Empty means not checked.
 	PCP opt.Bool
 
+	// PortMapping is the comma-separated list of port mapping
+	// protocols in use, such as "PCP" or "UPnP". An IPv6 mapping
+	// (a firewall pinhole) has a "6" suffix, such as "PCP6".
+	// Empty means none.
+	PortMapping string `json:",omitempty"`
+
 	// PreferredDERP is this node's preferred DERP server
 	// for incoming traffic. The node might be be temporarily
 	// connected to multiple DERP servers (to send to other nodes)
@@ -480,7 +497,11 @@ func (ni *NetInfo) portMapSummary() string {
 	if ni.UPnP == "" && ni.PMP == "" && ni.PCP == "" {
 		return "?"
 	}
-	return conciseOptBool(ni.UPnP, "U") + conciseOptBool(ni.PMP, "M") + conciseOptBool(ni.PCP, "C")
+	s := conciseOptBool(ni.UPnP, "U") + conciseOptBool(ni.PMP, "M") + conciseOptBool(ni.PCP, "C")
+	if ni.PortMapping != "" {
+		s += "(" + ni.PortMapping + ")"
+	}
+	return s
 }
 
 func conciseOptBool(b opt.Bool, trueVal string) string {
@@ -508,11 +529,14 @@ func (ni *NetInfo) BasicallyEqual(ni2 *NetInfo) bool {
 	}
 	return ni.MappingVariesByDestIP == ni2.MappingVariesByDestIP &&
 		ni.HairPinning == ni2.HairPinning &&
+		ni.NATMapping == ni2.NATMapping &&
+		ni.NATFiltering == ni2.NATFiltering &&
 		ni.WorkingIPv6 == ni2.WorkingIPv6 &&
 		ni.WorkingUDP == ni2.WorkingUDP &&
 		ni.UPnP == ni2.UPnP &&
 		ni.PMP == ni2.PMP &&
 		ni.PCP == ni2.PCP &&
+		ni.PortMapping == ni2.PortMapping &&
 		ni.PreferredDERP == ni2.PreferredDERP &&
 		ni.LinkType == ni2.LinkType
 }
@@ -711,6 +735,26 @@ type DNSConfig struct {
 	// Proxied indicates whether DNS requests are proxied through a tsdns.Resolver.
 	// This enables Magic DNS. It is togglable independently of PerDomain.
 	Proxied bool
+	// Routes are split DNS routes: queries for names within a route's
+	// Suffix are forwarded to its Nameservers rather than to Nameservers.
+	// They only apply if Proxied is set.
+	Routes []DNSRoute `json:",omitempty"`
+}
+
+// DNSRoute directs the forwarding of DNS queries for names within a
+// domain, as in split DNS.
+type DNSRoute struct {
+	// Suffix is the domain the route applies to, such as "corp.example.com".
+	// It matches the domain itself and all of its subdomains.
+	Suffix string
+	// Nameservers are the IP addresses of the nameservers to forward
+	// matching queries to.
+	Nameservers []netaddr.IP `json:",omitempty"`
+	// Fallback is whether matching queries are retried with the
+	// DNSConfig's Nameservers when Nameservers fail to answer.
+	// A route with Fallback and no Nameservers uses the DNSConfig's
+	// Nameservers directly.
+	Fallback bool `json:",omitempty"`
 }
 
 type MapResponse struct {
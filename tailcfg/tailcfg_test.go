@@ -373,11 +373,14 @@ func TestNetInfoFields(t *testing.T) {
 	handled := []string{
 		"MappingVariesByDestIP",
 		"HairPinning",
+		"NATMapping",
+		"NATFiltering",
 		"WorkingIPv6",
 		"WorkingUDP",
 		"UPnP",
 		"PMP",
 		"PCP",
+		"PortMapping",
 		"PreferredDERP",
 		"LinkType",
 		"DERPLatency",
@@ -0,0 +1,82 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package tsweb
+
+import (
+	"expvar"
+	"fmt"
+	"io"
+	"net/http"
+	"runtime"
+	"runtime/debug"
+	"runtime/pprof"
+	"time"
+)
+
+// MetricsHandler is an HTTP handler serving expvar values and Go
+// runtime stats in the Prometheus text exposition format, for
+// standard Prometheus scrapers to use directly, conventionally at
+// /metrics.
+//
+// Expvars are exported as documented at VarzHandler, except for the
+// "memstats" expvar, which is superseded by the runtime stats. Those
+// use the names of the official Prometheus Go client (go_goroutines,
+// go_memstats_alloc_bytes, go_gc_duration_seconds, etc.), so existing
+// dashboards and alerts work unchanged.
+func MetricsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", promContentType)
+	expvar.Do(func(kv expvar.KeyValue) {
+		if kv.Key == "memstats" {
+			return
+		}
+		writePromExpvar(w, "", kv)
+	})
+	writeGoMetrics(w)
+}
+
+// writeGoMetrics writes Go runtime and process stats to w in the
+// Prometheus text exposition format.
+func writeGoMetrics(w io.Writer) {
+	out := func(name, typ string, v interface{}, help string) {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n%s %v\n", name, help, name, typ, name, v)
+	}
+	g := func(name string, v interface{}, help string) { out(name, "gauge", v, help) }
+	c := func(name string, v interface{}, help string) { out(name, "counter", v, help) }
+
+	fmt.Fprintf(w, "# HELP go_info Information about the Go environment.\n# TYPE go_info gauge\ngo_info{version=%q} 1\n", runtime.Version())
+	g("go_goroutines", runtime.NumGoroutine(), "Number of goroutines that currently exist.")
+	g("go_threads", pprof.Lookup("threadcreate").Count(), "Number of OS threads created.")
+
+	var gc debug.GCStats
+	gc.PauseQuantiles = make([]time.Duration, 5)
+	debug.ReadGCStats(&gc)
+	fmt.Fprintf(w, "# HELP go_gc_duration_seconds A summary of the pause duration of garbage collection cycles.\n# TYPE go_gc_duration_seconds summary\n")
+	for i, q := range []string{"0", "0.25", "0.5", "0.75", "1"} {
+		fmt.Fprintf(w, "go_gc_duration_seconds{quantile=%q} %v\n", q, gc.PauseQuantiles[i].Seconds())
+	}
+	fmt.Fprintf(w, "go_gc_duration_seconds_sum %v\ngo_gc_duration_seconds_count %v\n", gc.PauseTotal.Seconds(), gc.NumGC)
+
+	var ms runtime.MemStats
+	runtime.ReadMemStats(&ms)
+	g("go_memstats_alloc_bytes", ms.Alloc, "Number of bytes allocated and still in use.")
+	c("go_memstats_alloc_bytes_total", ms.TotalAlloc, "Total number of bytes allocated, even if freed.")
+	g("go_memstats_sys_bytes", ms.Sys, "Number of bytes obtained from system.")
+	c("go_memstats_lookups_total", ms.Lookups, "Total number of pointer lookups.")
+	c("go_memstats_mallocs_total", ms.Mallocs, "Total number of mallocs.")
+	c("go_memstats_frees_total", ms.Frees, "Total number of frees.")
+	g("go_memstats_heap_alloc_bytes", ms.HeapAlloc, "Number of heap bytes allocated and still in use.")
+	g("go_memstats_heap_sys_bytes", ms.HeapSys, "Number of heap bytes obtained from system.")
+	g("go_memstats_heap_idle_bytes", ms.HeapIdle, "Number of heap bytes waiting to be used.")
+	g("go_memstats_heap_inuse_bytes", ms.HeapInuse, "Number of heap bytes that are in use.")
+	g("go_memstats_heap_released_bytes", ms.HeapReleased, "Number of heap bytes released to OS.")
+	g("go_memstats_heap_objects", ms.HeapObjects, "Number of allocated objects.")
+	g("go_memstats_stack_inuse_bytes", ms.StackInuse, "Number of bytes in use by the stack allocator.")
+	g("go_memstats_stack_sys_bytes", ms.StackSys, "Number of bytes obtained from system for stack allocator.")
+	g("go_memstats_next_gc_bytes", ms.NextGC, "Number of heap bytes when next garbage collection will take place.")
+	g("go_memstats_last_gc_time_seconds", float64(ms.LastGC)/1e9, "Number of seconds since 1970 of last garbage collection.")
+	g("go_memstats_gc_cpu_fraction", ms.GCCPUFraction, "The fraction of this program's available CPU time used by the GC since the program started.")
+
+	g("process_start_time_seconds", timeStart.Unix(), "Start time of the process since unix epoch in seconds.")
+}
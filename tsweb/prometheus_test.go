@@ -0,0 +1,87 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package tsweb
+
+import (
+	"bytes"
+	"expvar"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"tailscale.com/metrics"
+)
+
+func TestWritePromExpvar(t *testing.T) {
+	newInt := func(v int64) *expvar.Int {
+		i := new(expvar.Int)
+		i.Set(v)
+		return i
+	}
+	newFloat := func(v float64) *expvar.Float {
+		f := new(expvar.Float)
+		f.Set(v)
+		return f
+	}
+	labelMap := func(label string, kv ...interface{}) *metrics.LabelMap {
+		m := &metrics.LabelMap{Label: label}
+		for i := 0; i < len(kv); i += 2 {
+			m.Add(kv[i].(string), int64(kv[i+1].(int)))
+		}
+		return m
+	}
+	set := new(metrics.Set)
+	set.Set("gauge_conns", newInt(3))
+	set.Set("counter_dropped", labelMap("reason", "full", 2, "gone", 1))
+
+	tests := []struct {
+		name string
+		v    expvar.Var
+		want string
+	}{
+		{"foo", newInt(1), "# TYPE foo counter\nfoo 1\n"},
+		{"counter_foo", newInt(1), "# TYPE foo counter\nfoo 1\n"},
+		{"gauge_foo", newInt(-1), "# TYPE foo gauge\nfoo -1\n"},
+		{"foo", newFloat(0.5), "# TYPE foo gauge\nfoo 0.5\n"},
+		{"counter_foo", newFloat(1.5), "# TYPE foo counter\nfoo 1.5\n"},
+		{"gauge_foo", expvar.Func(func() interface{} { return 1.25 }), "# TYPE foo gauge\nfoo 1.25\n"},
+		{"gauge_foo", expvar.Func(func() interface{} { return "x" }), "# skipping expvar func \"foo\" returning unknown type string\n"},
+		{"foo", expvar.Func(func() interface{} { return 1 }), "# skipping expvar \"foo\" (Go type expvar.Func returning int) with undeclared Prometheus type\n"},
+		{"foo", labelMap("kind", "a", 1, "b", 2), "# TYPE foo counter\nfoo{kind=\"a\"} 1\nfoo{kind=\"b\"} 2\n"},
+		{"gauge_foo", labelMap("kind", "a", 1), "# TYPE foo gauge\nfoo{kind=\"a\"} 1\n"},
+		{"derp", set, "# TYPE derp_dropped counter\nderp_dropped{reason=\"full\"} 2\nderp_dropped{reason=\"gone\"} 1\n" +
+			"# TYPE derp_conns gauge\nderp_conns 3\n"},
+	}
+	for _, tt := range tests {
+		var buf bytes.Buffer
+		writePromExpvar(&buf, "", expvar.KeyValue{Key: tt.name, Value: tt.v})
+		if got := buf.String(); got != tt.want {
+			t.Errorf("%s (%T):\n got: %q\nwant: %q", tt.name, tt.v, got, tt.want)
+		}
+	}
+}
+
+func TestMetricsHandler(t *testing.T) {
+	rec := httptest.NewRecorder()
+	MetricsHandler(rec, httptest.NewRequest("GET", "/metrics", nil))
+	if got, want := rec.Header().Get("Content-Type"), "text/plain; version=0.0.4"; got != want {
+		t.Errorf("Content-Type = %q; want %q", got, want)
+	}
+	body := rec.Body.String()
+	for _, want := range []string{
+		"\ngo_goroutines ",
+		"\ngo_memstats_alloc_bytes ",
+		"\ngo_gc_duration_seconds_count ",
+		"\nprocess_start_time_seconds ",
+		"go_info{version=",
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("output lacks %q", want)
+		}
+	}
+	if strings.Contains(body, "\nmemstats_") {
+		t.Errorf("output contains legacy memstats_ metrics:\n%s", body)
+	}
+}
@@ -384,83 +384,104 @@ func Error(code int, msg string, err error) HTTPError {
 // It makes the following assumptions:
 //
 //   * *expvar.Int are counters (unless marked as a gauge_; see below)
+//   * *expvar.Float are gauges (unless marked as a counter_)
 //   * a *tailscale/metrics.Set is descended into, joining keys with
 //     underscores. So use underscores as your metric names.
+//   * a *tailscale/metrics.LabelMap is exported as a single metric
+//     with one labelled series per key, and is a counter unless
+//     marked as a gauge_.
 //   * an expvar named starting with "gauge_" or "counter_" is of that
 //     Prometheus type, and has that prefix stripped.
 //   * anything else is untyped and thus not exported.
-//   * expvar.Func can return an int or int64 (for now) and anything else
-//     is not exported.
+//   * expvar.Func can return an int, int64 or float64 (for now) and
+//     anything else is not exported.
 //
 // This will evolve over time, or perhaps be replaced.
+//
+// See MetricsHandler for a variant suitable for standard Prometheus
+// scrapers.
 func VarzHandler(w http.ResponseWriter, r *http.Request) {
-	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	w.Header().Set("Content-Type", promContentType)
+	expvar.Do(func(kv expvar.KeyValue) {
+		writePromExpvar(w, "", kv)
+	})
+}
 
-	var dump func(prefix string, kv expvar.KeyValue)
-	dump = func(prefix string, kv expvar.KeyValue) {
-		name := prefix + kv.Key
+// promContentType is the Content-Type of the Prometheus text
+// exposition format.
+const promContentType = "text/plain; version=0.0.4"
 
-		var typ string
-		switch {
-		case strings.HasPrefix(kv.Key, "gauge_"):
-			typ = "gauge"
-			name = prefix + strings.TrimPrefix(kv.Key, "gauge_")
+// writePromExpvar writes kv to w in the Prometheus text exposition
+// format, naming it prefix+kv.Key, as documented at VarzHandler.
+func writePromExpvar(w io.Writer, prefix string, kv expvar.KeyValue) {
+	name := prefix + kv.Key
+
+	var typ string
+	switch {
+	case strings.HasPrefix(kv.Key, "gauge_"):
+		typ = "gauge"
+		name = prefix + strings.TrimPrefix(kv.Key, "gauge_")
 
-		case strings.HasPrefix(kv.Key, "counter_"):
+	case strings.HasPrefix(kv.Key, "counter_"):
+		typ = "counter"
+		name = prefix + strings.TrimPrefix(kv.Key, "counter_")
+	}
+
+	switch v := kv.Value.(type) {
+	case *expvar.Int:
+		if typ == "" {
 			typ = "counter"
-			name = prefix + strings.TrimPrefix(kv.Key, "counter_")
 		}
-
-		switch v := kv.Value.(type) {
-		case *expvar.Int:
-			if typ == "" {
-				typ = "counter"
-			}
-			fmt.Fprintf(w, "# TYPE %s %s\n%s %v\n", name, typ, name, v.Value())
-			return
-		case *metrics.Set:
-			v.Do(func(kv expvar.KeyValue) {
-				dump(name+"_", kv)
-			})
-			return
+		fmt.Fprintf(w, "# TYPE %s %s\n%s %v\n", name, typ, name, v.Value())
+		return
+	case *expvar.Float:
+		if typ == "" {
+			typ = "gauge"
 		}
-
+		fmt.Fprintf(w, "# TYPE %s %s\n%s %v\n", name, typ, name, v.Value())
+		return
+	case *metrics.Set:
+		v.Do(func(kv expvar.KeyValue) {
+			writePromExpvar(w, name+"_", kv)
+		})
+		return
+	case *metrics.LabelMap:
 		if typ == "" {
-			var funcRet string
-			if f, ok := kv.Value.(expvar.Func); ok {
-				v := f()
-				if ms, ok := v.(runtime.MemStats); ok && name == "memstats" {
-					writeMemstats(w, &ms)
-					return
-				}
-				funcRet = fmt.Sprintf(" returning %T", v)
-			}
-			fmt.Fprintf(w, "# skipping expvar %q (Go type %T%s) with undeclared Prometheus type\n", name, kv.Value, funcRet)
-			return
+			typ = "counter"
 		}
+		fmt.Fprintf(w, "# TYPE %s %s\n", name, typ)
+		// IntMap uses expvar.Map on the inside, which presorts
+		// keys. The output ordering is deterministic.
+		v.Do(func(kv expvar.KeyValue) {
+			fmt.Fprintf(w, "%s{%s=%q} %v\n", name, v.Label, kv.Key, kv.Value)
+		})
+		return
+	}
 
-		switch v := kv.Value.(type) {
-		case expvar.Func:
-			val := v()
-			switch val.(type) {
-			case int64, int:
-				fmt.Fprintf(w, "# TYPE %s %s\n%s %v\n", name, typ, name, val)
-			default:
-				fmt.Fprintf(w, "# skipping expvar func %q returning unknown type %T\n", name, val)
+	if typ == "" {
+		var funcRet string
+		if f, ok := kv.Value.(expvar.Func); ok {
+			v := f()
+			if ms, ok := v.(runtime.MemStats); ok && name == "memstats" {
+				writeMemstats(w, &ms)
+				return
 			}
+			funcRet = fmt.Sprintf(" returning %T", v)
+		}
+		fmt.Fprintf(w, "# skipping expvar %q (Go type %T%s) with undeclared Prometheus type\n", name, kv.Value, funcRet)
+		return
+	}
 
-		case *metrics.LabelMap:
-			fmt.Fprintf(w, "# TYPE %s %s\n", name, typ)
-			// IntMap uses expvar.Map on the inside, which presorts
-			// keys. The output ordering is deterministic.
-			v.Do(func(kv expvar.KeyValue) {
-				fmt.Fprintf(w, "%s{%s=%q} %v\n", name, v.Label, kv.Key, kv.Value)
-			})
+	switch v := kv.Value.(type) {
+	case expvar.Func:
+		val := v()
+		switch val.(type) {
+		case int64, int, float64:
+			fmt.Fprintf(w, "# TYPE %s %s\n%s %v\n", name, typ, name, val)
+		default:
+			fmt.Fprintf(w, "# skipping expvar func %q returning unknown type %T\n", name, val)
 		}
 	}
-	expvar.Do(func(kv expvar.KeyValue) {
-		dump("", kv)
-	})
 }
 
 func writeMemstats(w io.Writer, ms *runtime.MemStats) {
@@ -23,3 +23,12 @@ var ErrProcessNotFound = errors.New("process not found")
 func OwnerOfPID(pid int) (userID string, err error) {
 	return ownerOfPID(pid)
 }
+
+// IsElevatedPID reports whether the given process ID runs with an
+// elevated (administrator) token.
+//
+// The returned error will be ErrNotImplemented on operating systems
+// other than Windows.
+func IsElevatedPID(pid int) (bool, error) {
+	return isElevatedPID(pid)
+}
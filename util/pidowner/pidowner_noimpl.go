@@ -7,3 +7,5 @@
 package pidowner
 
 func ownerOfPID(pid int) (userID string, err error) { return "", ErrNotImplemented }
+
+func isElevatedPID(pid int) (bool, error) { return false, ErrNotImplemented }
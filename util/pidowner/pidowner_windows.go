@@ -11,20 +11,31 @@ import (
 	"golang.org/x/sys/windows"
 )
 
-func ownerOfPID(pid int) (userID string, err error) {
+// processToken returns the access token of the given process ID.
+// The caller must close it.
+func processToken(pid int) (windows.Token, error) {
 	procHnd, err := windows.OpenProcess(windows.PROCESS_QUERY_INFORMATION, false, uint32(pid))
 	if err == syscall.Errno(0x57) { // invalid parameter, for PIDs that don't exist
-		return "", ErrProcessNotFound
+		return 0, ErrProcessNotFound
 	}
 	if err != nil {
-		return "", fmt.Errorf("OpenProcess: %T %#v", err, err)
+		return 0, fmt.Errorf("OpenProcess: %T %#v", err, err)
 	}
 	defer windows.CloseHandle(procHnd)
 
 	var tok windows.Token
 	if err := windows.OpenProcessToken(procHnd, windows.TOKEN_QUERY, &tok); err != nil {
-		return "", fmt.Errorf("OpenProcessToken: %w", err)
+		return 0, fmt.Errorf("OpenProcessToken: %w", err)
+	}
+	return tok, nil
+}
+
+func ownerOfPID(pid int) (userID string, err error) {
+	tok, err := processToken(pid)
+	if err != nil {
+		return "", err
 	}
+	defer tok.Close()
 
 	tokUser, err := tok.GetTokenUser()
 	if err != nil {
@@ -34,3 +45,12 @@ func ownerOfPID(pid int) (userID string, err error) {
 	sid := tokUser.User.Sid
 	return sid.String(), nil
 }
+
+func isElevatedPID(pid int) (bool, error) {
+	tok, err := processToken(pid)
+	if err != nil {
+		return false, err
+	}
+	defer tok.Close()
+	return tok.IsElevated(), nil
+}
@@ -0,0 +1,226 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package capture captures the decrypted packets passing through
+// tailscaled's TUN device and writes them out in pcapng format.
+package capture
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"inet.af/netaddr"
+	"tailscale.com/net/packet"
+	"tailscale.com/wgengine/filter"
+)
+
+// Path is where a captured packet passed through the TUN device.
+type Path uint8
+
+const (
+	// FromLocal packets were read from the OS, to be sent to a peer.
+	FromLocal Path = iota
+	// FromPeer packets were received from a peer, to be written to
+	// the OS.
+	FromPeer
+	// SynthesizedToLocal packets were generated by tailscaled and
+	// injected towards the OS, bypassing the packet filter.
+	SynthesizedToLocal
+	// SynthesizedToPeer packets were generated by tailscaled and
+	// injected towards a peer, bypassing the packet filter.
+	SynthesizedToPeer
+)
+
+func (p Path) String() string {
+	switch p {
+	case FromLocal:
+		return "from local"
+	case FromPeer:
+		return "from peer"
+	case SynthesizedToLocal:
+		return "synthesized to local"
+	case SynthesizedToPeer:
+		return "synthesized to peer"
+	default:
+		return "Path(" + strconv.Itoa(int(p)) + ")"
+	}
+}
+
+// inbound reports whether packets on path are headed to the OS.
+func (p Path) inbound() bool {
+	return p == FromPeer || p == SynthesizedToLocal
+}
+
+// Callback is called with each packet passing through the TUN device
+// while a capture is installed, along with the packet filter's
+// verdict on it. Synthesized packets aren't filtered, and have a
+// verdict of filter.Accept. The callback must not retain pkt.
+type Callback func(path Path, pkt []byte, verdict filter.Response)
+
+// Filter selects packets to capture. The zero value selects all
+// packets.
+type Filter struct {
+	// Hosts, if non-empty, are IPs that must all be the source or
+	// destination of captured packets.
+	Hosts []netaddr.IP
+	// Ports, if non-empty, are ports that must all be the source or
+	// destination port of captured packets.
+	Ports []uint16
+}
+
+// ParseFilter parses a filter expression, which is a BPF-like
+// sequence of "host IP" and "port N" terms, optionally separated by
+// "and". For instance, "host 100.101.102.103 and port 22" selects
+// SSH traffic to or from that host. The empty expression selects all
+// packets.
+func ParseFilter(expr string) (Filter, error) {
+	var f Filter
+	words := strings.Fields(expr)
+	for i := 0; i < len(words); i++ {
+		w := words[i]
+		if w == "and" && i > 0 && i < len(words)-1 {
+			continue
+		}
+		if i == len(words)-1 {
+			return Filter{}, fmt.Errorf("capture filter: missing value after %q", w)
+		}
+		i++
+		v := words[i]
+		switch w {
+		case "host":
+			ip, err := netaddr.ParseIP(v)
+			if err != nil {
+				return Filter{}, fmt.Errorf("capture filter: invalid host: %v", err)
+			}
+			f.Hosts = append(f.Hosts, ip)
+		case "port":
+			port, err := strconv.ParseUint(v, 10, 16)
+			if err != nil {
+				return Filter{}, fmt.Errorf("capture filter: invalid port %q", v)
+			}
+			f.Ports = append(f.Ports, uint16(port))
+		default:
+			return Filter{}, fmt.Errorf("capture filter: unknown term %q; want \"host IP\" or \"port N\"", w)
+		}
+	}
+	return f, nil
+}
+
+// match reports whether f selects pkt.
+func (f *Filter) match(pkt []byte) bool {
+	if len(f.Hosts) == 0 && len(f.Ports) == 0 {
+		return true
+	}
+	var p packet.Parsed
+	p.Decode(pkt)
+	if p.IPVersion == 0 {
+		return false
+	}
+	for _, ip := range f.Hosts {
+		if p.Src.IP != ip && p.Dst.IP != ip {
+			return false
+		}
+	}
+	for _, port := range f.Ports {
+		if p.Src.Port != port && p.Dst.Port != port {
+			return false
+		}
+	}
+	return true
+}
+
+// sinkQueueLen is the number of captured packets a Sink buffers for
+// writing before it starts dropping them.
+const sinkQueueLen = 1024
+
+// Sink writes the packets passed to its Capture method as a pcapng
+// stream.
+type Sink struct {
+	filter  Filter
+	ch      chan capturedPacket
+	dropped uint64 // atomic; matching packets Run couldn't keep up with
+}
+
+type capturedPacket struct {
+	t       time.Time
+	path    Path
+	verdict filter.Response
+	pkt     []byte
+}
+
+// NewSink returns a Sink capturing the packets selected by f.
+func NewSink(f Filter) *Sink {
+	return &Sink{
+		filter: f,
+		ch:     make(chan capturedPacket, sinkQueueLen),
+	}
+}
+
+// Capture is a Callback that queues pkt to be written by Run, if
+// s's filter selects it. It doesn't block: if Run can't keep up,
+// packets are dropped, and the pcapng stream records how many.
+func (s *Sink) Capture(path Path, pkt []byte, verdict filter.Response) {
+	if !s.filter.match(pkt) {
+		return
+	}
+	cp := capturedPacket{
+		t:       time.Now(),
+		path:    path,
+		verdict: verdict,
+		pkt:     append([]byte(nil), pkt...),
+	}
+	select {
+	case s.ch <- cp:
+	default:
+		atomic.AddUint64(&s.dropped, 1)
+	}
+}
+
+// Dropped returns the number of packets s dropped because Run
+// couldn't write them fast enough.
+func (s *Sink) Dropped() uint64 {
+	return atomic.LoadUint64(&s.dropped)
+}
+
+// Run writes the captured packets to w as a pcapng stream, until ctx
+// is done or a write fails. If w has a Flush method, like an
+// http.ResponseWriter, it's called whenever Run has written all
+// queued packets.
+func (s *Sink) Run(ctx context.Context, w io.Writer) error {
+	pw, err := newPCAPNGWriter(w, "tailscale")
+	if err != nil {
+		return err
+	}
+	flush := func() {}
+	if f, ok := w.(interface{ Flush() }); ok {
+		flush = f.Flush
+	}
+	flush()
+
+	var lastDropped uint64
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case cp := <-s.ch:
+			comment := cp.path.String()
+			if cp.path == FromLocal || cp.path == FromPeer {
+				comment += ": " + cp.verdict.String()
+			}
+			dropped := s.Dropped()
+			if err := pw.writePacket(cp.t, cp.pkt, cp.path.inbound(), comment, dropped-lastDropped); err != nil {
+				return err
+			}
+			lastDropped = dropped
+			if len(s.ch) == 0 {
+				flush()
+			}
+		}
+	}
+}
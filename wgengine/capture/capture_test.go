@@ -0,0 +1,255 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package capture
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"inet.af/netaddr"
+	"tailscale.com/net/packet"
+	"tailscale.com/wgengine/filter"
+)
+
+func TestParseFilter(t *testing.T) {
+	ip := netaddr.MustParseIP("100.101.102.103")
+	ip6 := netaddr.MustParseIP("fd7a:115c:a1e0::1")
+	tests := []struct {
+		in      string
+		want    Filter
+		wantErr bool
+	}{
+		{in: "", want: Filter{}},
+		{in: "host 100.101.102.103", want: Filter{Hosts: []netaddr.IP{ip}}},
+		{in: "port 22", want: Filter{Ports: []uint16{22}}},
+		{in: "host 100.101.102.103 and port 22", want: Filter{Hosts: []netaddr.IP{ip}, Ports: []uint16{22}}},
+		{in: "host 100.101.102.103 host fd7a:115c:a1e0::1", want: Filter{Hosts: []netaddr.IP{ip, ip6}}},
+		{in: "host", wantErr: true},
+		{in: "host foo", wantErr: true},
+		{in: "port 65536", wantErr: true},
+		{in: "and port 22", wantErr: true},
+		{in: "port 22 and", wantErr: true},
+		{in: "net 100.64.0.0/10", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := ParseFilter(tt.in)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("ParseFilter(%q) error = %v; want error %v", tt.in, err, tt.wantErr)
+			continue
+		}
+		if err == nil && !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("ParseFilter(%q) = %+v; want %+v", tt.in, got, tt.want)
+		}
+	}
+}
+
+func udp4(src, dst string, srcPort, dstPort uint16) []byte {
+	h := packet.UDP4Header{
+		IP4Header: packet.IP4Header{
+			IPProto: packet.UDP,
+			Src:     netaddr.MustParseIP(src),
+			Dst:     netaddr.MustParseIP(dst),
+		},
+		SrcPort: srcPort,
+		DstPort: dstPort,
+	}
+	return packet.Generate(h, []byte("hello"))
+}
+
+func TestFilterMatch(t *testing.T) {
+	f, err := ParseFilter("host 100.64.0.2 and port 53")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		pkt  []byte
+		want bool
+	}{
+		{udp4("100.64.0.1", "100.64.0.2", 1234, 53), true},
+		{udp4("100.64.0.2", "100.64.0.1", 53, 1234), true},
+		{udp4("100.64.0.1", "100.64.0.3", 1234, 53), false},
+		{udp4("100.64.0.1", "100.64.0.2", 1234, 80), false},
+		{[]byte{0x00, 0x01}, false},
+	}
+	for i, tt := range tests {
+		if got := f.match(tt.pkt); got != tt.want {
+			t.Errorf("%d. match = %v; want %v", i, got, tt.want)
+		}
+	}
+	var zero Filter
+	if !zero.match([]byte{0x00}) {
+		t.Error("zero Filter didn't match")
+	}
+}
+
+// syncBuffer is a bytes.Buffer safe for concurrent use, which
+// records how many times it was flushed.
+type syncBuffer struct {
+	mu      sync.Mutex
+	buf     bytes.Buffer
+	flushes int
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) Flush() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.flushes++
+}
+
+func (b *syncBuffer) Bytes() []byte {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return append([]byte(nil), b.buf.Bytes()...)
+}
+
+type block struct {
+	typ  uint32
+	body []byte
+}
+
+// parseBlocks splits a little-endian pcapng stream into its blocks.
+func parseBlocks(t *testing.T, b []byte) []block {
+	t.Helper()
+	var blocks []block
+	for len(b) > 0 {
+		if len(b) < 12 {
+			t.Fatalf("short block: %x", b)
+		}
+		typ := binary.LittleEndian.Uint32(b)
+		n := binary.LittleEndian.Uint32(b[4:])
+		if n%4 != 0 || int(n) > len(b) || n < 12 {
+			t.Fatalf("bad block length %d (have %d bytes)", n, len(b))
+		}
+		if trailer := binary.LittleEndian.Uint32(b[n-4:]); trailer != n {
+			t.Fatalf("block length %d, trailer %d", n, trailer)
+		}
+		blocks = append(blocks, block{typ, b[8 : n-4]})
+		b = b[n:]
+	}
+	return blocks
+}
+
+// parseOptions parses pcapng options into a map from code to value.
+func parseOptions(t *testing.T, b []byte) map[uint16][]byte {
+	t.Helper()
+	opts := map[uint16][]byte{}
+	for len(b) >= 4 {
+		code := binary.LittleEndian.Uint16(b)
+		n := int(binary.LittleEndian.Uint16(b[2:]))
+		if code == optEndOfOpt {
+			return opts
+		}
+		padded := (n + 3) &^ 3
+		if 4+padded > len(b) {
+			t.Fatalf("option %d overflows block", code)
+		}
+		opts[code] = b[4 : 4+n]
+		b = b[4+padded:]
+	}
+	t.Fatal("options lack opt_endofopt")
+	return nil
+}
+
+func TestSink(t *testing.T) {
+	f, _ := ParseFilter("port 22")
+	s := NewSink(f)
+	var buf syncBuffer
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- s.Run(ctx, &buf) }()
+
+	ssh := udp4("100.64.0.1", "100.64.0.2", 1234, 22)
+	s.Capture(FromPeer, ssh, filter.Drop)
+	s.Capture(FromLocal, udp4("100.64.0.1", "100.64.0.2", 1234, 80), filter.Accept) // filtered out
+	s.Capture(SynthesizedToPeer, udp4("100.64.0.2", "100.64.0.1", 22, 1234), filter.Accept)
+
+	var blocks []block
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		blocks = parseBlocks(t, buf.Bytes())
+		if len(blocks) == 4 || time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	cancel()
+	if err := <-done; err != context.Canceled {
+		t.Errorf("Run = %v; want context.Canceled", err)
+	}
+	if len(blocks) != 4 {
+		t.Fatalf("got %d blocks; want 4", len(blocks))
+	}
+	buf.mu.Lock()
+	if buf.flushes == 0 {
+		t.Error("never flushed")
+	}
+	buf.mu.Unlock()
+
+	if blocks[0].typ != blockSectionHeader || binary.LittleEndian.Uint32(blocks[0].body) != byteOrderMagic {
+		t.Errorf("first block isn't a section header: %x", blocks[0])
+	}
+	if idb := blocks[1]; idb.typ != blockInterfaceDescription || binary.LittleEndian.Uint16(idb.body) != linkTypeRaw {
+		t.Errorf("second block isn't a raw IP interface description: %x", idb)
+	} else if name := parseOptions(t, idb.body[8:])[optIfName]; string(name) != "tailscale" {
+		t.Errorf("interface name = %q", name)
+	}
+
+	wantPkts := []struct {
+		pkt     []byte
+		flags   uint32
+		comment string
+	}{
+		{ssh, epbInbound, "from peer: Drop"},
+		{udp4("100.64.0.2", "100.64.0.1", 22, 1234), epbOutbound, "synthesized to peer"},
+	}
+	for i, want := range wantPkts {
+		b := blocks[2+i]
+		if b.typ != blockEnhancedPacket {
+			t.Errorf("packet %d: block type %x", i, b.typ)
+			continue
+		}
+		capLen := int(binary.LittleEndian.Uint32(b.body[12:]))
+		origLen := int(binary.LittleEndian.Uint32(b.body[16:]))
+		if capLen != len(want.pkt) || origLen != len(want.pkt) {
+			t.Errorf("packet %d: lengths %d, %d; want %d", i, capLen, origLen, len(want.pkt))
+			continue
+		}
+		if got := b.body[20 : 20+capLen]; !bytes.Equal(got, want.pkt) {
+			t.Errorf("packet %d: got %x; want %x", i, got, want.pkt)
+		}
+		opts := parseOptions(t, b.body[20+(capLen+3)&^3:])
+		if got := binary.LittleEndian.Uint32(opts[optFlags]); got != want.flags {
+			t.Errorf("packet %d: flags %d; want %d", i, got, want.flags)
+		}
+		if got := string(opts[optComment]); got != want.comment {
+			t.Errorf("packet %d: comment %q; want %q", i, got, want.comment)
+		}
+		if _, ok := opts[optDropCnt]; ok {
+			t.Errorf("packet %d: unexpected drop count", i)
+		}
+	}
+}
+
+func TestSinkDrops(t *testing.T) {
+	s := NewSink(Filter{})
+	pkt := udp4("100.64.0.1", "100.64.0.2", 1, 2)
+	for i := 0; i < sinkQueueLen+10; i++ {
+		s.Capture(FromLocal, pkt, filter.Accept)
+	}
+	if got := s.Dropped(); got != 10 {
+		t.Errorf("Dropped = %d; want 10", got)
+	}
+}
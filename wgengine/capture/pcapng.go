@@ -0,0 +1,142 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package capture
+
+import (
+	"encoding/binary"
+	"io"
+	"time"
+)
+
+// pcapng block types and option codes, from
+// https://tools.ietf.org/html/draft-tuexen-opsawg-pcapng.
+const (
+	blockSectionHeader        = 0x0A0D0D0A
+	blockInterfaceDescription = 0x00000001
+	blockEnhancedPacket       = 0x00000006
+
+	byteOrderMagic = 0x1A2B3C4D
+
+	optEndOfOpt = 0
+	optComment  = 1
+	optIfName   = 2 // in an Interface Description Block
+	optFlags    = 2 // in an Enhanced Packet Block
+	optDropCnt  = 4 // in an Enhanced Packet Block
+
+	// linkTypeRaw is LINKTYPE_RAW: packets start with their IPv4 or
+	// IPv6 header.
+	linkTypeRaw = 101
+
+	// Enhanced Packet Block flags' direction bits.
+	epbInbound  = 1
+	epbOutbound = 2
+)
+
+// pcapngWriter writes packets to a pcapng stream with a single
+// section and a single interface, with the default microsecond
+// timestamp resolution.
+type pcapngWriter struct {
+	w   io.Writer
+	buf []byte // reused block buffer
+}
+
+// newPCAPNGWriter returns a writer of a pcapng stream to w,
+// starting it with the headers for an interface named ifName.
+func newPCAPNGWriter(w io.Writer, ifName string) (*pcapngWriter, error) {
+	pw := &pcapngWriter{w: w}
+
+	b := pw.start(blockSectionHeader)
+	b = le32(b, byteOrderMagic)
+	b = le16(b, 1) // major version
+	b = le16(b, 0) // minor version
+	b = le64(b, ^uint64(0))
+	if err := pw.finish(b); err != nil {
+		return nil, err
+	}
+
+	b = pw.start(blockInterfaceDescription)
+	b = le16(b, linkTypeRaw)
+	b = le16(b, 0) // reserved
+	b = le32(b, 0) // no snap length limit
+	b = appendOption(b, optIfName, []byte(ifName))
+	b = appendOption(b, optEndOfOpt, nil)
+	if err := pw.finish(b); err != nil {
+		return nil, err
+	}
+	return pw, nil
+}
+
+// writePacket writes an Enhanced Packet Block with pkt, captured
+// at t, going in the direction given by inbound, with comment. If
+// dropped is non-zero, it records that many packets were lost since
+// the previous one.
+func (pw *pcapngWriter) writePacket(t time.Time, pkt []byte, inbound bool, comment string, dropped uint64) error {
+	ts := uint64(t.UnixNano() / int64(time.Microsecond))
+	b := pw.start(blockEnhancedPacket)
+	b = le32(b, 0) // interface ID
+	b = le32(b, uint32(ts>>32))
+	b = le32(b, uint32(ts))
+	b = le32(b, uint32(len(pkt))) // captured length
+	b = le32(b, uint32(len(pkt))) // original length
+	b = appendPadded(b, pkt)
+	flags := uint32(epbOutbound)
+	if inbound {
+		flags = epbInbound
+	}
+	b = appendOption(b, optFlags, le32(nil, flags))
+	if dropped != 0 {
+		b = appendOption(b, optDropCnt, le64(nil, dropped))
+	}
+	if comment != "" {
+		b = appendOption(b, optComment, []byte(comment))
+	}
+	b = appendOption(b, optEndOfOpt, nil)
+	return pw.finish(b)
+}
+
+// start returns pw's buffer, reset to hold a block of type typ, with
+// room for its length to be filled in by finish.
+func (pw *pcapngWriter) start(typ uint32) []byte {
+	b := le32(pw.buf[:0], typ)
+	return le32(b, 0) // total length, set by finish
+}
+
+// finish completes the block in b and writes it.
+func (pw *pcapngWriter) finish(b []byte) error {
+	n := uint32(len(b) + 4)
+	binary.LittleEndian.PutUint32(b[4:], n)
+	b = le32(b, n)
+	pw.buf = b
+	_, err := pw.w.Write(b)
+	return err
+}
+
+func appendOption(b []byte, code uint16, v []byte) []byte {
+	b = le16(b, code)
+	b = le16(b, uint16(len(v)))
+	return appendPadded(b, v)
+}
+
+// appendPadded appends v to b, padded with zeros to a multiple of 4
+// bytes.
+func appendPadded(b, v []byte) []byte {
+	b = append(b, v...)
+	for n := len(v); n%4 != 0; n++ {
+		b = append(b, 0)
+	}
+	return b
+}
+
+func le16(b []byte, v uint16) []byte {
+	return append(b, byte(v), byte(v>>8))
+}
+
+func le32(b []byte, v uint32) []byte {
+	return append(b, byte(v), byte(v>>8), byte(v>>16), byte(v>>24))
+}
+
+func le64(b []byte, v uint64) []byte {
+	return le32(le32(b, uint32(v)), uint32(v>>32))
+}
@@ -0,0 +1,240 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package filter
+
+import (
+	"expvar"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"inet.af/netaddr"
+	"tailscale.com/metrics"
+	"tailscale.com/net/flowtrack"
+	"tailscale.com/net/packet"
+)
+
+// ConntrackConfig configures a filter's connection tracking, which
+// lets in the return traffic of UDP flows and ICMP echo requests
+// that this node started.
+//
+// TCP isn't tracked: the filter lets in all TCP packets except SYNs,
+// since a new inbound connection can't be started without one.
+//
+// Zero fields mean the default values.
+type ConntrackConfig struct {
+	// UDPTimeout is how long a UDP flow is remembered after its
+	// last packet in either direction.
+	UDPTimeout time.Duration
+	// ICMPTimeout is how long an ICMP echo flow is remembered
+	// after its last packet in either direction.
+	ICMPTimeout time.Duration
+
+	// MaxUDPFlows and MaxICMPFlows limit the number of tracked
+	// flows. When a table is full, its expired flows are removed
+	// first, then the least recently used live ones.
+	MaxUDPFlows  int
+	MaxICMPFlows int
+}
+
+const (
+	defaultUDPTimeout   = 2 * time.Minute
+	defaultICMPTimeout  = 30 * time.Second
+	defaultMaxUDPFlows  = 4096
+	defaultMaxICMPFlows = 512
+)
+
+// DefaultConntrackConfig returns the connection tracking
+// configuration of new filters. The defaults can be overridden with
+// the TS_FILTER_UDP_TIMEOUT, TS_FILTER_ICMP_TIMEOUT,
+// TS_FILTER_MAX_UDP_FLOWS and TS_FILTER_MAX_ICMP_FLOWS environment
+// variables.
+func DefaultConntrackConfig() ConntrackConfig {
+	c := ConntrackConfig{}
+	c.UDPTimeout, _ = time.ParseDuration(os.Getenv("TS_FILTER_UDP_TIMEOUT"))
+	c.ICMPTimeout, _ = time.ParseDuration(os.Getenv("TS_FILTER_ICMP_TIMEOUT"))
+	c.MaxUDPFlows, _ = strconv.Atoi(os.Getenv("TS_FILTER_MAX_UDP_FLOWS"))
+	c.MaxICMPFlows, _ = strconv.Atoi(os.Getenv("TS_FILTER_MAX_ICMP_FLOWS"))
+	return c.withDefaults(ConntrackConfig{
+		UDPTimeout:   defaultUDPTimeout,
+		ICMPTimeout:  defaultICMPTimeout,
+		MaxUDPFlows:  defaultMaxUDPFlows,
+		MaxICMPFlows: defaultMaxICMPFlows,
+	})
+}
+
+// withDefaults returns c with its zero or invalid fields replaced
+// by those of def.
+func (c ConntrackConfig) withDefaults(def ConntrackConfig) ConntrackConfig {
+	if c.UDPTimeout <= 0 {
+		c.UDPTimeout = def.UDPTimeout
+	}
+	if c.ICMPTimeout <= 0 {
+		c.ICMPTimeout = def.ICMPTimeout
+	}
+	if c.MaxUDPFlows <= 0 {
+		c.MaxUDPFlows = def.MaxUDPFlows
+	}
+	if c.MaxICMPFlows <= 0 {
+		c.MaxICMPFlows = def.MaxICMPFlows
+	}
+	return c
+}
+
+// Connection tracking metrics, by protocol ("udp" or "icmp"),
+// summed over all filters.
+var (
+	metricConntrackNew     = &metrics.LabelMap{Label: "proto"}
+	metricConntrackHit     = &metrics.LabelMap{Label: "proto"}
+	metricConntrackExpired = &metrics.LabelMap{Label: "proto"}
+	metricConntrackEvicted = &metrics.LabelMap{Label: "proto"}
+
+	udpMetrics  = newConntrackMetrics("udp")
+	icmpMetrics = newConntrackMetrics("icmp")
+)
+
+func init() {
+	expvar.Publish("counter_filter_conntrack_new", metricConntrackNew)
+	expvar.Publish("counter_filter_conntrack_hit", metricConntrackHit)
+	expvar.Publish("counter_filter_conntrack_expired", metricConntrackExpired)
+	expvar.Publish("counter_filter_conntrack_evicted", metricConntrackEvicted)
+}
+
+// conntrackMetrics are one protocol's connection tracking metrics.
+type conntrackMetrics struct {
+	added   *expvar.Int // flows added
+	hit     *expvar.Int // inbound packets accepted as part of a flow
+	expired *expvar.Int // flows removed after their timeout
+	evicted *expvar.Int // live flows removed because the table was full
+}
+
+func newConntrackMetrics(proto string) *conntrackMetrics {
+	return &conntrackMetrics{
+		added:   metricConntrackNew.Get(proto),
+		hit:     metricConntrackHit.Get(proto),
+		expired: metricConntrackExpired.Get(proto),
+		evicted: metricConntrackEvicted.Get(proto),
+	}
+}
+
+// filterState is the connection tracking state of a filter, shared
+// with its successors. See New.
+type filterState struct {
+	mu   sync.Mutex
+	udp  conntrackTable
+	icmp conntrackTable
+	now  func() time.Time // or nil for time.Now; for tests
+}
+
+func newFilterState(c ConntrackConfig) *filterState {
+	st := &filterState{
+		udp:  conntrackTable{metrics: udpMetrics},
+		icmp: conntrackTable{metrics: icmpMetrics},
+	}
+	st.setConfig(c)
+	return st
+}
+
+// setConfig applies c to st. Tables over their new size limit are
+// trimmed as flows are added.
+func (st *filterState) setConfig(c ConntrackConfig) {
+	c = c.withDefaults(DefaultConntrackConfig())
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	st.udp.timeout, st.udp.max = c.UDPTimeout, c.MaxUDPFlows
+	st.icmp.timeout, st.icmp.max = c.ICMPTimeout, c.MaxICMPFlows
+}
+
+func (st *filterState) timeNow() time.Time {
+	if st.now != nil {
+		return st.now()
+	}
+	return time.Now()
+}
+
+// lookup reports whether the inbound packet with tuple t belongs to
+// a live flow in ct, and if so, keeps the flow alive.
+func (st *filterState) lookup(ct *conntrackTable, t flowtrack.Tuple) bool {
+	now := st.timeNow()
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	return ct.lookup(t, now)
+}
+
+// track records that an outbound packet starts or continues a flow
+// in ct, whose inbound packets have tuple t. It reports whether a
+// live flow had to be evicted to make room.
+func (st *filterState) track(ct *conntrackTable, t flowtrack.Tuple) (evicted bool) {
+	now := st.timeNow()
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	return ct.track(t, now)
+}
+
+// conntrackTable tracks the flows of one protocol. Its methods must
+// be called with the owning filterState's mu held.
+type conntrackTable struct {
+	timeout time.Duration
+	max     int
+	lru     flowtrack.Cache // from flowtrack.Tuple (inbound direction) -> *flowEntry
+	metrics *conntrackMetrics
+}
+
+// flowEntry is the value type of conntrackTable.lru.
+type flowEntry struct {
+	expires time.Time
+}
+
+func (ct *conntrackTable) lookup(t flowtrack.Tuple, now time.Time) bool {
+	v, ok := ct.lru.Get(t)
+	if !ok {
+		return false
+	}
+	fe := v.(*flowEntry)
+	if now.After(fe.expires) {
+		ct.lru.Remove(t)
+		ct.metrics.expired.Add(1)
+		return false
+	}
+	fe.expires = now.Add(ct.timeout)
+	ct.metrics.hit.Add(1)
+	return true
+}
+
+func (ct *conntrackTable) track(t flowtrack.Tuple, now time.Time) (evicted bool) {
+	if v, ok := ct.lru.Get(t); ok {
+		v.(*flowEntry).expires = now.Add(ct.timeout)
+		return false
+	}
+	// Expired flows collect at the LRU end of the table; drop them
+	// before they take up room.
+	for {
+		_, v, ok := ct.lru.Oldest()
+		if !ok || !now.After(v.(*flowEntry).expires) {
+			break
+		}
+		ct.lru.RemoveOldest()
+		ct.metrics.expired.Add(1)
+	}
+	for ct.lru.Len() >= ct.max {
+		ct.lru.RemoveOldest()
+		ct.metrics.evicted.Add(1)
+		evicted = true
+	}
+	ct.lru.Add(t, &flowEntry{expires: now.Add(ct.timeout)})
+	ct.metrics.added.Add(1)
+	return evicted
+}
+
+// icmpEchoTuple returns the flow tuple of q, an ICMP echo request or
+// response. The echo identifier takes the place of both ports.
+func icmpEchoTuple(q *packet.Parsed) flowtrack.Tuple {
+	id, _ := q.EchoIDSeq()
+	return flowtrack.Tuple{
+		Src: netaddr.IPPort{IP: q.Src.IP, Port: id},
+		Dst: netaddr.IPPort{IP: q.Dst.IP, Port: id},
+	}
+}
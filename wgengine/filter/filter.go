@@ -7,7 +7,6 @@ package filter
 
 import (
 	"fmt"
-	"sync"
 	"time"
 
 	"golang.org/x/time/rate"
@@ -32,24 +31,22 @@ type Filter struct {
 	// match is to drop the packet.
 	matches4 matches
 	matches6 matches
+	// rules4 and rules6 map each entry of matches4 and matches6
+	// to its index in the list of Matches passed to New, so
+	// trace events can say which rule they matched.
+	rules4 []int
+	rules6 []int
 	// state is the connection tracking state attached to this
 	// filter. It is used to allow incoming traffic that is a response
 	// to an outbound connection that this node made, even if those
 	// incoming packets don't get accepted by matches above.
 	state *filterState
+	// tracer, if non-nil, records the filter's decisions.
+	tracer *Tracer
 
 	shieldsUp bool
 }
 
-// filterState is a state cache of past seen packets.
-type filterState struct {
-	mu  sync.Mutex
-	lru *flowtrack.Cache // from flowtrack.Tuple -> nil
-}
-
-// lruMax is the size of the LRU cache in filterState.
-const lruMax = 512
-
 // Response is a verdict from the packet filter.
 type Response int
 
@@ -157,25 +154,35 @@ func New(matches []Match, localNets *netaddr.IPSet, shareStateWith *Filter, logf
 	if shareStateWith != nil {
 		state = shareStateWith.state
 	} else {
-		state = &filterState{
-			lru: &flowtrack.Cache{MaxEntries: lruMax},
-		}
+		state = newFilterState(DefaultConntrackConfig())
 	}
 	f := &Filter{
-		logf:     logf,
-		matches4: matchesFamily(matches, netaddr.IP.Is4),
-		matches6: matchesFamily(matches, netaddr.IP.Is6),
-		local:    localNets,
-		state:    state,
+		logf:  logf,
+		local: localNets,
+		state: state,
 	}
+	f.matches4, f.rules4 = matchesFamily(matches, netaddr.IP.Is4)
+	f.matches6, f.rules6 = matchesFamily(matches, netaddr.IP.Is6)
 	return f
 }
 
+// SetConntrackConfig changes the connection tracking configuration
+// of f and the filters it shares state with.
+func (f *Filter) SetConntrackConfig(c ConntrackConfig) {
+	f.state.setConfig(c)
+}
+
+// SetTracer makes f record its decisions to t. It must be called
+// before f is put into use.
+func (f *Filter) SetTracer(t *Tracer) {
+	f.tracer = t
+}
+
 // matchesFamily returns the subset of ms for which keep(srcNet.IP)
-// and keep(dstNet.IP) are both true.
-func matchesFamily(ms matches, keep func(netaddr.IP) bool) matches {
-	var ret matches
-	for _, m := range ms {
+// and keep(dstNet.IP) are both true, along with the index in ms of
+// each returned Match.
+func matchesFamily(ms matches, keep func(netaddr.IP) bool) (ret matches, idx []int) {
+	for i, m := range ms {
 		var retm Match
 		for _, src := range m.Srcs {
 			if keep(src.IP) {
@@ -189,9 +196,10 @@ func matchesFamily(ms matches, keep func(netaddr.IP) bool) matches {
 		}
 		if len(retm.Srcs) > 0 && len(retm.Dsts) > 0 {
 			ret = append(ret, retm)
+			idx = append(idx, i)
 		}
 	}
-	return ret
+	return ret, idx
 }
 
 func maybeHexdump(flag RunFlags, b []byte) string {
@@ -209,13 +217,20 @@ func maybeHexdump(flag RunFlags, b []byte) string {
 var acceptBucket = rate.NewLimiter(rate.Every(10*time.Second), 3)
 var dropBucket = rate.NewLimiter(rate.Every(5*time.Second), 10)
 
-func (f *Filter) logRateLimit(runflags RunFlags, q *packet.Parsed, dir direction, r Response, why string) {
+// logRateLimit records the filter's verdict r on q to f's tracer, if
+// any, and logs it subject to runflags and rate limits. rule is the
+// index of the rule that matched q, or -1 if none did.
+func (f *Filter) logRateLimit(runflags RunFlags, q *packet.Parsed, dir direction, r Response, why string, rule int) {
 	var verdict string
 
 	if r == Drop && omitDropLogging(q, dir) {
 		return
 	}
 
+	if f.tracer != nil {
+		f.tracer.trace(q, dir, r, why, rule)
+	}
+
 	if r == Drop && (runflags&LogDrops) != 0 && dropBucket.Allow() {
 		verdict = "Drop"
 		runflags &= HexdumpDrops
@@ -266,6 +281,34 @@ func (f *Filter) CheckTCP(srcIP, dstIP netaddr.IP, dstPort uint16) Response {
 	return f.RunIn(pkt, 0)
 }
 
+// Check reports what f would do with a packet of protocol proto from
+// srcIP to dstIP:dstPort arriving from a Tailscale peer: the verdict,
+// the reason for it, and the index of the rule that allowed the
+// packet, or -1 if none did. TCP packets are checked as SYNs, and ICMP
+// packets against the rules alone, not as replies or errors, so the
+// verdict says whether a new flow would be allowed.
+func (f *Filter) Check(proto packet.IPProto, srcIP, dstIP netaddr.IP, dstPort uint16) (r Response, why string, rule int) {
+	pkt := &packet.Parsed{}
+	pkt.Decode(dummyPacket) // initialize private fields
+	switch {
+	case srcIP.Is4() && dstIP.Is4():
+		pkt.IPVersion = 4
+	case srcIP.Is6() && dstIP.Is6():
+		pkt.IPVersion = 6
+	default:
+		return Drop, "mismatched address families", -1
+	}
+	pkt.Src.IP = srcIP
+	pkt.Dst.IP = dstIP
+	pkt.IPProto = proto
+	if proto == packet.TCP {
+		pkt.TCPFlags = packet.TCPSyn
+	}
+	pkt.Dst.Port = dstPort
+
+	return f.runIn(pkt, 0)
+}
+
 // ShieldsUp reports whether this is a "shields up" (block everything
 // incoming) filter.
 func (f *Filter) ShieldsUp() bool { return f.shieldsUp }
@@ -273,117 +316,81 @@ func (f *Filter) ShieldsUp() bool { return f.shieldsUp }
 // RunIn determines whether this node is allowed to receive q from a
 // Tailscale peer.
 func (f *Filter) RunIn(q *packet.Parsed, rf RunFlags) Response {
+	r, _, _ := f.runIn(q, rf)
+	return r
+}
+
+// runIn is RunIn, but also returns the reason for the verdict and
+// the index of the rule that matched q, or -1.
+func (f *Filter) runIn(q *packet.Parsed, rf RunFlags) (r Response, why string, rule int) {
 	dir := in
-	r := f.pre(q, rf, dir)
+	r, why = f.pre(q, rf, dir)
 	if r == Accept || r == Drop {
 		// already logged
-		return r
+		return r, why, -1
 	}
 
-	var why string
+	rule = -1
 	switch q.IPVersion {
 	case 4:
-		r, why = f.runIn4(q)
+		r, why, rule = f.runIn4(q)
 	case 6:
-		r, why = f.runIn6(q)
+		r, why, rule = f.runIn6(q)
 	default:
 		r, why = Drop, "not-ip"
 	}
-	f.logRateLimit(rf, q, dir, r, why)
-	return r
+	f.logRateLimit(rf, q, dir, r, why, rule)
+	return r, why, rule
 }
 
 // RunOut determines whether this node is allowed to send q to a
 // Tailscale peer.
 func (f *Filter) RunOut(q *packet.Parsed, rf RunFlags) Response {
 	dir := out
-	r := f.pre(q, rf, dir)
+	r, _ := f.pre(q, rf, dir)
 	if r == Drop || r == Accept {
 		// already logged
 		return r
 	}
 	r, why := f.runOut(q)
-	f.logRateLimit(rf, q, dir, r, why)
+	f.logRateLimit(rf, q, dir, r, why, -1)
 	return r
 }
 
-func (f *Filter) runIn4(q *packet.Parsed) (r Response, why string) {
-	// A compromised peer could try to send us packets for
-	// destinations we didn't explicitly advertise. This check is to
-	// prevent that.
-	if !f.local.Contains(q.Dst.IP) {
-		return Drop, "destination not allowed"
-	}
-
-	switch q.IPProto {
-	case packet.ICMPv4:
-		if q.IsEchoResponse() || q.IsError() {
-			// ICMP responses are allowed.
-			// TODO(apenwarr): consider using conntrack state.
-			//  We could choose to reject all packets that aren't
-			//  related to an existing ICMP-Echo, TCP, or UDP
-			//  session.
-			return Accept, "icmp response ok"
-		} else if f.matches4.matchIPsOnly(q) {
-			// If any port is open to an IP, allow ICMP to it.
-			return Accept, "icmp ok"
-		}
-	case packet.TCP:
-		// For TCP, we want to allow *outgoing* connections,
-		// which means we want to allow return packets on those
-		// connections. To make this restriction work, we need to
-		// allow non-SYN packets (continuation of an existing session)
-		// to arrive. This should be okay since a new incoming session
-		// can't be initiated without first sending a SYN.
-		// It happens to also be much faster.
-		// TODO(apenwarr): Skip the rest of decoding in this path?
-		if !q.IsTCPSyn() {
-			return Accept, "tcp non-syn"
-		}
-		if f.matches4.match(q) {
-			return Accept, "tcp ok"
-		}
-	case packet.UDP:
-		t := flowtrack.Tuple{Src: q.Src, Dst: q.Dst}
-
-		f.state.mu.Lock()
-		_, ok := f.state.lru.Get(t)
-		f.state.mu.Unlock()
+func (f *Filter) runIn4(q *packet.Parsed) (r Response, why string, rule int) {
+	return f.runInFamily(q, f.matches4, f.rules4)
+}
 
-		if ok {
-			return Accept, "udp cached"
-		}
-		if f.matches4.match(q) {
-			return Accept, "udp ok"
-		}
-	case packet.TSMP:
-		return Accept, "tsmp ok"
-	default:
-		return Drop, "Unknown proto"
-	}
-	return Drop, "no rules matched"
+func (f *Filter) runIn6(q *packet.Parsed) (r Response, why string, rule int) {
+	return f.runInFamily(q, f.matches6, f.rules6)
 }
 
-func (f *Filter) runIn6(q *packet.Parsed) (r Response, why string) {
+// runInFamily runs the input-specific part of the filter logic on q,
+// using ms, the rules for q's address family. rules maps each entry
+// of ms to its rule index.
+func (f *Filter) runInFamily(q *packet.Parsed, ms matches, rules []int) (r Response, why string, rule int) {
 	// A compromised peer could try to send us packets for
 	// destinations we didn't explicitly advertise. This check is to
 	// prevent that.
 	if !f.local.Contains(q.Dst.IP) {
-		return Drop, "destination not allowed"
+		return Drop, "destination not allowed", -1
 	}
 
 	switch q.IPProto {
-	case packet.ICMPv6:
-		if q.IsEchoResponse() || q.IsError() {
-			// ICMP responses are allowed.
-			// TODO(apenwarr): consider using conntrack state.
-			//  We could choose to reject all packets that aren't
-			//  related to an existing ICMP-Echo, TCP, or UDP
-			//  session.
-			return Accept, "icmp response ok"
-		} else if f.matches6.matchIPsOnly(q) {
+	case packet.ICMPv4, packet.ICMPv6:
+		if q.IsEchoResponse() {
+			if f.state.lookup(&f.state.icmp, icmpEchoTuple(q)) {
+				return Accept, "icmp response ok", -1
+			}
+		} else if q.IsError() {
+			// ICMP errors are allowed: they can be about any
+			// flow we started, including TCP ones, which
+			// aren't tracked.
+			return Accept, "icmp error ok", -1
+		}
+		if i := ms.matchIPsOnly(q); i >= 0 {
 			// If any port is open to an IP, allow ICMP to it.
-			return Accept, "icmp ok"
+			return Accept, "icmp ok", rules[i]
 		}
 	case packet.TCP:
 		// For TCP, we want to allow *outgoing* connections,
@@ -394,42 +401,45 @@ func (f *Filter) runIn6(q *packet.Parsed) (r Response, why string) {
 		// can't be initiated without first sending a SYN.
 		// It happens to also be much faster.
 		// TODO(apenwarr): Skip the rest of decoding in this path?
-		if q.IPProto == packet.TCP && !q.IsTCPSyn() {
-			return Accept, "tcp non-syn"
+		if !q.IsTCPSyn() {
+			return Accept, "tcp non-syn", -1
 		}
-		if f.matches6.match(q) {
-			return Accept, "tcp ok"
+		if i := ms.match(q); i >= 0 {
+			return Accept, "tcp ok", rules[i]
 		}
 	case packet.UDP:
-		t := flowtrack.Tuple{Src: q.Src, Dst: q.Dst}
-
-		f.state.mu.Lock()
-		_, ok := f.state.lru.Get(t)
-		f.state.mu.Unlock()
-
-		if ok {
-			return Accept, "udp cached"
+		if f.state.lookup(&f.state.udp, flowtrack.Tuple{Src: q.Src, Dst: q.Dst}) {
+			return Accept, "udp cached", -1
 		}
-		if f.matches6.match(q) {
-			return Accept, "udp ok"
+		if i := ms.match(q); i >= 0 {
+			return Accept, "udp ok", rules[i]
 		}
+	case packet.TSMP:
+		return Accept, "tsmp ok", -1
 	default:
-		return Drop, "Unknown proto"
+		return Drop, "Unknown proto", -1
 	}
-	return Drop, "no rules matched"
+	return Drop, "no rules matched", -1
 }
 
-// runIn runs the output-specific part of the filter logic.
+// runOut runs the output-specific part of the filter logic.
 func (f *Filter) runOut(q *packet.Parsed) (r Response, why string) {
-	if q.IPProto != packet.UDP {
+	var ct *conntrackTable
+	var t flowtrack.Tuple // of the return traffic
+	switch {
+	case q.IPProto == packet.UDP:
+		ct = &f.state.udp
+		t = flowtrack.Tuple{Src: q.Dst, Dst: q.Src}
+	case q.IsEchoRequest():
+		ct = &f.state.icmp
+		t = icmpEchoTuple(q)
+		t.Src, t.Dst = t.Dst, t.Src
+	default:
 		return Accept, "ok out"
 	}
-
-	tuple := flowtrack.Tuple{Src: q.Dst, Dst: q.Src} // src/dst reversed
-
-	f.state.mu.Lock()
-	f.state.lru.Add(tuple, nil)
-	f.state.mu.Unlock()
+	if f.state.track(ct, t) {
+		f.logf("[v1] filter: %s flow table full; evicted the least recently used flow", q.IPProto)
+	}
 	return Accept, "ok out"
 }
 
@@ -455,40 +465,40 @@ func (d direction) String() string {
 
 var gcpDNSAddr = netaddr.IPv4(169, 254, 169, 254)
 
-// pre runs the direction-agnostic filter logic. dir is only used for
-// logging.
-func (f *Filter) pre(q *packet.Parsed, rf RunFlags, dir direction) Response {
+// pre runs the direction-agnostic filter logic, returning its verdict
+// and the reason for it. dir is only used for logging.
+func (f *Filter) pre(q *packet.Parsed, rf RunFlags, dir direction) (Response, string) {
 	if len(q.Buffer()) == 0 {
 		// wireguard keepalive packet, always permit.
-		return Accept
+		return Accept, "keepalive"
 	}
 	if len(q.Buffer()) < 20 {
-		f.logRateLimit(rf, q, dir, Drop, "too short")
-		return Drop
+		f.logRateLimit(rf, q, dir, Drop, "too short", -1)
+		return Drop, "too short"
 	}
 
 	if q.Dst.IP.IsMulticast() {
-		f.logRateLimit(rf, q, dir, Drop, "multicast")
-		return Drop
+		f.logRateLimit(rf, q, dir, Drop, "multicast", -1)
+		return Drop, "multicast"
 	}
 	if q.Dst.IP.IsLinkLocalUnicast() && q.Dst.IP != gcpDNSAddr {
-		f.logRateLimit(rf, q, dir, Drop, "link-local-unicast")
-		return Drop
+		f.logRateLimit(rf, q, dir, Drop, "link-local-unicast", -1)
+		return Drop, "link-local-unicast"
 	}
 
 	switch q.IPProto {
 	case packet.Unknown:
 		// Unknown packets are dangerous; always drop them.
-		f.logRateLimit(rf, q, dir, Drop, "unknown")
-		return Drop
+		f.logRateLimit(rf, q, dir, Drop, "unknown", -1)
+		return Drop, "unknown"
 	case packet.Fragment:
 		// Fragments after the first always need to be passed through.
 		// Very small fragments are considered Junk by Parsed.
-		f.logRateLimit(rf, q, dir, Accept, "fragment")
-		return Accept
+		f.logRateLimit(rf, q, dir, Accept, "fragment", -1)
+		return Accept, "fragment"
 	}
 
-	return noVerdict
+	return noVerdict, ""
 }
 
 // omitDropLogging reports whether packet p, which has already been
@@ -10,6 +10,7 @@ import (
 	"strconv"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/google/go-cmp/cmp"
 	"inet.af/netaddr"
@@ -91,7 +92,7 @@ func TestFilter(t *testing.T) {
 		if test.p.IPVersion == 6 {
 			aclFunc = acl.runIn6
 		}
-		if got, why := aclFunc(&test.p); test.want != got {
+		if got, why, _ := aclFunc(&test.p); test.want != got {
 			t.Errorf("#%d runIn got=%v want=%v why=%q packet:%v", i, got, test.want, why, test.p)
 		}
 		if test.p.IPProto == packet.TCP {
@@ -106,7 +107,7 @@ func TestFilter(t *testing.T) {
 			}
 			// TCP and UDP are treated equivalently in the filter - verify that.
 			test.p.IPProto = packet.UDP
-			if got, why := aclFunc(&test.p); test.want != got {
+			if got, why, _ := aclFunc(&test.p); test.want != got {
 				t.Errorf("#%d runIn (UDP) got=%v want=%v why=%q packet:%v", i, got, test.want, why, test.p)
 			}
 		}
@@ -152,6 +153,238 @@ func TestUDPState(t *testing.T) {
 	}
 }
 
+func TestTCPNonSyn(t *testing.T) {
+	acl := newFilter(t.Logf)
+
+	// TCP isn't tracked: with nothing in the flow tables, the rest
+	// of a connection is let in without a rule, but not its SYN.
+	reply := parsed(packet.TCP, "119.119.119.119", "102.102.102.102", 4242, 4343)
+	reply.TCPFlags = packet.TCPAck
+	if got := acl.RunIn(&reply, 0); got != Accept {
+		t.Fatalf("incoming non-SYN packet not accepted, got=%v: %v", got, reply)
+	}
+	syn := parsed(packet.TCP, "119.119.119.119", "102.102.102.102", 4242, 4343)
+	syn.TCPFlags = packet.TCPSyn
+	if got := acl.RunIn(&syn, 0); got != Drop {
+		t.Fatalf("incoming SYN packet not dropped, got=%v: %v", got, syn)
+	}
+
+	// Outbound TCP doesn't add flows.
+	if got := acl.RunOut(&syn, 0); got != Accept {
+		t.Fatalf("outbound packet didn't egress, got=%v: %v", got, syn)
+	}
+	acl.state.mu.Lock()
+	n := acl.state.udp.lru.Len() + acl.state.icmp.lru.Len()
+	acl.state.mu.Unlock()
+	if n != 0 {
+		t.Errorf("outbound TCP added %d flows; want 0", n)
+	}
+}
+
+func TestConntrackConfig(t *testing.T) {
+	acl := newFilter(t.Logf)
+	acl.SetConntrackConfig(ConntrackConfig{UDPTimeout: time.Minute, MaxUDPFlows: 1})
+	if got, want := acl.state.udp.timeout, time.Minute; got != want {
+		t.Errorf("udp timeout = %v; want %v", got, want)
+	}
+	if got, want := acl.state.udp.max, 1; got != want {
+		t.Errorf("udp max = %v; want %v", got, want)
+	}
+	if got, want := acl.state.icmp.timeout, defaultICMPTimeout; got != want {
+		t.Errorf("icmp timeout = %v; want default %v", got, want)
+	}
+
+	// Filters sharing state share the configuration.
+	next := New(nil, &netaddr.IPSet{}, acl, t.Logf)
+	if got, want := next.state.udp.timeout, time.Minute; got != want {
+		t.Errorf("successor's udp timeout = %v; want %v", got, want)
+	}
+}
+
+func TestICMPState(t *testing.T) {
+	var localNets netaddr.IPSetBuilder
+	localNets.AddPrefix(netaddr.MustParseIPPrefix("100.64.0.1/32"))
+	localNets.AddPrefix(netaddr.MustParseIPPrefix("fd7a::1/128"))
+	acl := New(nil, localNets.IPSet(), nil, t.Logf)
+	now := time.Unix(1000, 0)
+	acl.state.now = func() time.Time { return now }
+
+	// raw4 and raw6 build UDP headers, so the source port's
+	// bytes become the ICMP type and code.
+	echo4 := func(src, dst string, typ packet.ICMP4Type) *packet.Parsed {
+		q := new(packet.Parsed)
+		q.Decode(raw4(packet.ICMPv4, src, dst, uint16(typ)<<8, 0, 0))
+		return q
+	}
+	echo6 := func(src, dst string, typ packet.ICMP6Type) *packet.Parsed {
+		q := new(packet.Parsed)
+		q.Decode(raw6(packet.ICMPv6, src, dst, uint16(typ)<<8, 0, 0))
+		return q
+	}
+	tests := []struct {
+		name      string
+		req, resp *packet.Parsed
+	}{
+		{
+			"v4",
+			echo4("100.64.0.1", "100.64.0.2", packet.ICMP4EchoRequest),
+			echo4("100.64.0.2", "100.64.0.1", packet.ICMP4EchoReply),
+		},
+		{
+			"v6",
+			echo6("fd7a::1", "fd7a::2", packet.ICMP6EchoRequest),
+			echo6("fd7a::2", "fd7a::1", packet.ICMP6EchoReply),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := acl.RunIn(tt.resp, 0); got != Drop {
+				t.Fatalf("unsolicited echo reply: got %v; want Drop", got)
+			}
+			if got := acl.RunOut(tt.req, 0); got != Accept {
+				t.Fatalf("echo request: got %v; want Accept", got)
+			}
+			if got := acl.RunIn(tt.resp, 0); got != Accept {
+				t.Fatalf("echo reply: got %v; want Accept", got)
+			}
+			now = now.Add(defaultICMPTimeout + time.Second)
+			if got := acl.RunIn(tt.resp, 0); got != Drop {
+				t.Fatalf("echo reply after timeout: got %v; want Drop", got)
+			}
+		})
+	}
+}
+
+func TestConntrackTableLimit(t *testing.T) {
+	acl := newFilter(t.Logf)
+	acl.SetConntrackConfig(ConntrackConfig{MaxUDPFlows: 2})
+	evicted0 := udpMetrics.evicted.Value()
+
+	out := func(sport uint16) {
+		q := parsed(packet.UDP, "102.102.102.102", "119.119.119.119", sport, 4242)
+		if got := acl.RunOut(&q, 0); got != Accept {
+			t.Fatalf("outbound packet from port %d: got %v; want Accept", sport, got)
+		}
+	}
+	in := func(dport uint16) Response {
+		q := parsed(packet.UDP, "119.119.119.119", "102.102.102.102", 4242, dport)
+		return acl.RunIn(&q, 0)
+	}
+	out(1)
+	out(2)
+	out(3) // evicts the flow from port 1
+
+	if got := in(1); got != Drop {
+		t.Errorf("reply to evicted flow: got %v; want Drop", got)
+	}
+	for _, port := range []uint16{2, 3} {
+		if got := in(port); got != Accept {
+			t.Errorf("reply to flow from port %d: got %v; want Accept", port, got)
+		}
+	}
+	if got := udpMetrics.evicted.Value() - evicted0; got != 1 {
+		t.Errorf("evicted counter grew by %d; want 1", got)
+	}
+}
+
+func TestCheck(t *testing.T) {
+	acl := newFilter(t.Logf)
+	tests := []struct {
+		proto    packet.IPProto
+		src, dst string
+		port     uint16
+		want     Response
+		wantRule int
+	}{
+		{packet.TCP, "8.1.1.1", "1.2.3.4", 22, Accept, 0},
+		{packet.UDP, "8.2.2.2", "5.6.7.8", 27, Accept, 1},
+		{packet.TCP, "8.1.1.1", "1.2.3.4", 23, Drop, -1},
+		{packet.ICMPv4, "2.2.2.2", "8.1.1.1", 0, Accept, 2},
+		{packet.TCP, "::2", "2001::2", 22, Accept, 6},
+		{packet.TCP, "::2", "2001::2", 443, Accept, 7},
+		{packet.TCP, "8.1.1.1", "2001::2", 443, Drop, -1},
+		{packet.TCP, "8.1.1.1", "16.32.48.64", 443, Drop, -1}, // not a local IP
+	}
+	for _, tt := range tests {
+		r, why, rule := acl.Check(tt.proto, mustIP(tt.src), mustIP(tt.dst), tt.port)
+		if r != tt.want || rule != tt.wantRule {
+			t.Errorf("Check(%v, %s, %s, %d) = %v, %q, %d; want %v, rule %d",
+				tt.proto, tt.src, tt.dst, tt.port, r, why, rule, tt.want, tt.wantRule)
+		}
+	}
+
+	// Packets dropped before the rules are consulted say why.
+	if r, why, _ := acl.Check(packet.UDP, mustIP("8.2.2.2"), mustIP("224.0.0.1"), 27); r != Drop || why != "multicast" {
+		t.Errorf("Check to multicast = %v, %q; want Drop, %q", r, why, "multicast")
+	}
+}
+
+func TestTracer(t *testing.T) {
+	acl := newFilter(t.Logf)
+	tr := NewTracer(3)
+	acl.SetTracer(tr)
+
+	syn := func(src, dst string, dport uint16) *packet.Parsed {
+		p := parsed(packet.TCP, src, dst, 1234, dport)
+		return &p
+	}
+	acl.RunIn(syn("8.1.1.1", "1.2.3.4", 22), 0) // accepted by rule 0
+	acl.RunIn(syn("8.1.1.1", "1.2.3.4", 21), 0) // dropped
+	acl.RunIn(syn("::1", "2001::1", 443), 0)    // accepted by rule 7
+	nonSyn := parsed(packet.TCP, "8.1.1.1", "1.2.3.4", 1234, 21)
+	nonSyn.TCPFlags = packet.TCPAck
+	acl.RunIn(&nonSyn, 0) // accepted without a rule; not traced
+
+	evs := tr.Events(TraceFilter{})
+	if len(evs) != 3 {
+		t.Fatalf("got %d events; want 3: %+v", len(evs), evs)
+	}
+	type ev struct {
+		Verdict string
+		DstPort uint16
+		Rule    int
+	}
+	var got []ev
+	for _, e := range evs {
+		got = append(got, ev{e.Verdict, e.DstPort, e.Rule})
+	}
+	want := []ev{
+		{"Accept", 22, 0},
+		{"Drop", 21, -1},
+		{"Accept", 443, 7},
+	}
+	if diff := cmp.Diff(got, want); diff != "" {
+		t.Errorf("events mismatch (-got +want):\n%s", diff)
+	}
+
+	// Overflow the ring; the oldest event goes.
+	acl.RunIn(syn("8.2.2.2", "1.2.3.4", 23), 0)
+	evs = tr.Events(TraceFilter{})
+	if len(evs) != 3 || evs[0].Seq != 2 || evs[2].Seq != 4 {
+		t.Errorf("after overflow, got %+v; want Seqs 2-4", evs)
+	}
+
+	tests := []struct {
+		name string
+		tf   TraceFilter
+		want []uint64
+	}{
+		{"drops", TraceFilter{DropsOnly: true}, []uint64{2, 4}},
+		{"peer", TraceFilter{Peer: netaddr.MustParseIP("8.2.2.2")}, []uint64{4}},
+		{"port", TraceFilter{Port: 443}, []uint64{3}},
+		{"since", TraceFilter{Since: 3}, []uint64{4}},
+	}
+	for _, tt := range tests {
+		var got []uint64
+		for _, e := range tr.Events(tt.tf) {
+			got = append(got, e.Seq)
+		}
+		if !cmp.Equal(got, tt.want) {
+			t.Errorf("%s: got Seqs %v; want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
 func TestNoAllocs(t *testing.T) {
 	acl := newFilter(t.Logf)
 
@@ -286,25 +519,26 @@ func BenchmarkFilter(b *testing.B) {
 
 func TestPreFilter(t *testing.T) {
 	packets := []struct {
-		desc string
-		want Response
-		b    []byte
+		desc    string
+		want    Response
+		wantWhy string
+		b       []byte
 	}{
-		{"empty", Accept, []byte{}},
-		{"short", Drop, []byte("short")},
-		{"junk", Drop, raw4default(packet.Unknown, 10)},
-		{"fragment", Accept, raw4default(packet.Fragment, 40)},
-		{"tcp", noVerdict, raw4default(packet.TCP, 0)},
-		{"udp", noVerdict, raw4default(packet.UDP, 0)},
-		{"icmp", noVerdict, raw4default(packet.ICMPv4, 0)},
+		{"empty", Accept, "keepalive", []byte{}},
+		{"short", Drop, "too short", []byte("short")},
+		{"junk", Drop, "too short", raw4default(packet.Unknown, 10)},
+		{"fragment", Accept, "fragment", raw4default(packet.Fragment, 40)},
+		{"tcp", noVerdict, "", raw4default(packet.TCP, 0)},
+		{"udp", noVerdict, "", raw4default(packet.UDP, 0)},
+		{"icmp", noVerdict, "", raw4default(packet.ICMPv4, 0)},
 	}
 	f := NewAllowNone(t.Logf)
 	for _, testPacket := range packets {
 		p := &packet.Parsed{}
 		p.Decode(testPacket.b)
-		got := f.pre(p, LogDrops|LogAccepts, in)
-		if got != testPacket.want {
-			t.Errorf("%q got=%v want=%v packet:\n%s", testPacket.desc, got, testPacket.want, packet.Hexdump(testPacket.b))
+		got, why := f.pre(p, LogDrops|LogAccepts, in)
+		if got != testPacket.want || why != testPacket.wantWhy {
+			t.Errorf("%q got=%v, %q want=%v, %q packet:\n%s", testPacket.desc, got, why, testPacket.want, testPacket.wantWhy, packet.Hexdump(testPacket.b))
 		}
 	}
 }
@@ -0,0 +1,124 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package filter
+
+import (
+	"sync"
+	"time"
+
+	"inet.af/netaddr"
+	"tailscale.com/net/packet"
+)
+
+// TraceEvent is a structured record of one filter decision.
+type TraceEvent struct {
+	// Seq is the event's sequence number. It increases by one for
+	// each event a Tracer records.
+	Seq  uint64
+	Time time.Time
+
+	Dir     string // "in" (from a peer) or "out" (to a peer)
+	Proto   string // IP protocol, as in packet.IPProto.String
+	Src     netaddr.IP
+	SrcPort uint16
+	Dst     netaddr.IP
+	DstPort uint16
+
+	Verdict string // a Response, as a string
+	Why     string // the reason for Verdict
+
+	// Rule is the index of the matching rule in the packet
+	// filter, or -1 if the verdict didn't come from a rule.
+	Rule int
+}
+
+// TraceFilter selects a subset of a Tracer's events. The zero value
+// selects all events.
+type TraceFilter struct {
+	Peer      netaddr.IP // if non-zero, the event's Src or Dst
+	Port      uint16     // if non-zero, the event's SrcPort or DstPort
+	DropsOnly bool       // only dropped packets
+	Since     uint64     // only events with a Seq greater than this
+}
+
+func (tf TraceFilter) match(ev *TraceEvent) bool {
+	if !tf.Peer.IsZero() && ev.Src != tf.Peer && ev.Dst != tf.Peer {
+		return false
+	}
+	if tf.Port != 0 && ev.SrcPort != tf.Port && ev.DstPort != tf.Port {
+		return false
+	}
+	if tf.DropsOnly && ev.Verdict == Accept.String() {
+		return false
+	}
+	return ev.Seq > tf.Since
+}
+
+// Tracer records a Filter's decisions in a fixed-size ring buffer.
+//
+// To keep the buffer useful, only dropped packets and the accepted
+// packets that needed a rule (that is, the first packets of new
+// inbound flows) are recorded.
+//
+// A Tracer may be shared by successive Filters, so its history
+// survives packet filter updates. See Filter.SetTracer.
+type Tracer struct {
+	mu   sync.Mutex
+	ring []TraceEvent
+	seq  uint64 // Seq of the most recent event
+}
+
+// NewTracer returns a Tracer that retains the size most recent
+// events.
+func NewTracer(size int) *Tracer {
+	if size <= 0 {
+		panic("filter.NewTracer: size must be positive")
+	}
+	return &Tracer{ring: make([]TraceEvent, size)}
+}
+
+// trace records the verdict r on q, if it's interesting.
+func (t *Tracer) trace(q *packet.Parsed, dir direction, r Response, why string, rule int) {
+	if r != Drop && rule < 0 {
+		return
+	}
+	now := time.Now()
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.seq++
+	t.ring[t.seq%uint64(len(t.ring))] = TraceEvent{
+		Seq:     t.seq,
+		Time:    now,
+		Dir:     dir.String(),
+		Proto:   q.IPProto.String(),
+		Src:     q.Src.IP,
+		SrcPort: q.Src.Port,
+		Dst:     q.Dst.IP,
+		DstPort: q.Dst.Port,
+		Verdict: r.String(),
+		Why:     why,
+		Rule:    rule,
+	}
+}
+
+// Events returns the retained events selected by tf, oldest first.
+func (t *Tracer) Events(tf TraceFilter) []TraceEvent {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	var ret []TraceEvent
+	n := uint64(len(t.ring))
+	first := uint64(1)
+	if t.seq > n {
+		first = t.seq - n + 1
+	}
+	for seq := first; seq <= t.seq; seq++ {
+		ev := &t.ring[seq%n]
+		if tf.match(ev) {
+			ret = append(ret, *ev)
+		}
+	}
+	return ret
+}
@@ -286,6 +286,7 @@ type Conn struct {
 	derpStarted chan struct{}      // closed on first connection to DERP; for tests & cleaner Close
 	activeDerp  map[int]activeDerp // DERP regionID -> connection to a node in that region
 	prevDerp    map[int]*syncs.WaitGroupChan
+	derpLatency map[int]time.Duration // DERP regionID -> last DERP ping RTT over activeDerp
 
 	// derpRoute contains optional alternate routes to use as an
 	// optimization instead of contacting a peer via their home
@@ -482,7 +483,7 @@ func NewConn(opts Options) (*Conn, error) {
 	c.noteRecvActivity = opts.NoteRecvActivity
 	c.simulatedNetwork = opts.SimulatedNetwork
 	c.disableLegacy = opts.DisableLegacyNetworking
-	c.portMapper = portmapper.NewClient(logger.WithPrefix(c.logf, "portmapper: "))
+	c.portMapper = portmapper.NewClient(logger.WithPrefix(c.logf, "portmapper: "), c.onPortMapChanged)
 
 	if err := c.initialBind(); err != nil {
 		return nil, err
@@ -495,6 +496,7 @@ func NewConn(opts Options) (*Conn, error) {
 		GetSTUNConn4:        func() netcheck.STUNConn { return c.pconn4 },
 		SkipExternalNetwork: inTest(),
 		PortMapper:          c.portMapper,
+		PacketListener:      c.packetListener,
 	}
 
 	if c.pconn6 != nil {
@@ -655,10 +657,23 @@ func (c *Conn) updateNetInfo(ctx context.Context) (*netcheck.Report, error) {
 		DERPLatency:           map[string]float64{},
 		MappingVariesByDestIP: report.MappingVariesByDestIP,
 		HairPinning:           report.HairPinning,
+		NATMapping:            string(report.MappingBehavior),
+		NATFiltering:          string(report.FilteringBehavior),
 		UPnP:                  report.UPnP,
 		PMP:                   report.PMP,
 		PCP:                   report.PCP,
 	}
+	var mappings []string
+	for _, m := range report.PortMappings {
+		proto := m.Protocol
+		if m.External.IP.Is6() {
+			proto += "6"
+		}
+		if len(mappings) == 0 || mappings[len(mappings)-1] != proto {
+			mappings = append(mappings, proto)
+		}
+	}
+	ni.PortMapping = strings.Join(mappings, ",")
 	for rid, d := range report.RegionV4Latency {
 		ni.DERPLatency[fmt.Sprintf("%d-v4", rid)] = d.Seconds()
 	}
@@ -1020,6 +1035,14 @@ func (c *Conn) determineEndpoints(ctx context.Context) (ipPorts []string, reason
 	} else if !portmapper.IsNoMappingError(err) {
 		c.logf("portmapper: %v", err)
 	}
+	if c.pconn6 != nil {
+		if ext, err := c.portMapper.CreateOrGetMapping6(ctx); err == nil {
+			c.logf("portmapper: using %v", ext)
+			addAddr(ext.String(), "portmap")
+		} else if !portmapper.IsNoMappingError(err) {
+			c.logf("portmapper: IPv6: %v", err)
+		}
+	}
 
 	if nr.GlobalV4 != "" {
 		addAddr(nr.GlobalV4, "stun")
@@ -1303,7 +1326,7 @@ func (c *Conn) derpWriteChanOfAddr(addr netaddr.IPPort, peer key.Public) chan<-
 	c.setPeerLastDerpLocked(peer, regionID, regionID)
 	c.scheduleCleanStaleDerpLocked()
 
-	// Build a startGate for the derp reader+writer
+	// Build a startGate for the derp reader+writer+pinger
 	// goroutines, so they don't start running until any
 	// previous generation is closed.
 	startGate := syncs.ClosedChan()
@@ -1312,7 +1335,7 @@ func (c *Conn) derpWriteChanOfAddr(addr netaddr.IPPort, peer key.Public) chan<-
 	}
 	// And register a WaitGroup(Chan) for this generation.
 	wg := syncs.NewWaitGroupChan()
-	wg.Add(2)
+	wg.Add(3)
 	c.prevDerp[regionID] = wg
 
 	if firstDerp {
@@ -1326,6 +1349,7 @@ func (c *Conn) derpWriteChanOfAddr(addr netaddr.IPPort, peer key.Public) chan<-
 
 	go c.runDerpReader(ctx, addr, dc, wg, startGate)
 	go c.runDerpWriter(ctx, dc, ch, wg, startGate)
+	go c.runDerpPinger(ctx, regionID, dc, wg, startGate)
 	go c.derpActiveFunc()
 
 	return ad.writeCh
@@ -1554,6 +1578,67 @@ func (c *Conn) runDerpWriter(ctx context.Context, dc *derphttp.Client, ch <-chan
 	}
 }
 
+// runDerpPinger pings the DERP server of regionID over dc every
+// derpPingInterval, to measure its latency for UpdateStatus, and so
+// that a connection that silently died is noticed and reestablished:
+// dc.Ping closes the connection when a pong doesn't arrive in time.
+func (c *Conn) runDerpPinger(ctx context.Context, regionID int, dc *derphttp.Client, wg *syncs.WaitGroupChan, startGate <-chan struct{}) {
+	defer wg.Decr()
+	select {
+	case <-startGate:
+	case <-ctx.Done():
+		return
+	}
+
+	t := time.NewTicker(derpPingInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+		pingCtx, cancel := context.WithTimeout(ctx, derpPingTimeout)
+		start := time.Now()
+		err := dc.Ping(pingCtx)
+		cancel()
+		latency := time.Since(start)
+		if ctx.Err() != nil {
+			return
+		}
+		switch {
+		case err == nil:
+			c.setDerpLatency(ctx, regionID, latency)
+		case errors.Is(err, derp.ErrPingUnsupported):
+			// Old server, or not yet connected.
+		default:
+			c.logf("magicsock: derp-%d ping failed, reconnecting: %v", regionID, err)
+			c.setDerpLatency(ctx, regionID, 0)
+		}
+	}
+}
+
+// setDerpLatency records the latency to the DERP server of regionID,
+// as measured over the connection whose context is ctx. A zero
+// latency forgets it.
+func (c *Conn) setDerpLatency(ctx context.Context, regionID int, latency time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if ctx.Err() != nil {
+		// The connection was closed (by closeDerpLocked) while
+		// its ping was outstanding.
+		return
+	}
+	if latency == 0 {
+		delete(c.derpLatency, regionID)
+		return
+	}
+	if c.derpLatency == nil {
+		c.derpLatency = map[int]time.Duration{}
+	}
+	c.derpLatency[regionID] = latency
+}
+
 // findEndpoint maps from a UDP address to a WireGuard endpoint, for
 // ReceiveIPv4/ReceiveIPv6.
 //
@@ -2340,6 +2425,7 @@ func (c *Conn) closeDerpLocked(node int, why string) {
 		go ad.c.Close()
 		ad.cancel()
 		delete(c.activeDerp, node)
+		delete(c.derpLatency, node)
 	}
 }
 
@@ -2573,6 +2659,18 @@ func (c *Conn) ReSTUN(why string) {
 	}
 }
 
+// onPortMapChanged is called by the portmapper when its mappings
+// change, to re-advertise our endpoints without waiting for the next
+// periodic ReSTUN.
+func (c *Conn) onPortMapChanged() {
+	c.mu.Lock()
+	started := c.started
+	c.mu.Unlock()
+	if started {
+		c.ReSTUN("portmap-changed")
+	}
+}
+
 func (c *Conn) initialBind() error {
 	if err := c.bind1(&c.pconn4, "udp4"); err != nil {
 		return err
@@ -2580,6 +2678,8 @@ func (c *Conn) initialBind() error {
 	c.portMapper.SetLocalPort(c.LocalPort())
 	if err := c.bind1(&c.pconn6, "udp6"); err != nil {
 		c.logf("magicsock: ignoring IPv6 bind failure: %v", err)
+	} else {
+		c.portMapper.SetLocalPort6(uint16(c.pconn6.LocalAddr().Port))
 	}
 	return nil
 }
@@ -2960,6 +3060,16 @@ func (c *Conn) UpdateStatus(sb *ipnstate.StatusBuilder) {
 			ss.Relay = derpRegion.RegionCode
 		}
 	}
+	c.foreachActiveDerpSortedLocked(func(regionID int, ad activeDerp) {
+		latency, ok := c.derpLatency[regionID]
+		if !ok {
+			return
+		}
+		if ss.DERPLatency == nil {
+			ss.DERPLatency = map[string]float64{}
+		}
+		ss.DERPLatency[c.derpRegionCodeOfIDLocked(regionID)] = latency.Seconds()
+	})
 
 	if c.netMap != nil {
 		for _, addr := range c.netMap.Addresses {
@@ -2995,11 +3105,6 @@ func (c *Conn) UpdateStatus(sb *ipnstate.StatusBuilder) {
 		as.populatePeerStatus(ps)
 		sb.AddPeer(k, ps)
 	}
-
-	c.foreachActiveDerpSortedLocked(func(node int, ad activeDerp) {
-		// TODO(bradfitz): add to ipnstate.StatusBuilder
-		//f("<li><b>derp-%v</b>: cr%v,wr%v</li>", node, simpleDur(now.Sub(ad.createTime)), simpleDur(now.Sub(*ad.lastWrite)))
-	})
 }
 
 func ippDebugString(ua netaddr.IPPort) string {
@@ -3093,6 +3198,14 @@ const (
 	// are potentially-stale DERP connections to close.
 	derpCleanStaleInterval = 15 * time.Second
 
+	// derpPingInterval is how often each DERP connection is pinged
+	// to measure its latency and check that it's still alive.
+	derpPingInterval = 20 * time.Second
+
+	// derpPingTimeout is how long we wait for a DERP pong before
+	// assuming the connection is dead and reconnecting.
+	derpPingTimeout = 5 * time.Second
+
 	// endpointsFreshEnoughDuration is how long we consider a
 	// STUN-derived endpoint valid for. UDP NAT mappings typically
 	// expire at 30 seconds, so this is a few seconds shy of that.
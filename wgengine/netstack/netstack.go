@@ -12,9 +12,13 @@ import (
 	"context"
 	"errors"
 	"fmt"
-	"log"
+	"io"
 	"net"
+	"os"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
 
 	"gvisor.dev/gvisor/pkg/tcpip"
 	"gvisor.dev/gvisor/pkg/tcpip/adapters/gonet"
@@ -22,6 +26,7 @@ import (
 	"gvisor.dev/gvisor/pkg/tcpip/header"
 	"gvisor.dev/gvisor/pkg/tcpip/link/channel"
 	"gvisor.dev/gvisor/pkg/tcpip/network/ipv4"
+	"gvisor.dev/gvisor/pkg/tcpip/network/ipv6"
 	"gvisor.dev/gvisor/pkg/tcpip/stack"
 	"gvisor.dev/gvisor/pkg/tcpip/transport/icmp"
 	"gvisor.dev/gvisor/pkg/tcpip/transport/tcp"
@@ -29,169 +34,564 @@ import (
 	"gvisor.dev/gvisor/pkg/waiter"
 	"inet.af/netaddr"
 	"tailscale.com/net/packet"
+	"tailscale.com/net/tsaddr"
 	"tailscale.com/types/logger"
 	"tailscale.com/types/netmap"
 	"tailscale.com/wgengine"
 	"tailscale.com/wgengine/filter"
 	"tailscale.com/wgengine/magicsock"
+	"tailscale.com/wgengine/tsdns"
 	"tailscale.com/wgengine/tstun"
 )
 
-func Impl(logf logger.Logf, tundev *tstun.TUN, e wgengine.Engine, mc *magicsock.Conn) error {
+var debugNetstack, _ = strconv.ParseBool(os.Getenv("TS_DEBUG_NETSTACK"))
+
+const (
+	mtu   = 1500
+	nicID = 1
+
+	// TCP forwarder settings.
+	tcpReceiveBufferSize          = 0 // use the default buffer size
+	maxInFlightConnectionAttempts = 16
+)
+
+var (
+	loopbackIPv4 = netaddr.IPv4(127, 0, 0, 1)
+	loopbackIPv6 = netaddr.MustParseIP("::1")
+
+	// serviceDNSAddr is where the local machine sends DNS
+	// queries. Those over TCP are answered by netstack.
+	serviceDNSAddr = netaddr.IPPort{IP: tsaddr.TailscaleServiceIP(), Port: 53}
+)
+
+// Impl contains the state for the netstack implementation,
+// acting as a userspace network stack when Tailscale is running
+// in fake mode.
+//
+// Inbound TCP and UDP flows that pass the packet filter are proxied
+// to real sockets on the host: flows addressed to one of this node's
+// Tailscale IPs go to the corresponding port on loopback, and flows
+// addressed to one of the node's advertised subnet routes are dialed
+// to their original destination.
+//
+// DNS queries over TCP from the local machine to TailscaleServiceIP
+// are answered by the engine's DNS resolver. Engines with a kernel
+// TUN device use an Impl for only that; see StartDNS.
+type Impl struct {
+	ipstack *stack.Stack
+	linkEP  *channel.Endpoint
+	tundev  *tstun.TUN
+	e       wgengine.Engine
+	mc      *magicsock.Conn
+	logf    logger.Logf
+	dns     *tsdns.Resolver // or nil, if e doesn't have one
+	dnsOnly bool            // set by StartDNS
+
+	mu         sync.Mutex
+	localIP    map[netaddr.IP]bool // this node's Tailscale IPs
+	subnets    []netaddr.IPPrefix  // advertised subnet routes
+	peerRoutes []netaddr.IPPrefix  // AllowedIPs of all peers
+}
+
+// Create creates and populates a new Impl.
+func Create(logf logger.Logf, tundev *tstun.TUN, e wgengine.Engine, mc *magicsock.Conn) (*Impl, error) {
 	if mc == nil {
-		return errors.New("nil magicsock.Conn")
+		return nil, errors.New("nil magicsock.Conn")
 	}
 	if tundev == nil {
-		return errors.New("nil tundev")
+		return nil, errors.New("nil tundev")
 	}
 	if logf == nil {
-		return errors.New("nil logger")
+		return nil, errors.New("nil logger")
 	}
 	if e == nil {
-		return errors.New("nil Engine")
+		return nil, errors.New("nil Engine")
 	}
 	ipstack := stack.New(stack.Options{
-		NetworkProtocols:   []stack.NetworkProtocolFactory{ipv4.NewProtocol},
-		TransportProtocols: []stack.TransportProtocolFactory{tcp.NewProtocol, udp.NewProtocol, icmp.NewProtocol4},
+		NetworkProtocols:   []stack.NetworkProtocolFactory{ipv4.NewProtocol, ipv6.NewProtocol},
+		TransportProtocols: []stack.TransportProtocolFactory{tcp.NewProtocol, udp.NewProtocol, icmp.NewProtocol4, icmp.NewProtocol6},
 	})
-
-	const mtu = 1500
 	linkEP := channel.New(512, mtu, "")
+	if tcpipErr := ipstack.CreateNIC(nicID, linkEP); tcpipErr != nil {
+		return nil, fmt.Errorf("could not create netstack NIC: %v", tcpipErr)
+	}
+	ipv4Subnet, _ := tcpip.NewSubnet(tcpip.Address(strings.Repeat("\x00", 4)), tcpip.AddressMask(strings.Repeat("\x00", 4)))
+	ipv6Subnet, _ := tcpip.NewSubnet(tcpip.Address(strings.Repeat("\x00", 16)), tcpip.AddressMask(strings.Repeat("\x00", 16)))
+	ipstack.SetRouteTable([]tcpip.Route{
+		{
+			Destination: ipv4Subnet,
+			NIC:         nicID,
+		},
+		{
+			Destination: ipv6Subnet,
+			NIC:         nicID,
+		},
+	})
+	ns := &Impl{
+		logf:    logf,
+		ipstack: ipstack,
+		linkEP:  linkEP,
+		tundev:  tundev,
+		e:       e,
+		mc:      mc,
+		localIP: make(map[netaddr.IP]bool),
+	}
+	if re, ok := e.(wgengine.ResolvingEngine); ok {
+		ns.dns, _ = re.GetResolver()
+	}
+	return ns, nil
+}
 
-	const nicID = 1
-	if err := ipstack.CreateNIC(nicID, linkEP); err != nil {
-		log.Fatal(err)
+// Start sets up all the handlers so netstack can start working.
+func (ns *Impl) Start() error {
+	// Accept packets for any destination address (needed for
+	// subnet routing) and allow replies to be sent from them.
+	// injectInbound decides which destinations we actually serve.
+	if tcpipErr := ns.ipstack.SetPromiscuousMode(nicID, true); tcpipErr != nil {
+		return fmt.Errorf("could not enable promiscuous mode: %v", tcpipErr)
 	}
+	if tcpipErr := ns.ipstack.SetSpoofing(nicID, true); tcpipErr != nil {
+		return fmt.Errorf("could not enable spoofing: %v", tcpipErr)
+	}
+	ns.e.AddNetworkMapCallback(ns.updateIPs)
+	tcpFwd := tcp.NewForwarder(ns.ipstack, tcpReceiveBufferSize, maxInFlightConnectionAttempts, ns.acceptTCP)
+	udpFwd := udp.NewForwarder(ns.ipstack, ns.acceptUDP)
+	ns.ipstack.SetTransportProtocolHandler(tcp.ProtocolNumber, tcpFwd.HandlePacket)
+	ns.ipstack.SetTransportProtocolHandler(udp.ProtocolNumber, udpFwd.HandlePacket)
+	go ns.injectOutbound()
+	ns.tundev.PostFilterIn = ns.injectInbound
+	ns.interceptLocalDNS()
+	return nil
+}
 
-	e.AddNetworkMapCallback(func(nm *netmap.NetworkMap) {
-		oldIPs := make(map[tcpip.Address]bool)
-		for _, ip := range ipstack.AllAddresses()[nicID] {
-			oldIPs[ip.AddressWithPrefix.Address] = true
+// StartDNS sets up ns to only answer DNS queries over TCP from the
+// local machine to TailscaleServiceIP. It's for engines with a kernel
+// TUN device, which don't need netstack for anything else, and is
+// called instead of Start. Unlike Start, it leaves the stack with
+// only the TailscaleServiceIP address, so it can't accept or send
+// packets for any other.
+func (ns *Impl) StartDNS() error {
+	if ns.dns == nil {
+		return errors.New("engine has no DNS resolver")
+	}
+	if tcpipErr := ns.ipstack.AddAddress(nicID, ipv4.ProtocolNumber, tcpipAddrFromNetaddrIP(serviceDNSAddr.IP)); tcpipErr != nil {
+		return fmt.Errorf("could not add %v: %v", serviceDNSAddr.IP, tcpipErr)
+	}
+	ns.dnsOnly = true
+	tcpFwd := tcp.NewForwarder(ns.ipstack, tcpReceiveBufferSize, maxInFlightConnectionAttempts, ns.acceptTCP)
+	ns.ipstack.SetTransportProtocolHandler(tcp.ProtocolNumber, tcpFwd.HandlePacket)
+	go ns.injectOutbound()
+	ns.interceptLocalDNS()
+	return nil
+}
+
+// interceptLocalDNS installs a TUN PreFilterOut hook, in front of any
+// existing one, that hands TCP packets from the local machine to
+// TailscaleServiceIP:53 to netstack, for acceptTCP to answer. The
+// engine itself answers DNS over UDP.
+func (ns *Impl) interceptLocalDNS() {
+	next := ns.tundev.PreFilterOut
+	ns.tundev.PreFilterOut = func(p *packet.Parsed, t *tstun.TUN) filter.Response {
+		if p.IPProto == packet.TCP && p.Dst == serviceDNSAddr && ns.dns != nil {
+			ns.injectPacket(p)
+			return filter.DropSilently
 		}
-		newIPs := make(map[tcpip.Address]bool)
-		for _, ip := range nm.Addresses {
-			newIPs[tcpip.Address(ip.IPNet().IP)] = true
+		if next != nil {
+			return next(p, t)
 		}
+		return filter.Accept
+	}
+}
 
-		ipsToBeAdded := make(map[tcpip.Address]bool)
-		for ip := range newIPs {
-			if !oldIPs[ip] {
-				ipsToBeAdded[ip] = true
-			}
+// updateIPs registers this node's Tailscale addresses with the
+// netstack and records the subnet routes it advertises.
+func (ns *Impl) updateIPs(nm *netmap.NetworkMap) {
+	oldIPs := make(map[tcpip.Address]bool)
+	for _, ip := range ns.ipstack.AllAddresses()[nicID] {
+		oldIPs[ip.AddressWithPrefix.Address] = true
+	}
+	newIPs := make(map[tcpip.Address]bool)
+	localIP := make(map[netaddr.IP]bool)
+	for _, ipp := range nm.Addresses {
+		newIPs[tcpipAddrFromNetaddrIP(ipp.IP)] = true
+		localIP[ipp.IP] = true
+	}
+	subnets := append([]netaddr.IPPrefix(nil), nm.Hostinfo.RoutableIPs...)
+	var peerRoutes []netaddr.IPPrefix
+	for _, p := range nm.Peers {
+		peerRoutes = append(peerRoutes, p.AllowedIPs...)
+	}
+
+	ns.mu.Lock()
+	ns.localIP = localIP
+	ns.subnets = subnets
+	ns.peerRoutes = peerRoutes
+	ns.mu.Unlock()
+
+	for ip := range oldIPs {
+		if newIPs[ip] {
+			continue
 		}
-		ipsToBeRemoved := make(map[tcpip.Address]bool)
-		for ip := range oldIPs {
-			if !newIPs[ip] {
-				ipsToBeRemoved[ip] = true
-			}
+		if err := ns.ipstack.RemoveAddress(nicID, ip); err != nil {
+			ns.logf("netstack: could not deregister IP %s: %v", ip, err)
+		} else {
+			ns.logf("netstack: deregistered IP %s", ip)
+		}
+	}
+	for ip := range newIPs {
+		if oldIPs[ip] {
+			continue
+		}
+		pn := ipv4.ProtocolNumber
+		if len(ip) == net.IPv6len {
+			pn = ipv6.ProtocolNumber
 		}
+		if err := ns.ipstack.AddAddress(nicID, pn, ip); err != nil {
+			ns.logf("netstack: could not register IP %s: %v", ip, err)
+		} else {
+			ns.logf("netstack: registered IP %s", ip)
+		}
+	}
+}
 
-		for ip := range ipsToBeRemoved {
-			err := ipstack.RemoveAddress(nicID, ip)
-			if err != nil {
-				logf("netstack: could not deregister IP %s: %v", ip, err)
-			} else {
-				logf("netstack: deregistered IP %s", ip)
-			}
+// isLocalIP reports whether ip is one of this node's Tailscale IPs.
+func (ns *Impl) isLocalIP(ip netaddr.IP) bool {
+	ns.mu.Lock()
+	defer ns.mu.Unlock()
+	return ns.localIP[ip]
+}
+
+// shouldProcessInbound reports whether netstack should handle an
+// inbound packet destined to ip: either one of our own addresses,
+// or an address within one of our advertised subnet routes.
+func (ns *Impl) shouldProcessInbound(ip netaddr.IP) bool {
+	ns.mu.Lock()
+	defer ns.mu.Unlock()
+	if ns.localIP[ip] {
+		return true
+	}
+	for _, r := range ns.subnets {
+		if r.Contains(ip) {
+			return true
 		}
-		for ip := range ipsToBeAdded {
-			err := ipstack.AddAddress(nicID, ipv4.ProtocolNumber, ip)
-			if err != nil {
-				logf("netstack: could not register IP %s: %v", ip, err)
-			} else {
-				logf("netstack: registered IP %s", ip)
+	}
+	return false
+}
+
+// ReachableViaTailnet reports whether ip should be dialed through
+// the tailnet: either it's a Tailscale IP, or it's within a route
+// advertised by one of our peers.
+func (ns *Impl) ReachableViaTailnet(ip netaddr.IP) bool {
+	if tsaddr.IsTailscaleIP(ip) {
+		return true
+	}
+	ns.mu.Lock()
+	defer ns.mu.Unlock()
+	for _, r := range ns.peerRoutes {
+		if r.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// DialContextTCP dials ipp over the tailnet using the netstack,
+// with this node's Tailscale IP as the source address.
+func (ns *Impl) DialContextTCP(ctx context.Context, ipp netaddr.IPPort) (*gonet.TCPConn, error) {
+	remoteAddress := tcpip.FullAddress{
+		NIC:  nicID,
+		Addr: tcpipAddrFromNetaddrIP(ipp.IP),
+		Port: ipp.Port,
+	}
+	pn := ipv4.ProtocolNumber
+	if ipp.IP.Is6() {
+		pn = ipv6.ProtocolNumber
+	}
+	return gonet.DialContextTCP(ctx, ns.ipstack, remoteAddress, pn)
+}
+
+// injectOutbound reads packets written by netstack and sends them
+// back out over the tunnel.
+func (ns *Impl) injectOutbound() {
+	for {
+		packetInfo, ok := ns.linkEP.ReadContext(context.Background())
+		if !ok {
+			continue
+		}
+		full := packetBytes(packetInfo.Pkt)
+		if debugNetstack {
+			ns.logf("[v2] packet Write out: % x", full)
+		}
+		var p packet.Parsed
+		p.Decode(full)
+		if p.IPProto == packet.TCP && p.Src == serviceDNSAddr {
+			// A DNS reply to the local machine; see
+			// interceptLocalDNS.
+			if err := ns.tundev.InjectInboundCopy(full); err != nil {
+				ns.logf("netstack inject DNS reply: %v", err)
 			}
+			continue
 		}
-	})
+		if err := ns.tundev.InjectOutbound(full); err != nil {
+			ns.logf("netstack inject outbound: %v", err)
+			return
+		}
+	}
+}
 
-	// Add 0.0.0.0/0 default route.
-	subnet, _ := tcpip.NewSubnet(tcpip.Address(strings.Repeat("\x00", 4)), tcpip.AddressMask(strings.Repeat("\x00", 4)))
-	ipstack.SetRouteTable([]tcpip.Route{
-		{
-			Destination: subnet,
-			NIC:         nicID,
-		},
+// packetBytes returns the contents of pkt, a packet written by
+// netstack.
+func packetBytes(pkt *stack.PacketBuffer) []byte {
+	full := make([]byte, 0, pkt.Size())
+	full = append(full, pkt.NetworkHeader().View()...)
+	full = append(full, pkt.TransportHeader().View()...)
+	full = append(full, pkt.Data.ToView()...)
+	return full
+}
+
+// injectInbound is installed as the TUN's PostFilterIn hook, so it
+// only ever sees packets that the packet filter has already accepted.
+func (ns *Impl) injectInbound(p *packet.Parsed, t *tstun.TUN) filter.Response {
+	if !ns.shouldProcessInbound(p.Dst.IP) {
+		// Not ours; let the fake TUN swallow it.
+		return filter.DropSilently
+	}
+	if !ns.injectPacket(p) {
+		return filter.DropSilently
+	}
+	return filter.Accept
+}
+
+// injectPacket hands a copy of p to netstack. It reports whether p
+// was an IP packet that netstack could take.
+func (ns *Impl) injectPacket(p *packet.Parsed) bool {
+	var pn tcpip.NetworkProtocolNumber
+	switch p.IPVersion {
+	case 4:
+		pn = header.IPv4ProtocolNumber
+	case 6:
+		pn = header.IPv6ProtocolNumber
+	default:
+		return false
+	}
+	if debugNetstack {
+		ns.logf("[v2] packet in (from %v): % x", p.Src, p.Buffer())
+	}
+	vv := buffer.View(append([]byte(nil), p.Buffer()...)).ToVectorisedView()
+	packetBuf := stack.NewPacketBuffer(stack.PacketBufferOptions{
+		Data: vv,
 	})
+	ns.linkEP.InjectInbound(pn, packetBuf)
+	return true
+}
 
-	// use Forwarder to accept any connection from stack
-	fwd := tcp.NewForwarder(ipstack, 0, 16, func(r *tcp.ForwarderRequest) {
-		logf("XXX ForwarderRequest: %v", r)
-		var wq waiter.Queue
-		ep, err := r.CreateEndpoint(&wq)
-		if err != nil {
-			r.Complete(true)
-			return
+// backendAddr returns the host address that a flow addressed to dst
+// inside the tailnet should be proxied to.
+func (ns *Impl) backendAddr(dst netaddr.IPPort) netaddr.IPPort {
+	if !ns.isLocalIP(dst.IP) {
+		return dst
+	}
+	if dst.IP.Is6() {
+		return netaddr.IPPort{IP: loopbackIPv6, Port: dst.Port}
+	}
+	return netaddr.IPPort{IP: loopbackIPv4, Port: dst.Port}
+}
+
+func (ns *Impl) acceptTCP(r *tcp.ForwarderRequest) {
+	reqDetails := r.ID()
+	if debugNetstack {
+		ns.logf("[v2] TCP ForwarderRequest: %s", stringifyTEI(reqDetails))
+	}
+	dst, ok := ipPortOfNetstackAddr(reqDetails.LocalAddress, reqDetails.LocalPort)
+	if !ok {
+		r.Complete(true)
+		return
+	}
+	isDNS := dst == serviceDNSAddr && ns.dns != nil
+	if !isDNS && ns.dnsOnly {
+		r.Complete(true)
+		return
+	}
+	var wq waiter.Queue
+	ep, err := r.CreateEndpoint(&wq)
+	if err != nil {
+		r.Complete(true)
+		return
+	}
+	r.Complete(false)
+	c := gonet.NewTCPConn(&wq, ep)
+	if isDNS {
+		go ns.dns.HandleTCPConn(c)
+		return
+	}
+	go ns.forwardTCP(c, &wq, ns.backendAddr(dst))
+}
+
+func (ns *Impl) forwardTCP(client *gonet.TCPConn, wq *waiter.Queue, backend netaddr.IPPort) {
+	defer client.Close()
+	dialAddrStr := backend.String()
+	if debugNetstack {
+		ns.logf("[v2] netstack: forwarding incoming connection to %s", dialAddrStr)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// Abort the dial if the client hangs up before we connect.
+	waitEntry, notifyCh := waiter.NewChannelEntry(nil)
+	wq.EventRegister(&waitEntry, waiter.EventHUp)
+	defer wq.EventUnregister(&waitEntry)
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-notifyCh:
+		case <-done:
 		}
-		r.Complete(false)
-		c := gonet.NewTCPConn(&wq, ep)
-		// TCP echo
-		go echo(c, e, mc)
+		cancel()
+	}()
 
+	var stdDialer net.Dialer
+	server, err := stdDialer.DialContext(ctx, "tcp", dialAddrStr)
+	if err != nil {
+		ns.logf("netstack: could not connect to server at %s: %v", dialAddrStr, err)
+		return
+	}
+	defer server.Close()
+	connClosed := make(chan error, 2)
+	go func() {
+		_, err := io.Copy(server, client)
+		connClosed <- err
+	}()
+	go func() {
+		_, err := io.Copy(client, server)
+		connClosed <- err
+	}()
+	err = <-connClosed
+	if err != nil {
+		ns.logf("netstack: proxy connection to %s closed with error: %v", dialAddrStr, err)
+	}
+	if debugNetstack {
+		ns.logf("[v2] netstack: forwarder connection to %s closed", dialAddrStr)
+	}
+}
+
+func (ns *Impl) acceptUDP(r *udp.ForwarderRequest) {
+	sess := r.ID()
+	if debugNetstack {
+		ns.logf("[v2] UDP ForwarderRequest: %v", stringifyTEI(sess))
+	}
+	var wq waiter.Queue
+	ep, err := r.CreateEndpoint(&wq)
+	if err != nil {
+		ns.logf("acceptUDP: could not create endpoint: %v", err)
+		return
+	}
+	dst, ok := ipPortOfNetstackAddr(sess.LocalAddress, sess.LocalPort)
+	if !ok {
+		ep.Close()
+		return
+	}
+	src, ok := ipPortOfNetstackAddr(sess.RemoteAddress, sess.RemotePort)
+	if !ok {
+		ep.Close()
+		return
+	}
+	c := gonet.NewUDPConn(ns.ipstack, &wq, ep)
+	go ns.forwardUDP(c, src, ns.backendAddr(dst))
+}
+
+// udpIdleTimeout is how long a proxied UDP flow may go without
+// traffic in either direction before it's torn down.
+const udpIdleTimeout = 2 * time.Minute
+
+// udpDNSIdleTimeout is udpIdleTimeout for flows to port 53, which
+// are almost always a single request and response.
+const udpDNSIdleTimeout = 30 * time.Second
+
+// forwardUDP proxies packets between client, a netstack UDP endpoint
+// whose remote is clientAddr, and a host UDP socket talking to backend.
+func (ns *Impl) forwardUDP(client *gonet.UDPConn, clientAddr, backend netaddr.IPPort) {
+	network := "udp4"
+	if backend.IP.Is6() {
+		network = "udp6"
+	}
+	backendConn, err := net.ListenUDP(network, nil)
+	if err != nil {
+		ns.logf("netstack: could not bind local UDP socket for %v: %v", backend, err)
+		client.Close()
+		return
+	}
+	if debugNetstack {
+		ns.logf("[v2] netstack: forwarding UDP from %v to %v", clientAddr, backend)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	idleTimeout := udpIdleTimeout
+	if backend.Port == 53 {
+		idleTimeout = udpDNSIdleTimeout
+	}
+	timer := time.AfterFunc(idleTimeout, func() {
+		if debugNetstack {
+			ns.logf("[v2] netstack: UDP session between %v and %v timed out", clientAddr, backend)
+		}
+		cancel()
 	})
-	ipstack.SetTransportProtocolHandler(tcp.ProtocolNumber, fwd.HandlePacket)
+	extend := func() {
+		timer.Reset(idleTimeout)
+	}
+	go func() {
+		<-ctx.Done()
+		timer.Stop()
+		client.Close()
+		backendConn.Close()
+	}()
+	startPacketCopy(ctx, cancel, client, clientAddr.UDPAddr(), backendConn, ns.logf, extend)
+	startPacketCopy(ctx, cancel, backendConn, backend.UDPAddr(), client, ns.logf, extend)
+}
 
+// startPacketCopy starts a goroutine copying packets read from src
+// to dstAddr via dst, until ctx is done or an error occurs.
+func startPacketCopy(ctx context.Context, cancel context.CancelFunc, dst net.PacketConn, dstAddr net.Addr, src net.PacketConn, logf logger.Logf, extend func()) {
 	go func() {
+		defer cancel() // tear down the other direction's copy
+		pkt := make([]byte, mtu)
 		for {
-			packetInfo, ok := linkEP.ReadContext(context.Background())
-			if !ok {
-				logf("XXX ReadContext-for-write = ok=false")
-				continue
+			n, srcAddr, err := src.ReadFrom(pkt)
+			if err != nil {
+				if ctx.Err() == nil {
+					logf("netstack: read packet from %s failed: %v", srcAddr, err)
+				}
+				return
 			}
-			pkt := packetInfo.Pkt
-			hdrNetwork := pkt.NetworkHeader()
-			hdrTransport := pkt.TransportHeader()
-
-			full := make([]byte, 0, pkt.Size())
-			full = append(full, hdrNetwork.View()...)
-			full = append(full, hdrTransport.View()...)
-			full = append(full, pkt.Data.ToView()...)
-
-			logf("XXX packet Write out: % x", full)
-			if err := tundev.InjectOutbound(full); err != nil {
-				log.Printf("netstack inject outbound: %v", err)
+			if _, err := dst.WriteTo(pkt[:n], dstAddr); err != nil {
+				if ctx.Err() == nil {
+					logf("netstack: write packet to %s failed: %v", dstAddr, err)
+				}
 				return
 			}
-
+			extend()
 		}
 	}()
+}
 
-	tundev.PostFilterIn = func(p *packet.Parsed, t *tstun.TUN) filter.Response {
-		var pn tcpip.NetworkProtocolNumber
-		switch p.IPVersion {
-		case 4:
-			pn = header.IPv4ProtocolNumber
-		case 6:
-			pn = header.IPv6ProtocolNumber
-		}
-		logf("XXX packet in (from %v): % x", p.Src, p.Buffer())
-		vv := buffer.View(append([]byte(nil), p.Buffer()...)).ToVectorisedView()
-		packetBuf := stack.NewPacketBuffer(stack.PacketBufferOptions{
-			Data: vv,
-		})
-		linkEP.InjectInbound(pn, packetBuf)
-		return filter.Accept
+func tcpipAddrFromNetaddrIP(ip netaddr.IP) tcpip.Address {
+	if ip.Is4() {
+		b := ip.As4()
+		return tcpip.Address(b[:])
 	}
-	return nil
+	b := ip.As16()
+	return tcpip.Address(b[:])
 }
 
-func echo(c *gonet.TCPConn, e wgengine.Engine, mc *magicsock.Conn) {
-	defer c.Close()
-	src, _ := netaddr.FromStdIP(c.RemoteAddr().(*net.TCPAddr).IP)
-	who := ""
-	if n, u, ok := mc.WhoIs(src); ok {
-		who = fmt.Sprintf("%v from %v", u.DisplayName, n.Name)
-	}
-	fmt.Fprintf(c, "Hello, %s! Thanks for connecting to me on port %v (Try other ports too!)\nEchoing...\n",
-		who,
-		c.LocalAddr().(*net.TCPAddr).Port)
-	buf := make([]byte, 1500)
-	for {
-		n, err := c.Read(buf)
-		if err != nil {
-			log.Printf("Err: %v", err)
-			break
-		}
-		c.Write(buf[:n])
+func ipPortOfNetstackAddr(a tcpip.Address, port uint16) (ipp netaddr.IPPort, ok bool) {
+	ip, ok := netaddr.FromStdIP(net.IP(a))
+	if !ok {
+		return netaddr.IPPort{}, false
 	}
-	log.Print("Connection closed")
+	return netaddr.IPPort{IP: ip, Port: port}, true
+}
+
+func stringifyTEI(tei stack.TransportEndpointID) string {
+	localHostPort := net.JoinHostPort(tei.LocalAddress.String(), strconv.Itoa(int(tei.LocalPort)))
+	remoteHostPort := net.JoinHostPort(tei.RemoteAddress.String(), strconv.Itoa(int(tei.RemotePort)))
+	return fmt.Sprintf("%s -> %s", remoteHostPort, localHostPort)
 }
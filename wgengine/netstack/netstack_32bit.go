@@ -8,14 +8,38 @@
 package netstack
 
 import (
+	"context"
 	"errors"
+	"net"
 
+	"inet.af/netaddr"
 	"tailscale.com/types/logger"
 	"tailscale.com/wgengine"
 	"tailscale.com/wgengine/magicsock"
 	"tailscale.com/wgengine/tstun"
 )
 
-func Impl(logf logger.Logf, tundev *tstun.TUN, e wgengine.Engine, mc *magicsock.Conn) error {
-	return errors.New("netstack is not supported on 32-bit platforms for now; see https://github.com/google/gvisor/issues/5241")
+var errUnsupported = errors.New("netstack is not supported on 32-bit platforms for now; see https://github.com/google/gvisor/issues/5241")
+
+// Impl is unused on 32-bit platforms.
+type Impl struct{}
+
+func Create(logf logger.Logf, tundev *tstun.TUN, e wgengine.Engine, mc *magicsock.Conn) (*Impl, error) {
+	return nil, errUnsupported
+}
+
+func (ns *Impl) Start() error {
+	return errUnsupported
+}
+
+func (ns *Impl) StartDNS() error {
+	return errUnsupported
+}
+
+func (ns *Impl) ReachableViaTailnet(ip netaddr.IP) bool {
+	return false
+}
+
+func (ns *Impl) DialContextTCP(ctx context.Context, ipp netaddr.IPPort) (net.Conn, error) {
+	return nil, errUnsupported
 }
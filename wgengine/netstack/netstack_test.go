@@ -0,0 +1,265 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// +build amd64 arm64 ppc64le riscv64 s390x
+
+package netstack
+
+import (
+	"context"
+	"encoding/binary"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/tailscale/wireguard-go/tun/tuntest"
+	dns "golang.org/x/net/dns/dnsmessage"
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/adapters/gonet"
+	"gvisor.dev/gvisor/pkg/tcpip/buffer"
+	"gvisor.dev/gvisor/pkg/tcpip/link/channel"
+	"gvisor.dev/gvisor/pkg/tcpip/network/ipv4"
+	"gvisor.dev/gvisor/pkg/tcpip/stack"
+	"gvisor.dev/gvisor/pkg/tcpip/transport/tcp"
+	"inet.af/netaddr"
+	"tailscale.com/tailcfg"
+	"tailscale.com/types/logger"
+	"tailscale.com/types/netmap"
+	"tailscale.com/wgengine"
+	"tailscale.com/wgengine/router"
+	"tailscale.com/wgengine/tsdns"
+)
+
+// newOSStack returns a TCP/IP stack with address ip, standing in for
+// the kernel's on the other side of the TUN device tun.
+func newOSStack(ctx context.Context, t *testing.T, tun *tuntest.ChannelTUN, ip netaddr.IP) *stack.Stack {
+	s := stack.New(stack.Options{
+		NetworkProtocols:   []stack.NetworkProtocolFactory{ipv4.NewProtocol},
+		TransportProtocols: []stack.TransportProtocolFactory{tcp.NewProtocol},
+	})
+	linkEP := channel.New(512, mtu, "")
+	if err := s.CreateNIC(nicID, linkEP); err != nil {
+		t.Fatalf("CreateNIC: %v", err)
+	}
+	if err := s.AddAddress(nicID, ipv4.ProtocolNumber, tcpipAddrFromNetaddrIP(ip)); err != nil {
+		t.Fatalf("AddAddress: %v", err)
+	}
+	subnet, _ := tcpip.NewSubnet(tcpip.Address("\x00\x00\x00\x00"), tcpip.AddressMask("\x00\x00\x00\x00"))
+	s.SetRouteTable([]tcpip.Route{{Destination: subnet, NIC: nicID}})
+
+	// What the OS writes to the TUN device, the engine reads, and
+	// vice versa.
+	go func() {
+		for {
+			pi, ok := linkEP.ReadContext(ctx)
+			if !ok {
+				return
+			}
+			select {
+			case tun.Outbound <- packetBytes(pi.Pkt):
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	go func() {
+		for {
+			select {
+			case b := <-tun.Inbound:
+				linkEP.InjectInbound(ipv4.ProtocolNumber, stack.NewPacketBuffer(stack.PacketBufferOptions{
+					Data: buffer.View(b).ToVectorisedView(),
+				}))
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return s
+}
+
+// newTestImpl returns an unstarted Impl for a userspace engine,
+// with the addresses and routes of nm.
+func newTestImpl(t *testing.T, nm *netmap.NetworkMap) *Impl {
+	t.Helper()
+	tun := tuntest.NewChannelTUN()
+	e, err := wgengine.NewUserspaceEngineAdvanced(wgengine.EngineConfig{
+		Logf:      t.Logf,
+		TUN:       tun.TUN(),
+		RouterGen: router.NewFake,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(e.Close)
+	tundev, mc := e.(wgengine.InternalsGetter).GetInternals()
+	ns, err := Create(logger.Discard, tundev, e, mc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ns.updateIPs(nm)
+	return ns
+}
+
+var testNetMap = &netmap.NetworkMap{
+	Addresses: []netaddr.IPPrefix{
+		netaddr.MustParseIPPrefix("100.101.102.103/32"),
+		netaddr.MustParseIPPrefix("fd7a:115c:a1e0::1/128"),
+	},
+	Hostinfo: tailcfg.Hostinfo{
+		RoutableIPs: []netaddr.IPPrefix{netaddr.MustParseIPPrefix("192.168.1.0/24")},
+	},
+	Peers: []*tailcfg.Node{
+		{AllowedIPs: []netaddr.IPPrefix{
+			netaddr.MustParseIPPrefix("100.64.0.2/32"),
+			netaddr.MustParseIPPrefix("10.0.0.0/8"),
+		}},
+	},
+}
+
+func TestShouldProcessInbound(t *testing.T) {
+	ns := newTestImpl(t, testNetMap)
+	tests := []struct {
+		ip   string
+		want bool
+	}{
+		{"100.101.102.103", true},    // ours
+		{"fd7a:115c:a1e0::1", true},  // ours
+		{"192.168.1.5", true},        // in our advertised subnet
+		{"192.168.2.5", false},       // outside it
+		{"100.101.102.104", false},   // another Tailscale IP
+		{"10.1.2.3", false},          // a peer's subnet, not ours
+		{"fd7a:115c:a1e0::2", false}, // another Tailscale IP
+	}
+	for _, tt := range tests {
+		if got := ns.shouldProcessInbound(netaddr.MustParseIP(tt.ip)); got != tt.want {
+			t.Errorf("shouldProcessInbound(%v) = %v; want %v", tt.ip, got, tt.want)
+		}
+	}
+}
+
+func TestBackendAddr(t *testing.T) {
+	ns := newTestImpl(t, testNetMap)
+	tests := []struct {
+		dst  string
+		want string
+	}{
+		// Flows to our own addresses go to loopback.
+		{"100.101.102.103:22", "127.0.0.1:22"},
+		{"[fd7a:115c:a1e0::1]:80", "[::1]:80"},
+		// Flows to our subnets go to their original destination.
+		{"192.168.1.5:443", "192.168.1.5:443"},
+	}
+	for _, tt := range tests {
+		got := ns.backendAddr(netaddr.MustParseIPPort(tt.dst))
+		if want := netaddr.MustParseIPPort(tt.want); got != want {
+			t.Errorf("backendAddr(%v) = %v; want %v", tt.dst, got, want)
+		}
+	}
+}
+
+func TestReachableViaTailnet(t *testing.T) {
+	ns := newTestImpl(t, testNetMap)
+	tests := []struct {
+		ip   string
+		want bool
+	}{
+		{"100.64.0.2", true},   // a Tailscale IP
+		{"100.99.0.1", true},   // any Tailscale IP, peer or not
+		{"10.1.2.3", true},     // in a peer's route
+		{"192.168.1.5", false}, // our own subnet route
+		{"8.8.8.8", false},
+	}
+	for _, tt := range tests {
+		if got := ns.ReachableViaTailnet(netaddr.MustParseIP(tt.ip)); got != tt.want {
+			t.Errorf("ReachableViaTailnet(%v) = %v; want %v", tt.ip, got, tt.want)
+		}
+	}
+}
+
+func TestDNSOverTCP(t *testing.T) {
+	tun := tuntest.NewChannelTUN()
+	e, err := wgengine.NewUserspaceEngineAdvanced(wgengine.EngineConfig{
+		Logf:      t.Logf,
+		TUN:       tun.TUN(),
+		RouterGen: router.NewFake,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer e.Close()
+	testIP := netaddr.IPv4(100, 101, 102, 104)
+	e.SetDNSMap(tsdns.NewMap(map[string]netaddr.IP{"test1.ipn.dev.": testIP}, []string{"ipn.dev."}))
+
+	tundev, mc := e.(wgengine.InternalsGetter).GetInternals()
+	// netstack's goroutines outlive the test, so mustn't use t.Logf.
+	ns, err := Create(logger.Discard, tundev, e, mc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ns.StartDNS(); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	osStack := newOSStack(ctx, t, tun, netaddr.IPv4(100, 101, 102, 103))
+	c, err := gonet.DialContextTCP(ctx, osStack, tcpip.FullAddress{
+		NIC:  nicID,
+		Addr: tcpipAddrFromNetaddrIP(serviceDNSAddr.IP),
+		Port: serviceDNSAddr.Port,
+	}, ipv4.ProtocolNumber)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer c.Close()
+	c.SetDeadline(time.Now().Add(10 * time.Second))
+
+	b := dns.NewBuilder(nil, dns.Header{ID: 1, RecursionDesired: true})
+	b.StartQuestions()
+	b.Question(dns.Question{Name: dns.MustNewName("test1.ipn.dev."), Type: dns.TypeA, Class: dns.ClassINET})
+	query, err := b.Finish()
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg := make([]byte, 2+len(query))
+	binary.BigEndian.PutUint16(msg, uint16(len(query)))
+	copy(msg[2:], query)
+	if _, err := c.Write(msg); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+
+	var length [2]byte
+	if _, err := io.ReadFull(c, length[:]); err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	resp := make([]byte, binary.BigEndian.Uint16(length[:]))
+	if _, err := io.ReadFull(c, resp); err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	var p dns.Parser
+	h, err := p.Start(resp)
+	if err != nil {
+		t.Fatalf("parse: %v", err)
+	}
+	if h.ID != 1 || h.RCode != dns.RCodeSuccess {
+		t.Fatalf("response header = %+v; want ID 1, success", h)
+	}
+	if err := p.SkipAllQuestions(); err != nil {
+		t.Fatal(err)
+	}
+	ans, err := p.AllAnswers()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ans) != 1 {
+		t.Fatalf("got %d answers; want 1", len(ans))
+	}
+	a, ok := ans[0].Body.(*dns.AResource)
+	if !ok {
+		t.Fatalf("answer is %T; want A record", ans[0].Body)
+	}
+	if got := netaddr.IPv4(a.A[0], a.A[1], a.A[2], a.A[3]); got != testIP {
+		t.Errorf("answer = %v; want %v", got, testIP)
+	}
+}
@@ -25,10 +25,26 @@ type Config struct {
 	// Proxied indicates whether DNS requests are proxied through a tsdns.Resolver.
 	// This enables Magic DNS.
 	Proxied bool
+	// Routes are split DNS routes, applied by the tsdns.Resolver if Proxied is set.
+	// Managers ignore them.
+	Routes []Route
+}
+
+// Route directs the forwarding of DNS queries for names within a domain,
+// as in split DNS.
+type Route struct {
+	// Suffix is the domain the route applies to, such as "corp.example.com".
+	Suffix string
+	// Nameservers are the IP addresses of the nameservers to forward matching queries to.
+	Nameservers []netaddr.IP
+	// Fallback indicates whether matching queries are retried with Config.Nameservers
+	// when Nameservers fail to answer.
+	Fallback bool
 }
 
 // Equal determines whether its argument and receiver
 // represent equivalent DNS configurations (then DNS reconfig is a no-op).
+// Routes are not compared, as managers ignore them.
 func (lhs Config) Equal(rhs Config) bool {
 	if lhs.Proxied != rhs.Proxied || lhs.PerDomain != rhs.PerDomain {
 		return false
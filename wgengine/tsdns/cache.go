@@ -0,0 +1,260 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package tsdns
+
+import (
+	"container/list"
+	"expvar"
+	"strings"
+	"sync"
+	"time"
+
+	dns "golang.org/x/net/dns/dnsmessage"
+	"tailscale.com/metrics"
+)
+
+// defaultCacheSize is the number of responses a Resolver caches.
+const defaultCacheSize = 1000
+
+// Cache metrics, summed over all resolvers.
+var (
+	// metricCacheHit counts cache hits by kind:
+	// "positive" for answers, "negative" for NXDOMAIN and NODATA.
+	metricCacheHit  = &metrics.LabelMap{Label: "kind"}
+	metricCacheMiss = expvar.NewInt("counter_tsdns_cache_miss")
+
+	metricCacheHitPositive = metricCacheHit.Get("positive")
+	metricCacheHitNegative = metricCacheHit.Get("negative")
+)
+
+func init() {
+	expvar.Publish("counter_tsdns_cache_hit", metricCacheHit)
+}
+
+// cacheKey identifies the question a cached response answers.
+type cacheKey struct {
+	name  string // lowercase, canonical
+	typ   dns.Type
+	class dns.Class
+}
+
+type cacheEntry struct {
+	key      cacheKey
+	msg      dns.Message
+	stored   time.Time
+	expires  time.Time
+	negative bool
+}
+
+// responseCache is an LRU cache of upstream DNS responses.
+//
+// Answers are cached for the smallest TTL among them. NXDOMAIN and
+// NODATA responses are cached as in RFC 2308: for the TTL of the SOA
+// record in the authority section, capped by its MINIMUM field.
+// Negative responses without an SOA record are not cached.
+//
+// It is safe for concurrent use.
+type responseCache struct {
+	max int
+	now func() time.Time // or nil for time.Now; for tests
+
+	mu      sync.Mutex
+	ll      *list.List // of *cacheEntry, most recently used first
+	entries map[cacheKey]*list.Element
+}
+
+func newResponseCache(max int) *responseCache {
+	return &responseCache{
+		max:     max,
+		ll:      list.New(),
+		entries: make(map[cacheKey]*list.Element),
+	}
+}
+
+func (c *responseCache) timeNow() time.Time {
+	if c.now != nil {
+		return c.now()
+	}
+	return time.Now()
+}
+
+// questionKey returns the cache key for q.
+func questionKey(q dns.Question) cacheKey {
+	return cacheKey{
+		name:  strings.ToLower(q.Name.String()),
+		typ:   q.Type,
+		class: q.Class,
+	}
+}
+
+// get returns a response to query from the cache, if there is one.
+// The response's ID and question are those of query,
+// and its TTLs are reduced by the time it spent in the cache.
+func (c *responseCache) get(query []byte) ([]byte, bool) {
+	var parser dns.Parser
+	h, err := parser.Start(query)
+	if err != nil {
+		return nil, false
+	}
+	q, err := parser.Question()
+	if err != nil {
+		return nil, false
+	}
+	key := questionKey(q)
+	now := c.timeNow()
+
+	c.mu.Lock()
+	el, ok := c.entries[key]
+	if !ok {
+		c.mu.Unlock()
+		metricCacheMiss.Add(1)
+		return nil, false
+	}
+	ent := el.Value.(*cacheEntry)
+	if !now.Before(ent.expires) {
+		c.ll.Remove(el)
+		delete(c.entries, key)
+		c.mu.Unlock()
+		metricCacheMiss.Add(1)
+		return nil, false
+	}
+	c.ll.MoveToFront(el)
+	msg := ent.msg
+	elapsed := now.Sub(ent.stored)
+	negative := ent.negative
+	c.mu.Unlock()
+
+	msg.Header.ID = h.ID
+	msg.Header.RecursionDesired = h.RecursionDesired
+	msg.Questions = []dns.Question{q}
+	msg.Answers = agedResources(msg.Answers, elapsed)
+	msg.Authorities = agedResources(msg.Authorities, elapsed)
+	msg.Additionals = agedResources(msg.Additionals, elapsed)
+	out, err := msg.Pack()
+	if err != nil {
+		return nil, false
+	}
+
+	if negative {
+		metricCacheHitNegative.Add(1)
+	} else {
+		metricCacheHitPositive.Add(1)
+	}
+	return out, true
+}
+
+// agedResources returns a copy of rs with their TTLs reduced by elapsed.
+func agedResources(rs []dns.Resource, elapsed time.Duration) []dns.Resource {
+	if len(rs) == 0 {
+		return nil
+	}
+	secs := uint32(elapsed / time.Second)
+	ret := make([]dns.Resource, len(rs))
+	for i, r := range rs {
+		// The TTL field of an OPT record holds flags, not a TTL.
+		if r.Header.Type != dns.TypeOPT {
+			if r.Header.TTL > secs {
+				r.Header.TTL -= secs
+			} else {
+				r.Header.TTL = 0
+			}
+		}
+		ret[i] = r
+	}
+	return ret
+}
+
+// put adds response, received from an upstream, to the cache,
+// if it can be cached.
+func (c *responseCache) put(response []byte) {
+	var msg dns.Message
+	if err := msg.Unpack(response); err != nil {
+		return
+	}
+	if !msg.Header.Response || msg.Header.Truncated || len(msg.Questions) != 1 {
+		return
+	}
+
+	var ttl uint32
+	negative := false
+	switch {
+	case msg.Header.RCode == dns.RCodeSuccess && len(msg.Answers) > 0:
+		ttl = msg.Answers[0].Header.TTL
+		for _, r := range msg.Answers[1:] {
+			if r.Header.TTL < ttl {
+				ttl = r.Header.TTL
+			}
+		}
+	case msg.Header.RCode == dns.RCodeSuccess || msg.Header.RCode == dns.RCodeNameError:
+		var ok bool
+		ttl, ok = negativeTTL(msg.Authorities)
+		if !ok {
+			return
+		}
+		negative = true
+	default:
+		return
+	}
+	if ttl == 0 {
+		return
+	}
+
+	key := questionKey(msg.Questions[0])
+	now := c.timeNow()
+	ent := &cacheEntry{
+		key:      key,
+		msg:      msg,
+		stored:   now,
+		expires:  now.Add(time.Duration(ttl) * time.Second),
+		negative: negative,
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if el, ok := c.entries[key]; ok {
+		el.Value = ent
+		c.ll.MoveToFront(el)
+		return
+	}
+	c.entries[key] = c.ll.PushFront(ent)
+	for c.ll.Len() > c.max {
+		oldest := c.ll.Back()
+		c.ll.Remove(oldest)
+		delete(c.entries, oldest.Value.(*cacheEntry).key)
+	}
+}
+
+// negativeTTL returns how long a negative response with the given
+// authority section may be cached, per RFC 2308, section 5.
+// It reports false if there is no SOA record to derive it from.
+func negativeTTL(authorities []dns.Resource) (ttl uint32, ok bool) {
+	for _, r := range authorities {
+		soa, isSOA := r.Body.(*dns.SOAResource)
+		if !isSOA {
+			continue
+		}
+		ttl = r.Header.TTL
+		if soa.MinTTL < ttl {
+			ttl = soa.MinTTL
+		}
+		return ttl, true
+	}
+	return 0, false
+}
+
+// flush removes all responses from the cache.
+func (c *responseCache) flush() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.ll.Init()
+	c.entries = make(map[cacheKey]*list.Element)
+}
+
+// size returns the number of responses in the cache, including expired ones.
+func (c *responseCache) size() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.ll.Len()
+}
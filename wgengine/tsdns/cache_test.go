@@ -0,0 +1,246 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package tsdns
+
+import (
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	dns "golang.org/x/net/dns/dnsmessage"
+	"tailscale.com/tstest"
+)
+
+// cacheQuery returns a query for name and tp with the given ID.
+func cacheQuery(t *testing.T, id uint16, name string, tp dns.Type) []byte {
+	t.Helper()
+	msg := dns.Message{
+		Header: dns.Header{ID: id, RecursionDesired: true},
+		Questions: []dns.Question{
+			{Name: dns.MustNewName(name), Type: tp, Class: dns.ClassINET},
+		},
+	}
+	b, err := msg.Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+// cacheResponse returns an upstream response to a query for name and tp
+// with the given rcode, answers and authorities.
+func cacheResponse(t *testing.T, name string, tp dns.Type, rcode dns.RCode, answers, authorities []dns.Resource) []byte {
+	t.Helper()
+	msg := dns.Message{
+		Header: dns.Header{Response: true, RCode: rcode},
+		Questions: []dns.Question{
+			{Name: dns.MustNewName(name), Type: tp, Class: dns.ClassINET},
+		},
+		Answers:     answers,
+		Authorities: authorities,
+	}
+	b, err := msg.Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func aRecord(name string, ttl uint32, a [4]byte) dns.Resource {
+	return dns.Resource{
+		Header: dns.ResourceHeader{Name: dns.MustNewName(name), Class: dns.ClassINET, TTL: ttl},
+		Body:   &dns.AResource{A: a},
+	}
+}
+
+func soaRecord(zone string, ttl, minTTL uint32) dns.Resource {
+	return dns.Resource{
+		Header: dns.ResourceHeader{Name: dns.MustNewName(zone), Class: dns.ClassINET, TTL: ttl},
+		Body: &dns.SOAResource{
+			NS:     dns.MustNewName("ns." + zone),
+			MBox:   dns.MustNewName("hostmaster." + zone),
+			MinTTL: minTTL,
+		},
+	}
+}
+
+func TestResponseCache(t *testing.T) {
+	now := time.Unix(1e9, 0)
+	c := newResponseCache(10)
+	c.now = func() time.Time { return now }
+
+	c.put(cacheResponse(t, "host.example.com.", dns.TypeA, dns.RCodeSuccess, []dns.Resource{
+		aRecord("host.example.com.", 60, [4]byte{1, 2, 3, 4}),
+		aRecord("host.example.com.", 30, [4]byte{1, 2, 3, 5}),
+	}, nil))
+
+	if _, ok := c.get(cacheQuery(t, 1, "other.example.com.", dns.TypeA)); ok {
+		t.Errorf("hit for uncached name")
+	}
+	if _, ok := c.get(cacheQuery(t, 1, "host.example.com.", dns.TypeAAAA)); ok {
+		t.Errorf("hit for uncached type")
+	}
+
+	now = now.Add(10 * time.Second)
+	out, ok := c.get(cacheQuery(t, 1234, "HOST.example.com.", dns.TypeA))
+	if !ok {
+		t.Fatalf("miss for cached name")
+	}
+	var msg dns.Message
+	if err := msg.Unpack(out); err != nil {
+		t.Fatal(err)
+	}
+	if msg.Header.ID != 1234 {
+		t.Errorf("ID = %d; want 1234", msg.Header.ID)
+	}
+	if got := msg.Questions[0].Name.String(); got != "HOST.example.com." {
+		t.Errorf("question name = %q; want the query's", got)
+	}
+	if len(msg.Answers) != 2 {
+		t.Fatalf("got %d answers; want 2", len(msg.Answers))
+	}
+	if ttl0, ttl1 := msg.Answers[0].Header.TTL, msg.Answers[1].Header.TTL; ttl0 != 50 || ttl1 != 20 {
+		t.Errorf("TTLs = %d, %d; want 50, 20", ttl0, ttl1)
+	}
+
+	// The response expires with its shortest TTL.
+	now = now.Add(20 * time.Second)
+	if _, ok := c.get(cacheQuery(t, 1, "host.example.com.", dns.TypeA)); ok {
+		t.Errorf("hit for expired response")
+	}
+	if n := c.size(); n != 0 {
+		t.Errorf("size = %d after expiry; want 0", n)
+	}
+}
+
+func TestResponseCacheNegative(t *testing.T) {
+	now := time.Unix(1e9, 0)
+	c := newResponseCache(10)
+	c.now = func() time.Time { return now }
+
+	soa := []dns.Resource{soaRecord("example.com.", 300, 60)}
+	c.put(cacheResponse(t, "nx.example.com.", dns.TypeA, dns.RCodeNameError, nil, soa))
+	c.put(cacheResponse(t, "nodata.example.com.", dns.TypeAAAA, dns.RCodeSuccess, nil, soa))
+
+	// Negative responses without an SOA record or TTL aren't cached,
+	// and neither are failures or truncated responses.
+	c.put(cacheResponse(t, "nosoa.example.com.", dns.TypeA, dns.RCodeNameError, nil, nil))
+	c.put(cacheResponse(t, "servfail.example.com.", dns.TypeA, dns.RCodeServerFailure, nil, soa))
+	c.put(cacheResponse(t, "zero.example.com.", dns.TypeA, dns.RCodeSuccess, []dns.Resource{
+		aRecord("zero.example.com.", 0, [4]byte{1, 2, 3, 4}),
+	}, nil))
+	truncated := cacheResponse(t, "tc.example.com.", dns.TypeA, dns.RCodeSuccess, []dns.Resource{
+		aRecord("tc.example.com.", 60, [4]byte{1, 2, 3, 4}),
+	}, nil)
+	truncated[2] |= 0x02
+	c.put(truncated)
+	if n := c.size(); n != 2 {
+		t.Errorf("size = %d; want 2", n)
+	}
+
+	// The negative TTL is the SOA's MINIMUM, as it is less than the SOA's TTL.
+	now = now.Add(59 * time.Second)
+	for _, q := range []struct {
+		name  string
+		tp    dns.Type
+		rcode dns.RCode
+	}{
+		{"nx.example.com.", dns.TypeA, dns.RCodeNameError},
+		{"nodata.example.com.", dns.TypeAAAA, dns.RCodeSuccess},
+	} {
+		out, ok := c.get(cacheQuery(t, 1, q.name, q.tp))
+		if !ok {
+			t.Errorf("%s: miss; want hit", q.name)
+			continue
+		}
+		var msg dns.Message
+		if err := msg.Unpack(out); err != nil {
+			t.Fatal(err)
+		}
+		if msg.Header.RCode != q.rcode {
+			t.Errorf("%s: rcode = %v; want %v", q.name, msg.Header.RCode, q.rcode)
+		}
+		if len(msg.Authorities) != 1 || msg.Authorities[0].Header.TTL != 241 {
+			t.Errorf("%s: authorities = %+v; want SOA with TTL 241", q.name, msg.Authorities)
+		}
+	}
+
+	now = now.Add(time.Second)
+	if _, ok := c.get(cacheQuery(t, 1, "nx.example.com.", dns.TypeA)); ok {
+		t.Errorf("hit for expired negative response")
+	}
+}
+
+func TestResponseCacheEviction(t *testing.T) {
+	c := newResponseCache(2)
+	for _, name := range []string{"a.example.", "b.example.", "c.example."} {
+		c.put(cacheResponse(t, name, dns.TypeA, dns.RCodeSuccess, []dns.Resource{
+			aRecord(name, 60, [4]byte{1, 2, 3, 4}),
+		}, nil))
+		if name == "b.example." {
+			// Make a.example. the most recently used.
+			if _, ok := c.get(cacheQuery(t, 1, "a.example.", dns.TypeA)); !ok {
+				t.Fatalf("a.example.: miss; want hit")
+			}
+		}
+	}
+	for name, want := range map[string]bool{"a.example.": true, "b.example.": false, "c.example.": true} {
+		if _, ok := c.get(cacheQuery(t, 1, name, dns.TypeA)); ok != want {
+			t.Errorf("%s: hit = %v; want %v", name, ok, want)
+		}
+	}
+
+	c.flush()
+	if n := c.size(); n != 0 {
+		t.Errorf("size = %d after flush; want 0", n)
+	}
+}
+
+func TestForwardCache(t *testing.T) {
+	tstest.ResourceCheck(t)
+
+	var queries int32
+	upstream := serveDNSHandler(t, countingResolveToIPv4(testipv4, 60, &queries))
+
+	r := NewResolver(ResolverConfig{Logf: t.Logf, Forward: true})
+	r.SetMap(dnsMap)
+	r.SetUpstreams([]net.Addr{upstream})
+	if err := r.Start(); err != nil {
+		t.Fatalf("start: %v", err)
+	}
+	defer r.Close()
+
+	query := func() {
+		t.Helper()
+		payload, err := syncRespond(r, dnspacket("cached.site.", dns.TypeA))
+		if err != nil {
+			t.Fatalf("err = %v; want nil", err)
+		}
+		response, err := unpackResponse(payload)
+		if err != nil {
+			t.Fatalf("extract: err = %v; want nil (in %x)", err, payload)
+		}
+		if want := (dnsResponse{ip: testipv4, rcode: dns.RCodeSuccess}); response != want {
+			t.Errorf("response = %+v; want %+v", response, want)
+		}
+	}
+
+	hits := metricCacheHitPositive.Value()
+	query()
+	query()
+	if n := atomic.LoadInt32(&queries); n != 1 {
+		t.Errorf("upstream got %d queries; want 1", n)
+	}
+	if got := metricCacheHitPositive.Value() - hits; got != 1 {
+		t.Errorf("cache hits = %d; want 1", got)
+	}
+
+	r.FlushCache()
+	query()
+	if n := atomic.LoadInt32(&queries); n != 2 {
+		t.Errorf("upstream got %d queries after flush; want 2", n)
+	}
+}
@@ -11,16 +11,21 @@ import (
 	"errors"
 	"fmt"
 	"hash/crc32"
+	"io"
 	"math/rand"
 	"net"
 	"os"
+	"sort"
+	"strings"
 	"sync"
 	"time"
 
+	dns "golang.org/x/net/dns/dnsmessage"
 	"inet.af/netaddr"
 	"tailscale.com/logtail/backoff"
 	"tailscale.com/net/netns"
 	"tailscale.com/types/logger"
+	"tailscale.com/util/dnsname"
 )
 
 // headerBytes is the number of bytes in a DNS message header.
@@ -29,11 +34,19 @@ const headerBytes = 12
 // connCount is the number of UDP connections to use for forwarding.
 const connCount = 32
 
+// maxUDPResponseBytes is the maximum size of a UDP response from an upstream.
+// Upstreams may send responses larger than maxResponseBytes
+// if the query advertises a larger EDNS buffer size.
+const maxUDPResponseBytes = 4096
+
 const (
 	// cleanupInterval is the interval between purged of timed-out entries from txMap.
 	cleanupInterval = 30 * time.Second
 	// responseTimeout is the maximal amount of time to wait for a DNS response.
 	responseTimeout = 5 * time.Second
+	// fallbackTimeout is how long to wait for a response from the upstreams
+	// of a route before falling back to the default upstreams.
+	fallbackTimeout = time.Second
 )
 
 var errNoUpstreams = errors.New("upstream nameservers not set")
@@ -43,6 +56,32 @@ var aLongTimeAgo = time.Unix(0, 1)
 type forwardingRecord struct {
 	src       netaddr.IPPort
 	createdAt time.Time
+	query     []byte
+	// responses is where to deliver the response.
+	responses chan<- Packet
+
+	// fallback are the upstreams to resend query to if the route's
+	// upstreams fail. It is nil if there is no fallback,
+	// or if it has already been used.
+	fallback []net.Addr
+	// fellBackTo are the upstreams the query was resent to on falling back,
+	// if it has. Failures from other upstreams are then ignored,
+	// as the fallback upstreams have taken over the query.
+	fellBackTo []net.Addr
+	// timer triggers the fallback if no response arrives in time.
+	timer *time.Timer
+	// tcp is whether the query is being retried over TCP
+	// after a truncated response.
+	tcp bool
+	// transport is what the query arrived over, for the query log.
+	transport string
+}
+
+// stopTimer stops the fallback timer of rec, if any.
+func (rec forwardingRecord) stopTimer() {
+	if rec.timer != nil {
+		rec.timer.Stop()
+	}
 }
 
 // txid identifies a DNS transaction.
@@ -106,6 +145,10 @@ type forwarder struct {
 
 	// responses is a channel by which responses are returned.
 	responses chan Packet
+	// cache, if non-nil, stores the responses.
+	cache *responseCache
+	// queryLog, if non-nil, records the forwarded queries.
+	queryLog *queryLog
 	// closed signals all goroutines to stop.
 	closed chan struct{}
 	// wg signals when all goroutines have stopped.
@@ -115,9 +158,16 @@ type forwarder struct {
 	// A random one is selected for each request, regardless of the target upstream.
 	conns []*fwdConn
 
+	// fallbackDelay is how long to wait for the upstreams of a route
+	// before falling back. It is fallbackTimeout, except in tests.
+	fallbackDelay time.Duration
+
 	mu sync.Mutex
-	// upstreams are the nameserver addresses that should be used for forwarding.
+	// upstreams are the nameserver addresses that should be used for forwarding
+	// names that match no route.
 	upstreams []net.Addr
+	// routes are the split DNS routes, longest suffix first.
+	routes []Route
 	// txMap maps DNS txids to active forwarding records.
 	txMap map[txid]forwardingRecord
 }
@@ -126,13 +176,17 @@ func init() {
 	rand.Seed(time.Now().UnixNano())
 }
 
-func newForwarder(logf logger.Logf, responses chan Packet) *forwarder {
+func newForwarder(logf logger.Logf, responses chan Packet, cache *responseCache, queryLog *queryLog) *forwarder {
 	return &forwarder{
 		logf:      logger.WithPrefix(logf, "forward: "),
 		responses: responses,
+		cache:     cache,
+		queryLog:  queryLog,
 		closed:    make(chan struct{}),
 		conns:     make([]*fwdConn, connCount),
 		txMap:     make(map[txid]forwardingRecord),
+
+		fallbackDelay: fallbackTimeout,
 	}
 }
 
@@ -156,6 +210,12 @@ func (f *forwarder) Close() {
 	}
 	close(f.closed)
 
+	f.mu.Lock()
+	for _, rec := range f.txMap {
+		rec.stopTimer()
+	}
+	f.mu.Unlock()
+
 	for _, conn := range f.conns {
 		conn.close()
 	}
@@ -169,6 +229,39 @@ func (f *forwarder) setUpstreams(upstreams []net.Addr) {
 	f.mu.Unlock()
 }
 
+func (f *forwarder) setRoutes(routes []Route) {
+	for i := range routes {
+		routes[i].Suffix = canonicalSuffix(routes[i].Suffix)
+	}
+	sort.SliceStable(routes, func(i, j int) bool {
+		return len(routes[i].Suffix) > len(routes[j].Suffix)
+	})
+
+	f.mu.Lock()
+	f.routes = routes
+	f.mu.Unlock()
+}
+
+// upstreamsLocked returns the upstreams to forward queries for name to,
+// as chosen by the route with the longest matching suffix,
+// and the upstreams to fall back to if those fail.
+// f.mu must be held.
+func (f *forwarder) upstreamsLocked(name string) (upstreams, fallback []net.Addr) {
+	for _, route := range f.routes {
+		if !inSuffix(name, route.Suffix) {
+			continue
+		}
+		if !route.Fallback {
+			return route.Upstreams, nil
+		}
+		if len(route.Upstreams) == 0 {
+			return f.upstreams, nil
+		}
+		return route.Upstreams, f.upstreams
+	}
+	return f.upstreams, nil
+}
+
 // send sends packet to dst. It is best effort.
 func (f *forwarder) send(packet []byte, dst net.Addr) {
 	connIdx := rand.Intn(connCount)
@@ -185,8 +278,8 @@ func (f *forwarder) recv(conn *fwdConn) {
 			return
 		default:
 		}
-		out := make([]byte, maxResponseBytes)
-		n := conn.read(out)
+		out := make([]byte, maxUDPResponseBytes)
+		n, from := conn.read(out)
 		if n == 0 {
 			continue
 		}
@@ -206,21 +299,124 @@ func (f *forwarder) recv(conn *fwdConn) {
 			f.mu.Unlock()
 			continue
 		}
+		if isTruncated(out) {
+			// The answer didn't fit in a UDP packet. Ask the same upstream
+			// over TCP, unless another truncated answer got there first.
+			if !record.tcp {
+				record.stopTimer()
+				record.fallback = nil
+				record.tcp = true
+				f.txMap[txid] = record
+				f.wg.Add(1)
+				go f.forwardTCP(txid, record, from, out)
+			}
+			f.mu.Unlock()
+			continue
+		}
+		if record.fallback != nil && isFailure(out) {
+			// The route's upstreams can't answer; ask the fallback ones
+			// instead of returning the failure.
+			record.stopTimer()
+			f.mu.Unlock()
+			f.fallBack(txid, record.createdAt)
+			continue
+		}
+		if record.fellBackTo != nil && isFailure(out) && !containsAddr(record.fellBackTo, from) {
+			// A late failure from the route's upstreams.
+			f.mu.Unlock()
+			continue
+		}
 		delete(f.txMap, txid)
+		record.stopTimer()
 
 		f.mu.Unlock()
 
-		packet := Packet{
-			Payload: out,
-			Addr:    record.src,
+		if !f.deliver(record, from, out) {
+			return
 		}
+	}
+}
+
+// deliver caches the response out to the query of record, sent by upstream,
+// and returns it to the querier. It reports false if the forwarder was closed first.
+func (f *forwarder) deliver(record forwardingRecord, upstream net.Addr, out []byte) bool {
+	if f.cache != nil {
+		f.cache.put(out)
+	}
+	f.queryLog.record(QueryLogEntry{
+		Time:       record.createdAt,
+		Source:     record.src,
+		Transport:  record.transport,
+		Resolution: resolvedForward,
+		Upstream:   upstream.String(),
+	}, record.query, out, nil)
+	packet := Packet{
+		Payload: out,
+		Addr:    record.src,
+	}
+	select {
+	case <-f.closed:
+		return false
+	case record.responses <- packet:
+		return true
+	}
+}
+
+// forwardTCP retries the query of record, identified by txid,
+// over TCP to upstream, which sent the truncated response truncated over UDP.
+// It delivers the TCP response, or truncated if the retry fails.
+func (f *forwarder) forwardTCP(txid txid, record forwardingRecord, upstream net.Addr, truncated []byte) {
+	defer f.wg.Done()
+
+	out, err := f.exchangeTCP(record.query, upstream)
+	if err != nil {
+		f.logf("tcp: %v", err)
+		// The truncated response is still useful:
+		// it tells the client to try TCP itself.
+		out = truncated
+	}
+
+	f.mu.Lock()
+	current, found := f.txMap[txid]
+	if !found || !current.createdAt.Equal(record.createdAt) {
+		f.mu.Unlock()
+		return
+	}
+	delete(f.txMap, txid)
+	f.mu.Unlock()
+
+	f.deliver(record, upstream, out)
+}
+
+// exchangeTCP sends query to upstream over TCP and returns its response.
+func (f *forwarder) exchangeTCP(query []byte, upstream net.Addr) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), responseTimeout)
+	defer cancel()
+	// Abandon the exchange if the forwarder closes.
+	go func() {
 		select {
 		case <-f.closed:
-			return
-		case f.responses <- packet:
-			// continue
+			cancel()
+		case <-ctx.Done():
 		}
+	}()
+
+	conn, err := netns.NewDialer().DialContext(ctx, "tcp", upstream.String())
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	deadline, _ := ctx.Deadline()
+	conn.SetDeadline(deadline)
+	go func() {
+		<-ctx.Done()
+		conn.SetDeadline(aLongTimeAgo)
+	}()
+
+	if err := writeTCPMessage(conn, query); err != nil {
+		return nil, err
 	}
+	return readTCPMessage(conn)
 }
 
 // cleanMap periodically deletes timed-out forwarding records from f.txMap to bound growth.
@@ -239,31 +435,66 @@ func (f *forwarder) cleanMap() {
 			// continue
 		}
 
+		var expired []forwardingRecord
 		f.mu.Lock()
 		for k, v := range f.txMap {
 			if now.Sub(v.createdAt) > responseTimeout {
+				v.stopTimer()
 				delete(f.txMap, k)
+				expired = append(expired, v)
 			}
 		}
 		f.mu.Unlock()
+
+		for _, v := range expired {
+			f.queryLog.record(QueryLogEntry{
+				Time:       v.createdAt,
+				Source:     v.src,
+				Transport:  v.transport,
+				Resolution: resolvedForward,
+				Duration:   responseTimeout,
+			}, v.query, nil, errTimeout)
+		}
 	}
 }
 
-// forward forwards the query to all upstream nameservers and returns the first response.
+// forward forwards the query, received over UDP, to all upstream nameservers
+// of the route the queried name belongs to and returns the first response.
 func (f *forwarder) forward(query Packet) error {
+	return f.forwardTo(query, f.responses, transportUDP)
+}
+
+// forwardTo is like forward, but delivers the response to responses,
+// and logs the query as received over transport.
+// The channel must be buffered if nothing else is guaranteed to receive from it.
+func (f *forwarder) forwardTo(query Packet, responses chan<- Packet, transport string) error {
 	txid := getTxID(query.Payload)
+	// A query we can't parse isn't routed, but the upstreams
+	// may still know what to make of it.
+	name, _ := questionName(query.Payload)
 
 	f.mu.Lock()
 
-	upstreams := f.upstreams
+	upstreams, fallback := f.upstreamsLocked(name)
 	if len(upstreams) == 0 {
 		f.mu.Unlock()
 		return errNoUpstreams
 	}
-	f.txMap[txid] = forwardingRecord{
+	record := forwardingRecord{
 		src:       query.Addr,
 		createdAt: time.Now(),
+		query:     query.Payload,
+		responses: responses,
+		transport: transport,
 	}
+	if len(fallback) > 0 {
+		record.fallback = fallback
+		createdAt := record.createdAt
+		record.timer = time.AfterFunc(f.fallbackDelay, func() {
+			f.fallBack(txid, createdAt)
+		})
+	}
+	f.txMap[txid] = record
 
 	f.mu.Unlock()
 
@@ -274,6 +505,109 @@ func (f *forwarder) forward(query Packet) error {
 	return nil
 }
 
+// fallBack resends the query of the forwarding record for txid,
+// created at createdAt, to its fallback upstreams,
+// unless it has been answered or has already fallen back.
+func (f *forwarder) fallBack(txid txid, createdAt time.Time) {
+	f.mu.Lock()
+	record, found := f.txMap[txid]
+	if !found || record.fallback == nil || !record.createdAt.Equal(createdAt) {
+		f.mu.Unlock()
+		return
+	}
+	upstreams, query := record.fallback, record.query
+	record.fallback = nil
+	record.fellBackTo = upstreams
+	f.txMap[txid] = record
+	f.mu.Unlock()
+
+	f.logf("[v1] falling back to default upstreams")
+	for _, upstream := range upstreams {
+		f.send(query, upstream)
+	}
+}
+
+// containsAddr reports whether addrs contains addr.
+func containsAddr(addrs []net.Addr, addr net.Addr) bool {
+	for _, a := range addrs {
+		if a.String() == addr.String() {
+			return true
+		}
+	}
+	return false
+}
+
+// isTruncated reports whether the DNS response in packet has the TC bit set.
+func isTruncated(packet []byte) bool {
+	return len(packet) >= headerBytes && packet[2]&0x02 != 0
+}
+
+// readTCPMessage reads a DNS message from r,
+// framed with a two-byte length prefix as in RFC 1035, section 4.2.2.
+func readTCPMessage(r io.Reader) ([]byte, error) {
+	var length [2]byte
+	if _, err := io.ReadFull(r, length[:]); err != nil {
+		return nil, err
+	}
+	msg := make([]byte, binary.BigEndian.Uint16(length[:]))
+	if _, err := io.ReadFull(r, msg); err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
+
+// writeTCPMessage writes the DNS message msg to w,
+// framed with a two-byte length prefix as in RFC 1035, section 4.2.2.
+func writeTCPMessage(w io.Writer, msg []byte) error {
+	if len(msg) > 0xffff {
+		return errors.New("DNS message too large for TCP")
+	}
+	buf := make([]byte, 2+len(msg))
+	binary.BigEndian.PutUint16(buf, uint16(len(msg)))
+	copy(buf[2:], msg)
+	_, err := w.Write(buf)
+	return err
+}
+
+// isFailure reports whether the DNS response in packet indicates
+// that the nameserver could not or would not answer.
+func isFailure(packet []byte) bool {
+	if len(packet) < headerBytes {
+		return true
+	}
+	switch dns.RCode(packet[3] & 0x0f) {
+	case dns.RCodeServerFailure, dns.RCodeRefused:
+		return true
+	}
+	return false
+}
+
+// questionName returns the name in the first question of the DNS query in packet,
+// in lowercase canonical form.
+func questionName(packet []byte) (string, error) {
+	var parser dns.Parser
+	if _, err := parser.Start(packet); err != nil {
+		return "", err
+	}
+	q, err := parser.Question()
+	if err != nil {
+		return "", err
+	}
+	return strings.ToLower(q.Name.String()), nil
+}
+
+// canonicalSuffix returns suffix in lowercase canonical form (with a trailing period).
+func canonicalSuffix(suffix string) string {
+	suffix = strings.ToLower(strings.Trim(suffix, "."))
+	return suffix + "."
+}
+
+// inSuffix reports whether name is suffix or a subdomain of it.
+// Both must be in lowercase canonical form.
+func inSuffix(name, suffix string) bool {
+	return suffix == "." || name == suffix || dnsname.HasSuffix(name, suffix)
+}
+
 // A fwdConn manages a single connection used to forward DNS requests.
 // Net link changes can cause a *net.UDPConn to become permanently unusable, particularly on macOS.
 // fwdConn detects such situations and transparently creates new connections.
@@ -385,8 +719,8 @@ func (c *fwdConn) send(packet []byte, dst net.Addr) {
 
 // read waits for a response from c's connection.
 // It returns the number of bytes read, which may be 0
-// in case of an error or a closed connection.
-func (c *fwdConn) read(out []byte) int {
+// in case of an error or a closed connection, and the sender's address.
+func (c *fwdConn) read(out []byte) (int, net.Addr) {
 	for {
 		// Gather the current connection.
 		// We can't hold the lock while we call ReadFrom.
@@ -395,7 +729,7 @@ func (c *fwdConn) read(out []byte) int {
 		closed := c.closed
 		if closed {
 			c.mu.Unlock()
-			return 0
+			return 0, nil
 		}
 		if conn == nil {
 			// There is no current connection.
@@ -407,11 +741,11 @@ func (c *fwdConn) read(out []byte) int {
 		c.mu.Unlock()
 
 		c.wg.Add(1)
-		n, _, err := conn.ReadFrom(out)
+		n, from, err := conn.ReadFrom(out)
 		c.wg.Done()
 		if err == nil {
 			// Success.
-			return n
+			return n, from
 		}
 		if errors.Is(err, os.ErrDeadlineExceeded) {
 			// We intentionally closed this connection.
@@ -420,7 +754,7 @@ func (c *fwdConn) read(out []byte) int {
 		}
 
 		c.logf("read: unrecognized error: %v", err)
-		return 0
+		return 0, nil
 	}
 }
 
@@ -5,24 +5,93 @@
 package tsdns
 
 import (
+	"fmt"
+	"hash/crc32"
 	"sort"
+	"strconv"
 	"strings"
 
 	"inet.af/netaddr"
+	"tailscale.com/net/tsaddr"
 )
 
+// Records are the DNS records of one name in a Map.
+type Records struct {
+	// IPs are the addresses of the name, served as A and AAAA records.
+	IPs []netaddr.IP
+	// SRV are the service records of the name.
+	// For example, _ssh._tcp.monitoring.tailscale.us has an SRV record
+	// pointing at monitoring.tailscale.us, port 22.
+	SRV []SRV
+	// TXT are the text records of the name, one string per record.
+	TXT []string
+}
+
+// SRV is the data of an SRV record, as described in RFC 2782.
+type SRV struct {
+	Priority uint16
+	Weight   uint16
+	Port     uint16
+	// Target is the name of the host providing the service,
+	// in canonical form (with a trailing period).
+	Target string
+}
+
+func (r Records) isEmpty() bool {
+	return len(r.IPs) == 0 && len(r.SRV) == 0 && len(r.TXT) == 0
+}
+
+// ipv4 returns the IPv4 addresses in r.IPs, which must be sorted.
+func (r Records) ipv4() []netaddr.IP {
+	for i, ip := range r.IPs {
+		if !ip.Is4() {
+			return r.IPs[:i]
+		}
+	}
+	return r.IPs
+}
+
+// ipv6 returns the IPv6 addresses in r.IPs, which must be sorted.
+func (r Records) ipv6() []netaddr.IP {
+	for i, ip := range r.IPs {
+		if ip.Is6() {
+			return r.IPs[i:]
+		}
+	}
+	return nil
+}
+
+// lines returns the records of name formatted one per line, for Pretty.
+func (r Records) lines(name string) []string {
+	var ret []string
+	for _, ip := range r.IPs {
+		ret = append(ret, name+"\t"+ip.String())
+	}
+	for _, srv := range r.SRV {
+		ret = append(ret, fmt.Sprintf("%s\tSRV %d %d %d %s", name, srv.Priority, srv.Weight, srv.Port, srv.Target))
+	}
+	for _, txt := range r.TXT {
+		ret = append(ret, name+"\tTXT "+strconv.Quote(txt))
+	}
+	return ret
+}
+
 // Map is all the data Resolver needs to resolve DNS queries within the Tailscale network.
 type Map struct {
-	// nameToIP is a mapping of Tailscale domain names to their IP addresses.
+	// nameToRecords is a mapping of Tailscale domain names to their records.
 	// For example, monitoring.tailscale.us -> 100.64.0.1.
-	nameToIP map[string]netaddr.IP
-	// ipToName is the inverse of nameToIP.
+	// The IPs of each name are sorted, IPv4 addresses first.
+	nameToRecords map[string]Records
+	// ipToName is the inverse of the IPs in nameToRecords.
 	ipToName map[netaddr.IP]string
-	// names are the keys of nameToIP in sorted order.
+	// names are the keys of nameToRecords in sorted order.
 	names []string
 	// rootDomains are the domains whose subdomains should always
 	// be resolved locally to prevent leakage of sensitive names.
 	rootDomains []string // e.g. "user.provider.beta.tailscale.net."
+	// zones are the zones the Map is authoritative for:
+	// rootDomains, then the reverse zones of Tailscale's address ranges.
+	zones []*zone
 }
 
 // NewMap returns a new Map with name to address mapping given by nameToIP.
@@ -31,68 +100,126 @@ type Map struct {
 // resolved locally to prevent leakage of sensitive names. They should
 // end in a period ("user-foo.tailscale.net.").
 func NewMap(initNameToIP map[string]netaddr.IP, rootDomains []string) *Map {
-	// TODO(dmytro): we have to allocate names and ipToName, but nameToIP can be avoided.
+	records := make(map[string]Records, len(initNameToIP))
+	for name, ip := range initNameToIP {
+		records[name] = Records{IPs: []netaddr.IP{ip}}
+	}
+	return NewMapFromRecords(records, rootDomains)
+}
+
+// NewMapFromRecords returns a new Map serving the given records.
+// Names without any records are ignored.
+//
+// rootDomains are as in NewMap. The Map is authoritative for them and,
+// if there are any, for the reverse zones of Tailscale's address ranges:
+// it synthesizes their SOA and NS records, and adds their SOA record
+// to negative answers. The nameserver of these zones is named
+// "magicdns." followed by the first root domain, and resolves to
+// 100.100.100.100 unless initRecords has records for that name.
+// The serial number of the zones is a checksum of the Map's records.
+func NewMapFromRecords(initRecords map[string]Records, rootDomains []string) *Map {
+	// TODO(dmytro): we have to allocate names and ipToName, but nameToRecords can be avoided.
 	// It is here because control sends us names not in canonical form. Change this.
-	names := make([]string, 0, len(initNameToIP))
-	nameToIP := make(map[string]netaddr.IP, len(initNameToIP))
-	ipToName := make(map[netaddr.IP]string, len(initNameToIP))
+	names := make([]string, 0, len(initRecords))
+	nameToRecords := make(map[string]Records, len(initRecords))
+	ipToName := make(map[netaddr.IP]string, len(initRecords))
 
-	for name, ip := range initNameToIP {
-		if len(name) == 0 {
+	for name, rec := range initRecords {
+		if len(name) == 0 || rec.isEmpty() {
 			// Nothing useful can be done with empty names.
 			continue
 		}
 		if name[len(name)-1] != '.' {
 			name += "."
 		}
+		ips := append([]netaddr.IP(nil), rec.IPs...)
+		sort.Slice(ips, func(i, j int) bool { return ips[i].Less(ips[j]) })
+		rec.IPs = ips
+
 		names = append(names, name)
-		nameToIP[name] = ip
-		ipToName[ip] = name
+		nameToRecords[name] = rec
+		for _, ip := range ips {
+			ipToName[ip] = name
+		}
+	}
+	if nsName := nameserverName(rootDomains); nsName != "" {
+		if _, ok := nameToRecords[nsName]; !ok {
+			serviceIP := tsaddr.TailscaleServiceIP()
+			names = append(names, nsName)
+			nameToRecords[nsName] = Records{IPs: []netaddr.IP{serviceIP}}
+			if _, ok := ipToName[serviceIP]; !ok {
+				ipToName[serviceIP] = nsName
+			}
+		}
 	}
 	sort.Strings(names)
 
-	return &Map{
-		nameToIP: nameToIP,
-		ipToName: ipToName,
-		names:    names,
+	m := &Map{
+		nameToRecords: nameToRecords,
+		ipToName:      ipToName,
+		names:         names,
 
 		rootDomains: rootDomains,
 	}
+	m.zones = newZones(rootDomains, crc32.ChecksumIEEE([]byte(m.Pretty())))
+	return m
 }
 
-func printSingleNameIP(buf *strings.Builder, name string, ip netaddr.IP) {
-	buf.WriteString(name)
-	buf.WriteByte('\t')
-	buf.WriteString(ip.String())
-	buf.WriteByte('\n')
+// zoneOf returns the zone containing name, which must be in
+// canonical form and lowercase, or nil if it is not in any of m's zones.
+func (m *Map) zoneOf(name string) *zone {
+	for _, z := range m.zones {
+		if z.contains(name) {
+			return z
+		}
+	}
+	return nil
+}
+
+func printLines(buf *strings.Builder, prefix string, lines []string) {
+	for _, line := range lines {
+		buf.WriteString(prefix)
+		buf.WriteString(line)
+		buf.WriteByte('\n')
+	}
 }
 
 func (m *Map) Pretty() string {
 	buf := new(strings.Builder)
 	for _, name := range m.names {
-		printSingleNameIP(buf, name, m.nameToIP[name])
+		printLines(buf, "", m.nameToRecords[name].lines(name))
 	}
 	return buf.String()
 }
 
 func (m *Map) PrettyDiffFrom(old *Map) string {
 	var (
-		oldNameToIP map[string]netaddr.IP
-		newNameToIP map[string]netaddr.IP
-		oldNames    []string
-		newNames    []string
+		oldNameToRecords map[string]Records
+		newNameToRecords map[string]Records
+		oldNames         []string
+		newNames         []string
 	)
 	if old != nil {
-		oldNameToIP = old.nameToIP
+		oldNameToRecords = old.nameToRecords
 		oldNames = old.names
 	}
 	if m != nil {
-		newNameToIP = m.nameToIP
+		newNameToRecords = m.nameToRecords
 		newNames = m.names
 	}
 
 	buf := new(strings.Builder)
 
+	diffName := func(name string) {
+		oldLines := oldNameToRecords[name].lines(name)
+		newLines := newNameToRecords[name].lines(name)
+		if strings.Join(oldLines, "\n") == strings.Join(newLines, "\n") {
+			return
+		}
+		printLines(buf, "-", oldLines)
+		printLines(buf, "+", newLines)
+	}
+
 	for len(oldNames) > 0 && len(newNames) > 0 {
 		var name string
 
@@ -109,36 +236,15 @@ func (m *Map) PrettyDiffFrom(old *Map) string {
 			oldNames = oldNames[1:]
 			newNames = newNames[1:]
 		}
-
-		ipOld, inOld := oldNameToIP[name]
-		ipNew, inNew := newNameToIP[name]
-		switch {
-		case !inOld:
-			buf.WriteByte('+')
-			printSingleNameIP(buf, name, ipNew)
-		case !inNew:
-			buf.WriteByte('-')
-			printSingleNameIP(buf, name, ipOld)
-		case ipOld != ipNew:
-			buf.WriteByte('-')
-			printSingleNameIP(buf, name, ipOld)
-			buf.WriteByte('+')
-			printSingleNameIP(buf, name, ipNew)
-		}
+		diffName(name)
 	}
 
 	for _, name := range oldNames {
-		if _, ok := newNameToIP[name]; !ok {
-			buf.WriteByte('-')
-			printSingleNameIP(buf, name, oldNameToIP[name])
-		}
+		diffName(name)
 	}
 
 	for _, name := range newNames {
-		if _, ok := oldNameToIP[name]; !ok {
-			buf.WriteByte('+')
-			printSingleNameIP(buf, name, newNameToIP[name])
-		}
+		diffName(name)
 	}
 
 	return buf.String()
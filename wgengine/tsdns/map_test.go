@@ -32,6 +32,25 @@ func TestPretty(t *testing.T) {
 			}, nil),
 			"test1.domain.\t100.101.102.103\ntest2.sub.domain.\t100.99.9.1\n",
 		},
+
+		{
+			"records",
+			NewMapFromRecords(map[string]Records{
+				"hello.ipn.dev.": {IPs: []netaddr.IP{
+					netaddr.MustParseIP("fd7a:115c:a1e0::1"),
+					netaddr.IPv4(100, 101, 102, 103),
+				}},
+				"_ssh._tcp.hello.ipn.dev.": {
+					SRV: []SRV{{Port: 22, Target: "hello.ipn.dev."}},
+					TXT: []string{"description=sshd"},
+				},
+				"empty.ipn.dev.": {},
+			}, nil),
+			"_ssh._tcp.hello.ipn.dev.\tSRV 0 0 22 hello.ipn.dev.\n" +
+				"_ssh._tcp.hello.ipn.dev.\tTXT \"description=sshd\"\n" +
+				"hello.ipn.dev.\t100.101.102.103\n" +
+				"hello.ipn.dev.\tfd7a:115c:a1e0::1\n",
+		},
 	}
 
 	for _, tt := range tests {
@@ -125,6 +144,22 @@ func TestPrettyDiffFrom(t *testing.T) {
 				"-test2.ipn.dev.\t100.103.102.101\n+test2.ipn.dev.\t100.104.102.101\n" +
 				"+test3.ipn.dev.\t100.64.1.1\n-test4.ipn.dev.\t100.107.106.105\n-test5.ipn.dev.\t100.64.1.1\n",
 		},
+		{
+			"added_records",
+			NewMap(map[string]netaddr.IP{
+				"test1.ipn.dev.": netaddr.IPv4(100, 101, 102, 103),
+			}, nil),
+			NewMapFromRecords(map[string]Records{
+				"test1.ipn.dev.": {IPs: []netaddr.IP{
+					netaddr.IPv4(100, 101, 102, 103),
+					netaddr.MustParseIP("fd7a:115c:a1e0::1"),
+				}},
+				"_ssh._tcp.test1.ipn.dev.": {SRV: []SRV{{Port: 22, Target: "test1.ipn.dev."}}},
+			}, nil),
+			"+_ssh._tcp.test1.ipn.dev.\tSRV 0 0 22 test1.ipn.dev.\n" +
+				"-test1.ipn.dev.\t100.101.102.103\n" +
+				"+test1.ipn.dev.\t100.101.102.103\n+test1.ipn.dev.\tfd7a:115c:a1e0::1\n",
+		},
 	}
 
 	for _, tt := range tests {
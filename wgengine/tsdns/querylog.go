@@ -0,0 +1,169 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package tsdns
+
+import (
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	dns "golang.org/x/net/dns/dnsmessage"
+	"inet.af/netaddr"
+)
+
+// How a query was resolved, as in QueryLogEntry.Resolution.
+const (
+	resolvedLocally = "local"     // from the DNS map
+	resolvedCached  = "cached"    // from the cache of upstream responses
+	resolvedForward = "forwarded" // by an upstream nameserver
+)
+
+// Transports a query can arrive over, as in QueryLogEntry.Transport.
+const (
+	transportUDP   = "udp"   // enqueued with EnqueueRequest
+	transportTCP   = "tcp"   // received by HandleTCPConn
+	transportQuery = "query" // sent with Resolver.Query
+)
+
+// QueryLogEntry is a record of one query handled by a Resolver.
+type QueryLogEntry struct {
+	// Seq is the entry's sequence number. It increases by one for
+	// each query the log records.
+	Seq uint64
+	// Time is when the query arrived.
+	Time time.Time
+
+	Source    netaddr.IPPort // the querier, if known
+	Transport string         // "udp", "tcp", or "query" for Resolver.Query
+	Name      string         // the queried name, or empty if the query is malformed
+	Type      string         // the queried type, as in "AAAA" or "TYPE65"
+
+	// Resolution is how the query was resolved: "local" from the DNS map,
+	// "cached" from the cache of upstream responses,
+	// or "forwarded" to an upstream nameserver.
+	Resolution string
+	// Upstream is the address of the nameserver that answered
+	// a forwarded query, if any.
+	Upstream string
+	// RCode is the response code, as in "NXDOMAIN", or empty if there
+	// was no response.
+	RCode    string
+	Duration time.Duration
+	// Err is why there was no response, if there wasn't.
+	Err string `json:",omitempty"`
+}
+
+// queryLog retains the most recent QueryLogEntries in a ring buffer.
+// It is disabled, recording nothing, until it is given a size.
+//
+// It is safe for concurrent use.
+type queryLog struct {
+	enabled int32 // atomic; whether ring is non-empty
+
+	mu   sync.Mutex
+	ring []QueryLogEntry
+	seq  uint64 // Seq of the most recent entry
+}
+
+// setSize sets the number of entries l retains, discarding
+// the ones it has. A size of zero disables the log.
+func (l *queryLog) setSize(size int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if size <= 0 {
+		l.ring = nil
+		atomic.StoreInt32(&l.enabled, 0)
+		return
+	}
+	l.ring = make([]QueryLogEntry, size)
+	l.seq = 0
+	atomic.StoreInt32(&l.enabled, 1)
+}
+
+// record logs the handling of query, if l is enabled.
+// ent has the fields that only the caller knows:
+// Time, Source, Transport, Resolution and Upstream,
+// and Duration if it isn't the time since Time.
+// out is the response, if there is one; otherwise err is why not.
+func (l *queryLog) record(ent QueryLogEntry, query, out []byte, err error) {
+	if l == nil || atomic.LoadInt32(&l.enabled) == 0 {
+		return
+	}
+	if ent.Duration == 0 {
+		ent.Duration = time.Since(ent.Time)
+	}
+	var parser dns.Parser
+	if _, perr := parser.Start(query); perr == nil {
+		if q, perr := parser.Question(); perr == nil {
+			ent.Name = q.Name.String()
+			ent.Type = typeString(q.Type)
+		}
+	}
+	if len(out) >= headerBytes {
+		ent.RCode = rcodeString(dns.RCode(out[3] & 0x0f))
+	}
+	if err != nil {
+		ent.Err = err.Error()
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if len(l.ring) == 0 {
+		return
+	}
+	l.seq++
+	ent.Seq = l.seq
+	l.ring[l.seq%uint64(len(l.ring))] = ent
+}
+
+// entries returns the retained entries with a Seq greater than since,
+// oldest first.
+func (l *queryLog) entries(since uint64) []QueryLogEntry {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	var ret []QueryLogEntry
+	n := uint64(len(l.ring))
+	if n == 0 {
+		return nil
+	}
+	first := since + 1
+	if l.seq > n && first < l.seq-n+1 {
+		first = l.seq - n + 1
+	}
+	for seq := first; seq <= l.seq; seq++ {
+		ret = append(ret, l.ring[seq%n])
+	}
+	return ret
+}
+
+// typeString returns the conventional name of DNS type t,
+// as in "AAAA", or "TYPE" followed by its number if it has none.
+func typeString(t dns.Type) string {
+	s := t.String()
+	if strings.HasPrefix(s, "Type") {
+		return s[len("Type"):]
+	}
+	return "TYPE" + strconv.Itoa(int(t))
+}
+
+var rcodeNames = map[dns.RCode]string{
+	dns.RCodeSuccess:        "NOERROR",
+	dns.RCodeFormatError:    "FORMERR",
+	dns.RCodeServerFailure:  "SERVFAIL",
+	dns.RCodeNameError:      "NXDOMAIN",
+	dns.RCodeNotImplemented: "NOTIMP",
+	dns.RCodeRefused:        "REFUSED",
+}
+
+// rcodeString returns the conventional name of DNS response code rc,
+// as in "NXDOMAIN", or "RCODE" followed by its number if it has none.
+func rcodeString(rc dns.RCode) string {
+	if s, ok := rcodeNames[rc]; ok {
+		return s
+	}
+	return "RCODE" + strconv.Itoa(int(rc))
+}
@@ -0,0 +1,128 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package tsdns
+
+import (
+	"net"
+	"testing"
+
+	dns "golang.org/x/net/dns/dnsmessage"
+	"inet.af/netaddr"
+	"tailscale.com/tstest"
+)
+
+func TestQueryLog(t *testing.T) {
+	tstest.ResourceCheck(t)
+
+	var queries int32
+	upstream := serveDNSHandler(t, countingResolveToIPv4(testipv4, 60, &queries))
+
+	r := NewResolver(ResolverConfig{Logf: t.Logf, Forward: true})
+	r.SetMap(dnsMap)
+	r.SetUpstreams([]net.Addr{upstream})
+	if err := r.Start(); err != nil {
+		t.Fatalf("start: %v", err)
+	}
+	defer r.Close()
+
+	src := netaddr.MustParseIPPort("100.64.0.2:5353")
+	query := func(name string, tp dns.Type) {
+		t.Helper()
+		r.EnqueueRequest(Packet{Payload: dnspacket(name, tp), Addr: src})
+		if _, err := r.NextResponse(); err != nil {
+			t.Fatalf("%s: err = %v; want nil", name, err)
+		}
+	}
+
+	// Nothing is logged until the log is enabled.
+	query("test1.ipn.dev.", dns.TypeA)
+	if ents := r.QueryLog(0); len(ents) != 0 {
+		t.Fatalf("disabled log has %d entries; want 0", len(ents))
+	}
+
+	r.SetQueryLogSize(10)
+	query("test1.ipn.dev.", dns.TypeA)
+	query("test3.ipn.dev.", dns.TypeAAAA)
+	query("forwarded.site.", dns.TypeA)
+	query("forwarded.site.", dns.TypeA)
+	if _, err := r.Query(dnspacket("test2.ipn.dev.", dns.TypeAAAA)); err != nil {
+		t.Fatalf("Query: %v", err)
+	}
+
+	want := []QueryLogEntry{
+		{Seq: 1, Source: src, Transport: "udp", Name: "test1.ipn.dev.", Type: "A", Resolution: "local", RCode: "NOERROR"},
+		{Seq: 2, Source: src, Transport: "udp", Name: "test3.ipn.dev.", Type: "AAAA", Resolution: "local", RCode: "NXDOMAIN"},
+		{Seq: 3, Source: src, Transport: "udp", Name: "forwarded.site.", Type: "A", Resolution: "forwarded", Upstream: upstream.String(), RCode: "NOERROR"},
+		{Seq: 4, Source: src, Transport: "udp", Name: "forwarded.site.", Type: "A", Resolution: "cached", RCode: "NOERROR"},
+		{Seq: 5, Transport: "query", Name: "test2.ipn.dev.", Type: "AAAA", Resolution: "local", RCode: "NOERROR"},
+	}
+	ents := r.QueryLog(0)
+	if len(ents) != len(want) {
+		t.Fatalf("got %d entries; want %d: %+v", len(ents), len(want), ents)
+	}
+	for i, ent := range ents {
+		if ent.Time.IsZero() || ent.Duration <= 0 {
+			t.Errorf("entry %d: Time = %v, Duration = %v; want non-zero", i, ent.Time, ent.Duration)
+		}
+		ent.Time, ent.Duration = want[i].Time, want[i].Duration
+		if ent != want[i] {
+			t.Errorf("entry %d = %+v; want %+v", i, ent, want[i])
+		}
+	}
+
+	if ents := r.QueryLog(3); len(ents) != 2 || ents[0].Seq != 4 {
+		t.Errorf("QueryLog(3) = %+v; want entries 4 and 5", ents)
+	}
+}
+
+func TestQueryLogRing(t *testing.T) {
+	var l queryLog
+	query := dnspacket("test1.ipn.dev.", dns.TypeA)
+
+	l.setSize(3)
+	for i := 0; i < 5; i++ {
+		l.record(QueryLogEntry{Transport: "udp"}, query, nil, errTimeout)
+	}
+	ents := l.entries(0)
+	if len(ents) != 3 || ents[0].Seq != 3 || ents[2].Seq != 5 {
+		t.Fatalf("entries = %+v; want entries 3 to 5", ents)
+	}
+	if ents[0].Err != errTimeout.Error() || ents[0].RCode != "" {
+		t.Errorf("entry = %+v; want Err %q and no RCode", ents[0], errTimeout)
+	}
+	if ents := l.entries(4); len(ents) != 1 || ents[0].Seq != 5 {
+		t.Errorf("entries(4) = %+v; want entry 5", ents)
+	}
+	if ents := l.entries(5); len(ents) != 0 {
+		t.Errorf("entries(5) = %+v; want none", ents)
+	}
+
+	l.setSize(0)
+	l.record(QueryLogEntry{Transport: "udp"}, query, nil, errTimeout)
+	if ents := l.entries(0); len(ents) != 0 {
+		t.Errorf("disabled log has entries %+v", ents)
+	}
+}
+
+func TestTypeAndRCodeString(t *testing.T) {
+	for tp, want := range map[dns.Type]string{
+		dns.TypeA:    "A",
+		dns.TypeAAAA: "AAAA",
+		dns.TypeSRV:  "SRV",
+		dns.Type(65): "TYPE65",
+	} {
+		if got := typeString(tp); got != want {
+			t.Errorf("typeString(%d) = %q; want %q", tp, got, want)
+		}
+	}
+	for rc, want := range map[dns.RCode]string{
+		dns.RCodeNameError: "NXDOMAIN",
+		dns.RCode(9):       "RCODE9",
+	} {
+		if got := rcodeString(rc); got != want {
+			t.Errorf("rcodeString(%d) = %q; want %q", rc, got, want)
+		}
+	}
+}
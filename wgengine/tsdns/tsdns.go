@@ -17,10 +17,11 @@ import (
 	dns "golang.org/x/net/dns/dnsmessage"
 	"inet.af/netaddr"
 	"tailscale.com/types/logger"
-	"tailscale.com/util/dnsname"
 )
 
-// maxResponseBytes is the maximum size of a response from a Resolver.
+// maxResponseBytes is the maximum size of a response from a Resolver
+// to a queued request, as for DNS over UDP (RFC 1035, section 4.2.1).
+// Larger responses are truncated, so that clients retry over TCP.
 const maxResponseBytes = 512
 
 // queueSize is the maximal number of DNS requests that can await polling.
@@ -31,6 +32,10 @@ const queueSize = 64
 // defaultTTL is the TTL of all responses from Resolver.
 const defaultTTL = 600 * time.Second
 
+// tcpIdleTimeout is how long HandleTCPConn waits for the next query
+// on a connection before closing it.
+const tcpIdleTimeout = 10 * time.Second
+
 // ErrClosed indicates that the resolver has been closed and readers should exit.
 var ErrClosed = errors.New("closed")
 
@@ -41,6 +46,7 @@ var (
 	errNotImplemented = errors.New("query type not implemented")
 	errNotQuery       = errors.New("not a DNS query")
 	errNotOurName     = errors.New("not a Tailscale DNS name")
+	errTimeout        = errors.New("timed out waiting for upstream response")
 )
 
 // Packet represents a DNS payload together with the address of its origin.
@@ -56,11 +62,17 @@ type Packet struct {
 // Resolver is a DNS resolver for nodes on the Tailscale network,
 // associating them with domain names of the form <mynode>.<mydomain>.<root>.
 // If it is asked to resolve a domain that is not of that form,
-// it delegates to upstream nameservers if any are set.
+// it delegates to upstream nameservers if any are set,
+// choosing them by the routes set with SetRoutes.
 type Resolver struct {
 	logf logger.Logf
 	// forwarder forwards requests to upstream nameservers.
 	forwarder *forwarder
+	// cache holds the responses of upstream nameservers.
+	// It is nil if forwarding is disabled.
+	cache *responseCache
+	// queryLog records the queries the resolver handles, once enabled.
+	queryLog *queryLog
 
 	// queue is a buffered channel holding DNS requests queued for resolution.
 	queue chan Packet
@@ -79,6 +91,21 @@ type Resolver struct {
 	dnsMap *Map
 }
 
+// A Route directs the forwarding of queries for names within a DNS suffix,
+// as in split DNS.
+type Route struct {
+	// Suffix is the domain the route applies to, such as "corp.example.com.".
+	// The route matches the domain itself and all of its subdomains.
+	Suffix string
+	// Upstreams are the nameservers to forward matching queries to.
+	Upstreams []net.Addr
+	// Fallback is whether queries are retried on the default upstreams
+	// set with SetUpstreams when Upstreams fail:
+	// that is, when they answer SERVFAIL or REFUSED, or don't answer quickly.
+	// A route with Fallback and no Upstreams forwards to the default upstreams.
+	Fallback bool
+}
+
 // ResolverConfig is the set of configuration options for a Resolver.
 type ResolverConfig struct {
 	// Logf is the logger to use throughout the Resolver.
@@ -97,10 +124,12 @@ func NewResolver(config ResolverConfig) *Resolver {
 		responses: make(chan Packet),
 		errors:    make(chan error),
 		closed:    make(chan struct{}),
+		queryLog:  new(queryLog),
 	}
 
 	if config.Forward {
-		r.forwarder = newForwarder(r.logf, r.responses)
+		r.cache = newResponseCache(defaultCacheSize)
+		r.forwarder = newForwarder(r.logf, r.responses, r.cache, r.queryLog)
 	}
 
 	return r
@@ -151,10 +180,50 @@ func (r *Resolver) SetMap(m *Map) {
 func (r *Resolver) SetUpstreams(upstreams []net.Addr) {
 	if r.forwarder != nil {
 		r.forwarder.setUpstreams(upstreams)
+		// Different upstreams may have different answers.
+		r.cache.flush()
 	}
 	r.logf("set upstreams: %v", upstreams)
 }
 
+// SetRoutes sets the resolver's split DNS routes, taking ownership of the argument.
+// A query for a name that is not ours is forwarded according to the route
+// with the longest matching suffix, or to the upstreams set with SetUpstreams
+// if no route matches.
+func (r *Resolver) SetRoutes(routes []Route) {
+	if r.forwarder != nil {
+		r.forwarder.setRoutes(routes)
+		r.cache.flush()
+	}
+	r.logf("set routes: %v", routes)
+}
+
+// FlushCache removes all cached upstream responses.
+func (r *Resolver) FlushCache() {
+	if r.cache != nil {
+		r.cache.flush()
+	}
+}
+
+// SetQueryLogSize sets the number of queries the resolver keeps a record of,
+// for QueryLog. The query log is disabled by default, or if size is zero.
+// Changing the size clears the log.
+func (r *Resolver) SetQueryLogSize(size int) {
+	r.queryLog.setSize(size)
+}
+
+// QueryLog returns the recorded queries with a Seq greater than since,
+// oldest first. Queries are recorded as they are answered.
+func (r *Resolver) QueryLog(since uint64) []QueryLogEntry {
+	return r.queryLog.entries(since)
+}
+
+// Query returns the response to query, as if it was received over TCP,
+// without involving the request queue. It is for diagnostics.
+func (r *Resolver) Query(query []byte) ([]byte, error) {
+	return r.resolveSync(query, netaddr.IPPort{}, transportQuery)
+}
+
 // EnqueueRequest places the given DNS request in the resolver's queue.
 // It takes ownership of the payload and does not block.
 // If the queue is full, the request will be dropped and an error will be returned.
@@ -182,57 +251,60 @@ func (r *Resolver) NextResponse() (Packet, error) {
 	}
 }
 
-// Resolve maps a given domain name to the IP address of the host that owns it,
-// if the IP address conforms to the DNS resource type given by tp (one of A, AAAA, ALL).
+// Resolve maps a given domain name to the IP addresses of the host that owns it,
+// if the IP addresses conform to the DNS resource type given by tp (one of A, AAAA, ALL).
+// IPv4 addresses come first. The returned slice must not be modified.
 // The domain name must be in canonical form (with a trailing period).
-func (r *Resolver) Resolve(domain string, tp dns.Type) (netaddr.IP, dns.RCode, error) {
+func (r *Resolver) Resolve(domain string, tp dns.Type) ([]netaddr.IP, dns.RCode, error) {
 	r.mu.Lock()
 	dnsMap := r.dnsMap
 	r.mu.Unlock()
 
 	if dnsMap == nil {
-		return netaddr.IP{}, dns.RCodeServerFailure, errMapNotSet
+		return nil, dns.RCodeServerFailure, errMapNotSet
 	}
+	rec, rcode, err := dnsMap.lookup(domain, tp)
+	return rec.IPs, rcode, err
+}
 
-	anyHasSuffix := false
-	for _, suffix := range dnsMap.rootDomains {
-		if dnsname.HasSuffix(domain, suffix) {
-			anyHasSuffix = true
-			break
-		}
-	}
-	addr, found := dnsMap.nameToIP[domain]
+// lookup returns the records of type tp of a given domain name.
+// Records of type ALL include every record of the name.
+// The SOA and NS records of m's zones are not included.
+// The returned records must not be modified.
+// The domain name must be in canonical form (with a trailing period).
+func (m *Map) lookup(domain string, tp dns.Type) (Records, dns.RCode, error) {
+	rec, found := m.nameToRecords[domain]
 	if !found {
-		if !anyHasSuffix {
-			return netaddr.IP{}, dns.RCodeRefused, nil
+		z := m.zoneOf(domain)
+		if z == nil {
+			return Records{}, dns.RCodeRefused, nil
+		}
+		// The apex of a zone always exists.
+		if domain != z.name {
+			return Records{}, dns.RCodeNameError, nil
 		}
-		return netaddr.IP{}, dns.RCodeNameError, nil
 	}
 
 	// Refactoring note: this must happen after we check suffixes,
 	// otherwise we will respond with NOTIMP to requests that should be forwarded.
 	switch tp {
 	case dns.TypeA:
-		if !addr.Is4() {
-			return netaddr.IP{}, dns.RCodeSuccess, nil
-		}
-		return addr, dns.RCodeSuccess, nil
+		return Records{IPs: rec.ipv4()}, dns.RCodeSuccess, nil
 	case dns.TypeAAAA:
-		if !addr.Is6() {
-			return netaddr.IP{}, dns.RCodeSuccess, nil
-		}
-		return addr, dns.RCodeSuccess, nil
+		return Records{IPs: rec.ipv6()}, dns.RCodeSuccess, nil
+	case dns.TypeSRV:
+		return Records{SRV: rec.SRV}, dns.RCodeSuccess, nil
+	case dns.TypeTXT:
+		return Records{TXT: rec.TXT}, dns.RCodeSuccess, nil
 	case dns.TypeALL:
 		// Answer with whatever we've got.
-		// It could be IPv4, IPv6, or a zero addr.
-		// TODO: Return all available resolutions (A and AAAA, if we have them).
-		return addr, dns.RCodeSuccess, nil
+		return rec, dns.RCodeSuccess, nil
 
 	// Leave some some record types explicitly unimplemented.
 	// These types relate to recursive resolution or special
 	// DNS sematics and might be implemented in the future.
-	case dns.TypeNS, dns.TypeSOA, dns.TypeAXFR, dns.TypeHINFO:
-		return netaddr.IP{}, dns.RCodeNotImplemented, errNotImplemented
+	case dns.TypeAXFR, dns.TypeHINFO:
+		return Records{}, dns.RCodeNotImplemented, errNotImplemented
 
 	// For everything except for the few types above that are explictly not implemented, return no records.
 	// This is what other DNS systems do: always return NOERROR
@@ -242,7 +314,7 @@ func (r *Resolver) Resolve(domain string, tp dns.Type) (netaddr.IP, dns.RCode, e
 	// and note that NOERROR is returned, despite that record type being made up.
 	default:
 		// no records exist of this type
-		return netaddr.IP{}, dns.RCodeSuccess, nil
+		return Records{}, dns.RCodeSuccess, nil
 	}
 }
 
@@ -275,19 +347,36 @@ func (r *Resolver) poll() {
 			// continue
 		}
 
+		ent := QueryLogEntry{
+			Time:       time.Now(),
+			Source:     packet.Addr,
+			Transport:  transportUDP,
+			Resolution: resolvedLocally,
+		}
 		out, err := r.respond(packet.Payload)
+		if err == nil && len(out) > maxResponseBytes {
+			out, err = truncateResponse(out)
+		}
 
 		if err == errNotOurName {
+			ent.Resolution = resolvedForward
 			if r.forwarder != nil {
-				err = r.forwarder.forward(packet)
-				if err == nil {
-					// forward will send response into r.responses, nothing to do.
-					continue
+				if cached, ok := r.cache.get(packet.Payload); ok {
+					out, err = cached, nil
+					ent.Resolution = resolvedCached
+				} else {
+					err = r.forwarder.forward(packet)
+					if err == nil {
+						// forward will send response into r.responses
+						// and log the query, nothing to do.
+						continue
+					}
 				}
 			} else {
 				err = errNotForwarding
 			}
 		}
+		r.queryLog.record(ent, packet.Payload, out, err)
 
 		if err != nil {
 			select {
@@ -308,13 +397,99 @@ func (r *Resolver) poll() {
 	}
 }
 
+// HandleTCPConn answers the DNS queries that arrive on c,
+// framed as for DNS over TCP (RFC 1035, section 4.2.2),
+// until c is closed or idle, or the resolver is closed.
+// Queries are answered one at a time, in order. HandleTCPConn closes c.
+func (r *Resolver) HandleTCPConn(c net.Conn) {
+	defer c.Close()
+
+	// Unblock reads and writes when the resolver closes.
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-r.closed:
+			c.SetDeadline(aLongTimeAgo)
+		case <-done:
+		}
+	}()
+
+	for {
+		c.SetReadDeadline(time.Now().Add(tcpIdleTimeout))
+		query, err := readTCPMessage(c)
+		if err != nil {
+			return
+		}
+		src, _ := netaddr.ParseIPPort(c.RemoteAddr().String())
+		out, err := r.resolveSync(query, src, transportTCP)
+		if err != nil {
+			r.logf("tcp: %v", err)
+			return
+		}
+		c.SetWriteDeadline(time.Now().Add(tcpIdleTimeout))
+		if err := writeTCPMessage(c, out); err != nil {
+			return
+		}
+	}
+}
+
+// resolveSync returns the response to query, received from src over transport,
+// forwarding it if necessary, without involving the request queue.
+func (r *Resolver) resolveSync(query []byte, src netaddr.IPPort, transport string) ([]byte, error) {
+	ent := QueryLogEntry{
+		Time:       time.Now(),
+		Source:     src,
+		Transport:  transport,
+		Resolution: resolvedLocally,
+	}
+	out, err := r.respond(query)
+	if err != errNotOurName {
+		r.queryLog.record(ent, query, out, err)
+		return out, err
+	}
+	ent.Resolution = resolvedForward
+	if r.forwarder == nil {
+		r.queryLog.record(ent, query, nil, errNotForwarding)
+		return nil, errNotForwarding
+	}
+	if cached, ok := r.cache.get(query); ok {
+		ent.Resolution = resolvedCached
+		r.queryLog.record(ent, query, cached, nil)
+		return cached, nil
+	}
+
+	// From here on, the forwarder logs the query.
+	responses := make(chan Packet, 1)
+	if err := r.forwarder.forwardTo(Packet{Payload: query, Addr: src}, responses, transport); err != nil {
+		r.queryLog.record(ent, query, nil, err)
+		return nil, err
+	}
+	timer := time.NewTimer(responseTimeout)
+	defer timer.Stop()
+	select {
+	case resp := <-responses:
+		return resp.Payload, nil
+	case <-timer.C:
+		return nil, errTimeout
+	case <-r.closed:
+		return nil, ErrClosed
+	}
+}
+
 type response struct {
 	Header   dns.Header
 	Question dns.Question
 	// Name is the response to a PTR query.
 	Name string
-	// IP is the response to an A, AAAA, or ALL query.
-	IP netaddr.IP
+	// Records are the response to any other query.
+	Records Records
+	// Zone is the zone containing Question.Name, if any.
+	// Negative responses carry its SOA record in their authority section.
+	Zone *zone
+	// SOA and NS are whether the answer includes the SOA and NS records of Zone,
+	// as in responses to queries for its apex.
+	SOA, NS bool
 }
 
 // parseQuery parses the query in given packet into a response struct.
@@ -371,6 +546,76 @@ func marshalAAAARecord(name dns.Name, ip netaddr.IP, builder *dns.Builder) error
 	return builder.AAAAResource(answerHeader, answer)
 }
 
+// marshalSOARecord serializes an SOA record with the given TTL into an active builder.
+// The caller may continue using the builder following the call.
+func marshalSOARecord(name dns.Name, soa dns.SOAResource, ttl time.Duration, builder *dns.Builder) error {
+	answerHeader := dns.ResourceHeader{
+		Name:  name,
+		Type:  dns.TypeSOA,
+		Class: dns.ClassINET,
+		TTL:   uint32(ttl / time.Second),
+	}
+	return builder.SOAResource(answerHeader, soa)
+}
+
+// marshalNSRecord serializes an NS record into an active builder.
+// The caller may continue using the builder following the call.
+func marshalNSRecord(name dns.Name, ns dns.NSResource, builder *dns.Builder) error {
+	answerHeader := dns.ResourceHeader{
+		Name:  name,
+		Type:  dns.TypeNS,
+		Class: dns.ClassINET,
+		TTL:   uint32(defaultTTL / time.Second),
+	}
+	return builder.NSResource(answerHeader, ns)
+}
+
+// marshalSRVRecord serializes an SRV record into an active builder.
+// The caller may continue using the builder following the call.
+func marshalSRVRecord(name dns.Name, srv SRV, builder *dns.Builder) error {
+	answer := dns.SRVResource{
+		Priority: srv.Priority,
+		Weight:   srv.Weight,
+		Port:     srv.Port,
+	}
+	var err error
+
+	answerHeader := dns.ResourceHeader{
+		Name:  name,
+		Type:  dns.TypeSRV,
+		Class: dns.ClassINET,
+		TTL:   uint32(defaultTTL / time.Second),
+	}
+	answer.Target, err = dns.NewName(srv.Target)
+	if err != nil {
+		return err
+	}
+	return builder.SRVResource(answerHeader, answer)
+}
+
+// maxTXTStringLen is the maximum length of a string in a TXT record.
+const maxTXTStringLen = 255
+
+// marshalTXTRecord serializes a TXT record into an active builder,
+// splitting txt into as many strings as needed.
+// The caller may continue using the builder following the call.
+func marshalTXTRecord(name dns.Name, txt string, builder *dns.Builder) error {
+	var answer dns.TXTResource
+	for len(txt) > maxTXTStringLen {
+		answer.TXT = append(answer.TXT, txt[:maxTXTStringLen])
+		txt = txt[maxTXTStringLen:]
+	}
+	answer.TXT = append(answer.TXT, txt)
+
+	answerHeader := dns.ResourceHeader{
+		Name:  name,
+		Type:  dns.TypeTXT,
+		Class: dns.ClassINET,
+		TTL:   uint32(defaultTTL / time.Second),
+	}
+	return builder.TXTResource(answerHeader, answer)
+}
+
 // marshalPTRRecord serializes a PTR record into an active builder.
 // The caller may continue using the builder following the call.
 func marshalPTRRecord(queryName dns.Name, name string, builder *dns.Builder) error {
@@ -415,29 +660,109 @@ func marshalResponse(resp *response) ([]byte, error) {
 	}
 
 	// Only successful responses contain answers.
-	if !isSuccess {
-		return builder.Finish()
+	hasAnswers := false
+	if isSuccess {
+		err := builder.StartAnswers()
+		if err != nil {
+			return nil, err
+		}
+
+		if resp.Question.Type == dns.TypePTR {
+			if resp.Name != "" {
+				err = marshalPTRRecord(resp.Question.Name, resp.Name, &builder)
+				hasAnswers = true
+			}
+		} else {
+			err = marshalRecords(resp.Question.Name, resp.Records, &builder)
+			hasAnswers = !resp.Records.isEmpty()
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		if resp.SOA {
+			err = marshalSOARecord(resp.Question.Name, resp.Zone.soa, defaultTTL, &builder)
+			if err != nil {
+				return nil, err
+			}
+			hasAnswers = true
+		}
+		if resp.NS {
+			err = marshalNSRecord(resp.Question.Name, resp.Zone.ns, &builder)
+			if err != nil {
+				return nil, err
+			}
+			hasAnswers = true
+		}
 	}
 
-	err := builder.StartAnswers()
-	if err != nil {
-		return nil, err
+	// Negative responses (NXDOMAIN, and NOERROR without answers)
+	// from a zone carry its SOA record, as in RFC 2308, section 3.
+	isNegative := resp.Header.RCode == dns.RCodeNameError || (isSuccess && !hasAnswers)
+	if resp.Zone != nil && isNegative {
+		err := builder.StartAuthorities()
+		if err != nil {
+			return nil, err
+		}
+		err = marshalSOARecord(resp.Zone.apex, resp.Zone.soa, soaMinTTL, &builder)
+		if err != nil {
+			return nil, err
+		}
 	}
 
-	switch resp.Question.Type {
-	case dns.TypeA, dns.TypeAAAA, dns.TypeALL:
-		if resp.IP.Is4() {
-			err = marshalARecord(resp.Question.Name, resp.IP, &builder)
-		} else if resp.IP.Is6() {
-			err = marshalAAAARecord(resp.Question.Name, resp.IP, &builder)
+	return builder.Finish()
+}
+
+// marshalRecords serializes rec, the records of name, into an active builder.
+// The caller may continue using the builder following the call.
+func marshalRecords(name dns.Name, rec Records, builder *dns.Builder) error {
+	for _, ip := range rec.IPs {
+		var err error
+		if ip.Is4() {
+			err = marshalARecord(name, ip, builder)
+		} else if ip.Is6() {
+			err = marshalAAAARecord(name, ip, builder)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	for _, srv := range rec.SRV {
+		if err := marshalSRVRecord(name, srv, builder); err != nil {
+			return err
 		}
-	case dns.TypePTR:
-		err = marshalPTRRecord(resp.Question.Name, resp.Name, &builder)
 	}
+	for _, txt := range rec.TXT {
+		if err := marshalTXTRecord(name, txt, builder); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// truncateResponse returns out, a response too large for UDP,
+// with all of its records removed and the TC bit set,
+// so that the client retries over TCP.
+func truncateResponse(out []byte) ([]byte, error) {
+	var parser dns.Parser
+	h, err := parser.Start(out)
 	if err != nil {
 		return nil, err
 	}
-
+	questions, err := parser.AllQuestions()
+	if err != nil {
+		return nil, err
+	}
+	h.Truncated = true
+	builder := dns.NewBuilder(nil, h)
+	if err := builder.StartQuestions(); err != nil {
+		return nil, err
+	}
+	for _, q := range questions {
+		if err := builder.Question(q); err != nil {
+			return nil, err
+		}
+	}
 	return builder.Finish()
 }
 
@@ -570,8 +895,16 @@ func (r *Resolver) respondReverse(query []byte, name string, resp *response) ([]
 	}
 
 	// It is more likely that we failed in parsing the name than that it is actually malformed.
-	// To avoid frustrating users, just log and delegate.
+	// To avoid frustrating users, just log and delegate,
+	// unless the name is in one of our reverse zones, such as their apexes.
 	if !ok {
+		if resp.Zone != nil {
+			resp.Header.RCode = dns.RCodeNameError
+			if name == resp.Zone.name {
+				resp.Header.RCode = dns.RCodeSuccess
+			}
+			return marshalResponse(resp)
+		}
 		r.logf("parsing rdns: malformed name: %s", name)
 		return nil, errNotOurName
 	}
@@ -581,7 +914,7 @@ func (r *Resolver) respondReverse(query []byte, name string, resp *response) ([]
 	if err != nil {
 		r.logf("resolving rdns: %v", ip, err)
 	}
-	if resp.Header.RCode == dns.RCodeNameError {
+	if resp.Header.RCode == dns.RCodeNameError && resp.Zone == nil {
 		return nil, errNotOurName
 	}
 
@@ -610,18 +943,35 @@ func (r *Resolver) respond(query []byte) ([]byte, error) {
 	rawName := resp.Question.Name.Data[:resp.Question.Name.Length]
 	name := rawNameToLower(rawName)
 
-	// Always try to handle reverse lookups; delegate inside when not found.
+	r.mu.Lock()
+	dnsMap := r.dnsMap
+	r.mu.Unlock()
+	if dnsMap != nil {
+		resp.Zone = dnsMap.zoneOf(name)
+	}
+
+	// Always try to handle reverse lookups; delegate inside when not found,
+	// unless the name is in one of our reverse zones.
 	// This way, queries for existent nodes do not leak,
-	// but we behave gracefully if non-Tailscale nodes exist in CGNATRange.
+	// but those for other hosts are still answered upstream.
 	if resp.Question.Type == dns.TypePTR {
 		return r.respondReverse(query, name, resp)
 	}
 
-	resp.IP, resp.Header.RCode, err = r.Resolve(name, resp.Question.Type)
+	if dnsMap == nil {
+		resp.Header.RCode, err = dns.RCodeServerFailure, errMapNotSet
+	} else {
+		resp.Records, resp.Header.RCode, err = dnsMap.lookup(name, resp.Question.Type)
+	}
 	// This return code is special: it requests forwarding.
 	if resp.Header.RCode == dns.RCodeRefused {
 		return nil, errNotOurName
 	}
+	if resp.Header.RCode == dns.RCodeSuccess && resp.Zone != nil && name == resp.Zone.name {
+		tp := resp.Question.Type
+		resp.SOA = tp == dns.TypeSOA || tp == dns.TypeALL
+		resp.NS = tp == dns.TypeNS || tp == dns.TypeALL
+	}
 
 	// We will not return this error: it is the sender's fault.
 	if err != nil {
@@ -6,7 +6,11 @@ package tsdns
 
 import (
 	"log"
+	"net"
+	"strings"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/miekg/dns"
 	"inet.af/netaddr"
@@ -68,14 +72,117 @@ func resolveToIP(ipv4, ipv6 netaddr.IP, ns string) dns.HandlerFunc {
 	}
 }
 
+// countingResolveToIPv4 returns a handler function which responds
+// to all queries with an A record containing ipv4 with the given TTL,
+// and increments *queries for each query.
+func countingResolveToIPv4(ipv4 netaddr.IP, ttl uint32, queries *int32) dns.HandlerFunc {
+	return func(w dns.ResponseWriter, req *dns.Msg) {
+		atomic.AddInt32(queries, 1)
+		m := new(dns.Msg)
+		m.SetReply(req)
+		m.Answer = append(m.Answer, &dns.A{
+			Hdr: dns.RR_Header{
+				Name:   req.Question[0].Name,
+				Rrtype: dns.TypeA,
+				Class:  dns.ClassINET,
+				Ttl:    ttl,
+			},
+			A: ipv4.IPAddr().IP,
+		})
+		w.WriteMsg(m)
+	}
+}
+
 func resolveToNXDOMAIN(w dns.ResponseWriter, req *dns.Msg) {
 	m := new(dns.Msg)
 	m.SetRcode(req, dns.RcodeNameError)
 	w.WriteMsg(m)
 }
 
+func resolveToSERVFAIL(w dns.ResponseWriter, req *dns.Msg) {
+	m := new(dns.Msg)
+	m.SetRcode(req, dns.RcodeServerFailure)
+	w.WriteMsg(m)
+}
+
+// delayed returns a handler which waits for d before calling handler.
+func delayed(d time.Duration, handler dns.HandlerFunc) dns.HandlerFunc {
+	return func(w dns.ResponseWriter, req *dns.Msg) {
+		time.Sleep(d)
+		handler(w, req)
+	}
+}
+
+// neverRespond is a handler that drops all queries.
+func neverRespond(w dns.ResponseWriter, req *dns.Msg) {}
+
+// bigOverUDP returns a handler which responds to queries it receives
+// over TCP with n TXT records of 100 bytes each,
+// and to queries it receives over UDP with an empty, truncated response.
+func bigOverUDP(n int) dns.HandlerFunc {
+	return func(w dns.ResponseWriter, req *dns.Msg) {
+		m := new(dns.Msg)
+		m.SetReply(req)
+		if w.RemoteAddr().Network() == "udp" {
+			m.Truncated = true
+			w.WriteMsg(m)
+			return
+		}
+		question := req.Question[0]
+		for i := 0; i < n; i++ {
+			m.Answer = append(m.Answer, &dns.TXT{
+				Hdr: dns.RR_Header{
+					Name:   question.Name,
+					Rrtype: dns.TypeTXT,
+					Class:  dns.ClassINET,
+				},
+				Txt: []string{strings.Repeat(string(rune('a'+i%26)), 100)},
+			})
+		}
+		w.WriteMsg(m)
+	}
+}
+
 func serveDNS(tb testing.TB, addr string) (*dns.Server, chan error) {
-	server := &dns.Server{Addr: addr, Net: "udp"}
+	return serveDNSWithHandler(tb, "udp", addr, nil)
+}
+
+// serveDNSHandler serves DNS on a local UDP port, answering all queries
+// with handler, until t finishes. It returns the server's address.
+func serveDNSHandler(t *testing.T, handler dns.HandlerFunc) net.Addr {
+	server := serveDNSHandlerNet(t, "udp", "127.0.0.1:0", handler)
+	return server.PacketConn.LocalAddr()
+}
+
+// serveDNSHandlerTCP is like serveDNSHandler, but the server also
+// answers queries over TCP on the same port.
+func serveDNSHandlerTCP(t *testing.T, handler dns.HandlerFunc) net.Addr {
+	addr := serveDNSHandler(t, handler)
+	serveDNSHandlerNet(t, "tcp", addr.String(), handler)
+	return addr
+}
+
+// serveDNSHandlerNet serves DNS on addr over network ("udp" or "tcp"),
+// answering all queries with handler, until t finishes.
+func serveDNSHandlerNet(t *testing.T, network, addr string, handler dns.HandlerFunc) *dns.Server {
+	server, errch := serveDNSWithHandler(t, network, addr, handler)
+	if server == nil {
+		t.Fatalf("serve: %v", <-errch)
+	}
+	t.Cleanup(func() {
+		server.Shutdown()
+		if err := <-errch; err != nil {
+			t.Errorf("server error: %v", err)
+		}
+	})
+	return server
+}
+
+// serveDNSWithHandler is like serveDNS, but the server listens on network,
+// and answers all queries with handler instead of the handlers registered
+// with dnsHandleFunc, if handler is non-nil.
+func serveDNSWithHandler(tb testing.TB, network, addr string, handler dns.Handler) (*dns.Server, chan error) {
+	server := &dns.Server{Addr: addr, Net: network, Handler: handler}
 
 	waitch := make(chan struct{})
 	server.NotifyStartedFunc = func() { close(waitch) }
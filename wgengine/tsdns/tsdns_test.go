@@ -8,8 +8,11 @@ import (
 	"bytes"
 	"errors"
 	"net"
+	"reflect"
+	"strings"
 	"sync"
 	"testing"
+	"time"
 
 	dns "golang.org/x/net/dns/dnsmessage"
 	"inet.af/netaddr"
@@ -206,38 +209,134 @@ func TestResolve(t *testing.T) {
 		name  string
 		qname string
 		qtype dns.Type
-		ip    netaddr.IP
+		ips   []netaddr.IP
 		code  dns.RCode
 	}{
-		{"ipv4", "test1.ipn.dev.", dns.TypeA, testipv4, dns.RCodeSuccess},
-		{"ipv6", "test2.ipn.dev.", dns.TypeAAAA, testipv6, dns.RCodeSuccess},
-		{"no-ipv6", "test1.ipn.dev.", dns.TypeAAAA, netaddr.IP{}, dns.RCodeSuccess},
-		{"nxdomain", "test3.ipn.dev.", dns.TypeA, netaddr.IP{}, dns.RCodeNameError},
-		{"foreign domain", "google.com.", dns.TypeA, netaddr.IP{}, dns.RCodeRefused},
-		{"all", "test1.ipn.dev.", dns.TypeA, testipv4, dns.RCodeSuccess},
-		{"mx-ipv4", "test1.ipn.dev.", dns.TypeMX, netaddr.IP{}, dns.RCodeSuccess},
-		{"mx-ipv6", "test2.ipn.dev.", dns.TypeMX, netaddr.IP{}, dns.RCodeSuccess},
-		{"mx-nxdomain", "test3.ipn.dev.", dns.TypeMX, netaddr.IP{}, dns.RCodeNameError},
-		{"ns-nxdomain", "test3.ipn.dev.", dns.TypeNS, netaddr.IP{}, dns.RCodeNameError},
+		{"ipv4", "test1.ipn.dev.", dns.TypeA, []netaddr.IP{testipv4}, dns.RCodeSuccess},
+		{"ipv6", "test2.ipn.dev.", dns.TypeAAAA, []netaddr.IP{testipv6}, dns.RCodeSuccess},
+		{"no-ipv6", "test1.ipn.dev.", dns.TypeAAAA, nil, dns.RCodeSuccess},
+		{"nxdomain", "test3.ipn.dev.", dns.TypeA, nil, dns.RCodeNameError},
+		{"foreign domain", "google.com.", dns.TypeA, nil, dns.RCodeRefused},
+		{"all", "test1.ipn.dev.", dns.TypeA, []netaddr.IP{testipv4}, dns.RCodeSuccess},
+		{"mx-ipv4", "test1.ipn.dev.", dns.TypeMX, nil, dns.RCodeSuccess},
+		{"mx-ipv6", "test2.ipn.dev.", dns.TypeMX, nil, dns.RCodeSuccess},
+		{"mx-nxdomain", "test3.ipn.dev.", dns.TypeMX, nil, dns.RCodeNameError},
+		{"ns-nxdomain", "test3.ipn.dev.", dns.TypeNS, nil, dns.RCodeNameError},
 	}
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			ip, code, err := r.Resolve(tt.qname, tt.qtype)
+			ips, code, err := r.Resolve(tt.qname, tt.qtype)
 			if err != nil {
 				t.Errorf("err = %v; want nil", err)
 			}
 			if code != tt.code {
 				t.Errorf("code = %v; want %v", code, tt.code)
 			}
-			// Only check ip for non-err
-			if ip != tt.ip {
-				t.Errorf("ip = %v; want %v", ip, tt.ip)
+			// Only check ips for non-err
+			if !reflect.DeepEqual(ips, tt.ips) && len(ips)+len(tt.ips) > 0 {
+				t.Errorf("ips = %v; want %v", ips, tt.ips)
 			}
 		})
 	}
 }
 
+var recordsMap = NewMapFromRecords(
+	map[string]Records{
+		"dual.ipn.dev.": {IPs: []netaddr.IP{testipv6, testipv4}},
+		"_ssh._tcp.dual.ipn.dev.": {
+			SRV: []SRV{{Port: 22, Target: "dual.ipn.dev."}},
+			TXT: []string{"description=sshd"},
+		},
+		"long.ipn.dev.": {TXT: []string{strings.Repeat("a", 300)}},
+		"big.ipn.dev.":  {TXT: []string{strings.Repeat("a", 200), strings.Repeat("b", 200), strings.Repeat("c", 200)}},
+	},
+	[]string{"ipn.dev."},
+)
+
+func TestResolveRecords(t *testing.T) {
+	r := NewResolver(ResolverConfig{Logf: t.Logf, Forward: false})
+	r.SetMap(recordsMap)
+
+	if err := r.Start(); err != nil {
+		t.Fatalf("start: %v", err)
+	}
+	defer r.Close()
+
+	aRes := &dns.AResource{A: testipv4.As4()}
+	aaaaRes := &dns.AAAAResource{AAAA: testipv6.As16()}
+	srvRes := &dns.SRVResource{Port: 22, Target: dns.MustNewName("dual.ipn.dev.")}
+	txtRes := &dns.TXTResource{TXT: []string{"description=sshd"}}
+	longRes := &dns.TXTResource{TXT: []string{strings.Repeat("a", 255), strings.Repeat("a", 45)}}
+
+	tests := []struct {
+		name  string
+		qname string
+		qtype dns.Type
+		want  []dns.ResourceBody
+	}{
+		{"a", "dual.ipn.dev.", dns.TypeA, []dns.ResourceBody{aRes}},
+		{"aaaa", "dual.ipn.dev.", dns.TypeAAAA, []dns.ResourceBody{aaaaRes}},
+		{"all", "dual.ipn.dev.", dns.TypeALL, []dns.ResourceBody{aRes, aaaaRes}},
+		{"srv", "_ssh._tcp.dual.ipn.dev.", dns.TypeSRV, []dns.ResourceBody{srvRes}},
+		{"txt", "_ssh._tcp.dual.ipn.dev.", dns.TypeTXT, []dns.ResourceBody{txtRes}},
+		{"srv-all", "_ssh._tcp.dual.ipn.dev.", dns.TypeALL, []dns.ResourceBody{srvRes, txtRes}},
+		{"no-srv", "dual.ipn.dev.", dns.TypeSRV, nil},
+		{"long-txt", "long.ipn.dev.", dns.TypeTXT, []dns.ResourceBody{longRes}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			payload, err := syncRespond(r, dnspacket(tt.qname, tt.qtype))
+			if err != nil {
+				t.Fatalf("err = %v; want nil", err)
+			}
+			var msg dns.Message
+			if err := msg.Unpack(payload); err != nil {
+				t.Fatalf("unpack: %v", err)
+			}
+			if msg.Header.RCode != dns.RCodeSuccess {
+				t.Errorf("rcode = %v; want %v", msg.Header.RCode, dns.RCodeSuccess)
+			}
+			var got []dns.ResourceBody
+			for _, ans := range msg.Answers {
+				if ans.Header.Name.String() != tt.qname {
+					t.Errorf("answer name = %v; want %v", ans.Header.Name, tt.qname)
+				}
+				got = append(got, ans.Body)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("answers = %+v; want %+v", got, tt.want)
+			}
+		})
+	}
+
+	// Responses too large for UDP are truncated, but not over TCP.
+	query := dnspacket("big.ipn.dev.", dns.TypeTXT)
+	payload, err := syncRespond(r, query)
+	if err != nil {
+		t.Fatalf("err = %v; want nil", err)
+	}
+	var msg dns.Message
+	if err := msg.Unpack(payload); err != nil {
+		t.Fatalf("unpack: %v", err)
+	}
+	if !msg.Header.Truncated || len(msg.Answers) != 0 || len(msg.Questions) != 1 {
+		t.Errorf("UDP response: truncated = %v with %d questions, %d answers; want truncated with 1 question, 0 answers",
+			msg.Header.Truncated, len(msg.Questions), len(msg.Answers))
+	}
+	payload, err = r.Query(query)
+	if err != nil {
+		t.Fatalf("Query: %v", err)
+	}
+	if err := msg.Unpack(payload); err != nil {
+		t.Fatalf("unpack: %v", err)
+	}
+	if msg.Header.Truncated || len(msg.Answers) != 3 {
+		t.Errorf("TCP response: truncated = %v with %d answers; want 3 answers", msg.Header.Truncated, len(msg.Answers))
+	}
+}
+
 func TestResolveReverse(t *testing.T) {
 	r := NewResolver(ResolverConfig{Logf: t.Logf, Forward: false})
 	r.SetMap(dnsMap)
@@ -521,6 +620,239 @@ func TestConcurrentSetUpstreams(t *testing.T) {
 	wg.Wait()
 }
 
+func TestSplitDNS(t *testing.T) {
+	tstest.ResourceCheck(t)
+
+	var (
+		defaultIP = netaddr.IPv4(1, 1, 1, 1)
+		corpIP    = netaddr.IPv4(10, 0, 0, 1)
+		engIP     = netaddr.IPv4(10, 0, 0, 2)
+	)
+
+	defaultServer := serveDNSHandler(t, resolveToIP(defaultIP, testipv6, "dns.default."))
+	corpServer := serveDNSHandler(t, resolveToIP(corpIP, testipv6, "dns.corp."))
+	engServer := serveDNSHandler(t, resolveToIP(engIP, testipv6, "dns.eng."))
+	failingServer := serveDNSHandler(t, resolveToSERVFAIL)
+	silentServer := serveDNSHandler(t, neverRespond)
+
+	r := NewResolver(ResolverConfig{Logf: t.Logf, Forward: true})
+	r.forwarder.fallbackDelay = 50 * time.Millisecond
+	r.SetMap(dnsMap)
+	r.SetUpstreams([]net.Addr{defaultServer})
+	r.SetRoutes([]Route{
+		{Suffix: "corp.example.com", Upstreams: []net.Addr{corpServer}},
+		{Suffix: "eng.corp.example.com.", Upstreams: []net.Addr{engServer}},
+		{Suffix: "strict.example.", Upstreams: []net.Addr{failingServer}},
+		{Suffix: "failing.example.", Upstreams: []net.Addr{failingServer}, Fallback: true},
+		{Suffix: "silent.example.", Upstreams: []net.Addr{silentServer}, Fallback: true},
+		{Suffix: "empty.example.", Fallback: true},
+	})
+
+	if err := r.Start(); err != nil {
+		t.Fatalf("start: %v", err)
+	}
+	defer r.Close()
+
+	tests := []struct {
+		name     string
+		response dnsResponse
+	}{
+		{"test.site.", dnsResponse{ip: defaultIP, rcode: dns.RCodeSuccess}},
+		{"example.com.", dnsResponse{ip: defaultIP, rcode: dns.RCodeSuccess}},
+		{"notcorp.example.com.", dnsResponse{ip: defaultIP, rcode: dns.RCodeSuccess}},
+		{"corp.example.com.", dnsResponse{ip: corpIP, rcode: dns.RCodeSuccess}},
+		{"host.corp.example.com.", dnsResponse{ip: corpIP, rcode: dns.RCodeSuccess}},
+		{"HOST.Corp.Example.com.", dnsResponse{ip: corpIP, rcode: dns.RCodeSuccess}},
+		{"eng.corp.example.com.", dnsResponse{ip: engIP, rcode: dns.RCodeSuccess}},
+		{"host.eng.corp.example.com.", dnsResponse{ip: engIP, rcode: dns.RCodeSuccess}},
+		{"host.strict.example.", dnsResponse{rcode: dns.RCodeServerFailure}},
+		{"host.failing.example.", dnsResponse{ip: defaultIP, rcode: dns.RCodeSuccess}},
+		{"host.silent.example.", dnsResponse{ip: defaultIP, rcode: dns.RCodeSuccess}},
+		{"host.empty.example.", dnsResponse{ip: defaultIP, rcode: dns.RCodeSuccess}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			payload, err := syncRespond(r, dnspacket(tt.name, dns.TypeA))
+			if err != nil {
+				t.Fatalf("err = %v; want nil", err)
+			}
+			response, err := unpackResponse(payload)
+			if err != nil {
+				t.Fatalf("extract: err = %v; want nil (in %x)", err, payload)
+			}
+			if response.rcode != tt.response.rcode {
+				t.Errorf("rcode = %v; want %v", response.rcode, tt.response.rcode)
+			}
+			if response.ip != tt.response.ip {
+				t.Errorf("ip = %v; want %v", response.ip, tt.response.ip)
+			}
+		})
+	}
+}
+
+func TestSplitDNSLateFailure(t *testing.T) {
+	tstest.ResourceCheck(t)
+
+	defaultIP := netaddr.IPv4(1, 1, 1, 1)
+	// The route's upstream fails only after the query has fallen back
+	// to the default upstream, which hasn't answered yet.
+	defaultServer := serveDNSHandler(t, delayed(300*time.Millisecond, resolveToIP(defaultIP, testipv6, "dns.default.")))
+	failingServer := serveDNSHandler(t, delayed(150*time.Millisecond, resolveToSERVFAIL))
+
+	r := NewResolver(ResolverConfig{Logf: t.Logf, Forward: true})
+	r.forwarder.fallbackDelay = 50 * time.Millisecond
+	r.SetMap(dnsMap)
+	r.SetUpstreams([]net.Addr{defaultServer})
+	r.SetRoutes([]Route{
+		{Suffix: "failing.example.", Upstreams: []net.Addr{failingServer}, Fallback: true},
+	})
+	if err := r.Start(); err != nil {
+		t.Fatalf("start: %v", err)
+	}
+	defer r.Close()
+
+	payload, err := syncRespond(r, dnspacket("host.failing.example.", dns.TypeA))
+	if err != nil {
+		t.Fatal(err)
+	}
+	response, err := unpackResponse(payload)
+	if err != nil {
+		t.Fatalf("extract: %v", err)
+	}
+	if response.rcode != dns.RCodeSuccess || response.ip != defaultIP {
+		t.Errorf("got rcode %v, ip %v; want %v, %v", response.rcode, response.ip, dns.RCodeSuccess, defaultIP)
+	}
+}
+
+func TestSplitDNSNoUpstreams(t *testing.T) {
+	r := NewResolver(ResolverConfig{Logf: t.Logf, Forward: true})
+	r.SetRoutes([]Route{
+		{Suffix: "corp.example.com.", Upstreams: []net.Addr{&net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 53}}},
+		{Suffix: "empty.example."},
+	})
+
+	for _, name := range []string{"example.com.", "host.empty.example."} {
+		upstreams, _ := r.forwarder.upstreamsLocked(name)
+		if len(upstreams) != 0 {
+			t.Errorf("upstreams(%q) = %v; want none", name, upstreams)
+		}
+	}
+	upstreams, fallback := r.forwarder.upstreamsLocked("host.corp.example.com.")
+	if len(upstreams) != 1 || len(fallback) != 0 {
+		t.Errorf("upstreams(host.corp.example.com.) = %v, %v; want one upstream, no fallback", upstreams, fallback)
+	}
+}
+
+func TestForwardTruncated(t *testing.T) {
+	tstest.ResourceCheck(t)
+
+	const numTXT = 20 // too many to fit in 512 bytes
+
+	tests := []struct {
+		name          string
+		tcp           bool // whether the upstream answers over TCP
+		wantTruncated bool
+		wantAnswers   int
+	}{
+		{"tcp", true, false, numTXT},
+		{"no_tcp", false, true, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var upstream net.Addr
+			if tt.tcp {
+				upstream = serveDNSHandlerTCP(t, bigOverUDP(numTXT))
+			} else {
+				upstream = serveDNSHandler(t, bigOverUDP(numTXT))
+			}
+
+			r := NewResolver(ResolverConfig{Logf: t.Logf, Forward: true})
+			r.SetMap(dnsMap)
+			r.SetUpstreams([]net.Addr{upstream})
+			if err := r.Start(); err != nil {
+				t.Fatalf("start: %v", err)
+			}
+			defer r.Close()
+
+			payload, err := syncRespond(r, dnspacket("big.site.", dns.TypeTXT))
+			if err != nil {
+				t.Fatalf("err = %v; want nil", err)
+			}
+			var parser dns.Parser
+			h, err := parser.Start(payload)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if h.Truncated != tt.wantTruncated {
+				t.Errorf("truncated = %v; want %v", h.Truncated, tt.wantTruncated)
+			}
+			if err := parser.SkipAllQuestions(); err != nil {
+				t.Fatal(err)
+			}
+			answers, err := parser.AllAnswers()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(answers) != tt.wantAnswers {
+				t.Errorf("got %d answers; want %d", len(answers), tt.wantAnswers)
+			}
+		})
+	}
+}
+
+func TestHandleTCPConn(t *testing.T) {
+	tstest.ResourceCheck(t)
+
+	upstream := serveDNSHandler(t, resolveToIP(testipv4, testipv6, "dns.test.site."))
+
+	r := NewResolver(ResolverConfig{Logf: t.Logf, Forward: true})
+	r.SetMap(dnsMap)
+	r.SetUpstreams([]net.Addr{upstream})
+	if err := r.Start(); err != nil {
+		t.Fatalf("start: %v", err)
+	}
+	defer r.Close()
+
+	client, server := net.Pipe()
+	done := make(chan struct{})
+	go func() {
+		r.HandleTCPConn(server)
+		close(done)
+	}()
+
+	// All queries go over the same connection.
+	tests := []struct {
+		title    string
+		query    []byte
+		response dnsResponse
+	}{
+		{"local", dnspacket("test1.ipn.dev.", dns.TypeA), dnsResponse{ip: testipv4, rcode: dns.RCodeSuccess}},
+		{"forwarded", dnspacket("test.site.", dns.TypeAAAA), dnsResponse{ip: testipv6, rcode: dns.RCodeSuccess}},
+		{"local_again", dnspacket("test2.ipn.dev.", dns.TypeAAAA), dnsResponse{ip: testipv6, rcode: dns.RCodeSuccess}},
+	}
+	for _, tt := range tests {
+		if err := writeTCPMessage(client, tt.query); err != nil {
+			t.Fatalf("%s: write: %v", tt.title, err)
+		}
+		payload, err := readTCPMessage(client)
+		if err != nil {
+			t.Fatalf("%s: read: %v", tt.title, err)
+		}
+		response, err := unpackResponse(payload)
+		if err != nil {
+			t.Fatalf("%s: extract: err = %v; want nil (in %x)", tt.title, err, payload)
+		}
+		if response != tt.response {
+			t.Errorf("%s: response = %+v; want %+v", tt.title, response, tt.response)
+		}
+	}
+
+	client.Close()
+	<-done
+}
+
 var allResponse = []byte{
 	0x00, 0x00, // transaction id: 0
 	0x84, 0x00, // flags: response, authoritative, no error
@@ -651,10 +983,24 @@ var nxdomainResponse = []byte{
 	0x84, 0x03, // flags: response, authoritative, error: nxdomain
 	0x00, 0x01, // one question
 	0x00, 0x00, // no answers
-	0x00, 0x00, 0x00, 0x00, // no authority or additional RRs
+	0x00, 0x01, 0x00, 0x00, // one authority RR, no additional RRs
 	// Question:
 	0x05, 0x74, 0x65, 0x73, 0x74, 0x33, 0x03, 0x69, 0x70, 0x6e, 0x03, 0x64, 0x65, 0x76, 0x00, // name
 	0x00, 0x01, 0x00, 0x01, // type A, class IN
+	// Authority:
+	0x03, 0x69, 0x70, 0x6e, 0x03, 0x64, 0x65, 0x76, 0x00, // name: ipn.dev
+	0x00, 0x06, 0x00, 0x01, // type SOA, class IN
+	0x00, 0x00, 0x00, 0x3c, // TTL: 60
+	0x00, 0x3a, // length: 58 bytes
+	// MNAME: magicdns.ipn.dev
+	0x08, 0x6d, 0x61, 0x67, 0x69, 0x63, 0x64, 0x6e, 0x73, 0x03, 0x69, 0x70, 0x6e, 0x03, 0x64, 0x65, 0x76, 0x00,
+	// RNAME: hostmaster.ipn.dev
+	0x0a, 0x68, 0x6f, 0x73, 0x74, 0x6d, 0x61, 0x73, 0x74, 0x65, 0x72, 0x03, 0x69, 0x70, 0x6e, 0x03, 0x64, 0x65, 0x76, 0x00,
+	0x75, 0x55, 0x76, 0x12, // serial: checksum of dnsMap
+	0x00, 0x00, 0x0e, 0x10, // refresh: 3600
+	0x00, 0x00, 0x02, 0x58, // retry: 600
+	0x00, 0x09, 0x3a, 0x80, // expire: 604800
+	0x00, 0x00, 0x00, 0x3c, // minimum: 60
 }
 
 var emptyResponse = []byte{
@@ -662,10 +1008,24 @@ var emptyResponse = []byte{
 	0x84, 0x00, // flags: response, authoritative, no error
 	0x00, 0x01, // one question
 	0x00, 0x00, // no answers
-	0x00, 0x00, 0x00, 0x00, // no authority or additional RRs
+	0x00, 0x01, 0x00, 0x00, // one authority RR, no additional RRs
 	// Question:
 	0x05, 0x74, 0x65, 0x73, 0x74, 0x31, 0x03, 0x69, 0x70, 0x6e, 0x03, 0x64, 0x65, 0x76, 0x00, // name
 	0x00, 0x1c, 0x00, 0x01, // type AAAA, class IN
+	// Authority:
+	0x03, 0x69, 0x70, 0x6e, 0x03, 0x64, 0x65, 0x76, 0x00, // name: ipn.dev
+	0x00, 0x06, 0x00, 0x01, // type SOA, class IN
+	0x00, 0x00, 0x00, 0x3c, // TTL: 60
+	0x00, 0x3a, // length: 58 bytes
+	// MNAME: magicdns.ipn.dev
+	0x08, 0x6d, 0x61, 0x67, 0x69, 0x63, 0x64, 0x6e, 0x73, 0x03, 0x69, 0x70, 0x6e, 0x03, 0x64, 0x65, 0x76, 0x00,
+	// RNAME: hostmaster.ipn.dev
+	0x0a, 0x68, 0x6f, 0x73, 0x74, 0x6d, 0x61, 0x73, 0x74, 0x65, 0x72, 0x03, 0x69, 0x70, 0x6e, 0x03, 0x64, 0x65, 0x76, 0x00,
+	0x75, 0x55, 0x76, 0x12, // serial: checksum of dnsMap
+	0x00, 0x00, 0x0e, 0x10, // refresh: 3600
+	0x00, 0x00, 0x02, 0x58, // retry: 600
+	0x00, 0x09, 0x3a, 0x80, // expire: 604800
+	0x00, 0x00, 0x00, 0x3c, // minimum: 60
 }
 
 func TestFull(t *testing.T) {
@@ -0,0 +1,132 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package tsdns
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	dns "golang.org/x/net/dns/dnsmessage"
+	"tailscale.com/net/tsaddr"
+	"tailscale.com/util/dnsname"
+)
+
+const (
+	// nameserverLabel is the label, under the first root domain of a Map,
+	// of the nameserver named in the SOA and NS records of its zones.
+	// The nameserver name resolves to tsaddr.TailscaleServiceIP.
+	nameserverLabel = "magicdns"
+
+	// soaMinTTL is the MINIMUM field of SOA records: how long negative answers
+	// may be cached (RFC 2308). It is also the TTL of the SOA records
+	// in the authority section of negative answers.
+	soaMinTTL = 60 * time.Second
+	// soaRefresh, soaRetry and soaExpire are the timers of SOA records.
+	// They are only used by secondary nameservers, of which there are none.
+	soaRefresh = time.Hour
+	soaRetry   = 10 * time.Minute
+	soaExpire  = 7 * 24 * time.Hour
+)
+
+// zone is a DNS zone for which a Resolver is authoritative.
+type zone struct {
+	// name is the apex of the zone, in canonical form (with a trailing period).
+	name string
+	apex dns.Name
+	soa  dns.SOAResource
+	ns   dns.NSResource
+}
+
+// newZone returns the zone with the given apex and nameserver name.
+func newZone(name string, ns dns.Name, serial uint32) (*zone, error) {
+	apex, err := dns.NewName(name)
+	if err != nil {
+		return nil, err
+	}
+	mbox, err := dns.NewName("hostmaster." + name)
+	if err != nil {
+		return nil, err
+	}
+	return &zone{
+		name: name,
+		apex: apex,
+		soa: dns.SOAResource{
+			NS:      ns,
+			MBox:    mbox,
+			Serial:  serial,
+			Refresh: uint32(soaRefresh / time.Second),
+			Retry:   uint32(soaRetry / time.Second),
+			Expire:  uint32(soaExpire / time.Second),
+			MinTTL:  uint32(soaMinTTL / time.Second),
+		},
+		ns: dns.NSResource{NS: ns},
+	}, nil
+}
+
+// contains reports whether name, in canonical form and lowercase,
+// is in the zone.
+func (z *zone) contains(name string) bool {
+	return name == z.name || dnsname.HasSuffix(name, z.name)
+}
+
+// reverseZoneNames returns the apexes of the reverse DNS zones of the
+// address ranges Tailscale assigns from: one zone per /16 of
+// tsaddr.CGNATRange, and one for tsaddr.TailscaleULARange.
+func reverseZoneNames() []string {
+	var names []string
+
+	cgnat := tsaddr.CGNATRange()
+	b4 := cgnat.IP.As4()
+	for i := 0; i < 1<<(16-cgnat.Bits); i++ {
+		names = append(names, fmt.Sprintf("%d.%d%s", int(b4[1])+i, b4[0], rdnsv4Suffix))
+	}
+
+	ula := tsaddr.TailscaleULARange()
+	b16 := ula.IP.As16()
+	var sb strings.Builder
+	for i := int(ula.Bits)/4 - 1; i >= 0; i-- {
+		nibble := b16[i/2]
+		if i%2 == 0 {
+			nibble >>= 4
+		}
+		fmt.Fprintf(&sb, "%x.", nibble&0xf)
+	}
+	names = append(names, sb.String()+rdnsv6Suffix[1:])
+
+	return names
+}
+
+// nameserverName returns the name of the nameserver of the zones of a Map
+// with the given root domains, or the empty string if there are none.
+func nameserverName(rootDomains []string) string {
+	if len(rootDomains) == 0 {
+		return ""
+	}
+	return nameserverLabel + "." + strings.ToLower(rootDomains[0])
+}
+
+// newZones returns the zones of a Map with the given root domains:
+// the root domains themselves and, if there are any, the reverse zones
+// of Tailscale's address ranges.
+// Root domains that aren't valid DNS names are skipped.
+func newZones(rootDomains []string, serial uint32) []*zone {
+	if len(rootDomains) == 0 {
+		return nil
+	}
+	ns, err := dns.NewName(nameserverName(rootDomains))
+	if err != nil {
+		return nil
+	}
+	var zones []*zone
+	for _, name := range append(rootDomains[:len(rootDomains):len(rootDomains)], reverseZoneNames()...) {
+		z, err := newZone(strings.ToLower(name), ns, serial)
+		if err != nil {
+			continue
+		}
+		zones = append(zones, z)
+	}
+	return zones
+}
@@ -0,0 +1,160 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package tsdns
+
+import (
+	"testing"
+
+	dns "golang.org/x/net/dns/dnsmessage"
+	"inet.af/netaddr"
+)
+
+func TestReverseZoneNames(t *testing.T) {
+	names := reverseZoneNames()
+	if len(names) != 65 {
+		t.Fatalf("got %d zones; want 65", len(names))
+	}
+	for i, want := range map[int]string{
+		0:  "64.100.in-addr.arpa.",
+		63: "127.100.in-addr.arpa.",
+		64: "0.e.1.a.c.5.1.1.a.7.d.f.ip6.arpa.",
+	} {
+		if names[i] != want {
+			t.Errorf("names[%d] = %q; want %q", i, names[i], want)
+		}
+	}
+}
+
+func TestZones(t *testing.T) {
+	r := NewResolver(ResolverConfig{Logf: t.Logf, Forward: false})
+	r.SetMap(NewMap(map[string]netaddr.IP{
+		"test1.ipn.dev.": netaddr.IPv4(100, 64, 0, 1),
+	}, []string{"ipn.dev."}))
+
+	if err := r.Start(); err != nil {
+		t.Fatalf("start: %v", err)
+	}
+	defer r.Close()
+
+	const (
+		ipnZone = "ipn.dev."
+		v4Zone  = "64.100.in-addr.arpa."
+		v6Zone  = "0.e.1.a.c.5.1.1.a.7.d.f.ip6.arpa."
+		nsName  = "magicdns.ipn.dev."
+		noSOA   = ""
+	)
+
+	tests := []struct {
+		name      string
+		qname     string
+		qtype     dns.Type
+		rcode     dns.RCode
+		answers   []dns.Type
+		authority string // zone of the SOA record in the authority section
+	}{
+		{"apex-soa", ipnZone, dns.TypeSOA, dns.RCodeSuccess, []dns.Type{dns.TypeSOA}, noSOA},
+		{"apex-ns", ipnZone, dns.TypeNS, dns.RCodeSuccess, []dns.Type{dns.TypeNS}, noSOA},
+		{"apex-all", ipnZone, dns.TypeALL, dns.RCodeSuccess, []dns.Type{dns.TypeSOA, dns.TypeNS}, noSOA},
+		{"apex-a", ipnZone, dns.TypeA, dns.RCodeSuccess, nil, ipnZone},
+		{"nameserver", nsName, dns.TypeA, dns.RCodeSuccess, []dns.Type{dns.TypeA}, noSOA},
+		{"host-a", "test1.ipn.dev.", dns.TypeA, dns.RCodeSuccess, []dns.Type{dns.TypeA}, noSOA},
+		{"host-soa", "test1.ipn.dev.", dns.TypeSOA, dns.RCodeSuccess, nil, ipnZone},
+		{"host-ns", "test1.ipn.dev.", dns.TypeNS, dns.RCodeSuccess, nil, ipnZone},
+		{"nxdomain", "test2.ipn.dev.", dns.TypeA, dns.RCodeNameError, nil, ipnZone},
+		{"ptr", "1.0.64.100.in-addr.arpa.", dns.TypePTR, dns.RCodeSuccess, []dns.Type{dns.TypePTR}, noSOA},
+		{"ptr-nameserver", "100.100.100.100.in-addr.arpa.", dns.TypePTR, dns.RCodeSuccess, []dns.Type{dns.TypePTR}, noSOA},
+		{"ptr-nxdomain", "2.0.64.100.in-addr.arpa.", dns.TypePTR, dns.RCodeNameError, nil, v4Zone},
+		{"ptr-partial", "0.64.100.in-addr.arpa.", dns.TypePTR, dns.RCodeNameError, nil, v4Zone},
+		{"ptr-apex", v4Zone, dns.TypePTR, dns.RCodeSuccess, nil, v4Zone},
+		{"ptr-v6", "1.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0." + v6Zone, dns.TypePTR, dns.RCodeNameError, nil, v6Zone},
+		{"v4-apex-soa", v4Zone, dns.TypeSOA, dns.RCodeSuccess, []dns.Type{dns.TypeSOA}, noSOA},
+		{"v6-apex-ns", v6Zone, dns.TypeNS, dns.RCodeSuccess, []dns.Type{dns.TypeNS}, noSOA},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			payload, err := syncRespond(r, dnspacket(tt.qname, tt.qtype))
+			if err != nil {
+				t.Fatalf("err = %v; want nil", err)
+			}
+			var msg dns.Message
+			if err := msg.Unpack(payload); err != nil {
+				t.Fatalf("unpack: %v", err)
+			}
+			if !msg.Header.Authoritative {
+				t.Errorf("AA bit not set")
+			}
+			if msg.Header.RCode != tt.rcode {
+				t.Errorf("rcode = %v; want %v", msg.Header.RCode, tt.rcode)
+			}
+			var answers []dns.Type
+			for _, ans := range msg.Answers {
+				answers = append(answers, ans.Header.Type)
+				switch body := ans.Body.(type) {
+				case *dns.SOAResource:
+					if got := body.NS.String(); got != nsName {
+						t.Errorf("SOA MNAME = %q; want %q", got, nsName)
+					}
+					if got, want := body.MBox.String(), "hostmaster."+tt.qname; got != want {
+						t.Errorf("SOA RNAME = %q; want %q", got, want)
+					}
+				case *dns.NSResource:
+					if got := body.NS.String(); got != nsName {
+						t.Errorf("NS = %q; want %q", got, nsName)
+					}
+				}
+			}
+			if len(answers) != len(tt.answers) {
+				t.Fatalf("answers = %v; want %v", answers, tt.answers)
+			}
+			for i := range answers {
+				if answers[i] != tt.answers[i] {
+					t.Errorf("answers = %v; want %v", answers, tt.answers)
+				}
+			}
+
+			var authority string
+			if len(msg.Authorities) > 0 {
+				soa, ok := msg.Authorities[0].Body.(*dns.SOAResource)
+				if len(msg.Authorities) != 1 || !ok {
+					t.Fatalf("authorities = %+v; want one SOA record", msg.Authorities)
+				}
+				authority = msg.Authorities[0].Header.Name.String()
+				if ttl := msg.Authorities[0].Header.TTL; ttl != soa.MinTTL || ttl != 60 {
+					t.Errorf("SOA TTL = %d, MINIMUM = %d; want 60", ttl, soa.MinTTL)
+				}
+			}
+			if authority != tt.authority {
+				t.Errorf("authority zone = %q; want %q", authority, tt.authority)
+			}
+		})
+	}
+}
+
+func TestZonesNoRootDomains(t *testing.T) {
+	r := NewResolver(ResolverConfig{Logf: t.Logf, Forward: false})
+	r.SetMap(NewMap(map[string]netaddr.IP{
+		"test1.ipn.dev.": netaddr.IPv4(100, 64, 0, 1),
+	}, nil))
+
+	if err := r.Start(); err != nil {
+		t.Fatalf("start: %v", err)
+	}
+	defer r.Close()
+
+	// Without root domains, there are no zones, and no nameserver.
+	for _, q := range []struct {
+		name string
+		tp   dns.Type
+	}{
+		{"magicdns.ipn.dev.", dns.TypeA},
+		{"64.100.in-addr.arpa.", dns.TypeSOA},
+		{"2.0.64.100.in-addr.arpa.", dns.TypePTR},
+	} {
+		if _, err := r.respond(dnspacket(q.name, q.tp)); err != errNotOurName {
+			t.Errorf("%s: err = %v; want %v", q.name, err, errNotOurName)
+		}
+	}
+}
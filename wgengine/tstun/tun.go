@@ -19,6 +19,7 @@ import (
 	"inet.af/netaddr"
 	"tailscale.com/net/packet"
 	"tailscale.com/types/logger"
+	"tailscale.com/wgengine/capture"
 	"tailscale.com/wgengine/filter"
 )
 
@@ -110,6 +111,10 @@ type TUN struct {
 
 	// disableFilter disables all filtering when set. This should only be used in tests.
 	disableFilter bool
+
+	// captureHook, if set, is called with every packet passing
+	// through the TUN. See InstallCaptureHook.
+	captureHook atomic.Value // of capture.Callback
 }
 
 func WrapTUN(logf logger.Logf, tdev tun.Device) *TUN {
@@ -301,16 +306,20 @@ func (t *TUN) Read(buf []byte, offset int) (int, error) {
 
 	// For injected packets, we return early to bypass filtering.
 	if wasInjectedPacket {
+		t.capture(capture.SynthesizedToPeer, buf[offset:offset+n], filter.Accept)
 		t.noteActivity()
 		return n, nil
 	}
 
 	if !t.disableFilter {
 		response := t.filterOut(p)
+		t.capture(capture.FromLocal, buf[offset:offset+n], response)
 		if response != filter.Accept {
 			// Wireguard considers read errors fatal; pretend nothing was read
 			return 0, nil
 		}
+	} else {
+		t.capture(capture.FromLocal, buf[offset:offset+n], filter.Accept)
 	}
 
 	t.noteActivity()
@@ -375,12 +384,15 @@ func (t *TUN) filterIn(buf []byte) filter.Response {
 func (t *TUN) Write(buf []byte, offset int) (int, error) {
 	if !t.disableFilter {
 		res := t.filterIn(buf[offset:])
+		t.capture(capture.FromPeer, buf[offset:], res)
 		if res == filter.DropSilently {
 			return len(buf), nil
 		}
 		if res != filter.Accept {
 			return 0, ErrFiltered
 		}
+	} else {
+		t.capture(capture.FromPeer, buf[offset:], filter.Accept)
 	}
 
 	t.noteActivity()
@@ -415,6 +427,7 @@ func (t *TUN) InjectInboundDirect(buf []byte, offset int) error {
 		return errOffsetTooSmall
 	}
 
+	t.capture(capture.SynthesizedToLocal, buf[offset:], filter.Accept)
 	// Write to the underlying device to skip filters.
 	_, err := t.tdev.Write(buf, offset)
 	return err
@@ -459,6 +472,21 @@ func (t *TUN) InjectOutbound(packet []byte) error {
 	}
 }
 
+// InstallCaptureHook makes the TUN call cb with every packet passing
+// through it, in both directions, including those dropped by the
+// packet filter and those injected by tailscaled. A nil cb removes
+// the hook.
+func (t *TUN) InstallCaptureHook(cb capture.Callback) {
+	t.captureHook.Store(cb)
+}
+
+// capture passes pkt to the capture hook, if there is one.
+func (t *TUN) capture(path capture.Path, pkt []byte, verdict filter.Response) {
+	if cb, _ := t.captureHook.Load().(capture.Callback); cb != nil {
+		cb(path, pkt, verdict)
+	}
+}
+
 // Unwrap returns the underlying TUN device.
 func (t *TUN) Unwrap() tun.Device {
 	return t.tdev
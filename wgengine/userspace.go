@@ -41,6 +41,7 @@ import (
 	"tailscale.com/types/wgkey"
 	"tailscale.com/version"
 	"tailscale.com/version/distro"
+	"tailscale.com/wgengine/capture"
 	"tailscale.com/wgengine/filter"
 	"tailscale.com/wgengine/magicsock"
 	"tailscale.com/wgengine/monitor"
@@ -148,9 +149,10 @@ type EngineConfig struct {
 
 	// FakeImpl, if non-nil, specifies which type of fake implementation to
 	// use. Two values are typical: nil, for a basic ping-only fake
-	// implementation, and netstack.Impl, which brings in gvisor's netstack
-	// to the binary. The desire to keep that out of some binaries is why
-	// this func exists, so wgengine need not depend on gvisor.
+	// implementation, and one that creates and starts a netstack.Impl,
+	// which brings in gvisor's netstack to the binary. The desire to
+	// keep that out of some binaries is why this func exists, so
+	// wgengine need not depend on gvisor.
 	FakeImpl FakeImplFunc
 }
 
@@ -276,6 +278,10 @@ func newUserspaceEngineAdvanced(conf EngineConfig) (_ Engine, reterr error) {
 	closePool.add(e.magicConn)
 	e.magicConn.SetNetworkUp(e.linkState.AnyInterfaceUp())
 
+	// Set before FakeImpl runs, so that netstack can chain its own
+	// hook in front of it.
+	e.tundev.PreFilterOut = e.handleLocalPackets
+
 	// Respond to all pings only in fake mode.
 	if conf.Fake {
 		if impl := conf.FakeImpl; impl != nil {
@@ -287,7 +293,6 @@ func newUserspaceEngineAdvanced(conf EngineConfig) (_ Engine, reterr error) {
 			e.tundev.PostFilterIn = echoRespondToAll
 		}
 	}
-	e.tundev.PreFilterOut = e.handleLocalPackets
 
 	if debugConnectFailures() {
 		if e.tundev.PreFilterIn != nil {
@@ -463,6 +468,8 @@ func (e *userspaceEngine) isLocalAddr(ip netaddr.IP) bool {
 }
 
 // handleDNS is an outbound pre-filter resolving Tailscale domains.
+// It only handles DNS over UDP; queries over TCP need a TCP stack,
+// which netstack provides (see netstack.Impl.StartDNS).
 func (e *userspaceEngine) handleDNS(p *packet.Parsed, t *tstun.TUN) filter.Response {
 	if p.Dst.IP == magicDNSIP && p.Dst.Port == magicDNSPort && p.IPProto == packet.UDP {
 		request := tsdns.Packet{
@@ -998,17 +1005,16 @@ func (e *userspaceEngine) Reconfig(cfg *wgcfg.Config, routerCfg *router.Config)
 
 	if routerChanged {
 		if routerCfg.DNS.Proxied {
-			ips := routerCfg.DNS.Nameservers
-			upstreams := make([]net.Addr, len(ips))
-			for i, ip := range ips {
-				stdIP := ip.IPAddr()
-				upstreams[i] = &net.UDPAddr{
-					IP:   stdIP.IP,
-					Port: 53,
-					Zone: stdIP.Zone,
+			e.resolver.SetUpstreams(dnsUpstreams(routerCfg.DNS.Nameservers))
+			routes := make([]tsdns.Route, len(routerCfg.DNS.Routes))
+			for i, route := range routerCfg.DNS.Routes {
+				routes[i] = tsdns.Route{
+					Suffix:    route.Suffix,
+					Upstreams: dnsUpstreams(route.Nameservers),
+					Fallback:  route.Fallback,
 				}
 			}
-			e.resolver.SetUpstreams(upstreams)
+			e.resolver.SetRoutes(routes)
 			routerCfg.DNS.Nameservers = []netaddr.IP{tsaddr.TailscaleServiceIP()}
 		}
 		e.logf("wgengine: Reconfig: configuring router")
@@ -1023,6 +1029,20 @@ func (e *userspaceEngine) Reconfig(cfg *wgcfg.Config, routerCfg *router.Config)
 	return nil
 }
 
+// dnsUpstreams returns the addresses of the nameservers ips.
+func dnsUpstreams(ips []netaddr.IP) []net.Addr {
+	upstreams := make([]net.Addr, len(ips))
+	for i, ip := range ips {
+		stdIP := ip.IPAddr()
+		upstreams[i] = &net.UDPAddr{
+			IP:   stdIP.IP,
+			Port: 53,
+			Zone: stdIP.Zone,
+		}
+	}
+	return upstreams
+}
+
 // isSingleEndpoint reports whether endpoints contains exactly one host:port pair.
 func isSingleEndpoint(s string) bool {
 	return s != "" && !strings.Contains(s, ",")
@@ -1036,6 +1056,22 @@ func (e *userspaceEngine) SetFilter(filt *filter.Filter) {
 	e.tundev.SetFilter(filt)
 }
 
+// GetInternals implements InternalsGetter.
+func (e *userspaceEngine) GetInternals() (*tstun.TUN, *magicsock.Conn) {
+	return e.tundev, e.magicConn
+}
+
+// GetResolver implements ResolvingEngine.
+func (e *userspaceEngine) GetResolver() (r *tsdns.Resolver, ok bool) {
+	return e.resolver, true
+}
+
+// InstallCaptureHook implements CapturingEngine.
+func (e *userspaceEngine) InstallCaptureHook(cb capture.Callback) (ok bool) {
+	e.tundev.InstallCaptureHook(cb)
+	return true
+}
+
 func (e *userspaceEngine) SetDNSMap(dm *tsdns.Map) {
 	e.resolver.SetMap(dm)
 }
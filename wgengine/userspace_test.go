@@ -8,6 +8,8 @@ import (
 	"bytes"
 	"fmt"
 	"reflect"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
@@ -16,6 +18,7 @@ import (
 	"tailscale.com/tailcfg"
 	"tailscale.com/types/key"
 	"tailscale.com/wgengine/router"
+	"tailscale.com/wgengine/router/dns"
 	"tailscale.com/wgengine/tstun"
 	"tailscale.com/wgengine/wgcfg"
 )
@@ -129,6 +132,44 @@ func TestUserspaceEngineReconfig(t *testing.T) {
 	}
 }
 
+func TestUserspaceEngineReconfigDNSRoutes(t *testing.T) {
+	var mu sync.Mutex
+	var logs []string
+	logf := func(format string, args ...interface{}) {
+		mu.Lock()
+		defer mu.Unlock()
+		logs = append(logs, fmt.Sprintf(format, args...))
+	}
+	e, err := NewFakeUserspaceEngine(logf, 0, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer e.Close()
+
+	routerCfg := &router.Config{
+		DNS: dns.Config{
+			Nameservers: []netaddr.IP{netaddr.IPv4(1, 1, 1, 1)},
+			Proxied:     true,
+			Routes: []dns.Route{
+				{Suffix: "corp.example.com", Nameservers: []netaddr.IP{netaddr.IPv4(10, 0, 0, 53)}},
+			},
+		},
+	}
+	if err := e.Reconfig(&wgcfg.Config{}, routerCfg); err != nil {
+		t.Fatal(err)
+	}
+
+	const want = "tsdns: set routes: [{corp.example.com. [10.0.0.53:53] false}]"
+	mu.Lock()
+	defer mu.Unlock()
+	for _, line := range logs {
+		if strings.Contains(line, want) {
+			return
+		}
+	}
+	t.Errorf("resolver didn't get the DNS routes; want log line %q", want)
+}
+
 func dkFromHex(hex string) tailcfg.DiscoKey {
 	if len(hex) != 64 {
 		panic(fmt.Sprintf("%q is len %d; want 64", hex, len(hex)))
@@ -12,9 +12,12 @@ import (
 	"tailscale.com/net/interfaces"
 	"tailscale.com/tailcfg"
 	"tailscale.com/types/netmap"
+	"tailscale.com/wgengine/capture"
 	"tailscale.com/wgengine/filter"
+	"tailscale.com/wgengine/magicsock"
 	"tailscale.com/wgengine/router"
 	"tailscale.com/wgengine/tsdns"
+	"tailscale.com/wgengine/tstun"
 	"tailscale.com/wgengine/wgcfg"
 )
 
@@ -48,6 +51,27 @@ type someHandle struct{ _ byte }
 // ErrNoChanges is returned by Engine.Reconfig if no changes were made.
 var ErrNoChanges = errors.New("no changes made to Engine config")
 
+// ResolvingEngine is implemented by Engines that have a DNS resolver.
+type ResolvingEngine interface {
+	// GetResolver returns the Engine's DNS resolver, if any.
+	GetResolver() (_ *tsdns.Resolver, ok bool)
+}
+
+// CapturingEngine is implemented by Engines that can capture the
+// packets passing through their TUN device.
+type CapturingEngine interface {
+	// InstallCaptureHook makes the Engine call cb with every packet
+	// passing through its TUN device, or stops doing so if cb is
+	// nil. It reports whether the Engine supports capturing.
+	InstallCaptureHook(cb capture.Callback) (ok bool)
+}
+
+// InternalsGetter is implemented by Engines that can hand out their
+// TUN device and magicsock.Conn, for netstack to attach to.
+type InternalsGetter interface {
+	GetInternals() (*tstun.TUN, *magicsock.Conn)
+}
+
 // Engine is the Tailscale WireGuard engine interface.
 type Engine interface {
 	// Reconfig reconfigures WireGuard and makes sure it's running.